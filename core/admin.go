@@ -0,0 +1,96 @@
+package core
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/bgpfix/bgpfix/dir"
+	"github.com/bgpfix/bgpfix/msg"
+)
+
+// adminStats holds the pipe counters exposed by the admin API
+type adminStats struct {
+	start time.Time     // when the pipe started
+	msgL  atomic.Uint64 // messages seen in the L direction
+	msgR  atomic.Uint64 // messages seen in the R direction
+
+	parseDrop atomic.Uint64 // messages dropped on parse error
+	loopDrop  atomic.Uint64 // messages dropped by --loop-guard or --max-hops
+}
+
+// adminAttach attaches the admin API counters to the pipe
+func (b *Bgpipe) adminAttach() {
+	cb := b.Pipe.OnMsg(b.adminCount, dir.DIR_LR)
+	cb.Order = math.MinInt // count before anything else
+}
+
+// adminCount counts messages flowing through the pipe
+func (b *Bgpipe) adminCount(m *msg.Msg) bool {
+	if m.Dir == dir.DIR_L {
+		b.stats.msgL.Add(1)
+	} else {
+		b.stats.msgR.Add(1)
+	}
+	return true
+}
+
+// adminMux returns the admin API HTTP handler
+func (b *Bgpipe) adminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stages", b.adminStages)
+	mux.HandleFunc("/stats", b.adminStatsHandler)
+	mux.HandleFunc("/healthz", b.adminHealthz)
+	mux.HandleFunc("/readyz", b.adminReadyz)
+	mux.HandleFunc("/dump", b.adminDump)
+	return mux
+}
+
+// adminStages serves the status of all stages
+func (b *Bgpipe) adminStages(w http.ResponseWriter, r *http.Request) {
+	var ret []StageStatus
+	for _, s := range b.Stages {
+		if s != nil {
+			ret = append(ret, s.Status())
+		}
+	}
+	adminJSON(w, ret)
+}
+
+// adminStatsHandler serves the current pipe stats
+func (b *Bgpipe) adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	var running int
+	for _, s := range b.Stages {
+		if s != nil && s.Running() {
+			running++
+		}
+	}
+
+	var uptime float64
+	if start := b.stats.start; !start.IsZero() {
+		uptime = time.Since(start).Seconds()
+	}
+
+	adminJSON(w, map[string]any{
+		"uptime":  uptime,
+		"stages":  b.StageCount(),
+		"running": running,
+		"msg_l":   b.stats.msgL.Load(),
+		"msg_r":   b.stats.msgR.Load(),
+
+		"parse_drop": b.stats.parseDrop.Load(),
+		"loop_drop":  b.stats.loopDrop.Load(),
+	})
+}
+
+// adminJSON writes v as JSON to w
+func adminJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -3,10 +3,13 @@ package core
 import (
 	"fmt"
 	"math"
+	"slices"
 	"strconv"
+	"strings"
 
 	"github.com/bgpfix/bgpfix/caps"
 	"github.com/bgpfix/bgpfix/dir"
+	"github.com/bgpfix/bgpfix/msg"
 	"github.com/bgpfix/bgpfix/pipe"
 	"github.com/rs/zerolog"
 )
@@ -25,6 +28,16 @@ func (b *Bgpipe) AttachStages() error {
 		return fmt.Errorf("bgpipe needs at least 1 stage")
 	}
 
+	// map stage @names, also of stages added directly by AddStage
+	if err := b.attachNames(); err != nil {
+		return err
+	}
+
+	// catch structural problems early
+	if err := b.validate(); err != nil {
+		return err
+	}
+
 	// attach stages
 	var (
 		stdin_stage  *StageBase
@@ -68,6 +81,7 @@ func (b *Bgpipe) AttachStages() error {
 			return fmt.Errorf("--stdout: %w", err)
 		}
 		stdout_stage = s
+		b.auto = append(b.auto, s)
 	}
 
 	// add stdin?
@@ -87,8 +101,13 @@ func (b *Bgpipe) AttachStages() error {
 			return fmt.Errorf("--stdin: %w", err)
 		}
 		stdin_stage = s
+		b.auto = append(b.auto, s)
 	}
 
+	// per-type entry points, and drop messages past their --to stage
+	b.attachEntries()
+	b.attachExits()
+
 	// only 1 stage without I/O?
 	if count_stage == 1 && stdin_stage == nil && stdout_stage == nil {
 		return fmt.Errorf("single stage without I/O makes little sense, sorry")
@@ -101,6 +120,63 @@ func (b *Bgpipe) AttachStages() error {
 		p.Caps.Use(caps.CAP_AS4) // use CAP_AS4 by default
 	}
 
+	// admin API counters?
+	if len(k.String("admin")) > 0 {
+		b.adminAttach()
+	}
+
+	// per-stage input rates?
+	if k.Duration("input-rate-report") > 0 {
+		b.ratesAttach()
+	}
+
+	// log capabilities of both sides on OPEN
+	p.Options.OnEvent(b.logCaps, pipe.EVENT_OPEN)
+
+	// tag messages with the peer hostname?
+	if k.Bool("tag-hostname") {
+		cb := p.OnMsg(b.tagHostname, dir.DIR_LR)
+		cb.Order = math.MinInt + 2 // before stages
+		cb.Raw = true
+	}
+
+	// remember when the session got established
+	p.Options.OnEvent(b.kvEstablished, pipe.EVENT_ESTABLISHED)
+
+	// per-direction ESTABLISHED events
+	cb := p.OnMsg(b.onEstablish, dir.DIR_LR, msg.OPEN, msg.KEEPALIVE)
+	cb.Order = math.MinInt + 2 // after parse checks
+
+	// readiness requires the session?
+	if k.Bool("ready-established") {
+		p.Options.OnEvent(b.onReadyEstab, pipe.EVENT_ESTABLISHED)
+	}
+
+	// fail if no session comes up in time?
+	if k.Duration("established-timeout") > 0 && slices.ContainsFunc(b.Stages, func(s *StageBase) bool {
+		return s != nil && s.Options.IsSession
+	}) {
+		b.estabDone = make(chan struct{})
+		p.Options.OnEvent(b.onEstabDone, pipe.EVENT_ESTABLISHED)
+	}
+
+	// parse error policy?
+	switch v := k.String("on-parse-error"); v {
+	case "pass":
+		break // leave it to the stages
+	case "drop", "kill":
+		cb := p.OnMsg(b.parseCheck, dir.DIR_LR)
+		cb.Order = math.MinInt + 1 // right after admin counters
+		if v == "kill" {
+			p.Options.AddHandler(b.parseKill, &pipe.Handler{
+				Order: math.MaxInt, // let others (eg. speaker) handle it first
+				Types: []string{pipe.EVENT_PARSE},
+			})
+		}
+	default:
+		return fmt.Errorf("%w: %s", ErrParseMode, v)
+	}
+
 	// log events?
 	if evs := ParseEvents(k.Strings("events"), "START", "STOP", "READY", "PREPARE"); len(evs) > 0 {
 		b.Debug().Strs("events", evs).Msg("monitored events will be logged")
@@ -111,6 +187,14 @@ func (b *Bgpipe) AttachStages() error {
 		})
 	}
 
+	// log less once the session is stable?
+	if k.Bool("quiet-stable") {
+		b.quietKeep = ParseEvents(k.Strings("quiet-keep"), "STOP")
+		p.Options.OnEvent(b.onQuiet, pipe.EVENT_ESTABLISHED)
+		p.Options.OnEvent(b.onLoud, pipe.EVENT_OPEN)
+		p.OnMsg(b.quietNotify, dir.DIR_LR, msg.NOTIFY)
+	}
+
 	// kill events?
 	if evs := ParseEvents(k.Strings("kill"), "STOP"); len(evs) > 0 {
 		b.Debug().Strs("events", evs).Msg("will kill the session on given events")
@@ -124,6 +208,202 @@ func (b *Bgpipe) AttachStages() error {
 	return nil
 }
 
+// attachNames maps stage @names to their indexes in b.names, failing on duplicates
+func (b *Bgpipe) attachNames() error {
+	clear(b.names)
+	for _, s := range b.Stages {
+		if s == nil || !strings.HasPrefix(s.Name, "@") {
+			continue
+		}
+		if id, ok := b.names[s.Name]; ok {
+			return fmt.Errorf("[%d] %s: %w by [%d]", s.Index, s.Name, ErrStageName, id)
+		}
+		b.names[s.Name] = s.Index
+	}
+	return nil
+}
+
+// stageRef resolves v, a stage index or @name, to a stage index in b.Stages
+func (b *Bgpipe) stageRef(v string) (int, error) {
+	if id, err := strconv.Atoi(v); err == nil {
+		if id <= 0 || id > b.StageCount() || b.Stages[id] == nil {
+			return 0, fmt.Errorf("%s: no such stage index (have 1-%d)", v, b.StageCount())
+		}
+		return id, nil
+	} else if len(v) > 0 && v[0] == '@' {
+		if id, ok := b.names[v]; ok {
+			return id, nil
+		}
+		return 0, fmt.Errorf("%s: no such stage name", v)
+	}
+	return 0, fmt.Errorf("%s: need a stage index or @name", v)
+}
+
+// injectPoint describes where new messages enter the pipe, see --inject
+type injectPoint struct {
+	frev, ffwd pipe.FilterMode // input filter mode for the L and R directions
+	fid        int             // input filter callback id
+}
+
+// injectPoint resolves v, an --inject value, for the input filters of s
+func (s *StageBase) injectPoint(v string) (injectPoint, error) {
+	switch v {
+	case "next", "":
+		return injectPoint{pipe.FILTER_GE, pipe.FILTER_LE, s.Index}, nil
+	case "here":
+		return injectPoint{pipe.FILTER_GT, pipe.FILTER_LT, s.Index}, nil
+	case "first":
+		return injectPoint{pipe.FILTER_NONE, pipe.FILTER_NONE, 0}, nil
+	case "last":
+		// skip all stage callbacks, but not internal ones at math.MaxInt (eg. rates)
+		return injectPoint{pipe.FILTER_LT, pipe.FILTER_LT, math.MaxInt}, nil
+	default:
+		id, err := s.B.stageRef(v)
+		if err != nil {
+			return injectPoint{}, fmt.Errorf("%w: %w", ErrInject, err)
+		}
+		return injectPoint{pipe.FILTER_GE, pipe.FILTER_LE, id}, nil
+	}
+}
+
+// skips returns true iff a message entering at ip in direction d skips callback id,
+// the same way the pipe input filter would
+func (ip injectPoint) skips(d dir.Dir, id int) bool {
+	mode := ip.ffwd
+	if d == dir.DIR_L {
+		mode = ip.frev
+	}
+	switch mode {
+	case pipe.FILTER_NONE:
+		return false
+	case pipe.FILTER_EQ:
+		return id == ip.fid
+	case pipe.FILTER_LT:
+		return id < ip.fid
+	case pipe.FILTER_LE:
+		return id <= ip.fid
+	case pipe.FILTER_GT:
+		return id > ip.fid
+	case pipe.FILTER_GE:
+		return id >= ip.fid
+	default:
+		return true
+	}
+}
+
+// attachEntries makes stage callbacks skip messages from stages with --inject-type,
+// according to the entry point for the message type
+func (b *Bgpipe) attachEntries() {
+	for _, s := range b.Stages {
+		if s == nil || len(s.entries) == 0 || len(s.inputs) == 0 {
+			continue
+		}
+
+		// our inputs
+		ours := make(map[*pipe.Input]bool, len(s.inputs))
+		for _, li := range s.inputs {
+			ours[li] = true
+		}
+		skips := func(m *msg.Msg, id int) bool {
+			if !ours[pipe.MsgContext(m).Input] {
+				return false
+			}
+			ip, ok := s.entries[m.Type]
+			if !ok {
+				ip = s.entries[msg.INVALID]
+			}
+			return ip.skips(m.Dir, id)
+		}
+
+		// hide them from stages before the entry point
+		for _, s2 := range b.Stages {
+			if s2 == nil {
+				continue
+			}
+			for _, cb := range s2.callbacks {
+				id, next := s2.Index, cb.Func
+				cb.Func = func(m *msg.Msg) bool {
+					if skips(m, id) {
+						return true // pass through untouched
+					}
+					return next(m)
+				}
+			}
+		}
+	}
+}
+
+// attachExits makes sure messages from stages with --to are dropped
+// after they pass their exit stage. Messages that exit at the edge stage
+// for their direction are left to the pipe output, where I/O stages read them.
+func (b *Bgpipe) attachExits() {
+	for _, s := range b.Stages {
+		if s == nil || s.exit <= 0 || len(s.inputs) == 0 {
+			continue
+		}
+
+		// our inputs
+		ours := make(map[*pipe.Input]bool, len(s.inputs))
+		for _, li := range s.inputs {
+			ours[li] = true
+		}
+
+		// does the exit stage end the pipe in direction d?
+		edge := func(d dir.Dir) bool {
+			if d == dir.DIR_L {
+				return s.exit == 1
+			} else {
+				return s.exit == b.StageCount()
+			}
+		}
+		beyond := func(m *msg.Msg, id int) bool {
+			switch {
+			case !ours[pipe.MsgContext(m).Input]:
+				return false
+			case id == 0: // automatic stages are outside the pipe
+				return !edge(m.Dir)
+			case m.Dir == dir.DIR_L:
+				return id < s.exit
+			default:
+				return id > s.exit
+			}
+		}
+
+		// hide them from stages past the exit
+		for _, s2 := range slices.Concat(b.Stages, b.auto) {
+			if s2 == nil {
+				continue
+			}
+			for _, cb := range s2.callbacks {
+				id, next := s2.Index, cb.Func
+				cb.Func = func(m *msg.Msg) bool {
+					if beyond(m, id) {
+						return false
+					}
+					return next(m)
+				}
+			}
+		}
+
+		// drop on exit if no stage past the exit took care of them,
+		// unless the exit is an edge (eg. connect or listen reading the pipe output).
+		// NB: use ids that input filters of the L and R directions never skip
+		drop := func(m *msg.Msg) bool {
+			return !ours[pipe.MsgContext(m).Input]
+		}
+		if !edge(dir.DIR_L) {
+			cb := b.Pipe.OnMsg(drop, dir.DIR_L)
+			cb.Order = math.MaxInt
+		}
+		if !edge(dir.DIR_R) {
+			cb := b.Pipe.OnMsg(drop, dir.DIR_R)
+			cb.Id = math.MaxInt
+			cb.Order = math.MaxInt
+		}
+		s.Debug().Int("to", s.exit).Msg("messages will exit at given stage")
+	}
+}
+
 // attach wraps Stage.Attach and adds some logic
 func (s *StageBase) attach() error {
 	var (
@@ -133,6 +413,9 @@ func (s *StageBase) attach() error {
 		k  = s.K
 	)
 
+	// coalesce repeated events?
+	s.coalesce.window = k.Duration("event-coalesce")
+
 	// first / last?
 	if s.Index == 1 {
 		s.IsFirst = true
@@ -196,10 +479,35 @@ func (s *StageBase) attach() error {
 		}
 	}
 
+	// can be paused?
+	pause_on := ParseEvents(k.Strings("pause-on"), "START")
+	if len(pause_on) > 0 {
+		switch v := k.String("pause-mode"); v {
+		case "buffer", "":
+			s.pauseDrop = false
+		case "drop":
+			s.pauseDrop = true
+		default:
+			return fmt.Errorf("%w: %s", ErrPauseMode, v)
+		}
+		s.pauseMax = k.Int("pause-buffer")
+		if !s.pauseDrop && s.pauseMax <= 0 {
+			return fmt.Errorf("%w: --pause-buffer must be positive", ErrPauseMode)
+		}
+	}
+
 	// fix callbacks
+	// NB: pauseWrap goes last, so buffered messages re-enter loopWrap untouched
+	loop_guard, max_hops := s.B.K.Bool("loop-guard"), s.B.K.Int("max-hops")
 	for _, cb := range s.callbacks {
 		cb.Id = s.Index
 		cb.Enabled = &s.running
+		if loop_guard || max_hops > 0 {
+			cb.Func = s.loopWrap(cb.Func, loop_guard, max_hops)
+		}
+		if len(pause_on) > 0 {
+			cb.Func = s.pauseWrap(cb.Func)
+		}
 	}
 
 	// fix handlers
@@ -209,48 +517,64 @@ func (s *StageBase) attach() error {
 	}
 
 	// where to inject new messages?
-	var frev, ffwd pipe.FilterMode // input filter mode
-	var fid int                    // input filter callback id
-	switch v := k.String("inject"); v {
-	case "next", "":
-		frev, ffwd = pipe.FILTER_GE, pipe.FILTER_LE
-		fid = s.Index
-	case "here":
-		frev, ffwd = pipe.FILTER_GT, pipe.FILTER_LT
-		fid = s.Index
-	case "first":
-		frev, ffwd = pipe.FILTER_NONE, pipe.FILTER_NONE
-	case "last":
-		frev, ffwd = pipe.FILTER_ALL, pipe.FILTER_ALL
-	default:
-		frev, ffwd = pipe.FILTER_GE, pipe.FILTER_LE
-		if id, err := strconv.Atoi(v); err == nil {
-			fid = id
-		} else if len(v) > 0 && v[0] == '@' {
-			// a stage name reference?
-			for _, s2 := range s.B.Stages {
-				if s2 != nil && s2.Name == v {
-					fid = s2.Index
-					break
-				}
+	ip, err := s.injectPoint(k.String("inject"))
+	if err != nil {
+		return err
+	}
+
+	// exact entry point?
+	if v := k.String("from"); len(v) > 0 {
+		if iv := k.String("inject"); iv != "next" && iv != "" {
+			return fmt.Errorf("%w: --from and --inject %s: must not use both", ErrFromTo, iv)
+		}
+		id, err := b.stageRef(v)
+		if err != nil {
+			return fmt.Errorf("%w: --from %w", ErrFromTo, err)
+		}
+		ip = injectPoint{pipe.FILTER_GT, pipe.FILTER_LT, id} // start at id
+	}
+
+	// per-type entry points?
+	if vals := k.Strings("inject-type"); len(vals) > 0 {
+		s.entries = map[msg.Type]injectPoint{msg.INVALID: ip} // INVALID means other types
+		for _, v := range vals {
+			tv, where, ok := strings.Cut(v, "=")
+			if !ok {
+				return fmt.Errorf("%w: --inject-type %s: need TYPE=WHERE", ErrInject, v)
+			}
+			types, err := ParseTypes([]string{strings.ToUpper(tv)}, nil)
+			if err != nil || len(types) != 1 || types[0] == msg.INVALID {
+				return fmt.Errorf("%w: --inject-type %s: invalid message type", ErrInject, v)
+			}
+			if s.entries[types[0]], err = s.injectPoint(where); err != nil {
+				return fmt.Errorf("--inject-type %s: %w", v, err)
 			}
 		}
-		if fid <= 0 {
-			return fmt.Errorf("%w: %s", ErrInject, v)
+
+		// let all callbacks see our messages, filter them in attachEntries
+		ip = injectPoint{pipe.FILTER_NONE, pipe.FILTER_NONE, 0}
+	}
+
+	// exact exit point?
+	if v := k.String("to"); len(v) > 0 {
+		id, err := b.stageRef(v)
+		if err != nil {
+			return fmt.Errorf("%w: --to %w", ErrFromTo, err)
 		}
+		s.exit = id
 	}
 
 	// fix inputs
 	for _, li := range s.inputs {
 		li.Id = s.Index
-		li.FilterValue = fid
+		li.FilterValue = ip.fid
 
 		if li.Dir == dir.DIR_L {
 			li.Reverse = true // CLI gives L stages in reverse
-			li.CallbackFilter = frev
+			li.CallbackFilter = ip.frev
 		} else {
 			li.Reverse = false
-			li.CallbackFilter = ffwd
+			li.CallbackFilter = ip.ffwd
 		}
 	}
 
@@ -260,14 +584,35 @@ func (s *StageBase) attach() error {
 		s.Debug().Msgf("IsProducer=%v but has_inputs=%v - correcting", s.Options.IsProducer, has_inputs)
 		s.Options.IsProducer = has_inputs
 	}
+	if s.Options.IsProducer {
+		s.B.sources.Add(1)
+	}
+
+	// re-inject messages buffered while paused at this stage
+	// NB: not in s.inputs, as they do not make s a producer
+	if len(pause_on) > 0 && !s.pauseDrop {
+		here, _ := s.injectPoint("here")
+		s.pauseL = po.AddInput(dir.DIR_L)
+		s.pauseL.Reverse = true
+		s.pauseL.CallbackFilter = here.frev
+		s.pauseR = po.AddInput(dir.DIR_R)
+		s.pauseR.CallbackFilter = here.ffwd
+		for _, in := range []*pipe.Input{s.pauseL, s.pauseR} {
+			in.Id = s.Index
+			in.FilterValue = here.fid
+		}
+	}
 
 	// update related waitgroups
 	s.wgAdd(1)
 
 	// has trigger-on events?
+	// NB: handlers run in order, and runStart returns after Prepare, so --priority
+	// makes stages with lower values READY before the others begin to Prepare
+	var start *pipe.Handler
 	if evs := ParseEvents(k.Strings("wait"), "START"); len(evs) > 0 {
 		s.Debug().Strs("events", evs).Msg("waiting for given events before start")
-		po.OnEventPre(s.runStart, evs...)
+		start = po.OnEventPre(s.runStart, evs...)
 
 		// trigger pipe start handlers by --wait events
 		for _, h := range s.handlers {
@@ -278,8 +623,9 @@ func (s *StageBase) attach() error {
 			}
 		}
 	} else {
-		po.OnEventPre(s.runStart, pipe.EVENT_START)
+		start = po.OnEventPre(s.runStart, pipe.EVENT_START)
 	}
+	start.Order = k.Int("priority")
 
 	// has trigger-off events?
 	if evs := ParseEvents(k.Strings("stop"), "STOP"); len(evs) > 0 {
@@ -287,6 +633,16 @@ func (s *StageBase) attach() error {
 		po.OnEventPost(s.runStop, evs...)
 	}
 
+	// has pause / resume events?
+	if len(pause_on) > 0 {
+		s.Debug().Strs("events", pause_on).Msg("will pause after given events")
+		po.OnEventPost(s.runPause, pause_on...)
+	}
+	if evs := ParseEvents(k.Strings("resume-on"), "STOP"); len(evs) > 0 {
+		s.Debug().Strs("events", evs).Msg("will resume after given events")
+		po.OnEventPost(s.runResume, evs...)
+	}
+
 	// debug?
 	s.Debug().Msgf("[%d] attached %s %s", s.Index, s.Cmd, s.StringLR())
 	if s.GetLevel() <= zerolog.TraceLevel {
@@ -2,13 +2,18 @@ package core
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
+	"os/signal"
 	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/bgpfix/bgpfix/dir"
@@ -31,13 +36,38 @@ type Bgpipe struct {
 	K      *koanf.Koanf   // global config
 	Pipe   *pipe.Pipe     // bgpfix pipe
 	Stages []*StageBase   // pipe stages
+	auto   []*StageBase   // automatic stages (--stdin and --stdout)
 
-	repo map[string]NewStage // maps cmd to new stage func
+	repo  map[string]NewStage // maps cmd to new stage func
+	names map[string]int      // maps stage @name to its index
 
 	wg_lwrite sync.WaitGroup // stages that write to pipe L
 	wg_lread  sync.WaitGroup // stages that read from pipe L
 	wg_rwrite sync.WaitGroup // stages that write to pipe R
 	wg_rread  sync.WaitGroup // stages that read from pipe R
+
+	stats    adminStats  // admin API counters
+	shutdown atomic.Bool // shutdown in progress?
+	dumping  atomic.Bool // Dump in progress?
+	prof     profiler    // --cpuprofile and --memprofile
+
+	listeners []net.Listener // --pprof and --admin
+
+	sources atomic.Int32 // number of producer stages
+	failed  atomic.Int32 // number of failed producer stages (--keep-going)
+
+	estabL atomic.Int32 // L direction: 0 = idle, 1 = OPEN seen, 2 = established
+	estabR atomic.Int32 // R direction: 0 = idle, 1 = OPEN seen, 2 = established
+
+	estabDone chan struct{} // closed on EVENT_ESTABLISHED (--established-timeout)
+
+	quiet     atomic.Bool // --quiet-stable: session stable, log less?
+	quietKeep []string    // --quiet-keep: events still logged when quiet
+
+	healthMu sync.Mutex // guards health
+	health   health     // pipeline readiness
+
+	rates inputRates // --input-rate-report
 }
 
 // NewBgpipe creates a new bgpipe instance using given
@@ -66,6 +96,7 @@ func NewBgpipe(repo ...map[string]NewStage) *Bgpipe {
 
 	// command repository
 	b.repo = make(map[string]NewStage)
+	b.names = make(map[string]int)
 	for i := range repo {
 		b.AddRepo(repo[i])
 	}
@@ -75,6 +106,8 @@ func NewBgpipe(repo ...map[string]NewStage) *Bgpipe {
 
 // Run configures and runs the bgpipe
 func (b *Bgpipe) Run() error {
+	defer b.serveClose()
+
 	// configure bgpipe and its stages
 	if err := b.Configure(); err != nil {
 		b.Error().Err(err).Msg("configuration error")
@@ -96,10 +129,60 @@ func (b *Bgpipe) Run() error {
 		return nil
 	}
 
+	// print the effective config and quit?
+	if b.K.Bool("dump-config") {
+		return b.ConfigDump(os.Stdout, b.K.Bool("dump-config-secrets"))
+	}
+
+	// print the capabilities and quit?
+	if b.K.Bool("caps-print") {
+		fmt.Printf("%s\n", b.Pipe.Caps.ToJSON(nil))
+		return nil
+	}
+
+	// write the pidfile?
+	if err := b.pidfileWrite(); err != nil {
+		b.Error().Err(err).Msg("could not write the pidfile")
+		return err
+	}
+	defer b.pidfileRemove()
+
+	// write profiles?
+	if err := b.profileStart(); err != nil {
+		b.Error().Err(err).Msg("could not start profiling")
+		return err
+	}
+	defer b.profileStop()
+
 	// attach our b.Start
 	b.Pipe.Options.OnStart(b.onStart)
 
+	// shutdown in order on SIGINT / SIGTERM, exit on the second one
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		for range sig {
+			if b.shutdown.Load() {
+				b.Cancel(ErrShutdownTimeout)
+			} else {
+				go b.Shutdown()
+			}
+		}
+	}()
+
+	// dump the state to stderr on SIGQUIT, without exiting
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGQUIT)
+	defer signal.Stop(quit)
+	go func() {
+		for range quit {
+			go b.Dump(os.Stderr)
+		}
+	}()
+
 	// start the pipeline and block
+	b.stats.start = time.Now()
 	b.Pipe.Start() // will call b.Start
 	b.Pipe.Wait()  // until error or all processing is done
 
@@ -145,11 +228,135 @@ func (b *Bgpipe) onStart(ev *pipe.Event) bool {
 		b.Pipe.R.CloseOutput()
 	}()
 
+	// fail if the session does not come up?
+	b.estabTimeout()
+
+	// report input rates?
+	b.ratesReport()
+
 	return false
 }
 
+// estabTimeout cancels the main context with ErrEstabTimeout if no BGP session
+// gets established within --established-timeout since the pipe start.
+func (b *Bgpipe) estabTimeout() {
+	v := b.K.Duration("established-timeout")
+	if v <= 0 || b.estabDone == nil {
+		return
+	}
+
+	go func() {
+		select {
+		case <-b.estabDone:
+		case <-b.Ctx.Done():
+		case <-time.After(v):
+			b.Error().Stringer("timeout", v).Msg("BGP session not established in time")
+			b.Cancel(fmt.Errorf("%w: %s", ErrEstabTimeout, v))
+		}
+	}()
+}
+
+// onEstabDone disarms the --established-timeout on the first EVENT_ESTABLISHED
+func (b *Bgpipe) onEstabDone(ev *pipe.Event) bool {
+	close(b.estabDone)
+	return false // unregister
+}
+
+// Shutdown stops the pipeline in order: first stops all producers and waits
+// for the pipe to drain, then stops the remaining consumers. Cancels the
+// main context if it takes longer than --shutdown-timeout.
+func (b *Bgpipe) Shutdown() {
+	if b.shutdown.Swap(true) {
+		return // already shutting down
+	} else {
+		b.Info().Msg("shutting down")
+	}
+	if b.K.Bool("sd-notify") {
+		b.sdNotify("STOPPING=1")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		// stop producers, which closes and drains their inputs
+		stages := b.stopOrder()
+		for _, s := range stages {
+			if s != nil && s.Options.IsProducer {
+				s.runStop(nil)
+			}
+		}
+
+		// wait until the pipe processed all messages
+		b.wg_lwrite.Wait()
+		b.wg_rwrite.Wait()
+		b.Pipe.L.Wait()
+		b.Pipe.R.Wait()
+
+		// stop the consumers, let them flush remaining output
+		for _, s := range stages {
+			if s != nil {
+				s.runStop(nil)
+			}
+		}
+	}()
+
+	// bound the time it takes
+	var timeout <-chan time.Time
+	if v := b.K.Duration("shutdown-timeout"); v > 0 {
+		timeout = time.After(v)
+	}
+	select {
+	case <-done:
+		b.Debug().Msg("shutdown done")
+	case <-timeout:
+		b.Warn().Msg("shutdown timeout, exiting")
+		b.Cancel(ErrShutdownTimeout)
+	case <-b.Ctx.Done():
+	}
+}
+
+// stopOrder returns all stages in the producer to consumer order:
+// the automatic --stdin stage, b.Stages, and the automatic --stdout stage
+func (b *Bgpipe) stopOrder() []*StageBase {
+	var head, tail []*StageBase
+	for _, s := range b.auto {
+		if s.Options.IsProducer {
+			head = append(head, s)
+		} else {
+			tail = append(tail, s)
+		}
+	}
+	return slices.Concat(head, b.Stages, tail)
+}
+
+// keepGoing returns true iff the pipe should keep running despite error err in stage s,
+// ie. --keep-going is set, s is a producer, and some other producers have not failed.
+func (b *Bgpipe) keepGoing(s *StageBase, err error) bool {
+	if !b.K.Bool("keep-going") || !s.Options.IsProducer {
+		return false
+	}
+
+	failed := b.failed.Add(1)
+	if failed >= b.sources.Load() {
+		b.Error().Stringer("stage", s).Err(err).Msg("all sources failed")
+		return false
+	}
+
+	b.Error().Stringer("stage", s).Err(err).
+		Int32("failed", failed).Int32("sources", b.sources.Load()).
+		Msg("source failed, keep going")
+	s.Event("FAILED", err.Error())
+	return true
+}
+
 // LogEvent logs given event
 func (b *Bgpipe) LogEvent(ev *pipe.Event) bool {
+	// session stable and a routine event?
+	if ev.Error == nil && b.quiet.Load() && !b.quietKept(ev.Type) {
+		return true
+	}
+
 	// will b.Info() if ev.Error is nil
 	l := b.Err(ev.Error)
 
@@ -178,14 +385,110 @@ func (b *Bgpipe) LogEvent(ev *pipe.Event) bool {
 	return true
 }
 
+// quietKept returns true iff event type et should be logged despite --quiet-stable
+func (b *Bgpipe) quietKept(et string) bool {
+	for _, k := range b.quietKeep {
+		if k == "*" || k == et {
+			return true
+		} else if suffix, ok := strings.CutPrefix(k, "*"); ok && strings.HasSuffix(et, suffix) {
+			return true // eg. */STOP
+		}
+	}
+	return false
+}
+
+// onQuiet reduces event logging once the session is established (--quiet-stable)
+func (b *Bgpipe) onQuiet(ev *pipe.Event) bool {
+	if !b.quiet.Swap(true) {
+		b.Info().Strs("events", b.quietKeep).Msg("session established, logging only errors and given events")
+	}
+	return true
+}
+
+// onLoud restores event logging when the session goes down or restarts (--quiet-stable)
+func (b *Bgpipe) onLoud(ev *pipe.Event) bool {
+	if b.quiet.Swap(false) {
+		b.Info().Stringer("ev", ev).Msg("session changed, logging all events again")
+	}
+	return true
+}
+
+// quietNotify restores event logging on NOTIFICATION messages (--quiet-stable)
+func (b *Bgpipe) quietNotify(m *msg.Msg) bool {
+	if b.quiet.Swap(false) {
+		b.Info().Stringer("dir", m.Dir).Msg("NOTIFICATION seen, logging all events again")
+	}
+	return true
+}
+
 // KillEvent brutally kills the session because of given event ev
 func (b *Bgpipe) KillEvent(ev *pipe.Event) bool {
 	b.LogEvent(ev)
 	b.Warn().Stringer("ev", ev).Msg("session killed by event")
+	b.profileStop()
+	b.pidfileRemove()
+	b.serveClose()
 	os.Exit(1)
 	return false
 }
 
+// logCaps logs the capabilities from the OPEN messages seen in each direction,
+// and the negotiated result. Stores them in the pipe KV as L_CAPS and R_CAPS,
+// along with the peer hostnames as L_HOSTNAME and R_HOSTNAME, if sent.
+func (b *Bgpipe) logCaps(ev *pipe.Event) bool {
+	p := b.Pipe
+	for _, line := range []*pipe.Line{p.L, p.R} {
+		open := line.Open.Load()
+		if open == nil {
+			continue
+		}
+
+		js := open.Caps.ToJSON(nil)
+		p.KV.Store(kvKey(line.Dir, KV_CAPS), string(js))
+		b.kvHostname(line.Dir, open)
+		b.Info().Stringer("dir", line.Dir).RawJSON("caps", js).Msg("OPEN capabilities")
+	}
+
+	b.Info().RawJSON("caps", p.Caps.ToJSON(nil)).Msg("negotiated capabilities")
+	return false
+}
+
+// onEstablish emits EVENT_L_ESTABLISHED or EVENT_R_ESTABLISHED on the first
+// KEEPALIVE that follows an OPEN in given direction, ie. when the speaker
+// sending in that direction has accepted its peer
+func (b *Bgpipe) onEstablish(m *msg.Msg) bool {
+	st, et := &b.estabR, EVENT_R_ESTABLISHED
+	if m.Dir == dir.DIR_L {
+		st, et = &b.estabL, EVENT_L_ESTABLISHED
+	}
+
+	switch m.Type {
+	case msg.OPEN:
+		st.CompareAndSwap(0, 1)
+	case msg.KEEPALIVE:
+		if st.CompareAndSwap(1, 2) {
+			b.Pipe.Event(et)
+		}
+	}
+	return true
+}
+
+// parseCheck drops messages that fail to parse (--on-parse-error drop|kill)
+func (b *Bgpipe) parseCheck(m *msg.Msg) bool {
+	if b.Pipe.ParseMsg(m) != nil {
+		b.stats.parseDrop.Add(1)
+		return false
+	}
+	return true
+}
+
+// parseKill stops the pipe on parse error (--on-parse-error kill)
+func (b *Bgpipe) parseKill(ev *pipe.Event) bool {
+	b.Error().Err(ev.Error).Stringer("ev", ev).Msg("parse error, killing the session")
+	b.Cancel(ErrParseKill)
+	return false
+}
+
 // AddRepo adds mapping between stage commands and their NewStageFunc
 func (b *Bgpipe) AddRepo(cmds map[string]NewStage) {
 	for cmd, newfunc := range cmds {
@@ -201,6 +504,11 @@ func (b *Bgpipe) AddStage(idx int, cmd string) (*StageBase, error) {
 		idx = max(1, len(b.Stages))
 	}
 
+	// too many?
+	if limit := b.K.Int("max-stages"); limit > 0 && idx > limit {
+		return nil, fmt.Errorf("[%d] %s: %w (--max-stages %d)", idx, cmd, ErrStageMax, limit)
+	}
+
 	// already there? check cmd
 	if idx < len(b.Stages) {
 		if s := b.Stages[idx]; s != nil {
@@ -233,6 +541,74 @@ func (b *Bgpipe) StageCount() int {
 	return max(0, len(b.Stages)-1)
 }
 
+// ConfigDump writes the effective configuration of bgpipe and all its stages
+// to w in JSON, including defaults. Hides StageOptions.Secrets unless secrets is true.
+func (b *Bgpipe) ConfigDump(w io.Writer, secrets bool) error {
+	type stageConfig struct {
+		Index   int            `json:"index"`
+		Cmd     string         `json:"cmd"`
+		Name    string         `json:"name"`
+		Options map[string]any `json:"options"`
+	}
+	var dump struct {
+		Bgpipe map[string]any `json:"bgpipe"`
+		Stages []stageConfig  `json:"stages"`
+	}
+
+	dump.Bgpipe = configValues(b.K.All(), nil)
+	for _, s := range b.Stages {
+		if s == nil {
+			continue
+		}
+
+		var hide []string
+		if !secrets {
+			hide = s.Options.Secrets
+		}
+		opts := configValues(s.K.All(), hide)
+
+		dump.Stages = append(dump.Stages, stageConfig{
+			Index:   s.Index,
+			Cmd:     s.Cmd,
+			Name:    s.Name,
+			Options: opts,
+		})
+	}
+
+	buf, err := json.MarshalIndent(&dump, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", buf)
+	return err
+}
+
+// configValues prepares config values in src for printing, in place:
+// formats durations as text, and replaces non-empty values of hide keys.
+func configValues(src map[string]any, hide []string) map[string]any {
+	for key, v := range src {
+		if d, ok := v.(time.Duration); ok {
+			src[key] = d.String()
+		}
+	}
+	for _, key := range hide {
+		switch v := src[key].(type) {
+		case nil:
+			continue
+		case string:
+			if v == "" {
+				continue
+			}
+		case []string:
+			if len(v) == 0 {
+				continue
+			}
+		}
+		src[key] = "REDACTED"
+	}
+	return src
+}
+
 // StageDump prints all stages in dir direction in textual form to w (by default stdout)
 func (b *Bgpipe) StageDump(d dir.Dir, w io.Writer) (total int) {
 	// use default w?
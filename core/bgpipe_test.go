@@ -0,0 +1,850 @@
+package core
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bgpfix/bgpfix/caps"
+	"github.com/bgpfix/bgpfix/dir"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/knadh/koanf/providers/posflag"
+)
+
+var errTestFail = errors.New("source unavailable")
+
+// testStop is a test stage that records the order of Stop calls
+type testStop struct {
+	*StageBase
+	mu    *sync.Mutex
+	order *[]string
+}
+
+func (s *testStop) Prepare() error {
+	switch s.Cmd {
+	case "fail":
+		return errTestFail
+	case "block": // until cancelled
+		<-s.Ctx.Done()
+		s.record("block returned")
+		return context.Cause(s.Ctx)
+	case "slow": // ignores the context
+		time.Sleep(200 * time.Millisecond)
+	}
+	return nil
+}
+
+func (s *testStop) record(what string) {
+	s.mu.Lock()
+	*s.order = append(*s.order, what)
+	s.mu.Unlock()
+}
+func (s *testStop) Run() error { return nil }
+
+func (s *testStop) Attach() error {
+	if s.Options.IsProducer {
+		s.P.Options.AddInput(s.Dir)
+	}
+	switch s.Cmd {
+	case "filter", "stdout": // record messages seen
+		s.P.OnMsg(func(m *msg.Msg) bool {
+			s.record(s.Name + strconv.Itoa(s.Index))
+			return true
+		}, s.Dir)
+	}
+	return nil
+}
+
+func (s *testStop) Stop() error {
+	s.record(s.Name)
+	if s.running.Load() {
+		close(s.done) // as if Run returned
+	}
+	return nil
+}
+
+// testStopRepo returns a stage repo for testStop stages, recording in order
+func testStopRepo(order *[]string) map[string]NewStage {
+	mu := &sync.Mutex{}
+	stage := func(producer, stdin, stdout bool) NewStage {
+		return func(parent *StageBase) Stage {
+			s := &testStop{StageBase: parent, mu: mu, order: order}
+			o := &s.Options
+			o.Bidir = true
+			o.IsProducer = producer
+			o.IsStdin = stdin
+			o.IsStdout = stdout
+			o.IsListener = parent.Cmd == "listener"
+			return s
+		}
+	}
+	return map[string]NewStage{
+		"stdin":    stage(true, true, false),
+		"stdout":   stage(false, false, true),
+		"src":      stage(true, false, false),
+		"filter":   stage(false, false, false),
+		"fail":     stage(true, false, false),
+		"block":    stage(true, false, false),
+		"slow":     stage(true, false, false),
+		"listener": stage(true, false, false),
+		"sink":     stage(false, false, false), // eg. connect, reads the pipe output
+	}
+}
+
+func TestShutdownOrder(t *testing.T) {
+	var order []string
+	b := NewBgpipe(testStopRepo(&order))
+	for i, cmd := range []string{"filter", "src", "filter"} {
+		if _, err := b.AddStage(i+1, cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.K.Load(posflag.Provider(b.F, ".", b.K), nil) // defaults
+	b.K.Set("stdin", true)
+	b.K.Set("stdout", true)
+	if err := b.AttachStages(); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.auto) != 2 {
+		t.Fatalf("got %d automatic stages, want 2", len(b.auto))
+	}
+
+	// pretend all stages are running
+	for _, s := range b.stopOrder() {
+		if s != nil {
+			s.started.Store(true)
+			s.running.Store(true)
+		}
+	}
+
+	b.Shutdown()
+	if err := b.Ctx.Err(); err != nil {
+		t.Fatalf("shutdown did not finish cleanly: %v", err)
+	}
+
+	// producers first, then the consumers, --stdout very last
+	want := []string{"stdin", "src", "filter", "filter", "stdout"}
+	if !slices.Equal(order, want) {
+		t.Errorf("stop order: got %v, want %v", order, want)
+	}
+	for _, s := range b.stopOrder() {
+		if s != nil && !s.stopped.Load() {
+			t.Errorf("stage %s not stopped", s)
+		}
+	}
+}
+
+// testPipe returns an attached pipe with given global options and stages
+func testPipe(t *testing.T, opts map[string]any, cmds ...string) *Bgpipe {
+	t.Helper()
+	b, err := testPipeOpts(new([]string), opts, nil, cmds...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// testPipeOpts is like testPipe, but records in order, sets stage options in sopts
+// (by stage index), and returns the AttachStages error
+func testPipeOpts(order *[]string, opts map[string]any, sopts map[int]map[string]any, cmds ...string) (*Bgpipe, error) {
+	b := NewBgpipe(testStopRepo(order))
+	for i, cmd := range cmds {
+		s, err := b.AddStage(i+1, cmd)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range sopts[i+1] {
+			s.K.Set(k, v)
+		}
+	}
+	b.K.Load(posflag.Provider(b.F, ".", b.K), nil) // defaults
+	for k, v := range opts {
+		b.K.Set(k, v)
+	}
+	return b, b.AttachStages()
+}
+
+// testFlow sends m through the pipe callbacks from input in, like the pipe would.
+// Returns false iff m was dropped before the pipe output.
+func testFlow(b *Bgpipe, in *pipe.Input, m *msg.Msg) bool {
+	m.Dir = in.Dir
+	pipe.MsgContext(m).Input = in
+
+	cbs := slices.Clone(b.Pipe.Options.Callbacks)
+	slices.SortStableFunc(cbs, func(x, y *pipe.Callback) int {
+		if x.Order != y.Order {
+			return cmp.Compare(x.Order, y.Order)
+		} else if in.Reverse {
+			return cmp.Compare(y.Id, x.Id)
+		} else {
+			return cmp.Compare(x.Id, y.Id)
+		}
+	})
+
+	filter := injectPoint{in.CallbackFilter, in.CallbackFilter, in.FilterValue.(int)}
+	for _, cb := range cbs {
+		switch {
+		case cb.Dir != 0 && cb.Dir&m.Dir == 0:
+			continue
+		case len(cb.Types) > 0 && !slices.Contains(cb.Types, m.Type):
+			continue
+		case filter.skips(m.Dir, cb.Id):
+			continue
+		case !cb.Func(m):
+			return false
+		}
+	}
+	return true
+}
+
+// testEvent runs the pipe handlers for event type et in order, like the pipe would,
+// calling after (if non-nil) after each handler
+func testEvent(b *Bgpipe, et string, after func()) {
+	hs := slices.Clone(b.Pipe.Options.Handlers)
+	slices.SortStableFunc(hs, func(x, y *pipe.Handler) int {
+		return cmp.Compare(x.Order, y.Order)
+	})
+	ev := &pipe.Event{Type: et}
+	for _, h := range hs {
+		if !slices.Contains(h.Types, et) {
+			continue
+		}
+		h.Func(ev)
+		if after != nil {
+			after()
+		}
+	}
+}
+
+func TestKeepGoing(t *testing.T) {
+	b := testPipe(t, map[string]any{"keep-going": true}, "src", "fail", "fail", "filter")
+	if got := b.sources.Load(); got != 3 {
+		t.Fatalf("got %d sources, want 3", got)
+	}
+
+	// non-producers always fail the pipe
+	if b.keepGoing(b.Stages[4], errTestFail) {
+		t.Error("keepGoing() true for a non-producer")
+	}
+
+	// producers fail the pipe only when the last one fails
+	for i, want := range []bool{true, true, false} {
+		if got := b.keepGoing(b.Stages[1+i], errTestFail); got != want {
+			t.Errorf("failure %d: keepGoing() = %v, want %v", i+1, got, want)
+		}
+	}
+
+	// no --keep-going: any failure is fatal
+	b = testPipe(t, map[string]any{"keep-going": false}, "src", "fail", "fail", "filter")
+	if b.keepGoing(b.Stages[2], errTestFail) {
+		t.Error("keepGoing() true without --keep-going")
+	}
+}
+
+func TestKeepGoingPrepare(t *testing.T) {
+	ev := &pipe.Event{}
+
+	// one of two sources fails in Prepare: the pipe keeps going
+	b := testPipe(t, map[string]any{"keep-going": true}, "fail", "src", "filter")
+	b.Stages[1].runStart(ev)
+	if err := context.Cause(b.Ctx); err != nil {
+		t.Fatalf("pipe cancelled: %v", err)
+	}
+	if s := b.Stages[1]; !s.stopped.Load() || s.running.Load() {
+		t.Error("failed stage not stopped")
+	}
+
+	// all sources fail: the pipe fails with the error
+	b = testPipe(t, map[string]any{"keep-going": true}, "fail", "fail")
+	b.Stages[1].runStart(ev)
+	b.Stages[2].runStart(ev)
+	if err := context.Cause(b.Ctx); !errors.Is(err, errTestFail) {
+		t.Errorf("got %v, want %v", err, errTestFail)
+	}
+
+	// no --keep-going: the first failure is fatal
+	b = testPipe(t, map[string]any{"keep-going": false}, "fail", "src", "filter")
+	b.Stages[1].runStart(ev)
+	if err := context.Cause(b.Ctx); !errors.Is(err, errTestFail) {
+		t.Errorf("got %v, want %v", err, errTestFail)
+	}
+}
+
+func TestParseCheck(t *testing.T) {
+	bad := msg.NewMsg().Use(msg.UPDATE)
+	bad.Data = []byte{0xff}
+	good := msg.NewMsg().Use(msg.UPDATE)
+	good.Data = []byte{0, 0, 0, 0} // no withdrawn routes, no attributes
+
+	b := testPipe(t, map[string]any{"on-parse-error": "drop"}, "src", "filter")
+	if !b.parseCheck(good) {
+		t.Error("valid UPDATE dropped")
+	}
+	if b.parseCheck(bad) {
+		t.Error("malformed UPDATE passed")
+	}
+	if got := b.stats.parseDrop.Load(); got != 1 {
+		t.Errorf("parse_drop = %d, want 1", got)
+	}
+	if err := context.Cause(b.Ctx); err != nil {
+		t.Errorf("drop: pipe cancelled: %v", err)
+	}
+}
+
+func TestParseKill(t *testing.T) {
+	b := testPipe(t, map[string]any{"on-parse-error": "kill"}, "src", "filter")
+	b.parseKill(&pipe.Event{Type: pipe.EVENT_PARSE, Error: errTestFail})
+	if err := context.Cause(b.Ctx); !errors.Is(err, ErrParseKill) {
+		t.Errorf("got %v, want %v", err, ErrParseKill)
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	// handlers installed depending on the policy
+	var handlers [3]int
+	for i, v := range []string{"pass", "drop", "kill"} {
+		b := testPipe(t, map[string]any{"on-parse-error": v}, "src", "filter")
+		handlers[i] = len(b.Pipe.Options.Handlers)
+	}
+	if handlers[0] != handlers[1] || handlers[2] != handlers[1]+1 {
+		t.Errorf("handlers for pass, drop, kill: %v", handlers)
+	}
+
+	// invalid value
+	b := NewBgpipe(testStopRepo(new([]string)))
+	b.AddStage(1, "src")
+	b.AddStage(2, "filter")
+	b.K.Load(posflag.Provider(b.F, ".", b.K), nil)
+	b.K.Set("on-parse-error", "ignore")
+	if err := b.AttachStages(); !errors.Is(err, ErrParseMode) {
+		t.Errorf("got %v, want %v", err, ErrParseMode)
+	}
+}
+
+func TestLogCaps(t *testing.T) {
+	b := testPipe(t, nil, "src", "filter")
+	p := b.Pipe
+
+	// different OPENs in each direction
+	openL := &msg.NewMsg().Use(msg.OPEN).Open
+	openL.Caps.Use(caps.CAP_AS4)
+	openL.Caps.Use(caps.CAP_ROUTE_REFRESH)
+	openR := &msg.NewMsg().Use(msg.OPEN).Open
+	openR.Caps.Use(caps.CAP_AS4)
+	p.L.Open.Store(openL)
+	p.R.Open.Store(openR)
+
+	b.logCaps(&pipe.Event{Type: pipe.EVENT_OPEN})
+	for _, tt := range []struct {
+		key  string
+		open *msg.Open
+	}{
+		{"L_CAPS", openL},
+		{"R_CAPS", openR},
+	} {
+		v, ok := p.KV.Load(tt.key)
+		if want := string(tt.open.Caps.ToJSON(nil)); !ok || v != want {
+			t.Errorf("%s: got %v, want %s", tt.key, v, want)
+		}
+	}
+	l, _ := p.KV.Load("L_CAPS")
+	r, _ := p.KV.Load("R_CAPS")
+	if l == r {
+		t.Error("L_CAPS and R_CAPS not told apart")
+	}
+
+	// only one side seen so far
+	b = testPipe(t, nil, "src", "filter")
+	b.Pipe.R.Open.Store(openR)
+	b.logCaps(&pipe.Event{Type: pipe.EVENT_OPEN})
+	if _, ok := b.Pipe.KV.Load("L_CAPS"); ok {
+		t.Error("L_CAPS stored without an L OPEN")
+	}
+	if _, ok := b.Pipe.KV.Load("R_CAPS"); !ok {
+		t.Error("R_CAPS not stored")
+	}
+}
+
+func TestPrepareTimeout(t *testing.T) {
+	var order []string
+	b := NewBgpipe(testStopRepo(&order))
+	b.AddStage(1, "block")
+	b.AddStage(2, "filter")
+	b.K.Load(posflag.Provider(b.F, ".", b.K), nil)
+	if err := b.AttachStages(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := b.Stages[1]
+	s.K.Set("prepare-timeout", 50*time.Millisecond)
+	s.runStart(&pipe.Event{})
+
+	// the pipe fails with an error naming the stage
+	err := context.Cause(b.Ctx)
+	if !errors.Is(err, ErrPrepareTimeout) || !strings.HasPrefix(err.Error(), "block: ") {
+		t.Errorf("got %v, want %v for block", err, ErrPrepareTimeout)
+	}
+
+	// Prepare was unblocked, and the stage did not start
+	if !slices.Contains(order, "block returned") {
+		t.Error("Prepare still running after the timeout")
+	}
+	if s.running.Load() {
+		t.Error("stage running after the timeout")
+	}
+}
+
+func TestPrepareTimeoutLate(t *testing.T) {
+	var order []string
+	b := NewBgpipe(testStopRepo(&order))
+	b.AddStage(1, "slow")
+	b.AddStage(2, "filter")
+	b.K.Load(posflag.Provider(b.F, ".", b.K), nil)
+	if err := b.AttachStages(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prepare returns ok, but too late: must be stopped to release resources
+	s := b.Stages[1]
+	s.K.Set("prepare-timeout", 50*time.Millisecond)
+	if err := s.prepare(); !errors.Is(err, ErrPrepareTimeout) {
+		t.Errorf("got %v, want %v", err, ErrPrepareTimeout)
+	}
+	if !slices.Contains(order, s.Name) {
+		t.Error("Stop not called after Prepare returned late")
+	}
+}
+
+func TestPrepareTimeoutDefault(t *testing.T) {
+	b := NewBgpipe(testStopRepo(new([]string)))
+	for cmd, want := range map[string]string{"src": "5m0s", "listener": "0s"} {
+		f := b.NewStage(cmd).Options.Flags.Lookup("prepare-timeout")
+		if f == nil || f.DefValue != want {
+			t.Errorf("%s: got default %v, want %s", cmd, f, want)
+		}
+	}
+}
+
+// testLoop sends m around stages in a loop until dropped, or until limit hops.
+// Returns the number of stage callbacks that processed m.
+func testLoop(stages []*StageBase, guard bool, max_hops int, m *msg.Msg, limit int) (hops int) {
+	var cbs []pipe.CallbackFunc
+	for _, s := range stages {
+		cbs = append(cbs, s.loopWrap(func(m *msg.Msg) bool {
+			hops++
+			return true
+		}, guard, max_hops))
+	}
+	for i := 0; hops < limit; i++ {
+		if !cbs[i%len(cbs)](m) {
+			break
+		}
+	}
+	return hops
+}
+
+func TestLoopGuard(t *testing.T) {
+	tests := []struct {
+		name     string
+		guard    bool
+		max_hops int
+		want     int // number of hops before dropped
+	}{
+		{"--loop-guard", true, 0, 3},
+		{"--max-hops 7", false, 7, 7},
+		{"--max-hops 2", false, 2, 2},
+		{"both", true, 7, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBgpipe(testStopRepo(new([]string)))
+			var stages []*StageBase
+			for i, cmd := range []string{"src", "filter", "filter"} {
+				s, _ := b.AddStage(i+1, cmd)
+				stages = append(stages, s)
+			}
+
+			m := msg.NewMsg().Use(msg.UPDATE)
+			if got := testLoop(stages, tt.guard, tt.max_hops, m, 100); got != tt.want {
+				t.Errorf("got %d hops, want %d", got, tt.want)
+			}
+			if got := b.stats.loopDrop.Load(); got != 1 {
+				t.Errorf("loop_drop = %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestLoopGuardTags(t *testing.T) {
+	b := NewBgpipe(testStopRepo(new([]string)))
+	s1, _ := b.AddStage(1, "src")
+	s2, _ := b.AddStage(2, "filter")
+
+	// the state is in tags, eg. after a JSON round-trip via an external process
+	m := msg.NewMsg().Use(msg.UPDATE)
+	tags := pipe.MsgContext(m).UseTags()
+	tags[TAG_VISITED] = "2"
+	tags[TAG_HOPS] = "5"
+
+	if testLoop([]*StageBase{s1, s2}, true, 10, m, 100) != 1 {
+		t.Error("message visited by stage 2 not dropped there")
+	}
+	if tags[TAG_VISITED] != "2,1" || tags[TAG_HOPS] != "6" {
+		t.Errorf("got tags %v", tags)
+	}
+}
+
+func TestFromToMiddleTap(t *testing.T) {
+	tests := []struct {
+		name   string
+		sopts  map[string]any
+		seen   []string
+		output bool // reaches the pipe output?
+	}{
+		{"default", map[string]any{"right": true}, []string{"filter3", "filter4"}, true},
+		{"--to 3", map[string]any{"right": true, "to": "3"}, []string{"filter3"}, false},
+		{"--from 4", map[string]any{"right": true, "from": "4"}, []string{"filter4"}, true},
+		{"--to 5", map[string]any{"right": true, "to": "5"}, []string{"filter3", "filter4"}, true},
+		{"-L --to 1", map[string]any{"left": true, "to": "1"}, []string{"filter1", "stdout0"}, true},
+		{"-L --to 3", map[string]any{"left": true, "to": "3"}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen []string
+			b, err := testPipeOpts(&seen, map[string]any{"stdout": true}, map[int]map[string]any{2: tt.sopts},
+				"filter", "src", "filter", "filter", "sink")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tap := b.Stages[2]
+			if got := testFlow(b, tap.inputs[0], msg.NewMsg().Use(msg.UPDATE)); got != tt.output {
+				t.Errorf("reached the output: got %v, want %v", got, tt.output)
+			}
+			if !slices.Equal(seen, tt.seen) {
+				t.Errorf("seen by: got %v, want %v", seen, tt.seen)
+			}
+		})
+	}
+}
+
+func TestFromToDualReader(t *testing.T) {
+	// 2 readers, 1 writer: reader 2 messages exit at the filter
+	var seen []string
+	b, err := testPipeOpts(&seen, map[string]any{"stdout": true},
+		map[int]map[string]any{1: {"to": "4"}, 2: {"to": "3"}},
+		"src", "src", "filter", "sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reader 1 exits at the writer, which reads the pipe output
+	if !testFlow(b, b.Stages[1].inputs[0], msg.NewMsg().Use(msg.UPDATE)) {
+		t.Error("reader 1: dropped before the writer")
+	}
+	if want := []string{"filter3"}; !slices.Equal(seen, want) {
+		t.Errorf("reader 1: seen by %v, want %v", seen, want)
+	}
+
+	// reader 2 must not reach the writer, nor --stdout
+	seen = nil
+	if testFlow(b, b.Stages[2].inputs[0], msg.NewMsg().Use(msg.UPDATE)) {
+		t.Error("reader 2: reached the writer")
+	}
+	if want := []string{"filter3"}; !slices.Equal(seen, want) {
+		t.Errorf("reader 2: seen by %v, want %v", seen, want)
+	}
+}
+
+func TestInputRates(t *testing.T) {
+	tests := []struct {
+		name  string
+		sopts map[string]any
+	}{
+		{"R next", map[string]any{}},
+		{"L next", map[string]any{"left": true}},
+		{"R here", map[string]any{"inject": "here"}},
+		{"L here", map[string]any{"left": true, "inject": "here"}},
+		{"first", map[string]any{"inject": "first"}},
+		{"last", map[string]any{"inject": "last"}},
+		{"L last", map[string]any{"left": true, "inject": "last"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 2 producers, the 2nd one 3x faster
+			var seen []string
+			b, err := testPipeOpts(&seen, map[string]any{"input-rate-report": time.Second},
+				map[int]map[string]any{1: tt.sopts, 2: tt.sopts},
+				"src", "src", "filter", "sink")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 10; i++ {
+				testFlow(b, b.Stages[1].inputs[0], msg.NewMsg().Use(msg.UPDATE))
+				for j := 0; j < 3; j++ {
+					testFlow(b, b.Stages[2].inputs[0], msg.NewMsg().Use(msg.UPDATE))
+				}
+			}
+
+			r := &b.rates
+			if !slices.Equal(r.names, []string{"src", "src"}) {
+				t.Fatalf("names: got %v", r.names)
+			}
+			c1, c2 := r.count[0].Load(), r.count[1].Load()
+			if c1 != 10 || c2 != 30 {
+				t.Errorf("counts: got %d and %d, want 10 and 30", c1, c2)
+			}
+			if tt.sopts["inject"] == "last" && len(seen) > 0 {
+				t.Errorf("--inject last: seen by %v", seen)
+			}
+		})
+	}
+}
+
+func TestPriority(t *testing.T) {
+	// stage 2 has a lower --priority, so it must be READY before stage 1 starts
+	b, err := testPipeOpts(new([]string), nil,
+		map[int]map[string]any{1: {"priority": 2}, 2: {"priority": 1}},
+		"src", "src", "sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1, s2 := b.Stages[1], b.Stages[2]
+
+	testEvent(b, pipe.EVENT_START, func() {
+		if s1.started.Load() && !s2.running.Load() {
+			t.Fatal("stage 1 started before stage 2 was READY")
+		}
+	})
+	if !s1.running.Load() || !s2.running.Load() {
+		t.Error("not all stages started")
+	}
+	b.Cancel(nil)
+}
+
+func TestInjectTarget(t *testing.T) {
+	tests := []struct {
+		name   string
+		inject string
+		fid    int // want filter value, or -1 for an error
+	}{
+		{"index", "3", 3},
+		{"dangling @name", "@nope", -1},
+		{"out-of-range index", "4", -1},
+		{"huge index", "99999999999999999999", -1},
+		{"zero index", "0", -1},
+		{"negative index", "-1", -1},
+		{"garbage", "foo", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := testPipeOpts(new([]string), nil,
+				map[int]map[string]any{1: {"inject": tt.inject}},
+				"src", "filter", "sink")
+			switch {
+			case tt.fid < 0:
+				if !errors.Is(err, ErrPipeline) || !strings.Contains(err.Error(), "--inject "+tt.inject) {
+					t.Errorf("got %v, want ErrPipeline for --inject", err)
+				}
+			case err != nil:
+				t.Error(err)
+			case b.Stages[1].inputs[0].FilterValue != tt.fid:
+				t.Errorf("got filter value %v, want %d", b.Stages[1].inputs[0].FilterValue, tt.fid)
+			}
+		})
+	}
+}
+
+func TestMaxStages(t *testing.T) {
+	b := NewBgpipe(testStopRepo(new([]string)))
+	b.K.Load(posflag.Provider(b.F, ".", b.K), nil) // defaults
+	b.K.Set("max-stages", 2)
+	for i, cmd := range []string{"src", "sink"} {
+		if _, err := b.AddStage(i+1, cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := b.AddStage(3, "sink"); !errors.Is(err, ErrStageMax) {
+		t.Errorf("3rd stage: got %v, want ErrStageMax", err)
+	}
+	if _, err := b.AddStage(0, "sink"); !errors.Is(err, ErrStageMax) {
+		t.Errorf("appended stage: got %v, want ErrStageMax", err)
+	}
+}
+
+func TestInjectPointSkips(t *testing.T) {
+	s := &StageBase{Index: 3}
+	tests := []struct {
+		inject string
+		d      dir.Dir
+		seen   []int // callback ids not skipped, out of 0-5
+	}{
+		{"next", dir.DIR_R, []int{4, 5}},
+		{"next", dir.DIR_L, []int{0, 1, 2}},
+		{"here", dir.DIR_R, []int{3, 4, 5}},
+		{"here", dir.DIR_L, []int{0, 1, 2, 3}},
+		{"first", dir.DIR_R, []int{0, 1, 2, 3, 4, 5}},
+		{"first", dir.DIR_L, []int{0, 1, 2, 3, 4, 5}},
+		{"last", dir.DIR_R, nil},
+		{"last", dir.DIR_L, nil},
+	}
+	for _, tt := range tests {
+		ip, err := s.injectPoint(tt.inject)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var seen []int
+		for id := 0; id <= 5; id++ {
+			if !ip.skips(tt.d, id) {
+				seen = append(seen, id)
+			}
+		}
+		if !slices.Equal(seen, tt.seen) {
+			t.Errorf("%s %s: got %v, want %v", tt.inject, tt.d, seen, tt.seen)
+		}
+		if ip.skips(tt.d, math.MaxInt) && tt.d == dir.DIR_R {
+			t.Errorf("%s %s: skips internal callbacks", tt.inject, tt.d)
+		}
+	}
+}
+
+func TestInjectType(t *testing.T) {
+	var seen []string
+	b, err := testPipeOpts(&seen, nil,
+		map[int]map[string]any{1: {"right": true}, 2: {"inject-type": []string{"open=first", "update=3"}}},
+		"filter", "src", "filter", "sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// distinct entry points per type
+	s := b.Stages[2]
+	want := map[msg.Type]int{msg.INVALID: 2, msg.OPEN: 0, msg.UPDATE: 3}
+	for typ, fid := range want {
+		if got := s.entries[typ].fid; got != fid {
+			t.Errorf("%s: got filter id %d, want %d", typ, got, fid)
+		}
+	}
+
+	// each type takes its path
+	for _, tt := range []struct {
+		typ  msg.Type
+		seen []string
+	}{
+		{msg.OPEN, []string{"filter1", "filter3"}},
+		{msg.UPDATE, nil},
+		{msg.KEEPALIVE, []string{"filter3"}},
+	} {
+		seen = nil
+		testFlow(b, s.inputs[0], msg.NewMsg().Use(tt.typ))
+		if !slices.Equal(seen, tt.seen) {
+			t.Errorf("%s: seen by %v, want %v", tt.typ, seen, tt.seen)
+		}
+	}
+}
+
+func TestEstablishStaggered(t *testing.T) {
+	b, err := testPipeOpts(new([]string), nil,
+		map[int]map[string]any{2: {"wait": []string{"l_established"}}},
+		"sink", "src", "sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := b.Stages[2]
+
+	// send m through onEstablish, running the handlers of a new event
+	send := func(d dir.Dir, typ msg.Type) {
+		estab := []bool{b.estabL.Load() == 2, b.estabR.Load() == 2}
+		m := msg.NewMsg().Use(typ)
+		m.Dir = d
+		b.onEstablish(m)
+		if !estab[0] && b.estabL.Load() == 2 {
+			testEvent(b, EVENT_L_ESTABLISHED, nil)
+		}
+		if !estab[1] && b.estabR.Load() == 2 {
+			testEvent(b, EVENT_R_ESTABLISHED, nil)
+		}
+	}
+
+	// R side comes up first
+	send(dir.DIR_R, msg.OPEN)
+	send(dir.DIR_L, msg.OPEN)
+	send(dir.DIR_L, msg.UPDATE)
+	send(dir.DIR_R, msg.KEEPALIVE)
+	if b.estabR.Load() != 2 || b.estabL.Load() != 1 {
+		t.Fatalf("got L=%d R=%d, want L=1 R=2", b.estabL.Load(), b.estabR.Load())
+	}
+	if s.started.Load() {
+		t.Fatal("stage started on R_ESTABLISHED")
+	}
+
+	// then L
+	send(dir.DIR_L, msg.KEEPALIVE)
+	if b.estabL.Load() != 2 {
+		t.Fatalf("got L=%d, want 2", b.estabL.Load())
+	}
+	if !s.started.Load() {
+		t.Error("stage not started on L_ESTABLISHED")
+	}
+	b.Cancel(nil)
+
+	// KEEPALIVE before OPEN does not count
+	b.estabR.Store(0)
+	send(dir.DIR_R, msg.KEEPALIVE)
+	if b.estabR.Load() != 0 {
+		t.Errorf("KEEPALIVE before OPEN: got R=%d, want 0", b.estabR.Load())
+	}
+}
+
+func TestStageNames(t *testing.T) {
+	// duplicate @name on the command line
+	b := NewBgpipe(testStopRepo(new([]string)))
+	err := b.parseArgs([]string{"--", "@a", "src", "--", "@a", "sink"})
+	if !errors.Is(err, ErrStageName) {
+		t.Errorf("parseArgs: got %v, want ErrStageName", err)
+	}
+
+	// @names of stages added by AddStage
+	add := func(names ...string) *Bgpipe {
+		b := NewBgpipe(testStopRepo(new([]string)))
+		for i, name := range names {
+			s, err := b.AddStage(i+1, []string{"src", "filter", "sink"}[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != "" {
+				s.Name = name
+			}
+		}
+		b.K.Load(posflag.Provider(b.F, ".", b.K), nil) // defaults
+		return b
+	}
+
+	b = add("", "@a", "@a")
+	if err := b.AttachStages(); !errors.Is(err, ErrStageName) {
+		t.Errorf("AddStage: got %v, want ErrStageName", err)
+	}
+
+	b = add("", "@a", "")
+	b.Stages[1].K.Set("inject", "@a")
+	if err := b.AttachStages(); err != nil {
+		t.Fatalf("AddStage: %v", err)
+	}
+	if got := b.Stages[1].inputs[0].FilterValue; got != 2 {
+		t.Errorf("--inject @a: got filter value %v, want 2", got)
+	}
+
+	b = add("", "@a", "")
+	b.Stages[1].K.Set("inject", "@b")
+	if err := b.AttachStages(); !errors.Is(err, ErrPipeline) {
+		t.Errorf("--inject @b: got %v, want ErrPipeline", err)
+	}
+}
@@ -0,0 +1,70 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// coalescer holds back repeated stage events (--event-coalesce)
+type coalescer struct {
+	window time.Duration // --event-coalesce
+
+	mu      sync.Mutex            // guards pending
+	pending map[string]*coalesced // event type -> held back events
+}
+
+// coalesced counts events held back within the current window
+type coalesced struct {
+	count int   // number of events held back
+	args  []any // args of the last one
+}
+
+// coalesceEvent returns true iff event et with args should be held back,
+// because an event of the same type was already sent within --event-coalesce.
+// Never holds back stage lifecycle events (in upper case, eg. START).
+func (s *StageBase) coalesceEvent(et string, args []any) bool {
+	c := &s.coalesce
+	if c.window <= 0 || strings.ToUpper(et) == et {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if p, ok := c.pending[et]; ok {
+		p.count++
+		p.args = args
+		return true
+	}
+
+	// first in window: send it, open the window
+	if c.pending == nil {
+		c.pending = make(map[string]*coalesced)
+	}
+	c.pending[et] = &coalesced{}
+	time.AfterFunc(c.window, func() { s.coalesceFlush(et) })
+	return false
+}
+
+// coalesceFlush sends a summary of events et held back in the last window,
+// as the last event with "xN" appended to its args, and re-opens the window.
+// Closes the window if nothing was held back.
+func (s *StageBase) coalesceFlush(et string) {
+	c := &s.coalesce
+
+	c.mu.Lock()
+	p := c.pending[et]
+	if p == nil || p.count == 0 {
+		delete(c.pending, et)
+		c.mu.Unlock()
+		return
+	}
+	c.pending[et] = &coalesced{}
+	time.AfterFunc(c.window, func() { s.coalesceFlush(et) })
+	c.mu.Unlock()
+
+	args := append(p.args, fmt.Sprintf("x%d", p.count), s)
+	s.B.Pipe.Event(s.Name+"/"+et, args...)
+}
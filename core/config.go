@@ -1,15 +1,23 @@
 package core
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"runtime/debug"
 	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"net/http"
 	_ "net/http/pprof"
 
+	"github.com/bgpfix/bgpfix/afi"
+	"github.com/bgpfix/bgpfix/caps"
 	"github.com/knadh/koanf/providers/posflag"
 	"github.com/rs/zerolog"
 )
@@ -23,6 +31,37 @@ func (b *Bgpipe) Configure() error {
 	}
 	k := b.K
 
+	// log to file?
+	if v := k.String("log-file"); len(v) > 0 {
+		lf, err := openLogFile(v, k.Int64("log-max-size"))
+		if err != nil {
+			return fmt.Errorf("--log-file: %w", err)
+		}
+		var out io.Writer = zerolog.ConsoleWriter{
+			Out:        lf,
+			NoColor:    true,
+			TimeFormat: time.DateTime,
+		}
+		if k.Bool("log-tee") { // also to stderr
+			out = zerolog.MultiLevelWriter(out, zerolog.ConsoleWriter{
+				Out:        os.Stderr,
+				TimeFormat: time.DateTime,
+			})
+		}
+		b.Logger = b.Output(out)
+	} else if k.Bool("log-tee") || k.Int64("log-max-size") != 0 {
+		return fmt.Errorf("--log-tee and --log-max-size: need --log-file")
+	}
+
+	// sample repetitive log lines?
+	if v := k.String("log-sample"); len(v) > 0 {
+		ls, err := parseLogSample(v)
+		if err != nil {
+			return fmt.Errorf("--log-sample %s: %w", v, err)
+		}
+		b.Logger = b.Hook(ls)
+	}
+
 	// debugging level
 	if ll := k.String("log"); len(ll) > 0 {
 		lvl, err := zerolog.ParseLevel(ll)
@@ -34,25 +73,36 @@ func (b *Bgpipe) Configure() error {
 
 	// pprof?
 	if v := k.String("pprof"); len(v) > 0 {
-		go func() {
-			b.Fatal().Err(http.ListenAndServe(v, nil)).Msg("pprof failed")
-		}()
+		if err := b.serve("pprof", v, http.DefaultServeMux); err != nil {
+			return err
+		}
+	}
+
+	// admin API?
+	if v := k.String("admin"); len(v) > 0 {
+		if err := b.serve("admin", v, b.adminMux()); err != nil {
+			return err
+		}
 	}
 
 	// capabilities?
+	var caps_json []byte
 	switch v := k.String("caps"); {
 	case len(v) == 0: // none
 		break
 	case v[0] == '@': // read from file
-		jsv, err := os.ReadFile(v[1:])
+		caps_json, err = os.ReadFile(v[1:])
 		if err != nil {
 			return fmt.Errorf("could not read --caps file: %w", err)
 		}
-		if err := b.Pipe.Caps.FromJSON(jsv); err != nil {
-			return fmt.Errorf("could not parse --caps file: %w", err)
-		}
 	default: // parse JSON
-		if err := b.Pipe.Caps.FromJSON([]byte(v)); err != nil {
+		caps_json = []byte(v)
+	}
+	if len(caps_json) > 0 {
+		if err := checkCaps(caps_json, k.Bool("short-asn")); err != nil {
+			return fmt.Errorf("invalid --caps: %w", err)
+		}
+		if err := b.Pipe.Caps.FromJSON(caps_json); err != nil {
 			return fmt.Errorf("could not parse --caps: %w", err)
 		}
 	}
@@ -67,16 +117,43 @@ func (b *Bgpipe) addFlags() {
 	f.SetInterspersed(false)
 	f.BoolP("version", "v", false, "print detailed version info and quit")
 	f.BoolP("explain", "n", false, "print the pipeline as configured and quit")
+	f.Bool("dump-config", false, "print the effective configuration in JSON and quit")
+	f.Bool("dump-config-secrets", false, "do not hide secrets in --dump-config")
 	f.StringP("log", "l", "info", "log level (debug/info/warn/error/disabled)")
-	f.String("pprof", "", "bind pprof to given listen address")
+	f.String("log-file", "", "write logs to given file instead of stderr")
+	f.Bool("log-tee", false, "with --log-file, write logs to stderr too")
+	f.Int64("log-max-size", 0, "with --log-file, rotate the file at given size in bytes (0 means never)")
+	f.String("log-sample", "", "log only 1/N of identical log lines (except errors)")
+	f.String("pidfile", "", "write the process PID to given file")
+	f.Bool("pidfile-check", false, "fail if --pidfile names a running process")
+	f.String("pprof", "", "bind pprof to given listen address (or unix:/path)")
+	f.String("admin", "", "bind admin HTTP API to given listen address (or unix:/path)")
+	f.Duration("input-rate-report", 0, "log and emit per-stage input message rates at given interval (0 means never)")
+	f.Bool("sd-notify", false, "notify systemd when the pipeline is ready (Type=notify)")
+	f.Bool("ready-established", false, "consider the pipeline ready only after the session is established")
+	f.StringSlice("plugin", nil, "load stage commands from given Go plugin (.so) files")
+	f.String("cpuprofile", "", "write CPU profile to given file")
+	f.String("memprofile", "", "write heap profile to given file on exit")
 	f.StringSliceP("events", "e", []string{"PARSE", "ESTABLISHED", "EOR"}, "log given events (\"all\" means all events)")
+	f.Bool("quiet-stable", false, "after the session is established, log only errors and --quiet-keep events")
+	f.StringSlice("quiet-keep", []string{"PARSE", "*/STOP", "*/FAILED"}, "events to log despite --quiet-stable")
 	f.StringSliceP("kill", "k", nil, "kill session on any of these events")
+	f.String("on-parse-error", "pass", "on message parse error: pass, drop, or kill the session")
 	f.BoolP("stdin", "i", false, "read JSON from stdin")
 	f.BoolP("stdout", "o", false, "write JSON to stdout")
 	f.BoolP("stdin-wait", "I", false, "like --stdin but wait for EVENT_ESTABLISHED")
 	f.BoolP("stdout-wait", "O", false, "like --stdout but wait for EVENT_EOR")
 	f.BoolP("short-asn", "2", false, "use 2-byte ASN numbers")
+	f.Bool("loop-guard", false, "drop messages that would revisit a stage (eg. in feedback loops)")
+	f.Int("max-hops", 0, "drop messages that passed given number of stages (0 means no limit)")
+	f.Int("max-stages", 100, "max number of stages in the pipeline (0 means no limit)")
+	f.Duration("connect-timeout", 0, "default connect timeout for stages (0 means stage default)")
+	f.Bool("keep-going", false, "keep running if a source stage fails, unless all sources failed")
+	f.Duration("established-timeout", 0, "fail if no BGP session is established in given time (0 means no limit)")
+	f.Duration("shutdown-timeout", 10*time.Second, "max time to wait for the pipe to drain on shutdown")
 	f.String("caps", "", "use given BGP capabilities (JSON format)")
+	f.Bool("tag-hostname", false, "tag messages with the peer hostname from its OPEN (FQDN capability)")
+	f.Bool("caps-print", false, "print the effective BGP capabilities as JSON and quit")
 }
 
 func (b *Bgpipe) usage() {
@@ -165,6 +242,11 @@ func (b *Bgpipe) parseArgs(args []string) error {
 		os.Exit(1)
 	}
 
+	// load stage commands from plugins?
+	if err := b.pluginLoad(); err != nil {
+		return err
+	}
+
 	// parse stages and their args
 	args = b.F.Args()
 	for idx := 1; len(args) > 0; idx++ {
@@ -201,8 +283,12 @@ func (b *Bgpipe) parseArgs(args []string) error {
 			return err
 		}
 
-		// override the stage name?
+		// override the stage name? must be unique
 		if name != "" {
+			if id, ok := b.names[name]; ok && id != idx {
+				return fmt.Errorf("[%d] %s: %w by [%d]", idx, name, ErrStageName, id)
+			}
+			b.names[name] = idx
 			s.Name = name
 		}
 
@@ -270,3 +356,60 @@ func (s *StageBase) parseArgs(args []string) (unused []string, err error) {
 
 	return rem, nil
 }
+
+// checkCaps validates BGP capabilities in JSON format before parsing,
+// returning errors that point at the offending value.
+// If short_asn is true, the AS4 capability is not allowed.
+func checkCaps(src []byte, short_asn bool) error {
+	// parse as a JSON object
+	var db map[string]json.RawMessage
+	if err := json.Unmarshal(src, &db); err != nil {
+		var se *json.SyntaxError
+		if errors.As(err, &se) {
+			line := 1 + bytes.Count(src[:se.Offset], []byte{'\n'})
+			col := int(se.Offset) - bytes.LastIndexByte(src[:se.Offset], '\n') - 1
+			return fmt.Errorf("JSON syntax error at line %d column %d: %w", line, col, err)
+		}
+		return fmt.Errorf("need a JSON object: %w", err)
+	}
+
+	// check in a stable order
+	var names []string
+	for name := range db {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		// a canonical name, or a plain integer?
+		code, err := caps.CodeString(strings.ToUpper(name))
+		if err != nil {
+			cnum, err2 := strconv.ParseUint(name, 0, 8)
+			if err2 != nil {
+				return fmt.Errorf("%s: unknown capability", name)
+			}
+			code = caps.Code(cnum)
+		}
+
+		// AS4 vs. 2-byte ASNs
+		if code == caps.CAP_AS4 && short_asn {
+			return fmt.Errorf("%s: AS4 capability conflicts with --short-asn", name)
+		}
+
+		// check AFI/SAFI values
+		if code == caps.CAP_MP {
+			var afs []string
+			if err := json.Unmarshal(db[name], &afs); err != nil {
+				return fmt.Errorf("%s: need a list of AFI/SAFI strings: %w", name, err)
+			}
+			for _, v := range afs {
+				var as afi.AS
+				if err := as.FromJSON([]byte(v)); err != nil {
+					return fmt.Errorf("%s: %s: invalid AFI/SAFI: %w", name, v, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckCaps(t *testing.T) {
+	tests := []struct {
+		name      string
+		src       string
+		short_asn bool
+		err       string // expected error substring, or empty if valid
+	}{
+		{"ok", `{"ROUTE_REFRESH": true, "AS4": 65000}`, false, ""},
+		{"numeric code", `{"2": true}`, false, ""},
+		{"not an object", `["AS4"]`, false, "need a JSON object"},
+		{"unknown name", `{"ROUTE_REFRESH": true, "BOGUS": true}`, false, "BOGUS: unknown capability"},
+		{"code out of range", `{"300": true}`, false, "300: unknown capability"},
+		{"MP not a list", `{"MP": "IPV4/UNICAST"}`, false, "MP: need a list of AFI/SAFI strings"},
+		{"AS4 with short-asn", `{"AS4": 65000}`, true, "AS4: AS4 capability conflicts with --short-asn"},
+		{"AS4 code with short-asn", `{"65": 65000}`, true, "65: AS4 capability conflicts with --short-asn"},
+		{"no AS4 with short-asn", `{"ROUTE_REFRESH": true}`, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkCaps([]byte(tt.src), tt.short_asn)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.err != "" && err == nil:
+				t.Fatalf("expected error %q, got nil", tt.err)
+			case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+				t.Fatalf("expected error %q, got %q", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestCheckCapsMalformedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "caps.json")
+	src := "{\n  \"ROUTE_REFRESH\": true,\n  \"AS4\": 65000,\n}\n" // trailing comma
+	if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkCaps(buf, false)
+	if err == nil {
+		t.Fatal("expected a syntax error, got nil")
+	}
+	if !strings.Contains(err.Error(), "JSON syntax error at line 4 column 1") {
+		t.Fatalf("error does not point at the offending line: %v", err)
+	}
+}
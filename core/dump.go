@@ -0,0 +1,70 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// max size of the goroutine stacks dump
+const dump_stack_max = 64 << 20
+
+// Dump writes the state of all stages and their inputs, followed by
+// the stacks of all goroutines, to w. Does nothing if already dumping.
+func (b *Bgpipe) Dump(w io.Writer) {
+	if b.dumping.Swap(true) {
+		return // already in progress
+	}
+	defer b.dumping.Store(false)
+
+	fmt.Fprintf(w, "=== bgpipe dump at %s\n", time.Now().Format(time.DateTime))
+	if b.shutdown.Load() {
+		fmt.Fprintf(w, "shutdown in progress\n")
+	}
+
+	// stages
+	fmt.Fprintf(w, "\n=== stages\n")
+	for _, s := range b.Stages {
+		if s == nil {
+			continue
+		}
+		st := s.Status()
+		fmt.Fprintf(w, "%s: dir=%s started=%v running=%v stopped=%v",
+			s, st.Dir, st.Started, st.Running, st.Stopped)
+		if len(st.Counters) > 0 {
+			fmt.Fprintf(w, " counters=%v", st.Counters)
+		}
+		fmt.Fprintf(w, "\n")
+		for _, in := range s.inputs {
+			fmt.Fprintf(w, "  input %d %s: queued %d/%d\n",
+				in.Id, in.Dir, len(in.In), cap(in.In))
+		}
+	}
+
+	// pipe lines
+	if p := b.Pipe; p != nil && p.L != nil && p.R != nil {
+		fmt.Fprintf(w, "\n=== lines\n")
+		fmt.Fprintf(w, "L output: queued %d/%d\n", len(p.L.Out), cap(p.L.Out))
+		fmt.Fprintf(w, "R output: queued %d/%d\n", len(p.R.Out), cap(p.R.Out))
+	}
+
+	// goroutines
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= dump_stack_max {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	fmt.Fprintf(w, "\n=== goroutines\n%s\n=== end of dump\n", buf)
+}
+
+// adminDump serves Dump
+func (b *Bgpipe) adminDump(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	b.Dump(w)
+}
@@ -3,10 +3,20 @@ package core
 import "errors"
 
 var (
-	ErrStageCmd     = errors.New("invalid stage command")
-	ErrStageDiff    = errors.New("already defined but different")
-	ErrStageStopped = errors.New("stage stopped")
-	ErrFirstOrLast  = errors.New("must be either the first or the last stage")
-	ErrInject       = errors.New("invalid --in option value")
-	ErrLR           = errors.New("select either --left or --right, not both")
+	ErrStageCmd        = errors.New("invalid stage command")
+	ErrStageDiff       = errors.New("already defined but different")
+	ErrStageStopped    = errors.New("stage stopped")
+	ErrStageMax        = errors.New("too many stages")
+	ErrStageName       = errors.New("stage name already used")
+	ErrPrepareTimeout  = errors.New("prepare timeout")
+	ErrFirstOrLast     = errors.New("must be either the first or the last stage")
+	ErrInject          = errors.New("invalid --inject option value")
+	ErrFromTo          = errors.New("invalid --from or --to option value")
+	ErrPipeline        = errors.New("invalid pipeline")
+	ErrLR              = errors.New("select either --left or --right, not both")
+	ErrPauseMode       = errors.New("invalid --pause-mode value")
+	ErrShutdownTimeout = errors.New("shutdown timeout")
+	ErrEstabTimeout    = errors.New("session not established in time")
+	ErrParseMode       = errors.New("invalid --on-parse-error value")
+	ErrParseKill       = errors.New("killed on parse error")
 )
@@ -0,0 +1,119 @@
+package core
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/bgpfix/bgpfix/pipe"
+)
+
+// health tracks the readiness of the pipeline
+type health struct {
+	ready int  // number of stages that emitted READY
+	estab bool // session established? (--ready-established)
+	sent  bool // already reported as ready?
+}
+
+// onStageReady is called when stage s emitted READY
+func (b *Bgpipe) onStageReady(s *StageBase) {
+	if s.Index <= 0 {
+		return // internal stage, eg. --stdin
+	}
+	b.healthMu.Lock()
+	b.health.ready++
+	b.healthMu.Unlock()
+	b.readyCheck()
+}
+
+// onReadyEstab marks the session as established for --ready-established
+func (b *Bgpipe) onReadyEstab(ev *pipe.Event) bool {
+	b.healthMu.Lock()
+	b.health.estab = true
+	b.healthMu.Unlock()
+	b.readyCheck()
+	return false // unregister
+}
+
+// Ready returns true iff all stages emitted READY, and the session
+// is established if --ready-established is set.
+func (b *Bgpipe) Ready() bool {
+	b.healthMu.Lock()
+	defer b.healthMu.Unlock()
+	return b.ready()
+}
+
+// ready implements Ready. Must be called with b.healthMu locked.
+func (b *Bgpipe) ready() bool {
+	if b.health.ready < b.StageCount() {
+		return false
+	}
+	if b.K.Bool("ready-established") && !b.health.estab {
+		return false
+	}
+	return true
+}
+
+// readyCheck logs the pipeline readiness and notifies systemd, once
+func (b *Bgpipe) readyCheck() {
+	b.healthMu.Lock()
+	defer b.healthMu.Unlock()
+	if b.health.sent || !b.ready() {
+		return
+	}
+	b.health.sent = true
+
+	b.Info().Msg("pipeline ready")
+	if b.K.Bool("sd-notify") {
+		b.sdNotify("READY=1")
+	}
+}
+
+// sdNotify sends state to systemd if running under it with NOTIFY_SOCKET set
+func (b *Bgpipe) sdNotify(state string) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if len(path) == 0 {
+		return
+	} else if v, ok := strings.CutPrefix(path, "@"); ok {
+		path = "\x00" + v // abstract namespace
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err == nil {
+		defer conn.Close()
+		_, err = conn.Write([]byte(state))
+	}
+	if err != nil {
+		b.Warn().Err(err).Str("state", state).Msg("could not notify systemd")
+	}
+}
+
+// adminHealthz serves 200 while the pipeline is alive, or 503 on shutdown
+func (b *Bgpipe) adminHealthz(w http.ResponseWriter, r *http.Request) {
+	if b.Ctx.Err() != nil || b.shutdown.Load() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+	} else {
+		w.Write([]byte("ok\n"))
+	}
+}
+
+// adminReadyz serves 200 iff the pipeline is Ready, or 503 otherwise
+func (b *Bgpipe) adminReadyz(w http.ResponseWriter, r *http.Request) {
+	b.healthMu.Lock()
+	ready := b.ready() && b.Ctx.Err() == nil && !b.shutdown.Load()
+	res := map[string]any{
+		"ready":        ready,
+		"stages":       b.StageCount(),
+		"stages_ready": b.health.ready,
+	}
+	if b.K.Bool("ready-established") {
+		res["established"] = b.health.estab
+	}
+	b.healthMu.Unlock()
+
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	adminJSON(w, res)
+}
@@ -0,0 +1,60 @@
+package core
+
+import (
+	"os"
+	"sync"
+)
+
+// logFile is a log file writer that optionally rotates by size (--log-max-size),
+// keeping one old file with a ".1" suffix
+type logFile struct {
+	path string // file path
+	max  int64  // max file size in bytes (0 means no limit)
+
+	mu   sync.Mutex // guards below
+	fh   *os.File   // current file
+	size int64      // current file size
+}
+
+// openLogFile opens path for appending logs, rotating at max bytes if max > 0
+func openLogFile(path string, max int64) (*logFile, error) {
+	lf := &logFile{path: path, max: max}
+	if err := lf.open(); err != nil {
+		return nil, err
+	}
+	return lf, nil
+}
+
+// open (re-)opens lf.path. Must be called with lf.mu locked.
+func (lf *logFile) open() error {
+	fh, err := os.OpenFile(lf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return err
+	}
+	lf.fh, lf.size = fh, fi.Size()
+	return nil
+}
+
+// Write implements io.Writer
+func (lf *logFile) Write(p []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	// rotate?
+	if lf.max > 0 && lf.size > 0 && lf.size+int64(len(p)) > lf.max {
+		lf.fh.Close()
+		os.Rename(lf.path, lf.path+".1")
+		if err := lf.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := lf.fh.Write(p)
+	lf.size += int64(n)
+	return n, err
+}
@@ -0,0 +1,61 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+// max number of distinct log lines tracked by the log sampler
+const log_sample_max = 1000
+
+// logSampler is a zerolog hook that logs only 1 of every n identical
+// log lines (same level and message). Never drops errors.
+type logSampler struct {
+	n uint64 // sampling rate
+
+	mu   sync.Mutex        // guards seen
+	seen map[string]uint64 // log line -> count
+}
+
+// parseLogSample parses --log-sample value v in the form of "1/N"
+func parseLogSample(v string) (*logSampler, error) {
+	one, ns, ok := strings.Cut(v, "/")
+	if !ok || one != "1" {
+		return nil, fmt.Errorf("need 1/N")
+	}
+	n, err := strconv.ParseUint(ns, 10, 32)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid N: %s", ns)
+	}
+	return &logSampler{
+		n:    n,
+		seen: make(map[string]uint64),
+	}, nil
+}
+
+// Run implements zerolog.Hook
+func (ls *logSampler) Run(e *zerolog.Event, lvl zerolog.Level, msg string) {
+	if ls.n <= 1 || lvl >= zerolog.ErrorLevel {
+		return // never sample errors away
+	}
+
+	key := lvl.String() + "\x00" + msg
+	ls.mu.Lock()
+	if len(ls.seen) >= log_sample_max {
+		clear(ls.seen) // don't grow forever
+	}
+	cnt := ls.seen[key]
+	ls.seen[key] = cnt + 1
+	ls.mu.Unlock()
+
+	switch {
+	case cnt%ls.n != 0:
+		e.Discard()
+	case cnt > 0:
+		e.Uint64("suppressed", ls.n-1)
+	}
+}
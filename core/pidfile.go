@@ -0,0 +1,64 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// pidfileWrite writes the process PID to --pidfile, if set
+func (b *Bgpipe) pidfileWrite() error {
+	v := b.K.String("pidfile")
+	if len(v) == 0 {
+		return nil
+	}
+
+	// another instance running?
+	if b.K.Bool("pidfile-check") {
+		if pid, ok := pidfileRunning(v); ok {
+			return fmt.Errorf("--pidfile %s: already running as PID %d", v, pid)
+		}
+	}
+
+	pid := strconv.Itoa(os.Getpid()) + "\n"
+	if err := os.WriteFile(v, []byte(pid), 0644); err != nil {
+		return fmt.Errorf("--pidfile: %w", err)
+	}
+	return nil
+}
+
+// pidfileRemove removes --pidfile, if set and still ours
+func (b *Bgpipe) pidfileRemove() {
+	v := b.K.String("pidfile")
+	if len(v) == 0 {
+		return
+	}
+
+	buf, err := os.ReadFile(v)
+	if err != nil {
+		return
+	}
+	if pid, _ := strconv.Atoi(string(bytes.TrimSpace(buf))); pid == os.Getpid() {
+		os.Remove(v)
+	}
+}
+
+// pidfileRunning returns the PID in file path iff that process is alive
+func pidfileRunning(path string) (int, bool) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(string(bytes.TrimSpace(buf)))
+	if err != nil || pid <= 0 || pid == os.Getpid() {
+		return 0, false
+	}
+
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return 0, false
+	}
+	return pid, proc.Signal(syscall.Signal(0)) == nil
+}
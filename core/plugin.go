@@ -0,0 +1,35 @@
+package core
+
+import (
+	"fmt"
+	"plugin"
+)
+
+// pluginLoad loads stage commands from Go plugins given in --plugin.
+// Each plugin must export a Repo variable of type map[string]NewStage.
+func (b *Bgpipe) pluginLoad() error {
+	for _, path := range b.K.Strings("plugin") {
+		p, err := plugin.Open(path)
+		if err != nil {
+			return fmt.Errorf("--plugin %s: %w", path, err)
+		}
+
+		sym, err := p.Lookup("Repo")
+		if err != nil {
+			return fmt.Errorf("--plugin %s: %w", path, err)
+		}
+
+		repo, ok := sym.(*map[string]NewStage)
+		if !ok || repo == nil {
+			return fmt.Errorf("--plugin %s: Repo has type %T, need map[string]core.NewStage", path, sym)
+		}
+
+		for cmd := range *repo {
+			if _, exists := b.repo[cmd]; exists {
+				return fmt.Errorf("--plugin %s: stage %s already defined", path, cmd)
+			}
+		}
+		b.AddRepo(*repo)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+)
+
+// profiler writes CPU and heap profiles to files
+type profiler struct {
+	cpu  *os.File  // CPU profile file, if started
+	once sync.Once // stop only once
+}
+
+// profileStart starts the CPU profile if --cpuprofile is set
+func (b *Bgpipe) profileStart() error {
+	v := b.K.String("cpuprofile")
+	if len(v) == 0 {
+		return nil
+	}
+
+	fh, err := os.Create(v)
+	if err != nil {
+		return fmt.Errorf("--cpuprofile: %w", err)
+	}
+	if err := pprof.StartCPUProfile(fh); err != nil {
+		fh.Close()
+		return fmt.Errorf("--cpuprofile: %w", err)
+	}
+
+	b.prof.cpu = fh
+	return nil
+}
+
+// profileStop stops the CPU profile and writes the heap profile if --memprofile is set.
+// Safe to call more than once, eg. right before os.Exit.
+func (b *Bgpipe) profileStop() {
+	b.prof.once.Do(func() {
+		if fh := b.prof.cpu; fh != nil {
+			pprof.StopCPUProfile()
+			fh.Close()
+		}
+
+		v := b.K.String("memprofile")
+		if len(v) == 0 {
+			return
+		}
+		fh, err := os.Create(v)
+		if err != nil {
+			b.Error().Err(err).Msg("--memprofile: could not create file")
+			return
+		}
+		defer fh.Close()
+
+		runtime.GC() // get up-to-date statistics
+		if err := pprof.WriteHeapProfile(fh); err != nil {
+			b.Error().Err(err).Msg("--memprofile: could not write heap profile")
+		}
+	})
+}
@@ -0,0 +1,110 @@
+package core
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/bgpfix/bgpfix/dir"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+)
+
+// EVENT_RATES reports per-stage input message rates (--input-rate-report)
+const EVENT_RATES = "bgpipe/rates"
+
+// inputRates samples message rates of producer stages
+type inputRates struct {
+	index map[*pipe.Input]int  // maps stage input to index below
+	late  map[*pipe.Input]bool // stage input skips callback id 0?
+	names []string             // stage names
+	count []atomic.Uint64      // messages written by stage inputs
+	last  []uint64             // count at the last report
+}
+
+// ratesAttach attaches the --input-rate-report counters to the pipe
+func (b *Bgpipe) ratesAttach() {
+	r := &b.rates
+	r.index = make(map[*pipe.Input]int)
+	r.late = make(map[*pipe.Input]bool)
+	for _, s := range b.Stages {
+		if s == nil || len(s.inputs) == 0 {
+			continue
+		}
+		for _, li := range s.inputs {
+			r.index[li] = len(r.names)
+
+			// NB: input filters skip callbacks by id, see injectPoint
+			fid, _ := li.FilterValue.(int)
+			ip := injectPoint{li.CallbackFilter, li.CallbackFilter, fid}
+			r.late[li] = ip.skips(li.Dir, 0)
+		}
+		r.names = append(r.names, s.Name)
+	}
+	if len(r.names) == 0 {
+		return
+	}
+	r.count = make([]atomic.Uint64, len(r.names))
+	r.last = make([]uint64, len(r.names))
+
+	// count each input in exactly one of the callbacks below,
+	// which use ids that its filter never skips
+	for _, late := range []bool{false, true} {
+		cb := b.Pipe.OnMsg(b.ratesCounter(late), dir.DIR_LR)
+		if late {
+			cb.Id = math.MaxInt
+		}
+		cb.Order = math.MinInt // count before anything else
+		cb.Raw = true          // no need to parse
+	}
+}
+
+// ratesCounter returns a callback that attributes messages to the stage input
+// that wrote them, for inputs with given late value
+func (b *Bgpipe) ratesCounter(late bool) pipe.CallbackFunc {
+	r := &b.rates
+	return func(m *msg.Msg) bool {
+		in := pipe.MsgContext(m).Input
+		if i, ok := r.index[in]; ok && r.late[in] == late {
+			r.count[i].Add(1)
+		}
+		return true
+	}
+}
+
+// ratesReport logs and emits EVENT_RATES every --input-rate-report
+func (b *Bgpipe) ratesReport() {
+	v := b.K.Duration("input-rate-report")
+	if v <= 0 || len(b.rates.names) == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(v)
+		defer ticker.Stop()
+
+		r := &b.rates
+		last := time.Now()
+		for {
+			select {
+			case <-b.Ctx.Done():
+				return
+			case now := <-ticker.C:
+				secs := now.Sub(last).Seconds()
+				last = now
+
+				rates := make(map[string]float64, len(r.names))
+				ev := b.Info()
+				for i, name := range r.names {
+					cur := r.count[i].Load()
+					rate := math.Round(float64(cur-r.last[i])/secs*10) / 10
+					r.last[i] = cur
+					rates[name] = rate
+					ev = ev.Float64(name, rate)
+				}
+				ev.Msg("input rates (msg/s)")
+				b.Pipe.Event(EVENT_RATES, rates)
+			}
+		}
+	}()
+}
@@ -3,8 +3,14 @@ package core
 import (
 	"context"
 	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/bgpfix/bgpfix/dir"
+	"github.com/bgpfix/bgpfix/msg"
 	"github.com/bgpfix/bgpfix/pipe"
 )
 
@@ -26,6 +32,8 @@ func (s *StageBase) runStart(ev *pipe.Event) bool {
 		}
 		if err == nil || err == context.Canceled || errors.Is(err, ErrStageStopped) {
 			return false
+		} else if s.B.keepGoing(s, err) {
+			return false // just this stage
 		} else {
 			s.B.Cancel(s.Errorf("%w", err)) // game over
 			return true
@@ -35,12 +43,16 @@ func (s *StageBase) runStart(ev *pipe.Event) bool {
 	// run Prepare, make sure to get the error back
 	s.Trace().Msg("Prepare()")
 	s.Event("PREPARE")
-	err := s.Stage.Prepare()
+	err := s.prepare()
 	s.Trace().Err(err).Msg("Prepare() done")
 	if check_fatal(err) {
 		return false
+	} else if err != nil {
+		s.runStop(nil) // not fatal, but can't run
+		return false
 	} else {
 		s.Event("READY")
+		s.B.onStageReady(s)
 	}
 
 	// enable callbacks and handlers
@@ -75,6 +87,36 @@ func (s *StageBase) runStart(ev *pipe.Event) bool {
 	return false
 }
 
+// prepare runs Stage.Prepare, bounded by --prepare-timeout
+func (s *StageBase) prepare() error {
+	timeout := s.K.Duration("prepare-timeout")
+	if timeout <= 0 {
+		return s.Stage.Prepare()
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Stage.Prepare() }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		err := fmt.Errorf("%w: not ready after %s", ErrPrepareTimeout, timeout)
+		s.Cancel(err) // try to unblock Prepare
+
+		// give it 1s to return, so it does not linger in background
+		select {
+		case perr := <-done:
+			if perr == nil {
+				s.Stage.Stop() // ready too late, release what it prepared
+			}
+		case <-time.After(time.Second):
+			s.Warn().Msg("Prepare() did not return after the timeout")
+		}
+		return err
+	}
+}
+
 // runStop requests to stop Stage.Run; ev may be nil
 func (s *StageBase) runStop(ev *pipe.Event) bool {
 	if s.stopped.Swap(true) {
@@ -100,11 +142,21 @@ func (s *StageBase) runStop(ev *pipe.Event) bool {
 		}
 	}
 
+	// release messages still buffered by --pause-on
+	s.pauseMu.Lock()
+	s.paused.Store(false)
+	s.pauseFlush()
+	s.pauseMu.Unlock()
+
 	// close all inputs and wait for them to finish processing
-	for _, in := range s.inputs {
+	inputs := s.inputs
+	if s.pauseL != nil {
+		inputs = append(slices.Clip(inputs), s.pauseL, s.pauseR)
+	}
+	for _, in := range inputs {
 		in.Close()
 	}
-	for _, in := range s.inputs {
+	for _, in := range inputs {
 		in.Wait()
 	}
 
@@ -115,3 +167,120 @@ func (s *StageBase) runStop(ev *pipe.Event) bool {
 	s.Event("STOP")
 	return false
 }
+
+// runPause pauses message processing in the stage callbacks
+func (s *StageBase) runPause(ev *pipe.Event) bool {
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+	if s.paused.Load() {
+		return true // already paused
+	} else {
+		s.Debug().Stringer("ev", ev).Msg("pausing")
+	}
+
+	s.paused.Store(true)
+	s.Event("PAUSE")
+	return true
+}
+
+// runResume resumes message processing paused by runPause
+func (s *StageBase) runResume(ev *pipe.Event) bool {
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+	if !s.paused.Load() {
+		return true // not paused
+	} else {
+		s.Debug().Stringer("ev", ev).Msg("resuming")
+	}
+
+	s.resume()
+	return true
+}
+
+// resume resumes message processing, flushing the buffer.
+// Must be called with s.pauseMu locked.
+func (s *StageBase) resume() {
+	s.paused.Store(false) // NB: before the flush, for s.pauseL / s.pauseR to pass
+	s.pauseFlush()
+	s.Event("RESUME")
+}
+
+// pauseFlush re-injects buffered messages at this stage, in order.
+// Must be called with s.pauseMu locked.
+func (s *StageBase) pauseFlush() {
+	for _, m := range s.pauseBuf {
+		in := s.pauseR
+		if m.Dir == dir.DIR_L {
+			in = s.pauseL
+		}
+		if in == nil || in.WriteMsg(m) != nil {
+			s.P.PutMsg(m)
+		}
+	}
+	s.pauseBuf = nil
+}
+
+// pauseWrap wraps stage callback cb so that it respects the pause state.
+// In the buffer mode, paused messages are taken out of the pipe, so the rest of
+// the pipe keeps flowing, and re-injected at this stage in order on resume.
+// If more than --pause-buffer messages wait, the stage resumes on its own.
+// In the drop mode, paused messages skip this stage.
+func (s *StageBase) pauseWrap(cb pipe.CallbackFunc) pipe.CallbackFunc {
+	return func(m *msg.Msg) bool {
+		if !s.paused.Load() {
+			return cb(m)
+		} else if s.pauseDrop {
+			return true // pass through untouched
+		}
+
+		s.pauseMu.Lock()
+		if !s.paused.Load() { // resumed meanwhile
+			s.pauseMu.Unlock()
+			return cb(m)
+		}
+
+		// keep it
+		pipe.MsgContext(m).Action.Borrow()
+		s.pauseBuf = append(s.pauseBuf, m)
+
+		// too many?
+		if len(s.pauseBuf) > s.pauseMax {
+			s.Warn().Int("pause-buffer", s.pauseMax).Msg("too many messages buffered while paused, resuming")
+			s.resume()
+		}
+		s.pauseMu.Unlock()
+		return false
+	}
+}
+
+// loopWrap wraps cb so that messages already processed by s are dropped (if guard is true),
+// and so are messages that already passed max_hops stages (if max_hops > 0).
+// Keeps its state in message tags, so that it survives eg. a JSON round-trip via exec.
+func (s *StageBase) loopWrap(cb pipe.CallbackFunc, guard bool, max_hops int) pipe.CallbackFunc {
+	id := strconv.Itoa(s.Index)
+	return func(m *msg.Msg) bool {
+		tags := pipe.MsgContext(m).UseTags()
+
+		if guard {
+			visited := tags[TAG_VISITED]
+			if slices.Contains(strings.Split(visited, ","), id) {
+				s.B.stats.loopDrop.Add(1)
+				return false
+			} else if len(visited) > 0 {
+				visited += ","
+			}
+			tags[TAG_VISITED] = visited + id
+		}
+
+		if max_hops > 0 {
+			hops, _ := strconv.Atoi(tags[TAG_HOPS])
+			if hops >= max_hops {
+				s.B.stats.loopDrop.Add(1)
+				return false
+			}
+			tags[TAG_HOPS] = strconv.Itoa(hops + 1)
+		}
+
+		return cb(m)
+	}
+}
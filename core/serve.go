@@ -0,0 +1,42 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// serve starts an HTTP server for handler h on addr in background.
+// If addr is "unix:/path", listens on a Unix domain socket instead of TCP.
+func (b *Bgpipe) serve(name, addr string, h http.Handler) error {
+	network := "tcp"
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		network, addr = "unix", path
+		os.Remove(path) // stale socket from a previous run?
+	}
+
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return fmt.Errorf("--%s: %w", name, err)
+	}
+	b.listeners = append(b.listeners, l)
+
+	go func() {
+		err := http.Serve(l, h)
+		if !errors.Is(err, net.ErrClosed) {
+			b.Fatal().Err(err).Msgf("%s failed", name)
+		}
+	}()
+	return nil
+}
+
+// serveClose closes the listeners started by serve, removing Unix sockets
+func (b *Bgpipe) serveClose() {
+	for _, l := range b.listeners {
+		l.Close()
+	}
+	b.listeners = nil
+}
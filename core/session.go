@@ -0,0 +1,135 @@
+package core
+
+import (
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/bgpfix/bgpfix/caps"
+	"github.com/bgpfix/bgpfix/dir"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+)
+
+// pipe KV keys with session metadata. Per-direction keys are prefixed with
+// the direction of messages sent by the peer, eg. "L_REMOTE_ADDR".
+const (
+	KV_LOCAL_ADDR  = "LOCAL_ADDR"  // netip.AddrPort: our end of the TCP connection
+	KV_REMOTE_ADDR = "REMOTE_ADDR" // netip.AddrPort: peer end of the TCP connection
+	KV_CAPS        = "CAPS"        // string: JSON capabilities from the peer OPEN
+	KV_HOSTNAME    = "HOSTNAME"    // string: peer hostname from its OPEN (FQDN capability)
+	KV_ESTABLISHED = "ESTABLISHED" // time.Time: when the session got established
+)
+
+// kvKey returns the pipe KV key for direction d
+func kvKey(d dir.Dir, key string) string {
+	return d.String() + "_" + key
+}
+
+// kvLoad returns the value under key in the pipe KV, or the zero value if absent
+func kvLoad[T any](p *pipe.Pipe, key string) T {
+	var zero T
+	if p.KV == nil {
+		return zero
+	}
+	v, ok := p.KV.Load(key)
+	if !ok {
+		return zero
+	}
+	t, ok := v.(T)
+	if !ok {
+		return zero
+	}
+	return t
+}
+
+// PublishConn stores the addresses of TCP connection conn in the pipe KV,
+// for the peer sending messages in the stage direction
+func (s *StageBase) PublishConn(conn net.Conn) {
+	if s.P.KV == nil {
+		return
+	}
+	if ap, err := netip.ParseAddrPort(conn.LocalAddr().String()); err == nil {
+		s.P.KV.Store(kvKey(s.Dir, KV_LOCAL_ADDR), ap)
+	}
+	if ap, err := netip.ParseAddrPort(conn.RemoteAddr().String()); err == nil {
+		s.P.KV.Store(kvKey(s.Dir, KV_REMOTE_ADDR), ap)
+	}
+}
+
+// SessionLocalAddr returns our address of the TCP connection to the peer
+// sending messages in direction d, or an invalid AddrPort if unknown
+func (s *StageBase) SessionLocalAddr(d dir.Dir) netip.AddrPort {
+	return kvLoad[netip.AddrPort](s.P, kvKey(d, KV_LOCAL_ADDR))
+}
+
+// SessionRemoteAddr returns the address of the peer sending messages
+// in direction d, or an invalid AddrPort if unknown
+func (s *StageBase) SessionRemoteAddr(d dir.Dir) netip.AddrPort {
+	return kvLoad[netip.AddrPort](s.P, kvKey(d, KV_REMOTE_ADDR))
+}
+
+// SessionASN returns the ASN from the OPEN sent in direction d, or -1 if none seen yet
+func (s *StageBase) SessionASN(d dir.Dir) int {
+	line := s.P.LineFor(d)
+	if line == nil {
+		return -1
+	}
+	open := line.Open.Load()
+	if open == nil {
+		return -1
+	}
+	return open.GetASN()
+}
+
+// SessionCaps returns the JSON capabilities from the OPEN sent in direction d,
+// or an empty string if none seen yet. See Bgpipe.logCaps.
+func (s *StageBase) SessionCaps(d dir.Dir) string {
+	return kvLoad[string](s.P, kvKey(d, KV_CAPS))
+}
+
+// SessionHostname returns the peer hostname from the OPEN sent in direction d,
+// or an empty string if none seen yet or the peer did not send it
+func (s *StageBase) SessionHostname(d dir.Dir) string {
+	return kvLoad[string](s.P, kvKey(d, KV_HOSTNAME))
+}
+
+// SessionNegotiated returns the negotiated capabilities of the session
+func (s *StageBase) SessionNegotiated() *caps.Caps {
+	return &s.P.Caps
+}
+
+// SessionEstablished returns when the session got established, or zero time if not yet
+func (s *StageBase) SessionEstablished() time.Time {
+	return kvLoad[time.Time](s.P, KV_ESTABLISHED)
+}
+
+// kvHostname stores the peer hostname from open in the pipe KV, if present
+func (b *Bgpipe) kvHostname(d dir.Dir, open *msg.Open) {
+	fq, ok := open.Caps.Get(caps.CAP_FQDN).(*caps.Fqdn)
+	if !ok || fq == nil || len(fq.Host) == 0 || b.Pipe.KV == nil {
+		return
+	}
+
+	host := string(fq.Host)
+	if len(fq.Domain) > 0 {
+		host += "." + string(fq.Domain)
+	}
+	b.Pipe.KV.Store(kvKey(d, KV_HOSTNAME), host)
+}
+
+// tagHostname tags m with the peer hostname, if known (--tag-hostname)
+func (b *Bgpipe) tagHostname(m *msg.Msg) bool {
+	if host := kvLoad[string](b.Pipe, kvKey(m.Dir, KV_HOSTNAME)); len(host) > 0 {
+		pipe.MsgContext(m).UseTags()[TAG_HOSTNAME] = host
+	}
+	return true
+}
+
+// kvEstablished stores the session establishment time in the pipe KV
+func (b *Bgpipe) kvEstablished(ev *pipe.Event) bool {
+	if b.Pipe.KV != nil {
+		b.Pipe.KV.Store(KV_ESTABLISHED, ev.Time)
+	}
+	return false // unregister
+}
@@ -4,9 +4,12 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/bgpfix/bgpfix/dir"
+	"github.com/bgpfix/bgpfix/msg"
 	"github.com/bgpfix/bgpfix/pipe"
 	"github.com/knadh/koanf/v2"
 	"github.com/rs/zerolog"
@@ -39,13 +42,33 @@ type Stage interface {
 	Stop() error
 }
 
+// StageCounters is an optional Stage interface for exposing runtime counters,
+// eg. in the admin API.
+type StageCounters interface {
+	// Counters returns a snapshot of stage counters
+	Counters() map[string]any
+}
+
+// StageStatus describes the current state of a stage
+type StageStatus struct {
+	Index    int            `json:"index"`
+	Name     string         `json:"name"`
+	Cmd      string         `json:"cmd"`
+	Dir      string         `json:"dir"`
+	Started  bool           `json:"started"`
+	Running  bool           `json:"running"`
+	Stopped  bool           `json:"stopped"`
+	Counters map[string]any `json:"counters,omitempty"`
+}
+
 // StageOptions describe high-level settings of a stage
 type StageOptions struct {
-	Descr  string            // one-line description
-	Flags  *pflag.FlagSet    // CLI flags
-	Usage  string            // usage string
-	Args   []string          // required argument names
-	Events map[string]string // event names and descriptions
+	Descr   string            // one-line description
+	Flags   *pflag.FlagSet    // CLI flags
+	Usage   string            // usage string
+	Args    []string          // required argument names
+	Events  map[string]string // event names and descriptions
+	Secrets []string          // flag names with sensitive values (eg. passwords)
 
 	// these can be modified before Attach(), and even inside (with care)
 
@@ -53,6 +76,8 @@ type StageOptions struct {
 	IsConsumer bool // consumes messages? (reads from Line output)
 	IsStdin    bool // reads from stdin?
 	IsStdout   bool // writes to stdout?
+	IsSession  bool // establishes a BGP session with a peer?
+	IsListener bool // waits for a peer in Prepare? (no --prepare-timeout by default)
 	Bidir      bool // allow -LR (bidir mode)?
 }
 
@@ -66,6 +91,16 @@ type StageBase struct {
 	running atomic.Bool   // true if stage running
 	done    chan struct{} // closed when Run returns
 
+	paused    atomic.Bool // true if stage paused
+	pauseDrop bool        // skip the stage while paused, instead of buffering?
+	pauseMax  int         // max number of buffered messages (--pause-buffer)
+	pauseMu   sync.Mutex  // protects pauseBuf
+	pauseBuf  []*msg.Msg  // messages buffered while paused, in order
+	pauseL    *pipe.Input // re-injects buffered L messages at this stage
+	pauseR    *pipe.Input // re-injects buffered R messages at this stage
+
+	coalesce coalescer // --event-coalesce
+
 	Ctx    context.Context         // stage context
 	Cancel context.CancelCauseFunc // cancel to stop the stage
 
@@ -89,9 +124,11 @@ type StageBase struct {
 	IsBidir bool    // true iff IsRight && IsLeft
 	Dir     dir.Dir // target direction (IsLeft/IsRight translated, can be DIR_LR)
 
-	callbacks []*pipe.Callback // registered callbacks
-	handlers  []*pipe.Handler  // registered handlers
-	inputs    []*pipe.Input    // registered inputs
+	callbacks []*pipe.Callback         // registered callbacks
+	handlers  []*pipe.Handler          // registered handlers
+	inputs    []*pipe.Input            // registered inputs
+	exit      int                      // last stage to see our messages (--to), or 0
+	entries   map[msg.Type]injectPoint // per-type entry points (--inject-type), or nil
 }
 
 // Attach is the default Stage implementation that does nothing.
@@ -153,9 +190,23 @@ func (b *Bgpipe) NewStage(cmd string) *StageBase {
 	f.BoolP("right", "R", false, "operate in the R direction")
 	f.BoolP("args", "A", false, "consume all CLI arguments till --")
 	f.StringSliceP("wait", "W", []string{}, "wait for given event before starting")
+	f.Int("priority", 0, "start before stages with higher values waiting for the same event")
 	f.StringSliceP("stop", "S", []string{}, "stop after given event is handled")
+	f.StringSlice("pause-on", []string{}, "pause processing after given event is handled")
+	f.StringSlice("resume-on", []string{}, "resume processing after given event is handled")
+	f.String("pause-mode", "buffer", "while paused: buffer messages, or drop (skip this stage)")
+	f.Int("pause-buffer", 10000, "max messages to buffer while paused, resume when exceeded")
+	f.Duration("event-coalesce", 0, "send repeated stage events at most once per given window, with a count (0 means off)")
+	prepare_timeout := 5 * time.Minute
+	if so.IsListener {
+		prepare_timeout = 0 // the peer may take long
+	}
+	f.Duration("prepare-timeout", prepare_timeout, "max time to prepare before starting (0 means no limit)")
 	if so.IsProducer {
 		f.StringP("inject", "I", "next", "where to inject new messages")
+		f.StringSlice("inject-type", nil, "per-type --inject (format: TYPE=WHERE, eg. open=first)")
+		f.String("from", "", "first stage to see new messages (index or @name, instead of --inject)")
+		f.String("to", "", "last stage to see new messages (index or @name), drop them after")
 	}
 
 	return s
@@ -187,8 +238,12 @@ func (s *StageBase) Errorf(format string, a ...any) error {
 	return fmt.Errorf(s.Name+": "+format, a...)
 }
 
-// Event sends an event, prefixing et with stage name + slash
+// Event sends an event, prefixing et with stage name + slash.
+// Returns nil if the event was held back by --event-coalesce.
 func (s *StageBase) Event(et string, args ...any) *pipe.Event {
+	if s.coalesceEvent(et, args) {
+		return nil
+	}
 	return s.B.Pipe.Event(s.Name+"/"+et, append(args, s)...)
 }
 
@@ -197,6 +252,23 @@ func (s *StageBase) Running() bool {
 	return s.running.Load()
 }
 
+// Status returns the current stage status
+func (s *StageBase) Status() StageStatus {
+	st := StageStatus{
+		Index:   s.Index,
+		Name:    s.Name,
+		Cmd:     s.Cmd,
+		Dir:     s.Dir.String(),
+		Started: s.started.Load(),
+		Running: s.running.Load(),
+		Stopped: s.stopped.Load(),
+	}
+	if sc, ok := s.Stage.(StageCounters); ok {
+		st.Counters = sc.Counters()
+	}
+	return st
+}
+
 // String returns stage "[index] name" or "name" if index is 0
 func (s *StageBase) String() string {
 	if s.Index != 0 {
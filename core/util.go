@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math"
 	"net/netip"
+	"os"
 	"strconv"
 	"strings"
 
@@ -62,6 +63,43 @@ func IsFile(v string) bool {
 	}
 }
 
+// ResolveValue returns the value of environment variable NAME if v is $NAME,
+// the first line of file PATH if v is @PATH, or v otherwise
+func ResolveValue(v string) (string, error) {
+	switch {
+	case len(v) > 1 && v[0] == '$':
+		val, ok := os.LookupEnv(v[1:])
+		if !ok {
+			return "", fmt.Errorf("%s: environment variable not set", v)
+		}
+		return strings.TrimSpace(val), nil
+	case len(v) > 1 && v[0] == '@':
+		buf, err := os.ReadFile(v[1:])
+		if err != nil {
+			return "", err
+		}
+		line, _, _ := strings.Cut(string(buf), "\n")
+		return strings.TrimSpace(line), nil
+	default:
+		return v, nil
+	}
+}
+
+// per-direction session events, see Bgpipe.onEstablish
+const (
+	EVENT_L_ESTABLISHED = "bgpipe/L_ESTABLISHED"
+	EVENT_R_ESTABLISHED = "bgpipe/R_ESTABLISHED"
+)
+
+// message tags used by the loop guard, see StageBase.loopWrap
+const (
+	TAG_VISITED = "bgpipe/visited" // comma-separated indices of stages that processed the message
+	TAG_HOPS    = "bgpipe/hops"    // number of stages that processed the message
+)
+
+// message tag with the peer hostname, see --tag-hostname
+const TAG_HOSTNAME = "PEER_HOSTNAME"
+
 // ParseEvents parses events in src and returns the result, or nil.
 // If stage_defaults is given, events like "foobar" are translated to "foobar/stage_defaults[:]".
 func ParseEvents(src []string, stage_defaults ...string) []string {
@@ -90,6 +128,9 @@ func ParseEvents(src []string, stage_defaults ...string) []string {
 		lower := strings.ToLower(name)
 
 		switch {
+		case !has_dot && !has_slash && (UPPER == "L_ESTABLISHED" || UPPER == "R_ESTABLISHED"):
+			// eg. l_established -> bgpipe/L_ESTABLISHED
+			name = "bgpipe/" + UPPER
 		case has_dot && has_slash:
 			// eg. foo/bar.name -> foo/bar.NAME
 			name = fmt.Sprintf("%s/%s.%s", slash, dot, UPPER)
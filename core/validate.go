@@ -0,0 +1,88 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+// validate checks the structure of the pipeline before attaching stages,
+// reporting all problems found at once in a single ErrPipeline error.
+func (b *Bgpipe) validate() error {
+	var (
+		k        = b.K
+		problems []string
+		stdin    []string // stages reading stdin
+		stdout   []string // stages writing stdout
+	)
+	add := func(s *StageBase, format string, args ...any) {
+		problems = append(problems, fmt.Sprintf("stage %s: ", s)+fmt.Sprintf(format, args...))
+	}
+
+	last := b.StageCount()
+	for _, s := range b.Stages {
+		if s == nil || s.Index <= 0 {
+			continue
+		}
+		so, sk := &s.Options, s.K
+
+		if so.IsStdin {
+			stdin = append(stdin, s.String())
+		}
+		if so.IsStdout {
+			stdout = append(stdout, s.String())
+		}
+
+		// consumers read from the pipe ends
+		if so.IsConsumer && s.Index != 1 && s.Index != last {
+			add(s, "%s", ErrFirstOrLast)
+		}
+
+		// both directions?
+		if sk.Bool("left") && sk.Bool("right") && !so.Bidir {
+			add(s, "%s", ErrLR)
+		}
+
+		// stage references must resolve
+		inject := sk.String("inject")
+		switch inject {
+		case "", "next", "here", "first", "last":
+		default:
+			if _, err := b.stageRef(inject); err != nil {
+				add(s, "--inject %s", err)
+			}
+		}
+		for _, opt := range []string{"from", "to"} {
+			if v := sk.String(opt); len(v) > 0 {
+				if _, err := b.stageRef(v); err != nil {
+					add(s, "--%s %s", opt, err)
+				}
+			}
+		}
+		if len(sk.String("from")) > 0 && inject != "" && inject != "next" {
+			add(s, "--from and --inject %s: must not use both", inject)
+		}
+	}
+
+	// at most one stage per stdin / stdout
+	if len(stdin) > 1 {
+		problems = append(problems, fmt.Sprintf("more than one stage reads from stdin: %s", strings.Join(stdin, ", ")))
+	}
+	if len(stdout) > 1 {
+		problems = append(problems, fmt.Sprintf("more than one stage writes to stdout: %s", strings.Join(stdout, ", ")))
+	}
+	if (k.Bool("stdin") || k.Bool("stdin-wait")) && len(stdin) > 0 {
+		problems = append(problems, fmt.Sprintf("could not use --stdin: stage %s already reads from stdin", stdin[0]))
+	}
+	if (k.Bool("stdout") || k.Bool("stdout-wait")) && len(stdout) > 0 {
+		problems = append(problems, fmt.Sprintf("could not use --stdout: stage %s already writes to stdout", stdout[0]))
+	}
+
+	switch len(problems) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("%w: %s", ErrPipeline, problems[0])
+	default:
+		return fmt.Errorf("%w: %d problems: %s", ErrPipeline, len(problems), strings.Join(problems, "; "))
+	}
+}
@@ -3,6 +3,8 @@ package extio
 import "errors"
 
 var (
-	ErrFormat = errors.New("unrecognized format")
-	ErrLength = errors.New("invalid buffer length")
+	ErrFormat      = errors.New("unrecognized format")
+	ErrLength      = errors.New("invalid buffer length")
+	ErrUnknownAttr = errors.New("unknown attribute")
+	ErrPartial     = errors.New("partial message at end of input")
 )
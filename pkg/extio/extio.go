@@ -2,11 +2,19 @@ package extio
 
 import (
 	"bytes"
+	"encoding/hex"
 	"fmt"
+	"hash/maphash"
 	"io"
+	"maps"
+	"net/netip"
 	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/bgpfix/bgpfix/attrs"
 	"github.com/bgpfix/bgpfix/caps"
 	"github.com/bgpfix/bgpfix/dir"
 	"github.com/bgpfix/bgpfix/mrt"
@@ -18,6 +26,9 @@ import (
 
 var bbpool bytebufferpool.Pool
 
+// TAG_RAW is the message tag with its hex wire bytes in JSON (--include-raw)
+const TAG_RAW = "bgpipe/raw"
+
 // Extio helps in I/O with external processes eg. a background JSON filter,
 // or a remote websocket processor.
 // You must read Output and return disposed buffers using Put().
@@ -35,17 +46,50 @@ type Extio struct {
 	opt_notime bool       // --no-time
 	opt_notags bool       // --no-tags
 	opt_pardon bool       // --pardon
+	opt_dupwin int        // --drop-dup-window
+	opt_ovf    string     // --overflow
+	opt_select []string   // --select
+	opt_unk    string     // --unknown-attrs
+	opt_rs     []byte     // --record-sep
+	opt_rspre  []byte     // --rs-prefix
+	opt_incraw bool       // --include-raw
+	opt_pfail  bool       // --partial fail
+
+	opt_mrt_dir     bool       // --mrt-dir
+	opt_mrt_type    mrt.Type   // --mrt-type
+	opt_mrt_now     bool       // --mrt-time now
+	opt_mrt_peeras  uint32     // --mrt-peer-as
+	opt_mrt_peerip  netip.Addr // --mrt-peer-ip
+	opt_mrt_localas uint32     // --mrt-local-as
+	opt_mrt_localip netip.Addr // --mrt-local-ip
+
+	opt_flush time.Duration // --flush-interval
+
+	ovfDrops atomic.Int64 // messages dropped due to --overflow
+	partials atomic.Int64 // partial messages at end of input
 
 	mrt *mrt.Reader  // MRT reader
 	buf bytes.Buffer // for ReadBuf()
 
+	dupMu   sync.Mutex   // guards below
+	dupSeed maphash.Seed // hash seed for duplicate detection
+	dupRing []uint64     // recent output hashes
+	dupPos  int          // next position in dupRing
+
 	Callback *pipe.Callback // our callback for capturing bgpipe output
 	InputL   *pipe.Input    // our L input to bgpipe
 	InputR   *pipe.Input    // our R input to bgpipe
 	InputD   *pipe.Input    // default input if data doesn't specify the direction
 
-	Output chan *bytebufferpool.ByteBuffer // output ready to be sent to the process
-	Pool   *bytebufferpool.Pool            // pool of byte buffers
+	Output      chan *bytebufferpool.ByteBuffer // output ready to be sent to the process
+	OutputTyped chan Typed                      // if not nil, used instead of Output
+	Pool        *bytebufferpool.Pool            // pool of byte buffers
+}
+
+// Typed is serialized output with its message type, see Extio.OutputTyped
+type Typed struct {
+	Type msg.Type
+	BB   *bytebufferpool.ByteBuffer
 }
 
 type Mode = int
@@ -71,6 +115,7 @@ func NewExtio(parent *core.StageBase, mode Mode) *Extio {
 	if f.Lookup("raw") == nil {
 		f.Bool("raw", false, "speak raw BGP instead of JSON")
 		f.Bool("mrt", false, "speak MRT-BGP4MP instead of JSON")
+		f.Bool("mrt-dir", false, "store message direction in the MRT interface index field (non-standard)")
 		f.StringSlice("type", []string{}, "skip if message is not of specified type(s)")
 
 		if mode&(MODE_READ|MODE_WRITE) == 0 {
@@ -82,11 +127,29 @@ func NewExtio(parent *core.StageBase, mode Mode) *Extio {
 			f.Bool("copy", false, "copy messages instead of filtering (mirror)")
 		}
 
+		if mode&MODE_READ == 0 {
+			f.Int("drop-dup-window", 0, "drop output identical to one of last N messages (0 = off)")
+			f.String("overflow", "block", "when output is full: block, drop-oldest, or drop-newest")
+			f.Duration("flush-interval", 0, "flush buffered or compressed output at least every time interval (0 means never)")
+			f.String("unknown-attrs", "pass", "unknown UPDATE attributes on output: pass (as-is), drop, or fail")
+			f.Bool("include-raw", false, "include the wire bytes in JSON output, as hex in the "+TAG_RAW+" tag")
+			f.String("record-sep", `\n`, "JSON record separator (escapes allowed, eg. \\x1e)")
+			f.String("rs-prefix", "", "JSON record prefix (escapes allowed, eg. \\x1e for RFC 7464)")
+			f.StringSlice("select", nil, "write only given JSON fields, eg. time,type,reach,tags.KEY,attrs.NAME")
+			f.String("mrt-type", "BGP4MP_ET", "MRT record type to write: BGP4MP or BGP4MP_ET")
+			f.String("mrt-time", "msg", "MRT timestamp to write: msg (message time) or now")
+			f.Uint32("mrt-peer-as", 0, "peer ASN to write in MRT (default: PEER_AS tag)")
+			f.String("mrt-peer-ip", "", "peer IP to write in MRT (default: PEER_IP tag)")
+			f.Uint32("mrt-local-as", 0, "local ASN to write in MRT (default: LOCAL_AS tag)")
+			f.String("mrt-local-ip", "", "local IP to write in MRT (default: LOCAL_IP tag)")
+		}
+
 		if mode&MODE_WRITE == 0 {
 			f.Bool("pardon", false, "ignore input parse errors")
 			f.Bool("no-seq", false, "overwrite input message sequence number")
 			f.Bool("no-time", false, "overwrite input message time")
 			f.Bool("no-tags", false, "drop input message tags")
+			f.String("partial", "warn", "partial message at end of input: warn or fail")
 		}
 	}
 
@@ -99,6 +162,7 @@ func (eio *Extio) Attach() error {
 	k := eio.K
 
 	// options
+	var err error
 	eio.opt_raw = k.Bool("raw")
 	eio.opt_mrt = k.Bool("mrt")
 	eio.opt_read = k.Bool("read")
@@ -108,6 +172,93 @@ func (eio *Extio) Attach() error {
 	eio.opt_notime = k.Bool("no-time")
 	eio.opt_notags = k.Bool("no-tags")
 	eio.opt_pardon = k.Bool("pardon")
+	eio.opt_incraw = k.Bool("include-raw")
+	eio.opt_dupwin = k.Int("drop-dup-window")
+	if eio.opt_dupwin < 0 {
+		return fmt.Errorf("--drop-dup-window must not be negative")
+	} else if eio.opt_dupwin > 0 {
+		eio.dupSeed = maphash.MakeSeed()
+		eio.dupRing = make([]uint64, eio.opt_dupwin)
+	}
+	switch eio.opt_ovf = k.String("overflow"); eio.opt_ovf {
+	case "", "block", "drop-oldest", "drop-newest":
+		break
+	default:
+		return fmt.Errorf("--overflow %s: need block, drop-oldest, or drop-newest", eio.opt_ovf)
+	}
+
+	eio.opt_flush = k.Duration("flush-interval")
+	if eio.opt_flush < 0 {
+		return fmt.Errorf("--flush-interval must not be negative")
+	}
+
+	switch v := k.String("partial"); v {
+	case "", "warn":
+		eio.opt_pfail = false
+	case "fail":
+		eio.opt_pfail = true
+	default:
+		return fmt.Errorf("--partial %s: need warn or fail", v)
+	}
+
+	switch eio.opt_unk = k.String("unknown-attrs"); eio.opt_unk {
+	case "", "pass", "drop", "fail":
+		break
+	default:
+		return fmt.Errorf("--unknown-attrs %s: need pass, drop, or fail", eio.opt_unk)
+	}
+
+	// JSON record framing
+	if v := k.String("record-sep"); len(v) > 0 && v != `\n` {
+		v, err := unescape(v)
+		if err != nil {
+			return fmt.Errorf("--record-sep: %w", err)
+		}
+		eio.opt_rs = []byte(v)
+	}
+	if v := k.String("rs-prefix"); len(v) > 0 {
+		v, err := unescape(v)
+		if err != nil {
+			return fmt.Errorf("--rs-prefix: %w", err)
+		}
+		eio.opt_rspre = []byte(v)
+	}
+
+	eio.opt_select, err = parseSelect(k.Strings("select"))
+	if err != nil {
+		return fmt.Errorf("--select %w", err)
+	}
+
+	// MRT output
+	eio.opt_mrt_dir = k.Bool("mrt-dir")
+	switch v := k.String("mrt-type"); strings.ToUpper(v) {
+	case "BGP4MP_ET", "":
+		eio.opt_mrt_type = mrt.BGP4MP_ET
+	case "BGP4MP":
+		eio.opt_mrt_type = mrt.BGP4MP
+	default:
+		return fmt.Errorf("--mrt-type %s: need BGP4MP or BGP4MP_ET", v)
+	}
+	switch v := k.String("mrt-time"); v {
+	case "msg", "":
+		eio.opt_mrt_now = false
+	case "now":
+		eio.opt_mrt_now = true
+	default:
+		return fmt.Errorf("--mrt-time %s: need msg or now", v)
+	}
+	eio.opt_mrt_peeras = uint32(k.Int64("mrt-peer-as"))
+	eio.opt_mrt_localas = uint32(k.Int64("mrt-local-as"))
+	if v := k.String("mrt-peer-ip"); len(v) > 0 {
+		if eio.opt_mrt_peerip, err = netip.ParseAddr(v); err != nil {
+			return fmt.Errorf("--mrt-peer-ip: %w", err)
+		}
+	}
+	if v := k.String("mrt-local-ip"); len(v) > 0 {
+		if eio.opt_mrt_localip, err = netip.ParseAddr(v); err != nil {
+			return fmt.Errorf("--mrt-local-ip: %w", err)
+		}
+	}
 
 	// overrides
 	if eio.mode&MODE_READ != 0 {
@@ -121,7 +272,6 @@ func (eio *Extio) Attach() error {
 	}
 
 	// parse --type
-	var err error
 	eio.opt_type, err = core.ParseTypes(k.Strings("type"), nil)
 	if err != nil {
 		return fmt.Errorf("--type: %w", err)
@@ -138,6 +288,21 @@ func (eio *Extio) Attach() error {
 	if eio.opt_raw && eio.opt_mrt {
 		return fmt.Errorf("--raw and --mrt: must not use both at the same time")
 	}
+	if len(eio.opt_select) > 0 && (eio.opt_raw || eio.opt_mrt) {
+		return fmt.Errorf("--select: works only with JSON output")
+	}
+	if eio.opt_mrt_dir && !eio.opt_mrt {
+		return fmt.Errorf("--mrt-dir: works only with MRT")
+	}
+	if eio.opt_incraw && (eio.opt_raw || eio.opt_mrt) {
+		return fmt.Errorf("--include-raw: works only with JSON output")
+	}
+	if eio.opt_incraw && len(eio.opt_select) > 0 {
+		return fmt.Errorf("--include-raw and --select: must not use both at the same time (use --select raw)")
+	}
+	if (eio.opt_rs != nil || eio.opt_rspre != nil) && (eio.opt_raw || eio.opt_mrt) {
+		return fmt.Errorf("--record-sep and --rs-prefix: work only with JSON output")
+	}
 
 	// not write-only? read input to bgpipe
 	if !eio.opt_write {
@@ -207,6 +372,10 @@ func (eio *Extio) ReadSingle(buf []byte, cb pipe.CallbackFunc) (parse_err error)
 			parse_err = err // parse error
 		case n != len(buf):
 			parse_err = ErrLength // dangling bytes after msg?
+		case eio.opt_mrt_dir:
+			if d := mrtGetDir(buf); d != 0 {
+				m.Dir = d // restore the captured direction
+			}
 		}
 
 	} else { // parse text in buf into m
@@ -219,6 +388,11 @@ func (eio *Extio) ReadSingle(buf []byte, cb pipe.CallbackFunc) (parse_err error)
 			// TODO: optimize unmarshal (lookup cache of recently marshaled msgs)
 			parse_err = m.FromJSON(buf)
 
+			// prefer the wire bytes, if present
+			if parse_err == nil {
+				parse_err = eio.fromRaw(m)
+			}
+
 			// convenience
 			if parse_err == nil && m.Type == msg.INVALID {
 				m.Use(msg.KEEPALIVE)
@@ -280,25 +454,45 @@ func (eio *Extio) ReadBuf(buf []byte, cb pipe.CallbackFunc) (parse_err error) {
 	}
 
 	// raw message?
-	if eio.opt_raw { // raw message(s)
-		_, err := eio.InputD.WriteFunc(buf, check)
-		switch err {
-		case nil:
-			break // success
-		case io.ErrUnexpectedEOF:
-			return nil // wait for more
-		default:
-			parse_err = err
-		}
-	} else if eio.opt_mrt { // MRT message(s)
-		_, err := eio.mrt.WriteFunc(buf, check)
-		switch err {
-		case nil:
-			break // success
-		case io.ErrUnexpectedEOF:
-			return nil // wait for more
-		default:
-			parse_err = err
+	if eio.opt_raw { // raw message(s), buffer until complete
+		eio.buf.Write(buf)
+		for {
+			l := bgpMsgLen(eio.buf.Bytes())
+			if l < 0 {
+				break
+			}
+			if _, err := eio.InputD.WriteFunc(eio.buf.Next(l), check); err != nil {
+				parse_err = err
+				if !eio.opt_pardon {
+					break
+				}
+			}
+		}
+	} else if eio.opt_mrt && eio.IsBidir { // MRT message(s), respect captured direction
+		eio.buf.Write(buf)
+		for {
+			l := mrtRecordLen(eio.buf.Bytes())
+			if l < 0 {
+				break
+			}
+			err := eio.ReadSingle(eio.buf.Next(l), cb)
+			if err != nil {
+				return err
+			}
+		}
+	} else if eio.opt_mrt { // MRT message(s), buffer until complete
+		eio.buf.Write(buf)
+		for {
+			l := mrtRecordLen(eio.buf.Bytes())
+			if l < 0 {
+				break
+			}
+			if _, err := eio.mrt.WriteFunc(eio.buf.Next(l), check); err != nil {
+				parse_err = err
+				if !eio.opt_pardon {
+					break
+				}
+			}
 		}
 	} else { // buffer and parse all lines in buf so far
 		eio.buf.Write(buf)
@@ -339,7 +533,7 @@ func (eio *Extio) ReadStream(rd io.Reader, cb pipe.CallbackFunc) (parse_err erro
 		case parse_err != nil:
 			return parse_err
 		case err == io.EOF:
-			return nil
+			return eio.ReadEOF(cb)
 		case err != nil:
 			return err
 		}
@@ -351,6 +545,39 @@ func (eio *Extio) ReadStream(rd io.Reader, cb pipe.CallbackFunc) (parse_err erro
 	}
 }
 
+// ReadEOF handles the end of input read using ReadBuf: parses the last JSON line
+// if not terminated by a newline, and reports a partial raw or MRT message
+// left in the buffer (see --partial). Must not be used concurrently. cb may be nil.
+func (eio *Extio) ReadEOF(cb pipe.CallbackFunc) error {
+	left := eio.buf.Bytes()
+	if len(left) == 0 || eio.opt_write {
+		return nil
+	}
+	defer eio.buf.Reset()
+
+	// the last line of JSON?
+	if !eio.opt_raw && !eio.opt_mrt {
+		return eio.ReadSingle(left, cb)
+	}
+
+	// a truncated message
+	eio.partials.Add(1)
+	ev := eio.Warn()
+	if eio.opt_pfail {
+		ev = eio.Error()
+	}
+	ev.Int("len", len(left)).Hex("partial", left).Msg("partial message at end of input")
+	if eio.opt_pfail {
+		return ErrPartial
+	}
+	return nil
+}
+
+// Partials returns the number of partial messages found at end of input
+func (eio *Extio) Partials() int64 {
+	return eio.partials.Load()
+}
+
 func (eio *Extio) checkMsg(m *msg.Msg) bool {
 	// filter message types?
 	if len(eio.opt_type) > 0 && slices.Index(eio.opt_type, m.Type) < 0 {
@@ -387,8 +614,144 @@ func (eio *Extio) SendMsg(m *msg.Msg) bool {
 		mx.Action.Drop()
 	}
 
+	// seen it already?
+	if eio.Duplicate(m) {
+		return true
+	}
+
 	// copy to a bytes buffer
-	var err error
+	bb, err := eio.Marshal(m)
+	if err != nil {
+		eio.Warn().Err(err).Msg("extio write error")
+		return true
+	}
+
+	// try writing, don't panic on channel closed [1]
+	var ok bool
+	if eio.OutputTyped != nil {
+		ok = output(eio, eio.OutputTyped, Typed{m.Type, bb}, eio.putTyped)
+	} else {
+		ok = output(eio, eio.Output, bb, eio.Put)
+	}
+	if !ok {
+		mx.Callback.Drop()
+		return true
+	}
+
+	return true
+}
+
+// putTyped returns the buffer in t to the pool
+func (eio *Extio) putTyped(t Typed) {
+	eio.Put(t.BB)
+}
+
+// output queues v in ch, respecting --overflow if full, and disposing of
+// dropped values with put. Returns false iff ch is closed.
+func output[T comparable](eio *Extio, ch chan T, v T, put func(T)) (ok bool) {
+	if eio.opt_ovf == "" || eio.opt_ovf == "block" {
+		return send_safe(ch, v)
+	}
+
+	defer func() {
+		if recover() != nil {
+			ok = false // closed
+		}
+	}()
+
+	var (
+		zero   T    // nil signal value (see websocket)
+		signal bool // dropped a nil signal?
+	)
+	for {
+		select {
+		case ch <- v:
+			if signal {
+				select {
+				case ch <- zero:
+				default:
+				}
+			}
+			return true
+		default:
+			// full
+		}
+
+		// drop v?
+		if eio.opt_ovf == "drop-newest" {
+			put(v)
+			eio.ovfDrop()
+			return true
+		}
+
+		// drop the oldest and try again
+		select {
+		case old, ok := <-ch:
+			if !ok {
+				return false
+			} else if old == zero {
+				signal = true
+			} else {
+				put(old)
+				eio.ovfDrop()
+			}
+		default:
+			// drained in the meantime
+		}
+	}
+}
+
+// ovfDrop counts a message dropped due to --overflow
+func (eio *Extio) ovfDrop() {
+	if eio.ovfDrops.Add(1) == 1 {
+		eio.Warn().Str("overflow", eio.opt_ovf).Msg("output full, dropping messages")
+	}
+}
+
+// OverflowDrops returns the number of messages dropped due to --overflow
+func (eio *Extio) OverflowDrops() int64 {
+	return eio.ovfDrops.Load()
+}
+
+// Duplicate returns true iff --drop-dup-window is enabled and m is identical
+// to one of the recent messages (ignoring sequence numbers and timestamps).
+// UPDATEs with withdrawals are never considered duplicates. Records m as seen.
+func (eio *Extio) Duplicate(m *msg.Msg) bool {
+	if eio.opt_dupwin <= 0 {
+		return false
+	} else if m.Type == msg.UPDATE && m.Update.HasUnreach() {
+		return false
+	}
+
+	// hash the wire representation
+	if err := m.Marshal(eio.P.Caps); err != nil {
+		return false
+	}
+	var h maphash.Hash
+	h.SetSeed(eio.dupSeed)
+	h.WriteByte(byte(m.Dir))
+	h.WriteByte(byte(m.Type))
+	h.Write(m.Data)
+	sum := h.Sum64()
+
+	eio.dupMu.Lock()
+	defer eio.dupMu.Unlock()
+	if slices.Contains(eio.dupRing, sum) {
+		return true
+	}
+	eio.dupRing[eio.dupPos] = sum
+	eio.dupPos = (eio.dupPos + 1) % len(eio.dupRing)
+	return false
+}
+
+// Marshal serializes m into a new byte buffer, according to the stage options.
+// The buffer should be returned to the pool using Put() after use.
+func (eio *Extio) Marshal(m *msg.Msg) (*bytebufferpool.ByteBuffer, error) {
+	err := eio.unknownAttrs(m)
+	if err != nil {
+		return nil, err
+	}
+
 	bb := eio.Pool.Get()
 	switch {
 	case eio.opt_raw:
@@ -398,13 +761,14 @@ func (eio *Extio) SendMsg(m *msg.Msg) bool {
 		}
 		_, err = m.WriteTo(bb)
 	case eio.opt_mrt:
-		mr := mrt.NewMrt().Use(mrt.BGP4MP_ET)
+		mr := mrt.NewMrt().Use(eio.opt_mrt_type)
 
 		// marshal into BGP4MP
 		err = mr.Bgp4.FromMsg(m)
 		if err != nil {
 			break
 		}
+		eio.mrtHeader(mr, m)
 
 		// marshal into MRT
 		err = mr.Marshal()
@@ -413,34 +777,220 @@ func (eio *Extio) SendMsg(m *msg.Msg) bool {
 		}
 
 		_, err = mr.WriteTo(bb)
+		if eio.opt_mrt_dir {
+			mrtSetDir(bb.B, m.Dir) // store the direction
+		}
+	case len(eio.opt_select) > 0:
+		bb.B = eio.selectJSON(bb.B, m)
+	case eio.opt_incraw:
+		bb.B = eio.rawJSON(bb.B, m)
 	default:
 		_, err = bb.Write(m.GetJSON())
 	}
 	if err != nil {
-		eio.Warn().Err(err).Msg("extio write error")
-		return true
+		eio.Pool.Put(bb)
+		return nil, err
 	}
 
-	// try writing, don't panic on channel closed [1]
-	if !send_safe(eio.Output, bb) {
-		mx.Callback.Drop()
-		return true
+	// custom JSON record framing?
+	if eio.opt_rs != nil || eio.opt_rspre != nil {
+		bb.B = eio.frame(bb.B)
 	}
+	return bb, nil
+}
 
-	return true
+// rawHex returns the wire bytes of m in hex, or an empty string on error
+func (eio *Extio) rawHex(m *msg.Msg) string {
+	if err := m.Marshal(eio.P.Caps); err != nil {
+		return ""
+	}
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buf.Bytes())
+}
+
+// rawJSON appends to dst the JSON of m with its wire bytes in the TAG_RAW tag
+func (eio *Extio) rawJSON(dst []byte, m *msg.Msg) []byte {
+	raw := eio.rawHex(m)
+	if len(raw) == 0 {
+		return append(dst, m.GetJSON()...)
+	}
+
+	// NB: ToJSON, as GetJSON may return a cached JSON without the tag.
+	// Leave the message tags as found, as m may be written elsewhere too.
+	had := pipe.HasTags(m)
+	mx := pipe.MsgContext(m)
+	tags := mx.UseTags()
+	old, hadRaw := tags[TAG_RAW]
+	tags[TAG_RAW] = raw
+	dst = m.ToJSON(dst)
+	switch {
+	case !had:
+		mx.DropTags()
+	case hadRaw:
+		tags[TAG_RAW] = old
+	default:
+		delete(tags, TAG_RAW)
+	}
+
+	if l := len(dst); l == 0 || dst[l-1] != '\n' {
+		dst = append(dst, '\n')
+	}
+	return dst
+}
+
+// fromRaw replaces m with the wire bytes in its TAG_RAW tag, if present,
+// keeping the metadata and other tags
+func (eio *Extio) fromRaw(m *msg.Msg) error {
+	if !pipe.HasTags(m) {
+		return nil
+	}
+	raw, ok := pipe.MsgTags(m)[TAG_RAW]
+	if !ok {
+		return nil
+	}
+	data, err := hex.DecodeString(raw)
+	if err != nil {
+		return fmt.Errorf("%s: %w", TAG_RAW, err)
+	}
+
+	// save metadata
+	d, seq, t := m.Dir, m.Seq, m.Time
+	tags := maps.Clone(pipe.MsgTags(m))
+	delete(tags, TAG_RAW)
+
+	// parse the wire bytes
+	m.Reset()
+	switch n, err := m.FromBytes(data); {
+	case err != nil:
+		return fmt.Errorf("%s: %w", TAG_RAW, err)
+	case n != len(data):
+		return fmt.Errorf("%s: %w", TAG_RAW, ErrLength)
+	}
+
+	// restore metadata
+	m.Dir, m.Seq, m.Time = d, seq, t
+	if len(tags) > 0 {
+		maps.Copy(pipe.MsgContext(m).UseTags(), tags)
+	}
+	return nil
+}
+
+// frame replaces the trailing newline of JSON record buf with --record-sep,
+// and prepends --rs-prefix
+func (eio *Extio) frame(buf []byte) []byte {
+	buf = bytes.TrimRight(buf, "\n")
+	if eio.opt_rs != nil {
+		buf = append(buf, eio.opt_rs...)
+	} else {
+		buf = append(buf, '\n')
+	}
+	if len(eio.opt_rspre) > 0 {
+		buf = slices.Insert(buf, 0, eio.opt_rspre...)
+	}
+	return buf
+}
+
+// unknownAttrs handles UPDATE attributes in m that bgpfix does not model,
+// according to --unknown-attrs. By default, their raw bytes are kept as-is.
+func (eio *Extio) unknownAttrs(m *msg.Msg) error {
+	if eio.opt_unk == "" || eio.opt_unk == "pass" || m.Type != msg.UPDATE {
+		return nil
+	}
+
+	var unknown []attrs.Code
+	m.Update.Attrs.Each(func(i int, ac attrs.Code, at attrs.Attr) {
+		if _, ok := at.(*attrs.Raw); ok {
+			unknown = append(unknown, ac)
+		}
+	})
+	if len(unknown) == 0 {
+		return nil
+	} else if eio.opt_unk == "fail" {
+		return fmt.Errorf("%w: %s", ErrUnknownAttr, unknown[0])
+	}
+
+	for _, ac := range unknown {
+		m.Update.Attrs.Drop(ac)
+	}
+	m.Modified()
+	return nil
+}
+
+// mrtHeader overrides the MRT header fields in mr for message m,
+// using the --mrt-* options or the message tags
+func (eio *Extio) mrtHeader(mr *mrt.Mrt, m *msg.Msg) {
+	if eio.opt_mrt_now {
+		mr.Time = time.Now().UTC()
+	} else if !m.Time.IsZero() {
+		mr.Time = m.Time
+	}
+
+	var tags map[string]string
+	if pipe.HasTags(m) {
+		tags = pipe.MsgTags(m)
+	}
+	b4 := &mr.Bgp4
+	b4.PeerAS = mrtAsn(eio.opt_mrt_peeras, tags["PEER_AS"], b4.PeerAS)
+	b4.PeerIP = mrtAddr(eio.opt_mrt_peerip, tags["PEER_IP"], b4.PeerIP)
+	b4.LocalAS = mrtAsn(eio.opt_mrt_localas, tags["LOCAL_AS"], b4.LocalAS)
+	b4.LocalIP = mrtAddr(eio.opt_mrt_localip, tags["LOCAL_IP"], b4.LocalIP)
+}
+
+// Flusher is a writer that buffers output until flushed, eg. *bufio.Writer or *gzip.Writer
+type Flusher interface {
+	Flush() error
+}
+
+// FlushInterval returns the --flush-interval value
+func (eio *Extio) FlushInterval() time.Duration {
+	return eio.opt_flush
 }
 
 // WriteStream rewrites eio.Output to w.
+// If w is a Flusher, flushes it every --flush-interval if anything was written.
 func (eio *Extio) WriteStream(w io.Writer) error {
-	for bb := range eio.Output {
-		_, err := bb.WriteTo(w)
-		eio.Pool.Put(bb)
-		if err != nil {
-			eio.OutputClose()
-			return err
+	fl, ok := w.(Flusher)
+	if !ok || eio.opt_flush <= 0 {
+		for bb := range eio.Output {
+			_, err := bb.WriteTo(w)
+			eio.Pool.Put(bb)
+			if err != nil {
+				eio.OutputClose()
+				return err
+			}
+		}
+		return nil
+	}
+
+	ticker := time.NewTicker(eio.opt_flush)
+	defer ticker.Stop()
+	for dirty := false; ; {
+		select {
+		case bb, ok := <-eio.Output:
+			if !ok {
+				return fl.Flush()
+			}
+			_, err := bb.WriteTo(w)
+			eio.Pool.Put(bb)
+			if err != nil {
+				eio.OutputClose()
+				return err
+			}
+			dirty = true
+		case <-ticker.C:
+			if !dirty {
+				continue
+			}
+			if err := fl.Flush(); err != nil {
+				eio.OutputClose()
+				return err
+			}
+			dirty = false
 		}
 	}
-	return nil
 }
 
 // Put puts a byte buffer back to pool
@@ -455,6 +1005,7 @@ func (eio *Extio) OutputClose() error {
 	eio.opt_read = true
 	eio.Callback.Drop()
 	close_safe(eio.Output)
+	close_safe(eio.OutputTyped)
 	return nil
 }
 
@@ -0,0 +1,130 @@
+package extio
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/bgpfix/bgpipe/core"
+	"github.com/valyala/bytebufferpool"
+)
+
+// testTyped returns an Extio for testing the typed output with given --overflow
+func testTyped(ovf string, size int) *Extio {
+	return &Extio{
+		StageBase:   &core.StageBase{},
+		opt_ovf:     ovf,
+		Pool:        &bytebufferpool.Pool{},
+		OutputTyped: make(chan Typed, size),
+	}
+}
+
+func (eio *Extio) testSend(typ msg.Type, data string) bool {
+	bb := eio.Pool.Get()
+	bb.WriteString(data)
+	return output(eio, eio.OutputTyped, Typed{typ, bb}, eio.putTyped)
+}
+
+// testRecv drains OutputTyped, returning the queued types and contents
+func (eio *Extio) testRecv() (types []msg.Type, data []string) {
+	for {
+		select {
+		case t := <-eio.OutputTyped:
+			types = append(types, t.Type)
+			data = append(data, t.BB.String())
+		default:
+			return
+		}
+	}
+}
+
+func TestOutputTypedOverflow(t *testing.T) {
+	tests := []struct {
+		ovf   string
+		want  []string
+		drops int64
+	}{
+		{"drop-oldest", []string{"update 2", "keepalive 3"}, 1},
+		{"drop-newest", []string{"open 1", "update 2"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ovf, func(t *testing.T) {
+			eio := testTyped(tt.ovf, 2)
+			for i, v := range []struct {
+				typ  msg.Type
+				data string
+			}{
+				{msg.OPEN, "open 1"},
+				{msg.UPDATE, "update 2"},
+				{msg.KEEPALIVE, "keepalive 3"},
+			} {
+				if !eio.testSend(v.typ, v.data) {
+					t.Fatalf("send %d: output reported closed", i)
+				}
+			}
+
+			_, data := eio.testRecv()
+			if len(data) != len(tt.want) {
+				t.Fatalf("got %q, want %q", data, tt.want)
+			}
+			for i := range data {
+				if data[i] != tt.want[i] {
+					t.Errorf("got %q, want %q", data, tt.want)
+					break
+				}
+			}
+			if got := eio.OverflowDrops(); got != tt.drops {
+				t.Errorf("OverflowDrops() = %d, want %d", got, tt.drops)
+			}
+		})
+	}
+}
+
+func TestOutputTypedKeepsType(t *testing.T) {
+	eio := testTyped("drop-oldest", 1)
+	eio.testSend(msg.OPEN, "open")
+	eio.testSend(msg.UPDATE, "update")
+
+	types, data := eio.testRecv()
+	if len(types) != 1 || types[0] != msg.UPDATE || data[0] != "update" {
+		t.Errorf("got %v %q, want [UPDATE] [\"update\"]", types, data)
+	}
+}
+
+func TestOutputTypedClosed(t *testing.T) {
+	for _, ovf := range []string{"block", "drop-oldest", "drop-newest"} {
+		eio := testTyped(ovf, 1)
+		close(eio.OutputTyped)
+		if eio.testSend(msg.UPDATE, "update") {
+			t.Errorf("%s: send on closed output reported ok", ovf)
+		}
+	}
+}
+
+func TestRawJSONTags(t *testing.T) {
+	eio := &Extio{StageBase: &core.StageBase{P: pipe.NewPipe(context.Background())}}
+
+	// no tags: must not create any
+	m := msg.NewMsg().Use(msg.KEEPALIVE)
+	eio.rawJSON(nil, m)
+	if pipe.HasTags(m) {
+		t.Errorf("no tags: got tags %v after rawJSON", pipe.MsgTags(m))
+	}
+
+	// existing tags: must be left as found
+	m = msg.NewMsg().Use(msg.KEEPALIVE)
+	pipe.MsgContext(m).UseTags()["FOO"] = "bar"
+	eio.rawJSON(nil, m)
+	if tags := pipe.MsgTags(m); len(tags) != 1 || tags["FOO"] != "bar" {
+		t.Errorf("tags: got %v, want only FOO=bar", tags)
+	}
+
+	// existing TAG_RAW: must be restored
+	m = msg.NewMsg().Use(msg.KEEPALIVE)
+	pipe.MsgContext(m).UseTags()[TAG_RAW] = "old"
+	eio.rawJSON(nil, m)
+	if tags := pipe.MsgTags(m); len(tags) != 1 || tags[TAG_RAW] != "old" {
+		t.Errorf("%s: got %v, want only %s=old", TAG_RAW, tags, TAG_RAW)
+	}
+}
@@ -0,0 +1,99 @@
+package extio
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"strconv"
+
+	"github.com/bgpfix/bgpfix/dir"
+)
+
+// MRT record header length (RFC 6396)
+const mrtHeaderLen = 12
+
+// mrtIfindex returns the offset of the interface index field in BGP4MP message record buf,
+// or -1 if not found. With --mrt-dir, bgpipe uses this field to store the message
+// direction (1=L, 2=R), so that captured sessions can be replayed in both directions.
+func mrtIfindex(buf []byte) int {
+	if len(buf) < mrtHeaderLen {
+		return -1
+	}
+
+	// BGP4MP or BGP4MP_ET?
+	off := mrtHeaderLen
+	switch binary.BigEndian.Uint16(buf[4:6]) {
+	case 16: // BGP4MP
+		break
+	case 17: // BGP4MP_ET
+		off += 4 // microseconds
+	default:
+		return -1
+	}
+
+	// skip peer and local ASNs
+	switch binary.BigEndian.Uint16(buf[6:8]) {
+	case 1, 6, 8, 10: // 2-byte ASN message subtypes
+		off += 4
+	case 4, 7, 9, 11: // 4-byte ASN message subtypes
+		off += 8
+	default:
+		return -1
+	}
+
+	if len(buf) < off+2 {
+		return -1
+	}
+	return off
+}
+
+// mrtSetDir stores direction d in BGP4MP message record buf
+func mrtSetDir(buf []byte, d dir.Dir) {
+	if i := mrtIfindex(buf); i > 0 {
+		binary.BigEndian.PutUint16(buf[i:], uint16(d))
+	}
+}
+
+// mrtGetDir returns the direction stored in BGP4MP message record buf, or 0 if none
+func mrtGetDir(buf []byte) dir.Dir {
+	if i := mrtIfindex(buf); i > 0 {
+		switch d := dir.Dir(binary.BigEndian.Uint16(buf[i:])); d {
+		case dir.DIR_L, dir.DIR_R:
+			return d
+		}
+	}
+	return 0
+}
+
+// mrtRecordLen returns the length of the first MRT record in buf, or -1 if buf is too short
+func mrtRecordLen(buf []byte) int {
+	if len(buf) < mrtHeaderLen {
+		return -1
+	}
+	l := mrtHeaderLen + int(binary.BigEndian.Uint32(buf[8:12]))
+	if len(buf) < l {
+		return -1
+	}
+	return l
+}
+
+// mrtAsn returns opt if non-zero, or tag if a valid ASN, or def otherwise
+func mrtAsn(opt uint32, tag string, def uint32) uint32 {
+	if opt != 0 {
+		return opt
+	}
+	if v, err := strconv.ParseUint(tag, 10, 32); err == nil {
+		return uint32(v)
+	}
+	return def
+}
+
+// mrtAddr returns opt if valid, or tag if a valid IP address, or def otherwise
+func mrtAddr(opt netip.Addr, tag string, def netip.Addr) netip.Addr {
+	if opt.IsValid() {
+		return opt
+	}
+	if v, err := netip.ParseAddr(tag); err == nil {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,172 @@
+package extio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bgpfix/bgpfix/dir"
+	"github.com/bgpfix/bgpfix/mrt"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+)
+
+// testRecord returns a fake MRT record of given type and subtype, with the
+// BGP4MP interface index set to ifindex (if applicable)
+func testRecord(typ, sub uint16, ifindex uint16) []byte {
+	body := make([]byte, 0, 64)
+	if typ == 17 {
+		body = binary.BigEndian.AppendUint32(body, 123456) // microseconds
+	}
+	switch sub {
+	case 1, 6, 8, 10:
+		body = binary.BigEndian.AppendUint16(body, 65001)
+		body = binary.BigEndian.AppendUint16(body, 65002)
+	default:
+		body = binary.BigEndian.AppendUint32(body, 4200000001)
+		body = binary.BigEndian.AppendUint32(body, 4200000002)
+	}
+	body = binary.BigEndian.AppendUint16(body, ifindex)
+	body = binary.BigEndian.AppendUint16(body, 1)         // AFI
+	body = append(body, 192, 0, 2, 1, 192, 0, 2, 2, 0xff) // IPs, msg
+
+	buf := make([]byte, mrtHeaderLen, mrtHeaderLen+len(body))
+	binary.BigEndian.PutUint32(buf[0:4], 1700000000)
+	binary.BigEndian.PutUint16(buf[4:6], typ)
+	binary.BigEndian.PutUint16(buf[6:8], sub)
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(body)))
+	return append(buf, body...)
+}
+
+func TestMrtDirRoundTrip(t *testing.T) {
+	records := []struct {
+		name     string
+		typ, sub uint16
+	}{
+		{"BGP4MP/MESSAGE", 16, 1},
+		{"BGP4MP/MESSAGE_AS4", 16, 4},
+		{"BGP4MP_ET/MESSAGE", 17, 1},
+		{"BGP4MP_ET/MESSAGE_AS4_ADDPATH", 17, 9},
+	}
+	for _, r := range records {
+		for _, d := range []dir.Dir{dir.DIR_L, dir.DIR_R} {
+			buf := testRecord(r.typ, r.sub, 0)
+			if mrtRecordLen(buf) != len(buf) {
+				t.Fatalf("%s: bad test record", r.name)
+			}
+			mrtSetDir(buf, d)
+			if got := mrtGetDir(buf); got != d {
+				t.Errorf("%s: stored %s, got %s", r.name, d, got)
+			}
+		}
+	}
+}
+
+func TestMrtDirIfindex(t *testing.T) {
+	// a regular ifindex must not be taken for a direction
+	buf := testRecord(17, 4, 7)
+	if got := mrtGetDir(buf); got != 0 {
+		t.Errorf("ifindex 7: got direction %s", got)
+	}
+
+	// only the ifindex field is touched
+	orig := testRecord(17, 4, 0)
+	buf = testRecord(17, 4, 0)
+	mrtSetDir(buf, dir.DIR_R)
+	i := mrtIfindex(buf)
+	if !bytes.Equal(buf[:i], orig[:i]) || !bytes.Equal(buf[i+2:], orig[i+2:]) {
+		t.Errorf("modified more than the ifindex:\n%x\n%x", orig, buf)
+	}
+
+	// not BGP4MP: no-op
+	buf = testRecord(13, 1, 0) // TABLE_DUMP_V2
+	mrtSetDir(buf, dir.DIR_R)
+	if got := mrtGetDir(buf); got != 0 {
+		t.Errorf("TABLE_DUMP_V2: got direction %s", got)
+	}
+}
+
+func TestMrtHeader(t *testing.T) {
+	var (
+		ip1 = netip.MustParseAddr("192.0.2.1")
+		ip2 = netip.MustParseAddr("192.0.2.2")
+		ip3 = netip.MustParseAddr("2001:db8::3")
+		ts  = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	)
+
+	// no options or tags: the message time, other fields left as-is
+	eio := &Extio{}
+	m := msg.NewMsg().Use(msg.KEEPALIVE)
+	m.Time = ts
+	mr := mrt.NewMrt()
+	mr.Bgp4.PeerAS, mr.Bgp4.PeerIP = 65000, ip3
+	eio.mrtHeader(mr, m)
+	if !mr.Time.Equal(ts) {
+		t.Errorf("time: got %s, want %s", mr.Time, ts)
+	}
+	if mr.Bgp4.PeerAS != 65000 || mr.Bgp4.PeerIP != ip3 {
+		t.Errorf("peer: got %d %s, want 65000 %s", mr.Bgp4.PeerAS, mr.Bgp4.PeerIP, ip3)
+	}
+
+	// tags override the defaults
+	tags := pipe.MsgContext(m).UseTags()
+	tags["PEER_AS"], tags["PEER_IP"] = "65001", ip1.String()
+	tags["LOCAL_AS"], tags["LOCAL_IP"] = "4200000002", ip2.String()
+	mr = mrt.NewMrt()
+	eio.mrtHeader(mr, m)
+	b4 := &mr.Bgp4
+	if b4.PeerAS != 65001 || b4.PeerIP != ip1 || b4.LocalAS != 4200000002 || b4.LocalIP != ip2 {
+		t.Errorf("tags: got %d %s %d %s", b4.PeerAS, b4.PeerIP, b4.LocalAS, b4.LocalIP)
+	}
+
+	// options override the tags, --mrt-time now ignores the message time
+	eio = &Extio{
+		opt_mrt_now:     true,
+		opt_mrt_peeras:  65010,
+		opt_mrt_peerip:  ip3,
+		opt_mrt_localas: 65020,
+	}
+	mr = mrt.NewMrt()
+	before := time.Now()
+	eio.mrtHeader(mr, m)
+	b4 = &mr.Bgp4
+	if b4.PeerAS != 65010 || b4.PeerIP != ip3 || b4.LocalAS != 65020 || b4.LocalIP != ip2 {
+		t.Errorf("options: got %d %s %d %s", b4.PeerAS, b4.PeerIP, b4.LocalAS, b4.LocalIP)
+	}
+	if mr.Time.Before(before) {
+		t.Errorf("--mrt-time now: got %s, want after %s", mr.Time, before)
+	}
+}
+
+func TestMrtAsnAddr(t *testing.T) {
+	ip := netip.MustParseAddr("192.0.2.1")
+	def := netip.MustParseAddr("192.0.2.9")
+	for _, tc := range []struct {
+		opt  uint32
+		tag  string
+		want uint32
+	}{
+		{0, "", 1},
+		{0, "65001", 65001},
+		{0, "4294967295", 4294967295},
+		{0, "4294967296", 1}, // overflow
+		{0, "AS65001", 1},
+		{0, "-1", 1},
+		{65002, "65001", 65002},
+	} {
+		if got := mrtAsn(tc.opt, tc.tag, 1); got != tc.want {
+			t.Errorf("mrtAsn(%d, %q): got %d, want %d", tc.opt, tc.tag, got, tc.want)
+		}
+	}
+	if got := mrtAddr(netip.Addr{}, "bogus", def); got != def {
+		t.Errorf("mrtAddr bogus tag: got %s, want %s", got, def)
+	}
+	if got := mrtAddr(netip.Addr{}, ip.String(), def); got != ip {
+		t.Errorf("mrtAddr tag: got %s, want %s", got, ip)
+	}
+	if got := mrtAddr(def, ip.String(), netip.Addr{}); got != def {
+		t.Errorf("mrtAddr option: got %s, want %s", got, def)
+	}
+}
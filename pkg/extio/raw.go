@@ -0,0 +1,22 @@
+package extio
+
+import "encoding/binary"
+
+// BGP message header length (RFC 4271)
+const bgpHeaderLen = 19
+
+// bgpMsgLen returns the length of the first BGP message in buf, or -1 if buf is too short.
+// Returns len(buf) if the header length is invalid, so the parser reports the error.
+func bgpMsgLen(buf []byte) int {
+	if len(buf) < bgpHeaderLen {
+		return -1
+	}
+	l := int(binary.BigEndian.Uint16(buf[16:18]))
+	switch {
+	case l < bgpHeaderLen:
+		return len(buf)
+	case len(buf) < l:
+		return -1
+	}
+	return l
+}
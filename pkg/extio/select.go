@@ -0,0 +1,173 @@
+package extio
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bgpfix/bgpfix/attrs"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/nlri"
+	"github.com/bgpfix/bgpfix/pipe"
+)
+
+// JSON_TIME is the time format used by --select
+const JSON_TIME = "2006-01-02T15:04:05.000"
+
+// selectFields lists the top-level fields supported by --select,
+// apart from the dotted "tags.KEY" and "attrs.NAME" paths
+var selectFields = []string{
+	"dir", "seq", "time", "type", "reach", "unreach", "nexthop", "aspath", "origin", "tags", "raw",
+}
+
+// parseSelect parses the --select field list
+func parseSelect(src []string) ([]string, error) {
+	var dst []string
+	for _, v := range src {
+		v = strings.TrimSpace(v)
+		name, key, dotted := strings.Cut(v, ".")
+		switch {
+		case len(v) == 0:
+			continue
+		case dotted && len(key) > 0 && (name == "tags" || name == "attrs"):
+			dst = append(dst, v)
+		case !dotted && slices.Contains(selectFields, v):
+			dst = append(dst, v)
+		default:
+			return nil, fmt.Errorf("%s: invalid field", v)
+		}
+	}
+	return dst, nil
+}
+
+// selectJSON appends to dst a JSON object with the fields of m selected
+// in --select, in the order given. Fields missing in m are omitted.
+func (eio *Extio) selectJSON(dst []byte, m *msg.Msg) []byte {
+	var (
+		u     = &m.Update
+		isupd = m.Type == msg.UPDATE
+		tags  map[string]string
+		first = true
+	)
+	if pipe.HasTags(m) {
+		tags = pipe.MsgTags(m)
+	}
+
+	// key writes the next object key
+	key := func(k string) {
+		if first {
+			first = false
+		} else {
+			dst = append(dst, ',')
+		}
+		dst = appendString(dst, k)
+		dst = append(dst, ':')
+	}
+
+	dst = append(dst, '{')
+	for _, field := range eio.opt_select {
+		switch field {
+		case "dir":
+			key(field)
+			dst = appendString(dst, m.Dir.String())
+		case "seq":
+			key(field)
+			dst = strconv.AppendInt(dst, m.Seq, 10)
+		case "time":
+			key(field)
+			dst = appendString(dst, m.Time.Format(JSON_TIME))
+		case "type":
+			key(field)
+			dst = appendString(dst, m.Type.String())
+		case "reach":
+			if isupd {
+				if ps := u.GetReach(nil); len(ps) > 0 {
+					key(field)
+					dst = selectPrefixes(dst, ps)
+				}
+			}
+		case "unreach":
+			if isupd {
+				if ps := u.GetUnreach(nil); len(ps) > 0 {
+					key(field)
+					dst = selectPrefixes(dst, ps)
+				}
+			}
+		case "nexthop":
+			if !isupd {
+				break
+			}
+			if nh := u.NextHop(); nh.IsValid() {
+				key(field)
+				dst = appendString(dst, nh.String())
+			}
+		case "aspath":
+			if !isupd {
+				break
+			}
+			if ap := u.AsPath(); ap != nil {
+				key(field)
+				dst = ap.ToJSON(dst)
+			}
+		case "origin":
+			if !isupd {
+				break
+			}
+			if ap := u.AsPath(); ap != nil && len(ap.Segments) > 0 {
+				key(field)
+				dst = strconv.AppendUint(dst, uint64(ap.Origin()), 10)
+			}
+		case "tags":
+			if len(tags) > 0 {
+				key(field)
+				js, _ := json.Marshal(tags) // sorts the keys
+				dst = append(dst, js...)
+			}
+		case "raw":
+			if raw := eio.rawHex(m); len(raw) > 0 {
+				key(field)
+				dst = appendString(dst, raw)
+			}
+		default:
+			name, sub, _ := strings.Cut(field, ".")
+			switch name {
+			case "tags":
+				if v, ok := tags[sub]; ok {
+					key(field)
+					dst = appendString(dst, v)
+				}
+			case "attrs":
+				if !isupd {
+					break
+				}
+				u.Attrs.Each(func(i int, ac attrs.Code, at attrs.Attr) {
+					if at != nil && strings.EqualFold(ac.String(), sub) {
+						key(field)
+						dst = at.ToJSON(dst)
+					}
+				})
+			}
+		}
+	}
+	return append(dst, '}', '\n')
+}
+
+// selectPrefixes appends prefixes ps to dst as a JSON array of strings
+func selectPrefixes(dst []byte, ps []nlri.NLRI) []byte {
+	dst = append(dst, '[')
+	for i := range ps {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = appendString(dst, ps[i].String())
+	}
+	return append(dst, ']')
+}
+
+// appendString appends v to dst as a JSON string
+func appendString(dst []byte, v string) []byte {
+	js, _ := json.Marshal(v)
+	return append(dst, js...)
+}
@@ -0,0 +1,25 @@
+package extio
+
+import (
+	"testing"
+
+	"github.com/bgpfix/bgpfix/msg"
+)
+
+func TestSelectNonUpdate(t *testing.T) {
+	eio := &Extio{}
+	sel, err := parseSelect([]string{"type", "nexthop", "aspath", "origin", "reach", "unreach", "attrs.ORIGIN"})
+	if err != nil {
+		t.Fatalf("parseSelect: %v", err)
+	}
+	eio.opt_select = sel
+
+	for _, typ := range []msg.Type{msg.OPEN, msg.KEEPALIVE, msg.NOTIFY} {
+		m := msg.NewMsg().Use(typ)
+		got := string(eio.selectJSON(nil, m))
+		want := `{"type":"` + typ.String() + "\"}\n"
+		if got != want {
+			t.Errorf("%s: got %q, want %q", typ, got, want)
+		}
+	}
+}
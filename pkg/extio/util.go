@@ -1,5 +1,10 @@
 package extio
 
+import (
+	"strconv"
+	"strings"
+)
+
 func close_safe[T any](ch chan T) (ok bool) {
 	if ch != nil {
 		defer func() { recover() }()
@@ -17,3 +22,8 @@ func send_safe[T any](ch chan T, v T) (ok bool) {
 	}
 	return
 }
+
+// unescape interprets Go escape sequences in v, eg. \n or \x1e
+func unescape(v string) (string, error) {
+	return strconv.Unquote(`"` + strings.ReplaceAll(v, `"`, `\"`) + `"`)
+}
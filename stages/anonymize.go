@@ -0,0 +1,283 @@
+package stages
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/netip"
+
+	"github.com/bgpfix/bgpfix/attrs"
+	"github.com/bgpfix/bgpfix/caps"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/nlri"
+	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/bgpfix/bgpipe/core"
+	"github.com/puzpuzpuz/xsync/v3"
+)
+
+type Anonymize struct {
+	*core.StageBase
+
+	key      []byte // HMAC key derived from --salt
+	opt_tags string // --tags
+
+	addrs *xsync.MapOf[netip.Addr, netip.Addr] // cache of anonymized addresses
+}
+
+func NewAnonymize(parent *core.StageBase) core.Stage {
+	var (
+		s = &Anonymize{StageBase: parent}
+		o = &s.Options
+		f = o.Flags
+	)
+
+	o.Descr = "anonymize IP addresses (prefix-preserving) and ASNs"
+	o.Bidir = true
+	o.Secrets = []string{"salt"}
+
+	f.String("salt", "", "secret that makes the mapping deterministic (default: random)")
+	f.String("tags", "hash", "what to do with message tags: keep, drop, or hash")
+
+	s.addrs = xsync.NewMapOf[netip.Addr, netip.Addr]()
+	return s
+}
+
+func (s *Anonymize) Attach() error {
+	k := s.K
+
+	salt := k.String("salt")
+	if len(salt) == 0 {
+		buf := make([]byte, 32)
+		rand.Read(buf)
+		salt = string(buf)
+		s.Info().Msg("no --salt given, using a random one")
+	}
+	sum := sha256.Sum256([]byte(salt))
+	s.key = sum[:]
+
+	switch s.opt_tags = k.String("tags"); s.opt_tags {
+	case "keep", "drop", "hash":
+		break
+	default:
+		return fmt.Errorf("--tags %s: need keep, drop, or hash", s.opt_tags)
+	}
+
+	s.P.OnMsg(s.onMsg, s.Dir, msg.OPEN, msg.UPDATE)
+	return nil
+}
+
+func (s *Anonymize) onMsg(m *msg.Msg) bool {
+	switch m.Type {
+	case msg.OPEN:
+		s.anonOpen(&m.Open)
+	case msg.UPDATE:
+		s.anonUpdate(&m.Update)
+	}
+	m.Modified()
+
+	// message tags
+	if pipe.HasTags(m) {
+		switch s.opt_tags {
+		case "drop":
+			pipe.MsgContext(m).DropTags()
+		case "hash":
+			tags := pipe.MsgTags(m)
+			for key, val := range tags {
+				tags[key] = s.anonTag(val)
+			}
+		}
+	}
+
+	return true
+}
+
+// anonOpen anonymizes the ASN and router ID in OPEN o
+func (s *Anonymize) anonOpen(o *msg.Open) {
+	if as4, ok := o.Caps.Get(caps.CAP_AS4).(*caps.AS4); ok && as4 != nil {
+		as4.ASN = s.anonAsn(as4.ASN)
+		if as4.ASN > math.MaxUint16 {
+			o.ASN = as_trans
+		} else {
+			o.ASN = uint16(as4.ASN)
+		}
+	} else {
+		o.ASN = uint16(s.anonAsn(uint32(o.ASN)))
+	}
+
+	if o.Identifier.IsValid() {
+		o.Identifier = s.anonAddr(o.Identifier)
+	}
+}
+
+// anonUpdate anonymizes prefixes, next-hops, and ASNs in UPDATE u
+func (s *Anonymize) anonUpdate(u *msg.Update) {
+	ats := &u.Attrs
+
+	// prefixes
+	s.anonPrefixes(u.Reach)
+	s.anonPrefixes(u.Unreach)
+	for _, ac := range []attrs.Code{attrs.ATTR_MP_REACH, attrs.ATTR_MP_UNREACH} {
+		mp, ok := ats.Get(ac).(*attrs.MP)
+		if !ok || mp == nil {
+			continue
+		}
+		if mp.NextHop.IsValid() {
+			mp.NextHop = s.anonAddr(mp.NextHop)
+		}
+		if mpp := mp.Prefixes(); mpp != nil {
+			s.anonPrefixes(mpp.Prefixes)
+		}
+	}
+
+	// NEXT_HOP
+	if nh, ok := ats.Get(attrs.ATTR_NEXTHOP).(*attrs.IP); ok && nh != nil && nh.Addr.IsValid() {
+		nh.Addr = s.anonAddr(nh.Addr)
+	}
+
+	// AS_PATH and AS4_PATH
+	for _, ac := range []attrs.Code{attrs.ATTR_ASPATH, attrs.ATTR_AS4PATH} {
+		ap, ok := ats.Get(ac).(*attrs.Aspath)
+		if !ok || ap == nil {
+			continue
+		}
+		for i := range ap.Segments {
+			list := ap.Segments[i].List
+			for j, asn := range list {
+				list[j] = s.anonAsn(asn)
+			}
+		}
+	}
+
+	// AGGREGATOR and AS4_AGGREGATOR
+	for _, ac := range []attrs.Code{attrs.ATTR_AGGREGATOR, attrs.ATTR_AS4AGGREGATOR} {
+		ag, ok := ats.Get(ac).(*attrs.Aggregator)
+		if !ok || ag == nil {
+			continue
+		}
+		ag.ASN = s.anonAsn(ag.ASN)
+		if ag.Addr.IsValid() {
+			ag.Addr = s.anonAddr(ag.Addr)
+		}
+	}
+
+	// communities: the ASN part (anonAsn keeps the well-known ones)
+	if com, ok := ats.Get(attrs.ATTR_COMMUNITY).(*attrs.Community); ok && com != nil {
+		for i, asn := range com.ASN {
+			com.ASN[i] = uint16(s.anonAsn(uint32(asn)))
+		}
+	}
+	if lc, ok := ats.Get(attrs.ATTR_LARGE_COMMUNITY).(*attrs.LargeCom); ok && lc != nil {
+		for i, asn := range lc.ASN {
+			lc.ASN[i] = s.anonAsn(asn)
+		}
+	}
+}
+
+// anonPrefixes anonymizes prefixes in place, preserving their structure
+func (s *Anonymize) anonPrefixes(prefixes []nlri.NLRI) {
+	for i := range prefixes {
+		p := &prefixes[i]
+		bits := p.Bits()
+		addr := s.anonAddr(p.Masked().Addr())
+		p.Prefix = netip.PrefixFrom(addr, bits).Masked()
+	}
+}
+
+// anonAddr returns the prefix-preserving anonymization of addr, à la Crypto-PAn:
+// bit i of the result is bit i of addr flipped by a keyed PRF of bits 0..i-1,
+// so addresses sharing a prefix of length n map to addresses sharing a prefix of length n.
+func (s *Anonymize) anonAddr(addr netip.Addr) netip.Addr {
+	if v, ok := s.addrs.Load(addr); ok {
+		return v
+	}
+
+	var (
+		src  = addr.AsSlice()
+		dst  = make([]byte, len(src))
+		seen = make([]byte, len(src)+2) // family, bit index, bits seen so far
+		mac  = hmac.New(sha256.New, s.key)
+		sum  []byte
+	)
+	seen[0] = byte(len(src))
+	for i := 0; i < len(src)*8; i++ {
+		seen[1] = byte(i)
+		mac.Reset()
+		mac.Write(seen)
+		sum = mac.Sum(sum[:0])
+
+		byt, bit := i/8, byte(0x80>>(i%8))
+		dst[byt] |= (src[byt] ^ sum[0]) & bit
+		seen[2+byt] |= src[byt] & bit
+	}
+
+	ret, _ := netip.AddrFromSlice(dst)
+	ret = ret.WithZone(addr.Zone())
+	s.addrs.Store(addr, ret)
+	return ret
+}
+
+// anonAsn returns a deterministic mapping of public asn into the public 2-byte
+// or 4-byte range it came from. Keeps special-purpose ASNs, eg. so that well-known
+// communities like NO_EXPORT or BLACKHOLE (65535:*) keep their meaning.
+func (s *Anonymize) anonAsn(asn uint32) uint32 {
+	if !asn_public(asn) {
+		return asn
+	}
+
+	var buf [7]byte
+	copy(buf[:], "asn")
+	binary.BigEndian.PutUint32(buf[3:], asn)
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(buf[:])
+	v := binary.BigEndian.Uint32(mac.Sum(nil))
+
+	if asn <= math.MaxUint16 {
+		v = 1 + v%(asn_public2_max-1) // skip AS_TRANS below
+		if v >= as_trans {
+			v++
+		}
+		return v
+	}
+	return asn_public4_min + v%(asn_public4_max-asn_public4_min+1)
+}
+
+// the public ASN ranges, see the IANA special-purpose AS numbers registry
+const (
+	asn_public2_max = 64495      // 1-64495, apart from AS_TRANS
+	asn_public4_min = 131072     // below: documentation and reserved
+	asn_public4_max = 4199999999 // above: private use and reserved
+)
+
+// asn_public returns true iff asn is not a special-purpose ASN: 0, AS_TRANS,
+// documentation, private use, or reserved
+func asn_public(asn uint32) bool {
+	switch {
+	case asn == 0 || asn == as_trans:
+		return false
+	case asn <= asn_public2_max:
+		return true
+	default:
+		return asn >= asn_public4_min && asn <= asn_public4_max
+	}
+}
+
+// anonTag anonymizes a tag value: IP addresses and prefixes are anonymized,
+// other values are replaced with a keyed hash
+func (s *Anonymize) anonTag(val string) string {
+	if addr, err := netip.ParseAddr(val); err == nil {
+		return s.anonAddr(addr).String()
+	}
+	if p, err := netip.ParsePrefix(val); err == nil {
+		ps := []nlri.NLRI{nlri.FromPrefix(p)}
+		s.anonPrefixes(ps)
+		return ps[0].Prefix.String()
+	}
+
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(val))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
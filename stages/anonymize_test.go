@@ -0,0 +1,121 @@
+package stages
+
+import (
+	"math/bits"
+	"net/netip"
+	"testing"
+
+	"github.com/bgpfix/bgpfix/nlri"
+)
+
+// testAnonymize returns an attached anonymize stage with given --salt
+func testAnonymize(t *testing.T, salt string) *Anonymize {
+	t.Helper()
+	sb := testStage(t, "anonymize", "--salt", salt)
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatal(err)
+	}
+	return sb.Stage.(*Anonymize)
+}
+
+// testCommonBits returns the length of the common prefix of a and b
+func testCommonBits(a, b netip.Addr) int {
+	x, y := a.AsSlice(), b.AsSlice()
+	for i := range x {
+		if d := x[i] ^ y[i]; d != 0 {
+			return i*8 + bits.LeadingZeros8(d)
+		}
+	}
+	return len(x) * 8
+}
+
+func TestAnonymizePrefixPreserving(t *testing.T) {
+	s := testAnonymize(t, "test")
+	pairs := [][2]string{
+		{"10.0.0.1", "10.0.0.2"},
+		{"10.0.0.1", "10.0.1.1"},
+		{"10.0.0.1", "10.128.0.1"},
+		{"10.0.0.1", "192.0.2.1"},
+		{"192.0.2.1", "192.0.2.1"},
+		{"2001:db8::1", "2001:db8::2"},
+		{"2001:db8::1", "2001:db8:1::1"},
+		{"2001:db8::1", "2a00::1"},
+	}
+	for _, pair := range pairs {
+		a, b := netip.MustParseAddr(pair[0]), netip.MustParseAddr(pair[1])
+		xa, xb := s.anonAddr(a), s.anonAddr(b)
+		if xa.Is4() != a.Is4() {
+			t.Errorf("%s: got %s, changed the family", a, xa)
+		}
+		if got, want := testCommonBits(xa, xb), testCommonBits(a, b); got != want {
+			t.Errorf("%s %s -> %s %s: got %d common bits, want %d", a, b, xa, xb, got, want)
+		}
+	}
+
+	// a more-specific stays within its covering prefix
+	ps := []nlri.NLRI{
+		nlri.FromPrefix(netip.MustParsePrefix("10.1.0.0/16")),
+		nlri.FromPrefix(netip.MustParsePrefix("10.1.2.0/24")),
+		nlri.FromPrefix(netip.MustParsePrefix("10.2.0.0/16")),
+	}
+	s.anonPrefixes(ps)
+	if ps[0].Bits() != 16 || ps[1].Bits() != 24 || ps[2].Bits() != 16 {
+		t.Errorf("prefix lengths changed: %v", ps)
+	}
+	if !ps[0].Contains(ps[1].Addr()) {
+		t.Errorf("%s not within %s", ps[1].Prefix, ps[0].Prefix)
+	}
+	if ps[0].Prefix == ps[2].Prefix {
+		t.Errorf("2 prefixes mapped to the same %s", ps[0].Prefix)
+	}
+}
+
+func TestAnonymizeDeterministic(t *testing.T) {
+	s1, s2, s3 := testAnonymize(t, "salt1"), testAnonymize(t, "salt1"), testAnonymize(t, "salt2")
+
+	addr := netip.MustParseAddr("192.0.2.1")
+	if a, b := s1.anonAddr(addr), s2.anonAddr(addr); a != b {
+		t.Errorf("same salt: %s and %s", a, b)
+	}
+	if a, b := s1.anonAddr(addr), s3.anonAddr(addr); a == b {
+		t.Errorf("different salt: both %s", a)
+	}
+	if a, b := s1.anonAsn(65001), s2.anonAsn(65001); a != b {
+		t.Errorf("same salt: AS%d and AS%d", a, b)
+	}
+	if a, b := s1.anonAsn(3333), s1.anonAsn(3333); a != b {
+		t.Errorf("repeated call: AS%d and AS%d", a, b)
+	}
+	if a, b := s1.anonTag("foo"), s2.anonTag("foo"); a != b || a == "foo" {
+		t.Errorf("tags: got %q and %q", a, b)
+	}
+}
+
+func TestAnonymizeAsn(t *testing.T) {
+	s := testAnonymize(t, "test")
+
+	// special-purpose ASNs are kept
+	for _, asn := range []uint32{0, as_trans, 64496, 64511, 64512, 65000, 65534, 65535,
+		65536, 65551, 65552, 131071, 4200000000, 4294967294, 4294967295} {
+		if got := s.anonAsn(asn); got != asn {
+			t.Errorf("AS%d: got AS%d, want it kept", asn, got)
+		}
+	}
+
+	// public ASNs stay public, in the same range
+	for asn := uint32(1); asn < 64496; asn += 7 {
+		if asn == as_trans {
+			continue
+		}
+		got := s.anonAsn(asn)
+		if got == 0 || got > asn_public2_max || got == as_trans {
+			t.Fatalf("AS%d: got AS%d, not a public 2-byte ASN", asn, got)
+		}
+	}
+	for asn := uint32(asn_public4_min); asn < asn_public4_max-1e6; asn += 1e6 + 7 {
+		got := s.anonAsn(asn)
+		if got < asn_public4_min || got > asn_public4_max {
+			t.Fatalf("AS%d: got AS%d, not a public 4-byte ASN", asn, got)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package stages
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bgpfix/bgpfix/attrs"
+	"github.com/bgpfix/bgpfix/caps"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpipe/core"
+)
+
+// AS_TRANS is the 2-byte placeholder for 4-byte ASNs (RFC 6793)
+const as_trans = 23456
+
+// extended community families carrying an ASN (RFC 4360, RFC 5668)
+const (
+	extcom_as2 = 0x00 // 2-octet AS specific
+	extcom_as4 = 0x02 // 4-octet AS specific
+)
+
+type AsnRewrite struct {
+	*core.StageBase
+
+	asnmap map[uint32]uint32 // old ASN -> new ASN
+}
+
+func NewAsnRewrite(parent *core.StageBase) core.Stage {
+	var (
+		s = &AsnRewrite{StageBase: parent}
+		o = &s.Options
+		f = o.Flags
+	)
+
+	o.Descr = "rewrite ASNs consistently across messages"
+	o.Bidir = true
+
+	f.StringSlice("map", nil, "rewrite given ASN to another ASN (format: OLD:NEW)")
+
+	s.asnmap = make(map[uint32]uint32)
+	return s
+}
+
+func (s *AsnRewrite) Attach() error {
+	for _, v := range s.K.Strings("map") {
+		before, after, found := strings.Cut(v, ":")
+		if !found {
+			return fmt.Errorf("--map %s: invalid format, need OLD:NEW", v)
+		}
+		old, err := strconv.ParseUint(before, 10, 32)
+		if err != nil {
+			return fmt.Errorf("--map %s: %w", v, err)
+		}
+		to, err := strconv.ParseUint(after, 10, 32)
+		if err != nil {
+			return fmt.Errorf("--map %s: %w", v, err)
+		}
+		s.asnmap[uint32(old)] = uint32(to)
+	}
+	if len(s.asnmap) == 0 {
+		return fmt.Errorf("nothing to do: no --map given")
+	}
+
+	s.P.OnMsg(s.onMsg, s.Dir, msg.OPEN, msg.UPDATE)
+	return nil
+}
+
+func (s *AsnRewrite) onMsg(m *msg.Msg) bool {
+	var changed bool
+	switch m.Type {
+	case msg.OPEN:
+		changed = s.rewriteOpen(&m.Open)
+	case msg.UPDATE:
+		changed = s.rewriteUpdate(&m.Update)
+	}
+	if changed {
+		m.Modified()
+	}
+	return true
+}
+
+// rewriteOpen rewrites the local ASN in OPEN o, including the AS4 capability
+func (s *AsnRewrite) rewriteOpen(o *msg.Open) (changed bool) {
+	// 4-byte ASN in capabilities?
+	if as4, ok := o.Caps.Get(caps.CAP_AS4).(*caps.AS4); ok && as4 != nil {
+		if to, ok := s.asnmap[as4.ASN]; ok {
+			as4.ASN = to
+			changed = true
+
+			// update the 2-byte field accordingly
+			if to > math.MaxUint16 {
+				o.ASN = as_trans
+			} else {
+				o.ASN = uint16(to)
+			}
+			return changed
+		}
+	}
+
+	// 2-byte ASN
+	if to, ok := s.asnmap[uint32(o.ASN)]; ok && to <= math.MaxUint16 {
+		o.ASN = uint16(to)
+		changed = true
+	}
+
+	return changed
+}
+
+// rewriteUpdate rewrites ASNs in all ASN-bearing attributes of UPDATE u
+func (s *AsnRewrite) rewriteUpdate(u *msg.Update) (changed bool) {
+	ats := &u.Attrs
+	as2 := !s.P.Caps.Has(caps.CAP_AS4) // 2-byte ASN session?
+
+	// AS4_PATH carries the real ASNs
+	if ap, ok := ats.Get(attrs.ATTR_AS4PATH).(*attrs.Aspath); ok && ap != nil {
+		changed = s.rewritePath(ap)
+	}
+
+	// AS_PATH: on 2-byte sessions, 4-byte ASNs become AS_TRANS (RFC 6793)
+	if ap, ok := ats.Get(attrs.ATTR_ASPATH).(*attrs.Aspath); ok && ap != nil {
+		if s.rewritePath(ap) {
+			changed = true
+			if as2 {
+				aspath_trans(ats, ap)
+			}
+		}
+	}
+
+	// AS4_AGGREGATOR carries the real ASN
+	if ag, ok := ats.Get(attrs.ATTR_AS4AGGREGATOR).(*attrs.Aggregator); ok && ag != nil {
+		if to, ok := s.asnmap[ag.ASN]; ok {
+			ag.ASN = to
+			changed = true
+		}
+	}
+
+	// AGGREGATOR: on 2-byte sessions, 4-byte ASNs become AS_TRANS
+	if ag, ok := ats.Get(attrs.ATTR_AGGREGATOR).(*attrs.Aggregator); ok && ag != nil {
+		if to, ok := s.asnmap[ag.ASN]; ok {
+			ag.ASN = to
+			changed = true
+			if as2 && to > math.MaxUint16 {
+				ag.ASN = as_trans
+				ag4 := ats.Use(attrs.ATTR_AS4AGGREGATOR).(*attrs.Aggregator)
+				ag4.ASN, ag4.Addr = to, ag.Addr
+			}
+		}
+	}
+
+	// standard communities: only if the new ASN fits in 2 bytes
+	if com, ok := ats.Get(attrs.ATTR_COMMUNITY).(*attrs.Community); ok && com != nil {
+		for i, asn := range com.ASN {
+			if to, ok := s.asnmap[uint32(asn)]; ok && to <= math.MaxUint16 {
+				com.ASN[i] = uint16(to)
+				changed = true
+			}
+		}
+	}
+
+	// large communities: the global administrator field
+	if lc, ok := ats.Get(attrs.ATTR_LARGE_COMMUNITY).(*attrs.LargeCom); ok && lc != nil {
+		for i, asn := range lc.ASN {
+			if to, ok := s.asnmap[asn]; ok {
+				lc.ASN[i] = to
+				changed = true
+			}
+		}
+	}
+
+	// extended communities: 2-byte and 4-byte AS-specific types
+	if ec, ok := ats.Get(attrs.ATTR_EXT_COMMUNITY).(*attrs.Extcom); ok && ec != nil {
+		for i, v := range ec.Value {
+			rt, ok := v.(*attrs.ExtcomRT)
+			if !ok || rt == nil || i >= len(ec.Type) {
+				continue
+			}
+			to, ok := s.asnmap[rt.ASN]
+			if !ok {
+				continue
+			}
+			switch extcom_family(ec.Type[i]) {
+			case extcom_as2:
+				if to <= math.MaxUint16 {
+					rt.ASN = to
+					changed = true
+				}
+			case extcom_as4:
+				rt.ASN = to
+				changed = true
+			}
+		}
+	}
+
+	return changed
+}
+
+// rewritePath rewrites ASNs in all segments of ap
+func (s *AsnRewrite) rewritePath(ap *attrs.Aspath) (changed bool) {
+	for i := range ap.Segments {
+		list := ap.Segments[i].List
+		for j, asn := range list {
+			if to, ok := s.asnmap[asn]; ok {
+				list[j] = to
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+func aspath_trans(ats *attrs.Attrs, ap *attrs.Aspath) {
+	// anything to do?
+	if !slices.ContainsFunc(ap.Segments, func(seg attrs.Segment) bool {
+		return slices.ContainsFunc(seg.List, func(asn uint32) bool { return asn > math.MaxUint16 })
+	}) {
+		return
+	}
+
+	// prepend the leading AS_PATH hops not covered by AS4_PATH
+	ap4 := ats.Use(attrs.ATTR_AS4PATH).(*attrs.Aspath)
+	var segs []attrs.Segment
+	for i, n := 0, aspath_len(ap)-aspath_len(ap4); n > 0 && i < len(ap.Segments); i++ {
+		seg := ap.Segments[i]
+		list := seg.List
+		if seg.IsSet {
+			n--
+		} else {
+			list = list[:min(n, len(list))]
+			n -= len(list)
+		}
+		segs = append(segs, attrs.Segment{IsSet: seg.IsSet, List: slices.Clone(list)})
+	}
+	ap4.Segments = append(segs, ap4.Segments...)
+
+	// use AS_TRANS in AS_PATH
+	for _, seg := range ap.Segments {
+		for j, asn := range seg.List {
+			if asn > math.MaxUint16 {
+				seg.List[j] = as_trans
+			}
+		}
+	}
+}
+
+// aspath_len returns the AS_PATH length of ap, counting each AS_SET as 1
+func aspath_len(ap *attrs.Aspath) (n int) {
+	for _, seg := range ap.Segments {
+		if seg.IsSet {
+			n++
+		} else {
+			n += len(seg.List)
+		}
+	}
+	return n
+}
+
+// extcom_family returns the extended community type high octet, without
+// the IANA authority and transitive bits (RFC 4360)
+func extcom_family(et attrs.ExtcomType) byte {
+	return byte(et>>8) & 0x3f
+}
@@ -0,0 +1,196 @@
+package stages
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/bgpfix/bgpfix/attrs"
+	"github.com/bgpfix/bgpfix/caps"
+	"github.com/bgpfix/bgpfix/msg"
+)
+
+// testAsnRewrite returns an attached asn-rewrite stage for a 4-byte (as4)
+// or 2-byte ASN session
+func testAsnRewrite(t *testing.T, as4 bool) *AsnRewrite {
+	sb := testStage(t, "asn-rewrite", "--map", "65001:65101", "--map", "65002:4200000002")
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatal(err)
+	}
+	if as4 {
+		sb.P.Caps.Use(caps.CAP_AS4)
+	} else {
+		sb.P.Caps.Drop(caps.CAP_AS4)
+	}
+	return sb.Stage.(*AsnRewrite)
+}
+
+// testPath sets attribute ac in ats to an AS_SEQUENCE of asns
+func testPath(ats *attrs.Attrs, ac attrs.Code, asns ...uint32) {
+	ap := ats.Use(ac).(*attrs.Aspath)
+	ap.Segments = []attrs.Segment{{List: asns}}
+}
+
+// checkPath checks that attribute ac in ats is an AS_SEQUENCE of want
+func checkPath(t *testing.T, ats *attrs.Attrs, ac attrs.Code, want ...uint32) {
+	t.Helper()
+	ap, ok := ats.Get(ac).(*attrs.Aspath)
+	if !ok || ap == nil {
+		if want != nil {
+			t.Errorf("attribute %d: missing, want %v", ac, want)
+		}
+		return
+	} else if want == nil {
+		t.Errorf("attribute %d: got %v, want none", ac, ap.Segments)
+		return
+	}
+
+	var got []uint32
+	for _, seg := range ap.Segments {
+		got = append(got, seg.List...)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("attribute %d: got %v, want %v", ac, got, want)
+	}
+}
+
+func TestAsnRewriteUpdate(t *testing.T) {
+	s := testAsnRewrite(t, true)
+	u := &msg.Update{}
+	ats := &u.Attrs
+
+	testPath(ats, attrs.ATTR_ASPATH, 65001, 65002, 65003)
+	ag := ats.Use(attrs.ATTR_AGGREGATOR).(*attrs.Aggregator)
+	ag.ASN, ag.Addr = 65002, netip.MustParseAddr("192.0.2.1")
+	com := ats.Use(attrs.ATTR_COMMUNITY).(*attrs.Community)
+	com.ASN, com.Value = []uint16{65001, 65002, 65003}, []uint16{100, 200, 300}
+	lc := ats.Use(attrs.ATTR_LARGE_COMMUNITY).(*attrs.LargeCom)
+	lc.ASN, lc.Value1, lc.Value2 = []uint32{65002}, []uint32{1}, []uint32{2}
+
+	if !s.rewriteUpdate(u) {
+		t.Fatal("rewriteUpdate() reported no change")
+	}
+	checkPath(t, ats, attrs.ATTR_ASPATH, 65101, 4200000002, 65003)
+	checkPath(t, ats, attrs.ATTR_AS4PATH) // not on 4-byte sessions
+	if ag.ASN != 4200000002 || ats.Has(attrs.ATTR_AS4AGGREGATOR) {
+		t.Errorf("AGGREGATOR: got %d", ag.ASN)
+	}
+	if !slices.Equal(com.ASN, []uint16{65101, 65002, 65003}) { // 4-byte ASN does not fit
+		t.Errorf("COMMUNITY: got %v", com.ASN)
+	}
+	if lc.ASN[0] != 4200000002 {
+		t.Errorf("LARGE_COMMUNITY: got %v", lc.ASN)
+	}
+
+	// nothing to do
+	u2 := &msg.Update{}
+	testPath(&u2.Attrs, attrs.ATTR_ASPATH, 65003, 65004)
+	if s.rewriteUpdate(u2) {
+		t.Error("rewriteUpdate() reported a change for unmapped ASNs")
+	}
+}
+
+func TestAsnRewriteExtcom(t *testing.T) {
+	s := testAsnRewrite(t, true)
+	u := &msg.Update{}
+
+	var (
+		as2a = &attrs.ExtcomRT{ASN: 65001, Value: 100}
+		as2b = &attrs.ExtcomRT{ASN: 65002, Value: 200}
+		as4  = &attrs.ExtcomRT{ASN: 65002, Value: 300}
+		ip4  = &attrs.ExtcomRT{ASN: 65001, Addr: netip.MustParseAddr("192.0.2.1"), Value: 400}
+	)
+	ec := u.Attrs.Use(attrs.ATTR_EXT_COMMUNITY).(*attrs.Extcom)
+	ec.Type = []attrs.ExtcomType{0x0002, 0x0002, 0x0202, 0x0102}
+	ec.Value = []attrs.ExtcomValue{as2a, as2b, as4, ip4}
+
+	if !s.rewriteUpdate(u) {
+		t.Fatal("rewriteUpdate() reported no change")
+	}
+	for _, tt := range []struct {
+		name string
+		rt   *attrs.ExtcomRT
+		want uint32
+	}{
+		{"2-octet AS route target", as2a, 65101},
+		{"2-octet AS route target, 4-byte new ASN", as2b, 65002},
+		{"4-octet AS route target", as4, 4200000002},
+		{"IPv4 route target", ip4, 65001},
+	} {
+		if tt.rt.ASN != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, tt.rt.ASN, tt.want)
+		}
+	}
+}
+
+func TestAsnRewriteAsTrans(t *testing.T) {
+	s := testAsnRewrite(t, false)
+	u := &msg.Update{}
+	ats := &u.Attrs
+
+	testPath(ats, attrs.ATTR_ASPATH, 65001, 65002, 65003)
+	ag := ats.Use(attrs.ATTR_AGGREGATOR).(*attrs.Aggregator)
+	ag.ASN, ag.Addr = 65002, netip.MustParseAddr("192.0.2.1")
+
+	s.rewriteUpdate(u)
+	checkPath(t, ats, attrs.ATTR_ASPATH, 65101, as_trans, 65003)
+	checkPath(t, ats, attrs.ATTR_AS4PATH, 65101, 4200000002, 65003)
+
+	if ag.ASN != as_trans {
+		t.Errorf("AGGREGATOR: got %d, want AS_TRANS", ag.ASN)
+	}
+	ag4, ok := ats.Get(attrs.ATTR_AS4AGGREGATOR).(*attrs.Aggregator)
+	if !ok || ag4 == nil || ag4.ASN != 4200000002 || ag4.Addr != ag.Addr {
+		t.Errorf("AS4_AGGREGATOR: got %v", ag4)
+	}
+}
+
+func TestAsnRewriteAsTransPartial(t *testing.T) {
+	s := testAsnRewrite(t, false)
+	u := &msg.Update{}
+	ats := &u.Attrs
+
+	// AS4_PATH covers only the last two hops
+	testPath(ats, attrs.ATTR_ASPATH, 65002, 65010, as_trans)
+	testPath(ats, attrs.ATTR_AS4PATH, 65010, 4200000099)
+
+	s.rewriteUpdate(u)
+	checkPath(t, ats, attrs.ATTR_ASPATH, as_trans, 65010, as_trans)
+	checkPath(t, ats, attrs.ATTR_AS4PATH, 4200000002, 65010, 4200000099)
+
+	// 2-byte result: no AS_TRANS needed, AS4_PATH left as-is
+	u = &msg.Update{}
+	ats = &u.Attrs
+	testPath(ats, attrs.ATTR_ASPATH, 65001, 65010, as_trans)
+	testPath(ats, attrs.ATTR_AS4PATH, 65010, 4200000099)
+
+	s.rewriteUpdate(u)
+	checkPath(t, ats, attrs.ATTR_ASPATH, 65101, 65010, as_trans)
+	checkPath(t, ats, attrs.ATTR_AS4PATH, 65010, 4200000099)
+}
+
+func TestAsnRewriteOpen(t *testing.T) {
+	s := testAsnRewrite(t, true)
+
+	// 4-byte ASN in the AS4 capability
+	o := &msg.Open{ASN: 65002}
+	o.Caps.Use(caps.CAP_AS4).(*caps.AS4).ASN = 65002
+	if !s.rewriteOpen(o) {
+		t.Fatal("rewriteOpen() reported no change")
+	}
+	if as4 := o.Caps.Get(caps.CAP_AS4).(*caps.AS4); as4.ASN != 4200000002 || o.ASN != as_trans {
+		t.Errorf("got AS4 %d, ASN %d, want 4200000002 and AS_TRANS", as4.ASN, o.ASN)
+	}
+
+	// 2-byte ASN only
+	o = &msg.Open{ASN: 65001}
+	if !s.rewriteOpen(o) || o.ASN != 65101 {
+		t.Errorf("got ASN %d, want 65101", o.ASN)
+	}
+
+	// 4-byte new ASN does not fit without the AS4 capability
+	o = &msg.Open{ASN: 65002}
+	if s.rewriteOpen(o) || o.ASN != 65002 {
+		t.Errorf("got ASN %d, want 65002", o.ASN)
+	}
+}
@@ -0,0 +1,355 @@
+package stages
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bgpfix/bgpfix/attrs"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/bgpfix/bgpipe/core"
+)
+
+var ErrAssert = errors.New("assertion failed")
+
+// assert_step is a single step of the --expect sequence
+type assert_step struct {
+	class    string // message class, eg. OPEN or EOR
+	min, max int    // number of matching messages
+}
+
+func (st *assert_step) String() string {
+	switch {
+	case st.min == st.max:
+		return fmt.Sprintf("%s*%d", st.class, st.min)
+	case st.max == math.MaxInt:
+		return fmt.Sprintf("%s*%d-", st.class, st.min)
+	default:
+		return fmt.Sprintf("%s*%d-%d", st.class, st.min, st.max)
+	}
+}
+
+// assert_range is a --count requirement
+type assert_range struct {
+	min, max int
+}
+
+type Assert struct {
+	*core.StageBase
+
+	opt_expect []assert_step           // --expect
+	opt_count  map[string]assert_range // --count
+	opt_never  map[string]bool         // --never (message classes)
+	opt_tags   map[string]string       // --never (tags)
+	classes    map[string]bool         // classes in --expect
+
+	mu       sync.Mutex     // guards below
+	step     int            // current step in opt_expect
+	seen     int            // number of messages matched in current step
+	count    map[string]int // number of messages per class
+	failed   bool           // already failed?
+	finished bool           // end of the stream checked?
+
+	fail chan error // assertion failure
+}
+
+func NewAssert(parent *core.StageBase) core.Stage {
+	var (
+		s = &Assert{StageBase: parent}
+		o = &s.Options
+		f = o.Flags
+	)
+
+	o.Descr = "check the stream against expectations, fail the pipe if violated"
+	o.Bidir = true
+
+	o.Events = map[string]string{
+		"fail": "assertion failed",
+	}
+
+	f.StringSlice("expect", nil, "expect given sequence of message classes, eg. OPEN,KEEPALIVE,UPDATE+,EOR")
+	f.StringSlice("count", nil, "expect given number of messages, eg. UPDATE=10 or UPDATE=1-5 (checked on stop)")
+	f.StringSlice("never", nil, "fail on given message class or tag, eg. NOTIFY or rpki/status=INVALID")
+
+	s.count = make(map[string]int)
+	s.fail = make(chan error, 1)
+	return s
+}
+
+func (s *Assert) Attach() error {
+	k := s.K
+
+	// --expect
+	s.classes = make(map[string]bool)
+	for _, v := range k.Strings("expect") {
+		st, err := assert_parse_step(v)
+		if err != nil {
+			return fmt.Errorf("--expect %s: %w", v, err)
+		}
+		s.opt_expect = append(s.opt_expect, st)
+		s.classes[st.class] = true
+	}
+
+	// --count
+	s.opt_count = make(map[string]assert_range)
+	for _, v := range k.Strings("count") {
+		class, rng, ok := strings.Cut(v, "=")
+		if !ok {
+			return fmt.Errorf("--count %s: need CLASS=N or CLASS=MIN-MAX", v)
+		}
+		class, err := assert_class(class)
+		if err != nil {
+			return fmt.Errorf("--count %s: %w", v, err)
+		}
+		min, max, err := assert_parse_range(rng)
+		if err != nil {
+			return fmt.Errorf("--count %s: %w", v, err)
+		}
+		s.opt_count[class] = assert_range{min, max}
+	}
+
+	// --never
+	s.opt_never = make(map[string]bool)
+	s.opt_tags = make(map[string]string)
+	for _, v := range k.Strings("never") {
+		if key, val, ok := strings.Cut(v, "="); ok {
+			if len(key) == 0 {
+				return fmt.Errorf("--never %s: empty tag name", v)
+			}
+			s.opt_tags[key] = val
+		} else if class, err := assert_class(v); err != nil {
+			return fmt.Errorf("--never %s: %w", v, err)
+		} else {
+			s.opt_never[class] = true
+		}
+	}
+
+	if len(s.opt_expect) == 0 && len(s.opt_count) == 0 && len(s.opt_never) == 0 && len(s.opt_tags) == 0 {
+		return fmt.Errorf("nothing to check: need --expect, --count, or --never")
+	}
+
+	s.P.OnMsg(s.onMsg, s.Dir)
+	return nil
+}
+
+func (s *Assert) Run() error {
+	select {
+	case err := <-s.fail:
+		return err
+	case <-s.Ctx.Done():
+		return s.finish()
+	}
+}
+
+// Stop checks the end of the stream
+func (s *Assert) Stop() error {
+	return s.finish()
+}
+
+// finish checks the end of the stream, once.
+// Returns the assertion failure, if any.
+func (s *Assert) finish() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failed || s.finished {
+		return nil
+	}
+	s.finished = true
+
+	// rest of the sequence
+	for i := s.step; i < len(s.opt_expect); i++ {
+		st := &s.opt_expect[i]
+		seen := 0
+		if i == s.step {
+			seen = s.seen
+		}
+		if seen < st.min {
+			return s.failf("stream ended at step %d: expected %s, got %d", i+1, st, seen)
+		}
+	}
+
+	// counters
+	for class, rng := range s.opt_count {
+		if n := s.count[class]; n < rng.min || n > rng.max {
+			return s.failf("expected %s count %s, got %d", class, assert_range_str(rng), n)
+		}
+	}
+
+	s.Info().Msg("all assertions passed")
+	return nil
+}
+
+func (s *Assert) onMsg(m *msg.Msg) bool {
+	class := assert_msg_class(m)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failed {
+		return true
+	}
+	s.count[class]++
+
+	// invariants
+	if s.opt_never[class] {
+		s.failf("unexpected %s message", class)
+		return true
+	}
+	if len(s.opt_tags) > 0 && pipe.HasTags(m) {
+		tags := pipe.MsgTags(m)
+		for key, val := range s.opt_tags {
+			if v, ok := tags[key]; ok && v == val {
+				s.failf("%s message tagged %s=%s", class, key, val)
+				return true
+			}
+		}
+	}
+
+	// sequence
+	if s.classes[class] {
+		s.expect(class)
+	}
+
+	return true // keep the message
+}
+
+// expect moves the --expect sequence forward for a message of given class.
+// Matches greedily, ie. a step takes as many messages as it can before moving on.
+// Must be called with s.mu locked.
+func (s *Assert) expect(class string) {
+	for s.step < len(s.opt_expect) {
+		st := &s.opt_expect[s.step]
+		if st.class == class && s.seen < st.max {
+			s.seen++
+			return
+		}
+		if s.seen < st.min {
+			s.failf("step %d: expected %s, got %s after %d", s.step+1, st, class, s.seen)
+			return
+		}
+		s.step++
+		s.seen = 0
+	}
+	s.failf("unexpected %s message after the expected sequence", class)
+}
+
+// failf reports and returns an assertion failure. Must be called with s.mu locked.
+func (s *Assert) failf(format string, args ...any) error {
+	s.failed = true
+	why := fmt.Sprintf(format, args...)
+	s.Error().Msg(why)
+	s.Event("fail", why)
+	err := fmt.Errorf("%w: %s", ErrAssert, why)
+	select {
+	case s.fail <- err:
+	default:
+	}
+	return err
+}
+
+// Counters implements core.StageCounters
+func (s *Assert) Counters() map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make(map[string]any, len(s.count)+2)
+	for class, n := range s.count {
+		res[class] = n
+	}
+	res["step"] = s.step
+	res["failed"] = s.failed
+	return res
+}
+
+// assert_msg_class returns the class of message m: its type, or EOR for End-of-RIB
+func assert_msg_class(m *msg.Msg) string {
+	if m.Type == msg.UPDATE && assert_eor(&m.Update) {
+		return "EOR"
+	}
+	return m.Type.String()
+}
+
+// assert_eor returns true iff u is an End-of-RIB marker (RFC 4724)
+func assert_eor(u *msg.Update) bool {
+	if u.HasReach() || u.HasUnreach() {
+		return false
+	}
+	switch u.Attrs.Len() {
+	case 0:
+		return true // IPv4 unicast
+	case 1:
+		return u.Attrs.Has(attrs.ATTR_MP_UNREACH) // other AFI/SAFI
+	default:
+		return false
+	}
+}
+
+// assert_class parses message class v
+func assert_class(v string) (string, error) {
+	v = strings.ToUpper(v)
+	if v == "EOR" {
+		return v, nil
+	}
+	typ, err := msg.TypeString(v)
+	if err != nil {
+		return "", fmt.Errorf("invalid message class")
+	}
+	return typ.String(), nil
+}
+
+// assert_parse_step parses --expect step v: CLASS, CLASS?, CLASS+, CLASS*,
+// or CLASS*N, CLASS*MIN-MAX, CLASS*MIN-
+func assert_parse_step(v string) (st assert_step, err error) {
+	class := v
+	st.min, st.max = 1, 1
+	switch {
+	case strings.HasSuffix(v, "?"):
+		class, st.min = v[:len(v)-1], 0
+	case strings.HasSuffix(v, "+"):
+		class, st.max = v[:len(v)-1], math.MaxInt
+	case strings.HasSuffix(v, "*"):
+		class, st.min, st.max = v[:len(v)-1], 0, math.MaxInt
+	default:
+		if c, rng, ok := strings.Cut(v, "*"); ok {
+			class = c
+			if st.min, st.max, err = assert_parse_range(rng); err != nil {
+				return st, err
+			}
+		}
+	}
+	st.class, err = assert_class(class)
+	return st, err
+}
+
+// assert_parse_range parses N, MIN-MAX, or MIN-
+func assert_parse_range(v string) (min, max int, err error) {
+	a, b, isrange := strings.Cut(v, "-")
+	if min, err = strconv.Atoi(a); err != nil || min < 0 {
+		return 0, 0, fmt.Errorf("invalid number: %s", a)
+	}
+	switch {
+	case !isrange:
+		max = min
+	case len(b) == 0:
+		max = math.MaxInt
+	default:
+		if max, err = strconv.Atoi(b); err != nil || max < min {
+			return 0, 0, fmt.Errorf("invalid range: %s", v)
+		}
+	}
+	return min, max, nil
+}
+
+// assert_range_str returns rng as text
+func assert_range_str(rng assert_range) string {
+	switch {
+	case rng.min == rng.max:
+		return strconv.Itoa(rng.min)
+	case rng.max == math.MaxInt:
+		return fmt.Sprintf("%d-", rng.min)
+	default:
+		return fmt.Sprintf("%d-%d", rng.min, rng.max)
+	}
+}
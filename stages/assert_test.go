@@ -0,0 +1,150 @@
+package stages
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/bgpfix/bgpfix/msg"
+)
+
+func testAssert(t *testing.T, args ...string) *Assert {
+	t.Helper()
+	sb := testStage(t, "assert", args...)
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatal(err)
+	}
+	return sb.Stage.(*Assert)
+}
+
+// testAssertFeed sends messages of given classes to s
+func testAssertFeed(s *Assert, classes ...string) {
+	for _, class := range classes {
+		var m *msg.Msg
+		switch class {
+		case "EOR":
+			m = msg.NewMsg().Use(msg.UPDATE)
+		case "UPDATE":
+			m = testUpdate(65001, []string{"192.0.2.0/24"}, nil)
+		default:
+			typ, _ := msg.TypeString(class)
+			m = msg.NewMsg().Use(typ)
+		}
+		s.onMsg(m)
+	}
+}
+
+func TestAssertParseStep(t *testing.T) {
+	tests := []struct {
+		v        string
+		class    string
+		min, max int
+		err      bool
+	}{
+		{"OPEN", "OPEN", 1, 1, false},
+		{"keepalive?", "KEEPALIVE", 0, 1, false},
+		{"UPDATE+", "UPDATE", 1, math.MaxInt, false},
+		{"UPDATE*", "UPDATE", 0, math.MaxInt, false},
+		{"UPDATE*3", "UPDATE", 3, 3, false},
+		{"UPDATE*2-5", "UPDATE", 2, 5, false},
+		{"UPDATE*2-", "UPDATE", 2, math.MaxInt, false},
+		{"eor", "EOR", 1, 1, false},
+		{"UPDATE*5-2", "", 0, 0, true},
+		{"UPDATE*-1", "", 0, 0, true},
+		{"BOGUS", "", 0, 0, true},
+	}
+	for _, tt := range tests {
+		st, err := assert_parse_step(tt.v)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: no error", tt.v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.v, err)
+		} else if st.class != tt.class || st.min != tt.min || st.max != tt.max {
+			t.Errorf("%s: got %s %d-%d, want %s %d-%d", tt.v, st.class, st.min, st.max, tt.class, tt.min, tt.max)
+		}
+	}
+}
+
+func TestAssertExpect(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		feed []string
+		fail bool
+	}{
+		{"pass", []string{"--expect", "OPEN,KEEPALIVE?,UPDATE+,EOR"},
+			[]string{"OPEN", "KEEPALIVE", "UPDATE", "UPDATE", "EOR"}, false},
+		{"pass optional", []string{"--expect", "OPEN,KEEPALIVE?,UPDATE+,EOR"},
+			[]string{"OPEN", "UPDATE", "EOR"}, false},
+		{"wrong order", []string{"--expect", "OPEN,UPDATE+,EOR"},
+			[]string{"UPDATE", "OPEN", "EOR"}, true},
+		{"too many", []string{"--expect", "OPEN,UPDATE*2,EOR"},
+			[]string{"OPEN", "UPDATE", "UPDATE", "UPDATE", "EOR"}, true},
+		{"after sequence", []string{"--expect", "OPEN"},
+			[]string{"OPEN", "OPEN"}, true},
+		{"ended early", []string{"--expect", "OPEN,UPDATE+,EOR"},
+			[]string{"OPEN", "UPDATE"}, true},
+		{"count pass", []string{"--count", "UPDATE=2-3"},
+			[]string{"OPEN", "UPDATE", "UPDATE", "NOTIFY"}, false},
+		{"count fail", []string{"--count", "UPDATE=3"},
+			[]string{"UPDATE", "UPDATE"}, true},
+		{"never pass", []string{"--never", "NOTIFY"},
+			[]string{"OPEN", "UPDATE"}, false},
+		{"never fail", []string{"--never", "NOTIFY"},
+			[]string{"OPEN", "NOTIFY"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testAssert(t, tt.args...)
+			testAssertFeed(s, tt.feed...)
+			err := s.finish()
+			if s.failed != tt.fail {
+				t.Errorf("failed: got %v, want %v", s.failed, tt.fail)
+			}
+
+			// fails the stage?
+			select {
+			case err2 := <-s.fail:
+				if !tt.fail {
+					t.Errorf("unexpected failure: %v", err2)
+				} else if !errors.Is(err2, ErrAssert) {
+					t.Errorf("got %v, want ErrAssert", err2)
+				}
+			default:
+				if tt.fail {
+					t.Error("no failure reported")
+				}
+			}
+			if err != nil && !tt.fail {
+				t.Errorf("finish: %v", err)
+			}
+		})
+	}
+}
+
+func TestAssertRunCancel(t *testing.T) {
+	// the end of the stream is checked when the stage context ends
+	s := testAssert(t, "--expect", "OPEN,UPDATE+")
+	testAssertFeed(s, "OPEN")
+	s.Cancel(nil)
+	if err := s.Run(); !errors.Is(err, ErrAssert) {
+		t.Errorf("Run: got %v, want ErrAssert", err)
+	}
+
+	// checked only once
+	if err := s.Stop(); err != nil {
+		t.Errorf("Stop: got %v, want nil", err)
+	}
+
+	// pass
+	s = testAssert(t, "--expect", "OPEN,UPDATE+")
+	testAssertFeed(s, "OPEN", "UPDATE")
+	s.Cancel(nil)
+	if err := s.Run(); err != nil {
+		t.Errorf("Run: got %v, want nil", err)
+	}
+}
@@ -0,0 +1,292 @@
+package stages
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/bgpfix/bgpfix/attrs"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/nlri"
+	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/bgpfix/bgpipe/core"
+)
+
+// bestpath tie-breakers, in the order of the BGP decision process
+var bestpathCriteria = []string{"localpref", "aspath", "origin", "med"}
+
+type Bestpath struct {
+	*core.StageBase
+	in *pipe.Input
+
+	opt_tag      string   // --source-tag
+	opt_tiebreak []string // --tiebreak
+
+	mu     sync.Mutex             // guards rib
+	rib    map[nlri.NLRI]*bestRib // prefix -> candidate paths
+	output chan *msg.Msg          // messages to inject
+}
+
+// bestRib holds the candidate paths for a prefix
+type bestRib struct {
+	paths map[string]*bestPath // source -> path
+	best  *bestPath            // currently selected best path
+}
+
+// bestPath is a candidate path for a prefix
+type bestPath struct {
+	source    string // where the path came from
+	localpref uint32 // LOCAL_PREF (100 if missing)
+	pathlen   int    // AS_PATH length
+	origin    byte   // ORIGIN
+	med       uint32 // MED (0 if missing)
+	neighbor  uint32 // first ASN in AS_PATH
+	mp        bool   // announced in MP_REACH?
+	json      []byte // the UPDATE in JSON, shared by all prefixes in it
+}
+
+func NewBestpath(parent *core.StageBase) core.Stage {
+	var (
+		s = &Bestpath{StageBase: parent}
+		o = &s.Options
+		f = o.Flags
+	)
+
+	o.Descr = "select best path per prefix across merged feeds"
+	o.IsProducer = true
+
+	o.Events = map[string]string{
+		"change": "selected best path for a prefix changed",
+	}
+
+	f.String("source-tag", "SOURCE", "message tag that identifies the source feed")
+	f.StringSlice("tiebreak", bestpathCriteria, "decision criteria to use, in order")
+
+	s.rib = make(map[nlri.NLRI]*bestRib)
+	s.output = make(chan *msg.Msg, 100)
+	return s
+}
+
+func (s *Bestpath) Attach() error {
+	k := s.K
+
+	s.opt_tag = k.String("source-tag")
+	for _, v := range k.Strings("tiebreak") {
+		v = strings.ToLower(v)
+		if !slices.Contains(bestpathCriteria, v) {
+			return fmt.Errorf("--tiebreak %s: invalid criterion, need one of %s",
+				v, strings.Join(bestpathCriteria, ","))
+		}
+		s.opt_tiebreak = append(s.opt_tiebreak, v)
+	}
+
+	s.P.OnMsg(s.onUpdate, s.Dir, msg.UPDATE)
+	s.in = s.P.AddInput(s.Dir)
+	return nil
+}
+
+func (s *Bestpath) Run() error {
+	for m := range s.output {
+		if err := s.in.WriteMsg(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Bestpath) Stop() error {
+	close_safe(s.output)
+	return nil
+}
+
+// onUpdate updates the candidate paths and emits UPDATEs for prefixes
+// with a new best path. The original message is dropped.
+func (s *Bestpath) onUpdate(m *msg.Msg) bool {
+	u := &m.Update
+
+	// where does it come from?
+	var source string
+	if pipe.HasTags(m) {
+		source = pipe.MsgTags(m)[s.opt_tag]
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// withdrawals
+	for _, p := range u.GetUnreach(nil) {
+		s.update(p, source, nil)
+	}
+
+	// announcements
+	if !u.HasReach() {
+		return false
+	}
+	path := s.newPath(m, source)
+	for _, p := range u.Reach {
+		s.update(p, source, path)
+	}
+	if mp := u.MP(attrs.ATTR_MP_REACH).Prefixes(); mp != nil {
+		mpath := *path
+		mpath.mp = true
+		for _, p := range mp.Prefixes {
+			s.update(p, source, &mpath)
+		}
+	}
+
+	return false
+}
+
+// newPath returns a new candidate path from UPDATE m received from source
+func (s *Bestpath) newPath(m *msg.Msg, source string) *bestPath {
+	u := &m.Update
+	bp := &bestPath{
+		source:    source,
+		localpref: 100,
+		json:      slices.Clone(m.GetJSON()),
+	}
+
+	if ap := u.AsPath(); ap != nil {
+		bp.pathlen = ap.Len()
+		if len(ap.Segments) > 0 && len(ap.Segments[0].List) > 0 {
+			bp.neighbor = ap.Segments[0].List[0]
+		}
+	}
+	if a, ok := u.Attrs.Get(attrs.ATTR_LOCALPREF).(*attrs.U32); ok {
+		bp.localpref = a.Val
+	}
+	if a, ok := u.Attrs.Get(attrs.ATTR_MED).(*attrs.U32); ok {
+		bp.med = a.Val
+	}
+	if a, ok := u.Attrs.Get(attrs.ATTR_ORIGIN).(*attrs.Origin); ok {
+		bp.origin = a.Origin
+	}
+
+	return bp
+}
+
+// update sets the path from source for prefix p (or removes it if path is nil),
+// and emits the new best path if it changed. Must be called with s.mu locked.
+func (s *Bestpath) update(p nlri.NLRI, source string, path *bestPath) {
+	rib := s.rib[p]
+	if rib == nil {
+		if path == nil {
+			return // nothing to withdraw
+		}
+		rib = &bestRib{paths: make(map[string]*bestPath)}
+		s.rib[p] = rib
+	}
+
+	// update the candidates
+	if path != nil {
+		rib.paths[source] = path
+	} else {
+		delete(rib.paths, source)
+	}
+
+	// any change?
+	best := s.selectBest(rib)
+	old := rib.best
+	if best == old {
+		return
+	}
+	rib.best = best
+	if best == nil {
+		delete(s.rib, p)
+	}
+
+	// report and emit
+	var oldsrc, newsrc string
+	if old != nil {
+		oldsrc = old.source
+	}
+	if best != nil {
+		newsrc = best.source
+	}
+	s.Event("change", p.String(), oldsrc, newsrc)
+	s.emit(p, best)
+}
+
+// selectBest returns the best candidate path in rib, or nil if none.
+// MED makes better() non-transitive, so it first selects the best path
+// per neighbor AS, then the best among these, iterating in source order.
+func (s *Bestpath) selectBest(rib *bestRib) *bestPath {
+	sources := make([]string, 0, len(rib.paths))
+	for source := range rib.paths {
+		sources = append(sources, source)
+	}
+	slices.Sort(sources)
+
+	// best per neighbor AS
+	var groups []*bestPath
+	for _, source := range sources {
+		cand := rib.paths[source]
+		i := slices.IndexFunc(groups, func(bp *bestPath) bool {
+			return bp.neighbor == cand.neighbor
+		})
+		if i < 0 {
+			groups = append(groups, cand)
+		} else if s.better(cand, groups[i]) {
+			groups[i] = cand
+		}
+	}
+
+	// best overall (MED does not apply)
+	var best *bestPath
+	for _, cand := range groups {
+		if best == nil || s.better(cand, best) {
+			best = cand
+		}
+	}
+	return best
+}
+
+// better returns true iff path a is better than path b
+func (s *Bestpath) better(a, b *bestPath) bool {
+	for _, crit := range s.opt_tiebreak {
+		switch crit {
+		case "localpref":
+			if a.localpref != b.localpref {
+				return a.localpref > b.localpref
+			}
+		case "aspath":
+			if a.pathlen != b.pathlen {
+				return a.pathlen < b.pathlen
+			}
+		case "origin":
+			if a.origin != b.origin {
+				return a.origin < b.origin
+			}
+		case "med":
+			// compare only between paths from the same neighbor AS
+			if a.neighbor == b.neighbor && a.med != b.med {
+				return a.med < b.med
+			}
+		}
+	}
+
+	// deterministic final tie-breaker
+	return a.source < b.source
+}
+
+// emit sends an UPDATE announcing path for prefix p, or withdrawing p if path is nil
+func (s *Bestpath) emit(p nlri.NLRI, path *bestPath) {
+	m := s.P.GetMsg()
+
+	var err error
+	if path == nil {
+		err = update_withdraw(m, p)
+	} else {
+		err = update_single(m, p, path.json, path.mp)
+	}
+	if err != nil {
+		s.P.PutMsg(m)
+		s.Warn().Err(err).Stringer("prefix", p).Msg("could not build UPDATE")
+		return
+	}
+
+	if !send_safe(s.output, m) {
+		s.P.PutMsg(m)
+	}
+}
@@ -0,0 +1,91 @@
+package stages
+
+import (
+	"testing"
+)
+
+func testBestpath(t *testing.T, args ...string) *Bestpath {
+	t.Helper()
+	sb := testStage(t, "bestpath", args...)
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatal(err)
+	}
+	return sb.Stage.(*Bestpath)
+}
+
+func TestBestpathBetter(t *testing.T) {
+	s := testBestpath(t)
+	base := bestPath{source: "b", localpref: 100, pathlen: 3, origin: 0, med: 10, neighbor: 65001}
+
+	tests := []struct {
+		name string
+		edit func(bp *bestPath)
+		want bool // edited path better than base?
+	}{
+		{"higher localpref", func(bp *bestPath) { bp.localpref = 200; bp.pathlen = 9 }, true},
+		{"lower localpref", func(bp *bestPath) { bp.localpref = 50; bp.pathlen = 1 }, false},
+		{"shorter aspath", func(bp *bestPath) { bp.pathlen = 2; bp.origin = 2 }, true},
+		{"longer aspath", func(bp *bestPath) { bp.pathlen = 4 }, false},
+		{"lower origin", func(bp *bestPath) { bp.source = "z"; bp.origin = 0; bp.med = 99 }, false},
+		{"higher origin", func(bp *bestPath) { bp.origin = 1; bp.med = 0 }, false},
+		{"lower med", func(bp *bestPath) { bp.source = "z"; bp.med = 5 }, true},
+		{"lower med, other AS", func(bp *bestPath) { bp.source = "z"; bp.med = 5; bp.neighbor = 65002 }, false},
+		{"source order", func(bp *bestPath) { bp.source = "a" }, true},
+	}
+	for _, tt := range tests {
+		bp := base
+		tt.edit(&bp)
+		if got := s.better(&bp, &base); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBestpathTiebreak(t *testing.T) {
+	s := testBestpath(t, "--tiebreak", "med,aspath")
+	a := &bestPath{source: "a", pathlen: 2, med: 20, neighbor: 65001}
+	b := &bestPath{source: "b", pathlen: 1, med: 10, neighbor: 65001}
+	if !s.better(b, a) {
+		t.Error("lower MED not preferred")
+	}
+	b.med = 20
+	if !s.better(b, a) {
+		t.Error("shorter AS_PATH not preferred")
+	}
+
+	sb := testStage(t, "bestpath", "--tiebreak", "weight")
+	if err := sb.Stage.Attach(); err == nil {
+		t.Error("invalid --tiebreak: no error")
+	}
+}
+
+func TestBestpathSelect(t *testing.T) {
+	// a > b (source), b > c (source), c > a (MED): better() is not transitive
+	a := &bestPath{source: "a", med: 20, neighbor: 65001}
+	b := &bestPath{source: "b", med: 0, neighbor: 65002}
+	c := &bestPath{source: "c", med: 10, neighbor: 65001}
+
+	s := testBestpath(t)
+	if !s.better(a, b) || !s.better(b, c) || !s.better(c, a) {
+		t.Fatal("not a cycle")
+	}
+
+	// c beats a within AS65001, then b beats c
+	for i := 0; i < 20; i++ {
+		rib := &bestRib{paths: map[string]*bestPath{"a": a, "b": b, "c": c}}
+		if got := s.selectBest(rib); got != b {
+			t.Fatalf("got %s, want b", got.source)
+		}
+	}
+
+	// no b: c wins on MED
+	rib := &bestRib{paths: map[string]*bestPath{"a": a, "c": c}}
+	if got := s.selectBest(rib); got != c {
+		t.Errorf("got %s, want c", got.source)
+	}
+
+	// no candidates
+	if got := s.selectBest(&bestRib{paths: map[string]*bestPath{}}); got != nil {
+		t.Errorf("got %s, want nil", got.source)
+	}
+}
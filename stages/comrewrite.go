@@ -0,0 +1,179 @@
+package stages
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/bgpfix/bgpfix/attrs"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpipe/core"
+)
+
+type ComRewrite struct {
+	*core.StageBase
+
+	std   []comRule // rules for standard communities
+	large []comRule // rules for large communities
+}
+
+// comRule rewrites communities matching from into to
+type comRule struct {
+	from []comField
+	to   []comField
+}
+
+// comField is a community field: a value or a wildcard
+type comField struct {
+	any bool   // wildcard?
+	val uint32 // value if not a wildcard
+}
+
+func NewComRewrite(parent *core.StageBase) core.Stage {
+	var (
+		s = &ComRewrite{StageBase: parent}
+		o = &s.Options
+		f = o.Flags
+	)
+
+	o.Descr = "rewrite community values by pattern"
+	o.Bidir = true
+
+	f.StringSlice("rewrite-com", nil, "rewrite matching communities (format: OLD=NEW, eg. 65000:*=65001:*)")
+
+	return s
+}
+
+func (s *ComRewrite) Attach() error {
+	for _, v := range s.K.Strings("rewrite-com") {
+		before, after, found := strings.Cut(v, "=")
+		if !found {
+			return fmt.Errorf("--rewrite-com %s: invalid format, need OLD=NEW", v)
+		}
+		from, err := parse_com(before)
+		if err != nil {
+			return fmt.Errorf("--rewrite-com %s: %w", v, err)
+		}
+		to, err := parse_com(after)
+		if err != nil {
+			return fmt.Errorf("--rewrite-com %s: %w", v, err)
+		}
+
+		switch {
+		case len(from) != len(to):
+			return fmt.Errorf("--rewrite-com %s: can't rewrite between standard and large communities", v)
+		case len(from) == 2:
+			s.std = append(s.std, comRule{from, to})
+		default:
+			s.large = append(s.large, comRule{from, to})
+		}
+	}
+	if len(s.std) == 0 && len(s.large) == 0 {
+		return fmt.Errorf("nothing to do: no --rewrite-com given")
+	}
+
+	s.P.OnMsg(s.onUpdate, s.Dir, msg.UPDATE)
+	return nil
+}
+
+// parse_com parses a standard (ASN:VALUE) or large (ASN:VALUE1:VALUE2) community
+// pattern, where each field is a number or *
+func parse_com(v string) ([]comField, error) {
+	parts := strings.Split(v, ":")
+	if len(parts) != 2 && len(parts) != 3 {
+		return nil, fmt.Errorf("%s: need ASN:VALUE or ASN:VALUE1:VALUE2", v)
+	}
+
+	limit := uint64(math.MaxUint32)
+	if len(parts) == 2 {
+		limit = math.MaxUint16
+	}
+
+	ret := make([]comField, len(parts))
+	for i, p := range parts {
+		if p == "*" {
+			ret[i].any = true
+			continue
+		}
+		val, err := strconv.ParseUint(p, 10, 32)
+		if err != nil || val > limit {
+			return nil, fmt.Errorf("%s: invalid field %s", v, p)
+		}
+		ret[i].val = uint32(val)
+	}
+	return ret, nil
+}
+
+// com_match returns true iff community vals matches pattern pat
+func com_match(pat []comField, vals ...uint32) bool {
+	if len(pat) != len(vals) {
+		return false
+	}
+	for i, f := range pat {
+		if !f.any && f.val != vals[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// rewrite applies the first rule matching community vals, in place.
+// Wildcards in the new value keep the original field. Returns true on change.
+func (s *ComRewrite) rewrite(rules []comRule, vals []uint32) bool {
+	for _, r := range rules {
+		if !com_match(r.from, vals...) {
+			continue
+		}
+
+		changed := false
+		for i, f := range r.to {
+			if !f.any && f.val != vals[i] {
+				vals[i] = f.val
+				changed = true
+			}
+		}
+		return changed
+	}
+	return false
+}
+
+func (s *ComRewrite) onUpdate(m *msg.Msg) bool {
+	if s.rewriteUpdate(&m.Update) {
+		m.Modified()
+	}
+	return true
+}
+
+// rewriteUpdate rewrites the communities of u, in place. Returns true on change.
+func (s *ComRewrite) rewriteUpdate(u *msg.Update) (changed bool) {
+	var (
+		ats  = &u.Attrs
+		vals = make([]uint32, 3)
+	)
+
+	// standard communities
+	if com, ok := ats.Get(attrs.ATTR_COMMUNITY).(*attrs.Community); ok && com != nil && len(s.std) > 0 {
+		for i := range com.ASN {
+			vals[0], vals[1] = uint32(com.ASN[i]), uint32(com.Value[i])
+			if s.rewrite(s.std, vals[:2]) {
+				com.ASN[i], com.Value[i] = uint16(vals[0]), uint16(vals[1])
+				changed = true
+			}
+		}
+	}
+
+	// large communities
+	if lc, ok := ats.Get(attrs.ATTR_LARGE_COMMUNITY).(*attrs.LargeCom); ok && lc != nil && len(s.large) > 0 {
+		for i := range lc.ASN {
+			vals[0], vals[1], vals[2] = lc.ASN[i], lc.Value1[i], lc.Value2[i]
+			if s.rewrite(s.large, vals) {
+				lc.ASN[i], lc.Value1[i], lc.Value2[i] = vals[0], vals[1], vals[2]
+				changed = true
+			}
+		}
+	}
+
+	// NB: extended communities are left as-is
+	return changed
+}
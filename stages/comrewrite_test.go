@@ -0,0 +1,101 @@
+package stages
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/bgpfix/bgpfix/attrs"
+)
+
+func testComRewrite(t *testing.T, rules ...string) *ComRewrite {
+	t.Helper()
+	var args []string
+	for _, r := range rules {
+		args = append(args, "--rewrite-com", r)
+	}
+	sb := testStage(t, "community-rewrite", args...)
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatal(err)
+	}
+	return sb.Stage.(*ComRewrite)
+}
+
+func TestComRewriteRules(t *testing.T) {
+	s := testComRewrite(t,
+		"65000:100=65001:200", // exact
+		"65000:*=65002:*",     // wildcard, keeps the value
+		"*:666=65535:666",     // wildcard ASN
+		"65010:1:*=65011:*:7", // large
+		"65020:*=65020:*",     // fires, changes nothing
+	)
+
+	tests := []struct {
+		name    string
+		large   bool
+		in      []uint32
+		out     []uint32
+		changed bool
+	}{
+		{"exact", false, []uint32{65000, 100}, []uint32{65001, 200}, true},
+		{"wildcard", false, []uint32{65000, 5}, []uint32{65002, 5}, true},
+		{"wildcard ASN", false, []uint32{64512, 666}, []uint32{65535, 666}, true},
+		{"first rule wins", false, []uint32{65000, 666}, []uint32{65002, 666}, true},
+		{"no match", false, []uint32{65001, 100}, []uint32{65001, 100}, false},
+		{"no-op rule", false, []uint32{65020, 1}, []uint32{65020, 1}, false},
+		{"large", true, []uint32{65010, 1, 2}, []uint32{65011, 1, 7}, true},
+		{"large no match", true, []uint32{65010, 2, 2}, []uint32{65010, 2, 2}, false},
+	}
+	for _, tt := range tests {
+		rules := s.std
+		if tt.large {
+			rules = s.large
+		}
+		vals := slices.Clone(tt.in)
+		if changed := s.rewrite(rules, vals); changed != tt.changed {
+			t.Errorf("%s: got changed %v, want %v", tt.name, changed, tt.changed)
+		}
+		if !slices.Equal(vals, tt.out) {
+			t.Errorf("%s: got %v, want %v", tt.name, vals, tt.out)
+		}
+	}
+}
+
+func TestComRewriteUpdate(t *testing.T) {
+	s := testComRewrite(t, "65000:*=65001:*", "65020:*=65020:*")
+	tests := []struct {
+		name    string
+		asn     []uint16
+		want    []uint16
+		changed bool
+	}{
+		{"rule fires", []uint16{65000, 65100}, []uint16{65001, 65100}, true},
+		{"no match", []uint16{65100, 65200}, []uint16{65100, 65200}, false},
+		{"no-op rule", []uint16{65020}, []uint16{65020}, false},
+	}
+	for _, tt := range tests {
+		m := testUpdate(65000, []string{"192.0.2.0/24"}, nil)
+		com := m.Update.Attrs.Use(attrs.ATTR_COMMUNITY).(*attrs.Community)
+		com.ASN = slices.Clone(tt.asn)
+		com.Value = make([]uint16, len(tt.asn))
+		if changed := s.rewriteUpdate(&m.Update); changed != tt.changed {
+			t.Errorf("%s: got edited %v, want %v", tt.name, changed, tt.changed)
+		}
+		if !slices.Equal(com.ASN, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, com.ASN, tt.want)
+		}
+	}
+
+	// no communities at all
+	if s.rewriteUpdate(&testUpdate(65000, []string{"192.0.2.0/24"}, nil).Update) {
+		t.Error("no communities: edited")
+	}
+}
+
+func TestComRewriteInvalid(t *testing.T) {
+	for _, v := range []string{"65000:1", "65000:1=65001:1:1", "65536:1=1:1", "a:1=1:1", "1:2:3:4=1:2:3:4"} {
+		sb := testStage(t, "community-rewrite", "--rewrite-com", v)
+		if err := sb.Stage.Attach(); err == nil {
+			t.Errorf("%s: no error", v)
+		}
+	}
+}
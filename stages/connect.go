@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"syscall"
 	"time"
 
 	"github.com/bgpfix/bgpfix/pipe"
@@ -15,8 +16,9 @@ type Connect struct {
 	*core.StageBase
 	in *pipe.Input
 
-	target string
-	conn   net.Conn
+	target  string
+	conn    net.Conn
+	control func(net, addr string, c syscall.RawConn) error // socket options
 }
 
 func NewConnect(parent *core.StageBase) core.Stage {
@@ -29,10 +31,13 @@ func NewConnect(parent *core.StageBase) core.Stage {
 	o.Descr = "connect to a BGP endpoint over TCP"
 	o.IsProducer = true
 	o.IsConsumer = true
+	o.IsSession = true
+	o.Secrets = []string{"md5"}
 
 	f.Duration("timeout", time.Minute, "connect timeout (0 means none)")
 	f.Duration("closed", time.Second, "half-closed timeout (0 means none)")
 	f.String("md5", "", "TCP MD5 password")
+	tcp_flags(f)
 	o.Args = []string{"addr"}
 
 	return s
@@ -56,6 +61,11 @@ func (s *Connect) Attach() error {
 		}
 	}
 
+	// socket options
+	if s.control, err = tcp_sockopts(s.K); err != nil {
+		return err
+	}
+
 	s.in = s.P.AddInput(s.Dir)
 	return nil
 }
@@ -64,7 +74,7 @@ func (s *Connect) Prepare() error {
 	ctx := s.Ctx
 
 	// add timeout?
-	if t := s.K.Duration("timeout"); t > 0 {
+	if t := dial_timeout(s.StageBase); t > 0 {
 		v, fn := context.WithTimeout(ctx, t)
 		defer fn()
 		ctx = v
@@ -72,13 +82,13 @@ func (s *Connect) Prepare() error {
 
 	// dialer
 	var dialer net.Dialer
-	dialer.Control = tcp_md5(s.K.String("md5"))
+	dialer.Control = s.control
 
 	// dial
 	s.Info().Msgf("dialing %s", s.target)
 	conn, err := dialer.DialContext(ctx, "tcp", s.target)
 	if err != nil {
-		return err
+		return dial_error(err)
 	}
 
 	// success
@@ -0,0 +1,317 @@
+package stages
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bgpfix/bgpfix/attrs"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/nlri"
+	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/bgpfix/bgpipe/core"
+	"github.com/puzpuzpuz/xsync/v3"
+)
+
+type Damp struct {
+	*core.StageBase
+	in *pipe.Input
+
+	penalty     float64       // penalty per flap
+	suppress    float64       // suppress threshold
+	reuse       float64       // reuse threshold
+	halflife    time.Duration // penalty half-life
+	maxsuppress time.Duration // max time to suppress a prefix
+	ceiling     float64       // max penalty
+
+	db         *xsync.MapOf[nlri.NLRI, *dampPrefix] // per-prefix state
+	suppressed atomic.Int64                         // number of suppressed prefixes
+	output     chan *msg.Msg                        // messages to inject
+}
+
+// dampPrefix holds the flap damping state of a prefix
+type dampPrefix struct {
+	sync.Mutex
+	dropped    bool      // removed from db?
+	penalty    float64   // penalty at updated
+	updated    time.Time // last penalty update
+	suppressed time.Time // when suppressed (or zero if not)
+	reachable  bool      // last seen as reachable?
+	mp         bool      // last announced in MP_REACH?
+	json       []byte    // last announcement in JSON
+}
+
+func newDampPrefix() *dampPrefix {
+	return &dampPrefix{}
+}
+
+func NewDamp(parent *core.StageBase) core.Stage {
+	var (
+		s = &Damp{StageBase: parent}
+		o = &s.Options
+		f = o.Flags
+	)
+
+	o.Descr = "suppress flapping prefixes (RFC 2439 route flap damping)"
+	o.IsProducer = true
+
+	o.Events = map[string]string{
+		"suppress": "prefix suppressed due to flapping",
+		"reuse":    "suppressed prefix released",
+	}
+
+	f.Float64("penalty", 1000, "penalty added on withdrawal (half on attribute change)")
+	f.Float64("suppress", 2000, "suppress prefix if penalty exceeds this value")
+	f.Float64("reuse", 750, "release suppressed prefix if penalty drops below this value")
+	f.Duration("half-life", 15*time.Minute, "time for the penalty to decay by half")
+	f.Duration("max-suppress", time.Hour, "max time to suppress a prefix")
+
+	s.db = xsync.NewMapOf[nlri.NLRI, *dampPrefix]()
+	s.output = make(chan *msg.Msg, 100)
+	return s
+}
+
+func (s *Damp) Attach() error {
+	k := s.K
+
+	s.penalty = k.Float64("penalty")
+	if s.penalty <= 0 {
+		return fmt.Errorf("--penalty must be positive")
+	}
+	s.suppress = k.Float64("suppress")
+	s.reuse = k.Float64("reuse")
+	if s.reuse <= 0 || s.reuse >= s.suppress {
+		return fmt.Errorf("--reuse must be positive and lower than --suppress")
+	}
+	s.halflife = k.Duration("half-life")
+	if s.halflife <= 0 {
+		return fmt.Errorf("--half-life must be positive")
+	}
+	s.maxsuppress = k.Duration("max-suppress")
+	if s.maxsuppress <= 0 {
+		return fmt.Errorf("--max-suppress must be positive")
+	}
+
+	// max penalty that still decays below reuse within max-suppress
+	s.ceiling = s.reuse * math.Exp2(s.maxsuppress.Seconds()/s.halflife.Seconds())
+
+	s.P.OnMsg(s.onMsg, s.Dir, msg.UPDATE)
+	s.in = s.P.AddInput(s.Dir)
+	return nil
+}
+
+// Counters implements core.StageCounters
+func (s *Damp) Counters() map[string]any {
+	return map[string]any{
+		"prefixes":   s.db.Size(),
+		"suppressed": s.suppressed.Load(),
+	}
+}
+
+func (s *Damp) Run() error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case m, ok := <-s.output:
+			if !ok {
+				return nil
+			}
+			if err := s.in.WriteMsg(m); err != nil {
+				return err
+			}
+		case now := <-ticker.C:
+			for _, m := range s.sweep(now) {
+				if err := s.in.WriteMsg(m); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func (s *Damp) Stop() error {
+	close_safe(s.output)
+	return nil
+}
+
+// load returns locked state of prefix p
+func (s *Damp) load(p nlri.NLRI) *dampPrefix {
+	for {
+		dp, _ := s.db.LoadOrCompute(p, newDampPrefix)
+		dp.Lock()
+		if !dp.dropped {
+			return dp
+		}
+		dp.Unlock()
+	}
+}
+
+// decay updates the penalty of dp to time now
+func (s *Damp) decay(dp *dampPrefix, now time.Time) {
+	if !dp.updated.IsZero() {
+		dt := now.Sub(dp.updated)
+		dp.penalty *= math.Exp2(-dt.Seconds() / s.halflife.Seconds())
+	}
+	dp.updated = now
+}
+
+// flap adds penalty to prefix p, and returns true iff it just got suppressed
+func (s *Damp) flap(dp *dampPrefix, p nlri.NLRI, now time.Time, penalty float64) bool {
+	s.decay(dp, now)
+	dp.penalty = min(dp.penalty+penalty, s.ceiling)
+
+	if dp.suppressed.IsZero() && dp.penalty >= s.suppress {
+		dp.suppressed = now
+		s.suppressed.Add(1)
+		s.Event("suppress", p.String(), dp.penalty)
+		return true
+	}
+	return false
+}
+
+func (s *Damp) onMsg(m *msg.Msg) bool {
+	var (
+		u       = &m.Update
+		now     = time.Now()
+		js      []byte      // m in JSON, if needed
+		unreach []nlri.NLRI // prefixes to withdraw downstream
+		before  int         // number of prefixes before
+		after   int         // number of prefixes after
+	)
+
+	// drops withdrawal of p iff p is already suppressed
+	dropUnreach := func(p nlri.NLRI) bool {
+		dp := s.load(p)
+		defer dp.Unlock()
+
+		was_suppressed := !dp.suppressed.IsZero()
+		if dp.reachable {
+			dp.reachable = false
+			s.flap(dp, p, now, s.penalty)
+		}
+		return was_suppressed
+	}
+
+	// drops announcement of p iff p is suppressed
+	dropReach := func(p nlri.NLRI, mp bool) bool {
+		dp := s.load(p)
+		defer dp.Unlock()
+
+		// attribute change?
+		was_suppressed := !dp.suppressed.IsZero()
+		if dp.reachable && s.flap(dp, p, now, s.penalty/2) {
+			unreach = append(unreach, p) // just got suppressed
+		}
+
+		dp.reachable = true
+		if was_suppressed || !dp.suppressed.IsZero() {
+			// remember for re-announcement on reuse
+			if js == nil {
+				js = slices.Clone(m.GetJSON())
+			}
+			dp.mp = mp
+			dp.json = js
+			return true
+		}
+
+		dp.json = nil
+		return false
+	}
+
+	// withdrawals in the non-MP IPv4 part
+	before += len(u.Unreach)
+	u.Unreach = slices.DeleteFunc(u.Unreach, dropUnreach)
+	after += len(u.Unreach)
+
+	// withdrawals in the MP part
+	if mp := u.MP(attrs.ATTR_MP_UNREACH).Prefixes(); mp != nil {
+		before += len(mp.Prefixes)
+		mp.Prefixes = slices.DeleteFunc(mp.Prefixes, dropUnreach)
+		after += len(mp.Prefixes)
+		if len(mp.Prefixes) == 0 {
+			u.Attrs.Drop(attrs.ATTR_MP_UNREACH)
+		}
+	}
+
+	// announcements in the non-MP IPv4 part
+	before += len(u.Reach)
+	u.Reach = slices.DeleteFunc(u.Reach, func(p nlri.NLRI) bool {
+		return dropReach(p, false)
+	})
+	after += len(u.Reach)
+
+	// announcements in the MP part
+	if mp := u.MP(attrs.ATTR_MP_REACH).Prefixes(); mp != nil {
+		before += len(mp.Prefixes)
+		mp.Prefixes = slices.DeleteFunc(mp.Prefixes, func(p nlri.NLRI) bool {
+			return dropReach(p, true)
+		})
+		after += len(mp.Prefixes)
+		if len(mp.Prefixes) == 0 {
+			u.Attrs.Drop(attrs.ATTR_MP_REACH)
+		}
+	}
+
+	// withdraw prefixes that just got suppressed on attribute change
+	if len(unreach) > 0 {
+		wm := s.P.GetMsg()
+		if err := update_withdraw(wm, unreach...); err != nil {
+			s.P.PutMsg(wm)
+			s.Warn().Err(err).Msg("could not build withdrawal")
+		} else if !send_safe(s.output, wm) {
+			s.P.PutMsg(wm)
+		}
+	}
+
+	// anything left?
+	if after != before {
+		m.Modified()
+		if after == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// sweep decays penalties at time now, releases suppressed prefixes, and forgets
+// prefixes with negligible penalty. Returns the re-announcements to inject.
+func (s *Damp) sweep(now time.Time) (out []*msg.Msg) {
+	s.db.Range(func(p nlri.NLRI, dp *dampPrefix) bool {
+		dp.Lock()
+		defer dp.Unlock()
+		s.decay(dp, now)
+
+		// release?
+		if !dp.suppressed.IsZero() && (dp.penalty < s.reuse || now.Sub(dp.suppressed) >= s.maxsuppress) {
+			dp.suppressed = time.Time{}
+			s.suppressed.Add(-1)
+			s.Event("reuse", p.String(), dp.penalty)
+
+			// re-announce?
+			if dp.reachable && dp.json != nil {
+				m := s.P.GetMsg()
+				if err := update_single(m, p, dp.json, dp.mp); err != nil {
+					s.P.PutMsg(m)
+					s.Warn().Err(err).Stringer("prefix", p).Msg("could not build UPDATE")
+				} else {
+					out = append(out, m)
+				}
+			}
+			dp.json = nil
+		}
+
+		// forget?
+		if !dp.reachable && dp.suppressed.IsZero() && dp.penalty < s.reuse/2 {
+			dp.dropped = true
+			s.db.Delete(p)
+		}
+
+		return true
+	})
+	return out
+}
@@ -0,0 +1,127 @@
+package stages
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func testDamp(t *testing.T, args ...string) *Damp {
+	t.Helper()
+	sb := testStage(t, "damp", args...)
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatal(err)
+	}
+	return sb.Stage.(*Damp)
+}
+
+func testNear(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+func TestDampPenalty(t *testing.T) {
+	s := testDamp(t) // penalty 1000, suppress 2000, reuse 750, half-life 15m, max-suppress 1h
+	if !testNear(s.ceiling, 12000) {
+		t.Fatalf("ceiling: got %f, want 12000", s.ceiling)
+	}
+
+	p := testPrefixes("192.0.2.0/24")[0]
+	dp := s.load(p)
+	defer dp.Unlock()
+
+	t0 := time.Now()
+	if s.flap(dp, p, t0, 1000) || !testNear(dp.penalty, 1000) {
+		t.Fatalf("1st flap: got penalty %f, suppressed %v", dp.penalty, !dp.suppressed.IsZero())
+	}
+
+	// decays by half every half-life
+	s.decay(dp, t0.Add(15*time.Minute))
+	if !testNear(dp.penalty, 500) {
+		t.Errorf("after 15m: got %f, want 500", dp.penalty)
+	}
+	s.decay(dp, t0.Add(30*time.Minute))
+	if !testNear(dp.penalty, 250) {
+		t.Errorf("after 30m: got %f, want 250", dp.penalty)
+	}
+
+	// suppressed at the threshold, once
+	t1 := t0.Add(30 * time.Minute)
+	if s.flap(dp, p, t1, 1000) {
+		t.Errorf("suppressed at %f", dp.penalty)
+	}
+	if !s.flap(dp, p, t1, 750) || !testNear(dp.penalty, 2000) {
+		t.Errorf("not suppressed at %f", dp.penalty)
+	}
+	if s.flap(dp, p, t1, 1000) {
+		t.Error("suppressed twice")
+	}
+	if got := s.suppressed.Load(); got != 1 {
+		t.Errorf("got %d suppressed, want 1", got)
+	}
+
+	// capped at the ceiling
+	s.flap(dp, p, t1, 1e9)
+	if !testNear(dp.penalty, s.ceiling) {
+		t.Errorf("got %f, want the ceiling %f", dp.penalty, s.ceiling)
+	}
+}
+
+func TestDampReuse(t *testing.T) {
+	s := testDamp(t)
+	t0 := time.Now()
+
+	// suppressed at 2000, reachable
+	p := testPrefixes("192.0.2.0/24")[0]
+	dp := s.load(p)
+	s.flap(dp, p, t0, 2000)
+	dp.reachable = true
+	dp.json = append([]byte{}, testUpdate(65001, []string{"192.0.2.0/24"}, nil).GetJSON()...)
+	dp.Unlock()
+
+	// 1000 after 15m: still suppressed
+	if out := s.sweep(t0.Add(15 * time.Minute)); len(out) != 0 || dp.suppressed.IsZero() {
+		t.Fatalf("released at %f", dp.penalty)
+	}
+
+	// 500 after 30m: reused and re-announced
+	if out := s.sweep(t0.Add(30 * time.Minute)); len(out) != 1 || !dp.suppressed.IsZero() {
+		t.Fatalf("not released at %f: %d re-announcements", dp.penalty, len(out))
+	}
+	if got := s.suppressed.Load(); got != 0 {
+		t.Errorf("got %d suppressed, want 0", got)
+	}
+
+	// reachable: never forgotten
+	s.sweep(t0.Add(24 * time.Hour))
+	if s.db.Size() != 1 {
+		t.Error("reachable prefix forgotten")
+	}
+}
+
+func TestDampMaxSuppress(t *testing.T) {
+	s := testDamp(t)
+	t0 := time.Now()
+
+	// at the ceiling, unreachable
+	p := testPrefixes("192.0.2.0/24")[0]
+	dp := s.load(p)
+	s.flap(dp, p, t0, 1e9)
+	dp.Unlock()
+
+	// still above reuse just before max-suppress
+	s.sweep(t0.Add(time.Hour - time.Second))
+	if dp.suppressed.IsZero() {
+		t.Fatalf("released early at %f", dp.penalty)
+	}
+
+	// released at max-suppress, not re-announced
+	if out := s.sweep(t0.Add(time.Hour)); len(out) != 0 || !dp.suppressed.IsZero() {
+		t.Fatalf("max-suppress: got %d re-announcements, suppressed %v", len(out), !dp.suppressed.IsZero())
+	}
+
+	// then forgotten below reuse/2
+	s.sweep(t0.Add(2 * time.Hour))
+	if s.db.Size() != 0 {
+		t.Error("unreachable prefix not forgotten")
+	}
+}
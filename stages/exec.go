@@ -6,7 +6,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
+	"strings"
 	"time"
 
 	"github.com/bgpfix/bgpipe/core"
@@ -37,10 +39,14 @@ func NewExec(parent *core.StageBase) core.Stage {
 	o.IsProducer = true
 	o.Bidir = true
 	o.Args = []string{"cmd"}
+	o.Secrets = []string{"env"}
 
 	f := o.Flags
 	f.Bool("keep-stdin", false, "keep running if stdin is closed")
 	f.Bool("keep-stdout", false, "keep running if stdout is closed")
+	f.String("dir", "", "run the command in given working directory")
+	f.StringSlice("env", nil, "set environment variable for the command (format: KEY=VALUE)")
+	f.Bool("env-clear", false, "do not inherit the bgpipe environment")
 
 	s.eio = extio.NewExtio(parent, 0)
 	return s
@@ -58,6 +64,25 @@ func (s *Exec) Attach() error {
 	// create cmd
 	var err error
 	s.cmd_exec = exec.CommandContext(s.Ctx, s.cmd_path, s.cmd_args...)
+	s.cmd_exec.Dir = k.String("dir")
+
+	// environment
+	env := k.Strings("env")
+	if len(env) > 0 || k.Bool("env-clear") {
+		if !k.Bool("env-clear") {
+			s.cmd_exec.Env = os.Environ()
+		} else {
+			s.cmd_exec.Env = []string{}
+		}
+		for _, v := range env {
+			key, val, found := strings.Cut(v, "=")
+			if !found || len(key) == 0 {
+				return fmt.Errorf("--env %s: invalid format, need KEY=VALUE", v)
+			}
+			s.cmd_exec.Env = append(s.cmd_exec.Env, key+"="+os.ExpandEnv(val))
+		}
+	}
+
 	s.cmd_in, err = s.cmd_exec.StdinPipe()
 	if err != nil {
 		return err
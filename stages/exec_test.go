@@ -0,0 +1,76 @@
+package stages
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testExec runs a shell script via the exec stage with args,
+// returning what the script printed on its stdout
+func testExec(t *testing.T, script string, args ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	sb := testStage(t, "exec", append(args, path)...)
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatal(err)
+	}
+	s := sb.Stage.(*Exec)
+	if err := s.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	s.cmd_in.Close()
+
+	out, err := io.ReadAll(s.cmd_out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.cmd_exec.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestExecEnv(t *testing.T) {
+	t.Setenv("BGPIPE_TEST_INHERITED", "inherited")
+	t.Setenv("BGPIPE_TEST_SECRET", "s3cret")
+
+	got := testExec(t, `echo "$BGPIPE_TEST_INHERITED $BGPIPE_TEST_TOKEN"`,
+		"--env", "BGPIPE_TEST_TOKEN=token-$BGPIPE_TEST_SECRET")
+	if want := "inherited token-s3cret"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestExecEnvClear(t *testing.T) {
+	t.Setenv("BGPIPE_TEST_INHERITED", "inherited")
+
+	got := testExec(t, `echo "${BGPIPE_TEST_INHERITED:-none} $BGPIPE_TEST_TOKEN"`,
+		"--env-clear", "--env", "BGPIPE_TEST_TOKEN=token")
+	if want := "none token"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestExecDir(t *testing.T) {
+	dir := t.TempDir()
+	got := testExec(t, `pwd -P`, "--dir", dir)
+	if want, _ := filepath.EvalSymlinks(dir); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestExecEnvInvalid(t *testing.T) {
+	for _, v := range []string{"NOVALUE", "=value"} {
+		sb := testStage(t, "exec", "--env", v, "/bin/true")
+		if err := sb.Stage.Attach(); err == nil {
+			t.Errorf("--env %s: expected an error", v)
+		}
+	}
+}
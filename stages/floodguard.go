@@ -0,0 +1,184 @@
+package stages
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/bgpfix/bgpipe/core"
+)
+
+var ErrFlood = errors.New("peer exceeded --max-rate")
+
+// number of buckets in the --window
+const flood_buckets = 10
+
+type FloodGuard struct {
+	*core.StageBase
+	notify *pipe.Input // for NOTIFICATION to the peer (--action teardown)
+
+	opt_rate     float64       // --max-rate
+	opt_window   time.Duration // --window
+	opt_prefixes bool          // --count prefixes
+	opt_teardown bool          // --action teardown
+	opt_notify   *msg.Notify   // --notify
+
+	mu      sync.Mutex           // guards below
+	buckets [flood_buckets]int64 // counts per window bucket
+	bpos    int                  // current bucket
+	bstart  time.Time            // start of current bucket
+	high    bool                 // above --max-rate?
+	floods  int                  // number of breaches
+	torn    bool                 // teardown started?
+}
+
+func NewFloodGuard(parent *core.StageBase) core.Stage {
+	var (
+		s = &FloodGuard{StageBase: parent}
+		o = &s.Options
+		f = o.Flags
+	)
+
+	o.Descr = "tear down the session if the peer announces too fast"
+	o.IsProducer = true
+
+	o.Events = map[string]string{
+		"flood": "announcement rate exceeded --max-rate",
+	}
+
+	f.Float64("max-rate", 1000, "max announcements per second, averaged over --window")
+	f.Duration("window", 10*time.Second, "time window to measure the rate over")
+	f.String("count", "prefixes", "what to count: prefixes (announced) or messages (UPDATEs with announcements)")
+	f.String("action", "event", "what to do on breach: event, or teardown (send --notify and stop the pipe)")
+	f.String("notify", "6:2", "NOTIFICATION to send on teardown (format: CODE:SUBCODE[:HEXDATA])")
+
+	return s
+}
+
+func (s *FloodGuard) Attach() error {
+	k := s.K
+
+	s.opt_rate = k.Float64("max-rate")
+	if s.opt_rate <= 0 {
+		return fmt.Errorf("--max-rate must be positive")
+	}
+	s.opt_window = k.Duration("window")
+	if s.opt_window < flood_buckets*time.Millisecond {
+		return fmt.Errorf("--window must be at least %dms", flood_buckets)
+	}
+
+	switch v := k.String("count"); v {
+	case "prefixes":
+		s.opt_prefixes = true
+	case "messages":
+		s.opt_prefixes = false
+	default:
+		return fmt.Errorf("--count %s: need prefixes or messages", v)
+	}
+
+	switch v := k.String("action"); v {
+	case "event":
+		s.opt_teardown = false
+	case "teardown":
+		s.opt_teardown = true
+		n, err := parse_notify(k.String("notify"))
+		if err != nil {
+			return fmt.Errorf("--notify %s: %w", k.String("notify"), err)
+		}
+		s.opt_notify = n
+		s.notify = s.P.AddInput(s.Dir.Flip()) // towards the peer
+	default:
+		return fmt.Errorf("--action %s: need event or teardown", v)
+	}
+
+	s.P.OnMsg(s.onUpdate, s.Dir, msg.UPDATE)
+	return nil
+}
+
+func (s *FloodGuard) onUpdate(m *msg.Msg) bool {
+	u := &m.Update
+	if !u.HasReach() {
+		return true // not an announcement
+	}
+
+	n := int64(1)
+	if s.opt_prefixes {
+		n = int64(len(u.GetReach(nil)))
+	}
+
+	rate, flood, teardown := s.check(time.Now(), n)
+	if flood {
+		s.Warn().Float64("rate", rate).Float64("max-rate", s.opt_rate).Msg("peer announcing too fast")
+		s.Event("flood", rate, s.opt_rate)
+	}
+	if teardown {
+		s.teardown(fmt.Errorf("%w: %.1f/s over %s", ErrFlood, rate, s.opt_window))
+	}
+	return true
+}
+
+// check counts n announcements at time now, returning the rate per second,
+// and whether it just went over --max-rate and requires a teardown
+func (s *FloodGuard) check(now time.Time, n int64) (rate float64, flood, teardown bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rate = s.count(now, n)
+	flood = rate > s.opt_rate && !s.high
+	if flood {
+		s.floods++
+	}
+	s.high = rate > s.opt_rate
+	teardown = flood && s.opt_teardown && !s.torn
+	if teardown {
+		s.torn = true
+	}
+	return rate, flood, teardown
+}
+
+// count adds n to the window at time now, returning the rate per second.
+// Must be called with s.mu locked.
+func (s *FloodGuard) count(now time.Time, n int64) float64 {
+	bw := s.opt_window / flood_buckets
+	if s.bstart.IsZero() {
+		s.bstart = now
+	}
+
+	// move to the current bucket, zeroing the ones passed
+	if now.Sub(s.bstart) >= s.opt_window {
+		s.buckets = [flood_buckets]int64{}
+		s.bstart = now
+	}
+	for now.Sub(s.bstart) >= bw {
+		s.bpos = (s.bpos + 1) % flood_buckets
+		s.buckets[s.bpos] = 0
+		s.bstart = s.bstart.Add(bw)
+	}
+	s.buckets[s.bpos] += n
+
+	var total int64
+	for _, v := range s.buckets {
+		total += v
+	}
+	return float64(total) / s.opt_window.Seconds()
+}
+
+// teardown sends the --notify NOTIFICATION to the peer, and stops the pipe with err
+func (s *FloodGuard) teardown(err error) {
+	s.Error().Err(err).Msg("tearing down the session")
+	notify_cancel(s.StageBase, s.notify, s.opt_notify, err)
+}
+
+// Counters implements core.StageCounters
+func (s *FloodGuard) Counters() map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]any{
+		"rate":   s.count(time.Now(), 0),
+		"high":   s.high,
+		"floods": s.floods,
+	}
+}
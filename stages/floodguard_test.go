@@ -0,0 +1,61 @@
+package stages
+
+import (
+	"testing"
+	"time"
+)
+
+func testFloodGuard(t *testing.T, args ...string) *FloodGuard {
+	t.Helper()
+	sb := testStage(t, "flood-guard", args...)
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatal(err)
+	}
+	return sb.Stage.(*FloodGuard)
+}
+
+func TestFloodGuardThreshold(t *testing.T) {
+	// max 10/s over 1s: flood on the 11th announcement
+	s := testFloodGuard(t, "--max-rate", "10", "--window", "1s", "--action", "teardown")
+	now := time.Now()
+	for i := 1; i <= 20; i++ {
+		rate, flood, teardown := s.check(now, 1)
+		switch {
+		case i <= 10 && (flood || teardown):
+			t.Fatalf("%d: flood at %.1f/s, below the threshold", i, rate)
+		case i == 11 && !(flood && teardown):
+			t.Fatalf("%d: no flood and teardown at %.1f/s", i, rate)
+		case i > 11 && (flood || teardown):
+			t.Fatalf("%d: flood fired again while still high", i)
+		}
+		now = now.Add(time.Millisecond)
+	}
+
+	// back to normal after the window, then a 2nd flood: event only
+	now = now.Add(2 * time.Second)
+	if _, flood, _ := s.check(now, 1); flood || s.high {
+		t.Fatal("still flooding after the window")
+	}
+	if _, flood, teardown := s.check(now, 20); !flood || teardown {
+		t.Errorf("2nd flood: got flood %v teardown %v, want true false", flood, teardown)
+	}
+	if s.floods != 2 {
+		t.Errorf("got %d floods, want 2", s.floods)
+	}
+}
+
+func TestFloodGuardWindow(t *testing.T) {
+	// 10 buckets of 100ms: old counts expire one bucket at a time
+	s := testFloodGuard(t, "--max-rate", "100", "--window", "1s")
+	now := time.Now()
+	s.check(now, 50)
+	if rate, _, _ := s.check(now.Add(500*time.Millisecond), 50); rate != 100 {
+		t.Errorf("got %.1f/s, want 100", rate)
+	}
+	if rate, _, _ := s.check(now.Add(1050*time.Millisecond), 0); rate != 50 {
+		t.Errorf("got %.1f/s after the 1st bucket expired, want 50", rate)
+	}
+	if rate, _, _ := s.check(now.Add(3*time.Second), 0); rate != 0 {
+		t.Errorf("got %.1f/s after the window, want 0", rate)
+	}
+}
@@ -0,0 +1,213 @@
+package stages
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/bgpfix/bgpfix/attrs"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/nlri"
+	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/bgpfix/bgpipe/core"
+)
+
+type Gen struct {
+	*core.StageBase
+	in *pipe.Input
+
+	opt_rate     float64       // --rate
+	opt_count    int           // --count
+	opt_duration time.Duration // --duration
+	opt_prefixes int           // --prefixes
+	opt_len      int           // --prefix-len
+	opt_random   bool          // --random
+	opt_aspath   int           // --aspath
+	opt_coms     int           // --communities
+	opt_nexthop  netip.Addr    // --nexthop
+
+	rng  *rand.Rand    // deterministic given --seed
+	next uint32        // next sequential prefix
+	stop chan struct{} // closed on Stop()
+
+	sent atomic.Uint64 // number of messages sent
+}
+
+func NewGen(parent *core.StageBase) core.Stage {
+	var (
+		s = &Gen{StageBase: parent}
+		o = &s.Options
+		f = o.Flags
+	)
+
+	o.Descr = "generate synthetic UPDATEs for benchmarking"
+	o.IsProducer = true
+
+	f.Float64("rate", 0, "messages per second (0 means as fast as possible)")
+	f.Int("count", 0, "stop after given number of messages (0 means no limit)")
+	f.Duration("duration", 0, "stop after given time (0 means no limit)")
+	f.Int("prefixes", 1, "number of IPv4 prefixes per message")
+	f.Int("prefix-len", 24, "length of generated prefixes")
+	f.Bool("random", false, "generate random prefixes instead of sequential ones")
+	f.Int("aspath", 3, "AS_PATH length")
+	f.Int("communities", 0, "number of communities per message")
+	f.String("nexthop", "192.0.2.1", "IPv4 next-hop")
+	f.Uint64("seed", 1, "random seed, for deterministic output")
+
+	s.stop = make(chan struct{})
+	return s
+}
+
+func (s *Gen) Attach() error {
+	k := s.K
+
+	s.opt_rate = k.Float64("rate")
+	s.opt_count = k.Int("count")
+	s.opt_duration = k.Duration("duration")
+	s.opt_prefixes = k.Int("prefixes")
+	s.opt_len = k.Int("prefix-len")
+	s.opt_random = k.Bool("random")
+	s.opt_aspath = k.Int("aspath")
+	s.opt_coms = k.Int("communities")
+	switch {
+	case s.opt_rate < 0:
+		return fmt.Errorf("--rate must not be negative")
+	case s.opt_count < 0:
+		return fmt.Errorf("--count must not be negative")
+	case s.opt_duration < 0:
+		return fmt.Errorf("--duration must not be negative")
+	case s.opt_prefixes < 1:
+		return fmt.Errorf("--prefixes must be positive")
+	case s.opt_len < 8 || s.opt_len > 32:
+		return fmt.Errorf("--prefix-len %d: need 8-32", s.opt_len)
+	case s.opt_aspath < 1 || s.opt_aspath > aspath_seg_max:
+		return fmt.Errorf("--aspath %d: need 1-%d", s.opt_aspath, aspath_seg_max)
+	case s.opt_coms < 0:
+		return fmt.Errorf("--communities must not be negative")
+	}
+
+	var err error
+	s.opt_nexthop, err = netip.ParseAddr(k.String("nexthop"))
+	if err != nil || !s.opt_nexthop.Is4() {
+		return fmt.Errorf("--nexthop %s: need an IPv4 address", k.String("nexthop"))
+	}
+
+	seed := uint64(k.Int64("seed"))
+	s.rng = rand.New(rand.NewPCG(seed, seed))
+	s.next = 10 << 24 // 10.0.0.0
+
+	s.in = s.P.AddInput(s.Dir)
+	return nil
+}
+
+func (s *Gen) Run() error {
+	return s.produce(s.in.WriteMsg)
+}
+
+// produce generates UPDATEs at --rate until --count or --duration, passing them to send
+func (s *Gen) produce(send func(m *msg.Msg) error) error {
+	var (
+		start    = time.Now()
+		deadline time.Time
+	)
+	if s.opt_duration > 0 {
+		deadline = start.Add(s.opt_duration)
+	}
+
+	for i := 0; s.opt_count == 0 || i < s.opt_count; i++ {
+		// pace
+		now := time.Now()
+		if !deadline.IsZero() && !now.Before(deadline) {
+			break
+		}
+		if s.opt_rate > 0 {
+			at := start.Add(time.Duration(float64(i) / s.opt_rate * float64(time.Second)))
+			if delay := at.Sub(now); delay > 0 {
+				select {
+				case <-time.After(delay):
+				case <-s.stop:
+					return nil
+				case <-s.Ctx.Done():
+					return nil
+				}
+			}
+		} else {
+			select {
+			case <-s.stop:
+				return nil
+			case <-s.Ctx.Done():
+				return nil
+			default:
+			}
+		}
+
+		// generate and send
+		m := s.P.GetMsg().Use(msg.UPDATE)
+		s.generate(&m.Update)
+		m.Modified()
+		if err := send(m); err != nil {
+			return err
+		}
+		s.sent.Add(1)
+	}
+
+	s.Info().Uint64("sent", s.sent.Load()).Stringer("took", time.Since(start)).Msg("done")
+	return nil
+}
+
+func (s *Gen) Stop() error {
+	close_safe(s.stop)
+	return nil
+}
+
+// generate fills u with synthetic prefixes and attributes
+func (s *Gen) generate(u *msg.Update) {
+	ats := &u.Attrs
+
+	// prefixes
+	step := uint32(1) << (32 - s.opt_len)
+	for range s.opt_prefixes {
+		var ip uint32
+		if s.opt_random {
+			ip = s.rng.Uint32() &^ (step - 1)
+		} else {
+			ip = s.next
+			s.next += step
+		}
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], ip)
+		u.Reach = append(u.Reach, nlri.FromPrefix(netip.PrefixFrom(netip.AddrFrom4(b), s.opt_len)))
+	}
+
+	// attributes
+	if a, ok := ats.Use(attrs.ATTR_ORIGIN).(*attrs.Origin); ok {
+		a.Origin = attrs.ORIGIN_IGP
+	}
+	if a, ok := ats.Use(attrs.ATTR_ASPATH).(*attrs.Aspath); ok {
+		list := make([]uint32, s.opt_aspath)
+		for i := range list {
+			list[i] = 64512 + s.rng.Uint32N(1000)
+		}
+		a.Segments = []attrs.Segment{{List: list}}
+	}
+	if a, ok := ats.Use(attrs.ATTR_NEXTHOP).(*attrs.IP); ok {
+		a.Addr = s.opt_nexthop
+	}
+	if s.opt_coms > 0 {
+		if a, ok := ats.Use(attrs.ATTR_COMMUNITY).(*attrs.Community); ok {
+			for range s.opt_coms {
+				a.Add(uint16(64512+s.rng.UintN(1000)), uint16(s.rng.UintN(1<<16)))
+			}
+		}
+	}
+}
+
+// Counters implements core.StageCounters
+func (s *Gen) Counters() map[string]any {
+	return map[string]any{
+		"sent": s.sent.Load(),
+	}
+}
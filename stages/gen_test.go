@@ -0,0 +1,81 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bgpfix/bgpfix/msg"
+)
+
+func testGen(t *testing.T, args ...string) *Gen {
+	t.Helper()
+	sb := testStage(t, "gen", args...)
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatal(err)
+	}
+	return sb.Stage.(*Gen)
+}
+
+func TestGenCount(t *testing.T) {
+	s := testGen(t, "--count", "50", "--prefixes", "2")
+	var got []*msg.Msg
+	err := s.produce(func(m *msg.Msg) error {
+		got = append(got, m)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 50 || s.sent.Load() != 50 {
+		t.Fatalf("got %d messages (sent %d), want 50", len(got), s.sent.Load())
+	}
+
+	// sequential prefixes, continuing across messages
+	if p := got[0].Update.Reach; len(p) != 2 || p[0].String() != "10.0.0.0/24" || p[1].String() != "10.0.1.0/24" {
+		t.Errorf("1st message: got %v", p)
+	}
+	if p := got[49].Update.Reach; len(p) != 2 || p[1].String() != "10.0.99.0/24" {
+		t.Errorf("last message: got %v", p)
+	}
+}
+
+func TestGenRate(t *testing.T) {
+	// 200/s for 20 messages: about 95ms
+	s := testGen(t, "--count", "20", "--rate", "200")
+	start := time.Now()
+	n := 0
+	err := s.produce(func(m *msg.Msg) error {
+		n++
+		return nil
+	})
+	took := time.Since(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 20 {
+		t.Errorf("got %d messages, want 20", n)
+	}
+	if took < 90*time.Millisecond || took > time.Second {
+		t.Errorf("took %s, want about 95ms", took)
+	}
+}
+
+func TestGenDuration(t *testing.T) {
+	// stops after --duration, or on Stop
+	s := testGen(t, "--rate", "100", "--duration", "100ms")
+	start := time.Now()
+	n := 0
+	s.produce(func(m *msg.Msg) error { n++; return nil })
+	if took := time.Since(start); took < 90*time.Millisecond || took > time.Second {
+		t.Errorf("--duration: took %s, want about 100ms", took)
+	}
+	if n < 5 || n > 11 {
+		t.Errorf("--duration: got %d messages, want about 10", n)
+	}
+
+	s = testGen(t, "--rate", "100")
+	time.AfterFunc(50*time.Millisecond, func() { s.Stop() })
+	if err := s.produce(func(m *msg.Msg) error { return nil }); err != nil {
+		t.Errorf("Stop: %v", err)
+	}
+}
@@ -0,0 +1,250 @@
+package stages
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bgpfix/bgpfix/attrs"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/bgpfix/bgpipe/core"
+)
+
+type Geo struct {
+	*core.StageBase
+
+	fpath       string          // mapping file
+	opt_country map[string]bool // --country
+	opt_region  map[string]bool // --region
+	opt_deny    bool            // --deny
+	opt_unknown bool            // --unknown: keep?
+	opt_reload  time.Duration   // --reload
+
+	db    atomic.Pointer[map[uint32]geoEntry] // ASN -> location
+	mtime time.Time                           // last file modification time
+	stop  chan struct{}                       // closed on Stop()
+}
+
+// geoEntry is the location of an AS
+type geoEntry struct {
+	country string
+	region  string
+}
+
+func NewGeo(parent *core.StageBase) core.Stage {
+	var (
+		s = &Geo{StageBase: parent}
+		o = &s.Options
+		f = o.Flags
+	)
+
+	o.Descr = "filter UPDATEs by country or region of the origin AS"
+	o.Args = []string{"path"}
+	o.Bidir = true
+
+	f.StringSlice("country", nil, "keep routes originated in given countries (ISO codes)")
+	f.StringSlice("region", nil, "keep routes originated in given regions")
+	f.Bool("deny", false, "drop routes matching --country or --region instead")
+	f.String("unknown", "keep", "what to do with origins not in the mapping: keep or drop")
+	f.Duration("reload", 0, "check the mapping file for changes every time interval (0 means never)")
+
+	s.opt_country = make(map[string]bool)
+	s.opt_region = make(map[string]bool)
+	s.stop = make(chan struct{})
+	return s
+}
+
+func (s *Geo) Attach() error {
+	k := s.K
+
+	s.fpath = k.String("path")
+	if len(s.fpath) == 0 {
+		return errors.New("path must be set")
+	}
+	s.fpath = filepath.Clean(s.fpath)
+
+	for _, v := range k.Strings("country") {
+		s.opt_country[strings.ToUpper(v)] = true
+	}
+	for _, v := range k.Strings("region") {
+		s.opt_region[strings.ToUpper(v)] = true
+	}
+	s.opt_deny = k.Bool("deny")
+	if s.opt_deny && len(s.opt_country) == 0 && len(s.opt_region) == 0 {
+		return errors.New("--deny needs --country or --region")
+	}
+
+	switch v := k.String("unknown"); v {
+	case "keep":
+		s.opt_unknown = true
+	case "drop":
+		s.opt_unknown = false
+	default:
+		return fmt.Errorf("--unknown %s: need keep or drop", v)
+	}
+
+	s.opt_reload = k.Duration("reload")
+
+	s.P.OnMsg(s.check, s.Dir, msg.UPDATE)
+	return nil
+}
+
+func (s *Geo) Prepare() error {
+	return s.load()
+}
+
+func (s *Geo) Run() error {
+	if s.opt_reload <= 0 {
+		select {
+		case <-s.stop:
+		case <-s.Ctx.Done():
+		}
+		return nil
+	}
+
+	ticker := time.NewTicker(s.opt_reload)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fi, err := os.Stat(s.fpath)
+			if err != nil {
+				s.Warn().Err(err).Msg("could not check the mapping file")
+				continue
+			}
+			if fi.ModTime().Equal(s.mtime) {
+				continue
+			}
+			if err := s.load(); err != nil {
+				s.Warn().Err(err).Msg("could not reload the mapping file, keeping the old one")
+			}
+		case <-s.stop:
+			return nil
+		case <-s.Ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (s *Geo) Stop() error {
+	close_safe(s.stop)
+	return nil
+}
+
+// load reads the mapping file, with lines in the format: ASN COUNTRY [REGION]
+func (s *Geo) load() error {
+	fh, err := os.Open(s.fpath)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	fi, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+
+	db := make(map[uint32]geoEntry)
+	scan := bufio.NewScanner(fh)
+	for lineno := 1; scan.Scan(); lineno++ {
+		line := strings.TrimSpace(scan.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return fmt.Errorf("%s line %d: need ASN and country", s.fpath, lineno)
+		}
+
+		asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(fields[0]), "AS"), 10, 32)
+		if err != nil {
+			return fmt.Errorf("%s line %d: invalid ASN: %w", s.fpath, lineno, err)
+		}
+
+		e := geoEntry{country: strings.ToUpper(fields[1])}
+		if len(fields) > 2 {
+			e.region = strings.ToUpper(fields[2])
+		}
+		db[uint32(asn)] = e
+	}
+	if err := scan.Err(); err != nil {
+		return err
+	}
+
+	s.Info().Msgf("loaded %d ASNs from %s", len(db), s.fpath)
+	s.db.Store(&db)
+	s.mtime = fi.ModTime()
+	return nil
+}
+
+func (s *Geo) check(m *msg.Msg) bool {
+	u := &m.Update
+	if !u.HasReach() {
+		return true // nothing to check
+	}
+
+	// find the origin location
+	e, keep := s.match(u)
+	if !keep {
+		return s.dropReach(m)
+	} else if len(e.country) == 0 {
+		return true // unknown
+	}
+
+	// tag the message
+	tags := pipe.MsgContext(m).UseTags()
+	tags["geo/country"] = e.country
+	if len(e.region) > 0 {
+		tags["geo/region"] = e.region
+	}
+	return true
+}
+
+// match returns the origin location of the routes in u, and whether to keep them
+func (s *Geo) match(u *msg.Update) (e geoEntry, keep bool) {
+	ap := u.AsPath()
+	if ap == nil {
+		return e, s.opt_unknown
+	}
+	e, ok := (*s.db.Load())[ap.Origin()]
+	if !ok {
+		return e, s.opt_unknown
+	}
+
+	match := len(s.opt_country) == 0 && len(s.opt_region) == 0
+	if s.opt_country[e.country] || (len(e.region) > 0 && s.opt_region[e.region]) {
+		match = true
+	}
+	return e, match != s.opt_deny
+}
+
+// dropReach drops the announcements in UPDATE m, keeping the withdrawals.
+// Returns false iff nothing is left in m.
+func (s *Geo) dropReach(m *msg.Msg) bool {
+	u := &m.Update
+	if !u.HasUnreach() {
+		return false
+	}
+
+	// keep only the withdrawals, the attributes were for the announcements
+	var drop []attrs.Code
+	u.Attrs.Each(func(i int, ac attrs.Code, at attrs.Attr) {
+		if ac != attrs.ATTR_MP_UNREACH {
+			drop = append(drop, ac)
+		}
+	})
+	for _, ac := range drop {
+		u.Attrs.Drop(ac)
+	}
+	u.Reach = nil
+	m.Modified()
+	return true
+}
@@ -0,0 +1,121 @@
+package stages
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bgpfix/bgpfix/attrs"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+)
+
+// testGeo returns a prepared geo stage with a small mapping file
+func testGeo(t *testing.T, args ...string) *Geo {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "geo.txt")
+	data := "# ASN country region\nAS65001 nl eu\n65002 US NA\n65003 PL\n"
+	if err := os.WriteFile(path, []byte(data), 0666); err != nil {
+		t.Fatal(err)
+	}
+	sb := testStage(t, "geo", append(args, path)...)
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.Stage.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	return sb.Stage.(*Geo)
+}
+
+// testUpdate returns an UPDATE announcing reach from given origin (0 = no AS_PATH),
+// and withdrawing unreach
+func testUpdate(origin uint32, reach, unreach []string) *msg.Msg {
+	m := msg.NewMsg().Use(msg.UPDATE)
+	u := &m.Update
+	u.Reach = testPrefixes(reach...)
+	u.Unreach = testPrefixes(unreach...)
+	if origin != 0 {
+		ap := u.Attrs.Use(attrs.ATTR_ASPATH).(*attrs.Aspath)
+		ap.Segments = []attrs.Segment{{List: []uint32{65000, origin}}}
+	}
+	return m
+}
+
+func TestGeoCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		origin  uint32
+		keep    bool
+		country string // expected tag
+	}{
+		{"known, allowed", []string{"--country", "nl"}, 65001, true, "NL"},
+		{"known, not allowed", []string{"--country", "nl"}, 65002, false, ""},
+		{"known, by region", []string{"--region", "NA"}, 65002, true, "US"},
+		{"known, no region", []string{"--region", "EU"}, 65003, false, ""},
+		{"known, denied", []string{"--deny", "--country", "NL,PL"}, 65003, false, ""},
+		{"known, not denied", []string{"--deny", "--country", "NL"}, 65002, true, "US"},
+		{"known, no filter", nil, 65003, true, "PL"},
+		{"unknown, keep", []string{"--country", "NL"}, 65009, true, ""},
+		{"unknown, drop", []string{"--country", "NL", "--unknown", "drop"}, 65009, false, ""},
+		{"no AS_PATH, drop", []string{"--unknown", "drop"}, 0, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testGeo(t, tt.args...)
+			m := testUpdate(tt.origin, []string{"192.0.2.0/24"}, nil)
+			if got := s.check(m); got != tt.keep {
+				t.Errorf("got keep=%v, want %v", got, tt.keep)
+			}
+			var country string
+			if pipe.HasTags(m) {
+				country = pipe.MsgTags(m)["geo/country"]
+			}
+			if country != tt.country {
+				t.Errorf("got geo/country %q, want %q", country, tt.country)
+			}
+		})
+	}
+}
+
+func TestGeoKeepsWithdrawals(t *testing.T) {
+	s := testGeo(t, "--country", "NL")
+
+	// withdrawals only: not checked
+	m := testUpdate(0, nil, []string{"198.51.100.0/24"})
+	if !s.check(m) {
+		t.Error("withdrawal-only UPDATE dropped")
+	}
+
+	// announcements dropped, withdrawals kept
+	m = testUpdate(65002, []string{"192.0.2.0/24"}, []string{"198.51.100.0/24"})
+	u := &m.Update
+	mp := u.Attrs.Use(attrs.ATTR_MP_UNREACH).(*attrs.MP)
+	mp.Value = &attrs.MPPrefixes{MP: mp, Prefixes: testPrefixes("2001:db8::/32")}
+	if !s.check(m) {
+		t.Fatal("UPDATE with withdrawals dropped")
+	}
+	if len(u.Reach) != 0 || u.HasReach() {
+		t.Errorf("announcements left: %v", u.Reach)
+	}
+	if len(u.Unreach) != 1 || !u.Attrs.Has(attrs.ATTR_MP_UNREACH) {
+		t.Errorf("withdrawals not kept: %v", u.GetUnreach(nil))
+	}
+	if u.Attrs.Has(attrs.ATTR_ASPATH) {
+		t.Error("AS_PATH kept without announcements")
+	}
+}
+
+func TestGeoRunCancel(t *testing.T) {
+	s := testGeo(t)
+	done := make(chan error, 1)
+	go func() { done <- s.Run() }()
+	s.Cancel(nil)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return on context cancel")
+	}
+}
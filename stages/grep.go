@@ -28,6 +28,7 @@ type Grep struct {
 	opt_fail_accept string
 	opt_fail_event  string
 	opt_fail_kill   bool
+	opt_match_event string
 	opt_parse       bool
 
 	enabled_matches int // number of different checks we must do for each message
@@ -63,6 +64,7 @@ func NewGrep(parent *core.StageBase) core.Stage {
 	f.String("fail-event", "", "on match failure, emit given event and DROP the message")
 	f.String("fail-accept", "", "on match failure, emit given event and ACCEPT the message")
 	f.Bool("fail-kill", false, "on match failure, kill the session")
+	f.String("match-event", "", "on match success, emit given event (eg. to --stop a source)")
 
 	f.BoolP("invert", "v", false, "invert the final result: drop messages that matched successfully")
 	f.BoolP("or", "o", false, "require any match type (default: require ALL match types)")
@@ -98,6 +100,7 @@ func (s *Grep) Attach() error {
 	s.opt_fail_event = k.String("fail-event")
 	s.opt_fail_accept = k.String("fail-accept")
 	s.opt_fail_kill = k.Bool("fail-kill")
+	s.opt_match_event = k.String("match-event")
 	if s.opt_fail_accept != "" && s.opt_fail_event != "" {
 		return fmt.Errorf("--fail-event and --fail-accept must not be used together")
 	} else if s.opt_fail_kill && s.opt_fail_accept != s.opt_fail_event {
@@ -401,6 +404,9 @@ func (s *Grep) check(m *msg.Msg) (accept_message bool) {
 
 		// if message accepted, we're done
 		if accept_message {
+			if s.opt_match_event != "" {
+				s.Event(s.opt_match_event, m)
+			}
 			return
 		}
 
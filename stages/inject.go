@@ -0,0 +1,256 @@
+package stages
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/nlri"
+	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/bgpfix/bgpipe/core"
+)
+
+type Inject struct {
+	*core.StageBase
+	in *pipe.Input
+
+	fpath     string        // file path
+	opt_every time.Duration // --every
+	opt_poll  time.Duration // --poll
+	opt_wstop bool          // --withdraw-on-stop
+
+	mtime time.Time              // last file modification time
+	size  int64                  // last file size
+	state map[string][]nlri.NLRI // UPDATE JSON line -> its reachable prefixes
+	stop  chan struct{}          // closed on Stop()
+}
+
+func NewInject(parent *core.StageBase) core.Stage {
+	var (
+		s = &Inject{StageBase: parent}
+		o = &s.Options
+		f = o.Flags
+	)
+
+	o.Descr = "announce routes from file, re-announcing on change"
+	o.IsProducer = true
+	o.Args = []string{"path"}
+
+	f.Duration("every", 0, "re-announce all routes every time interval (0 means never)")
+	f.Duration("poll", time.Second, "check the file for changes every time interval")
+	f.Bool("withdraw-on-stop", false, "withdraw all routes when the stage stops")
+
+	s.state = make(map[string][]nlri.NLRI)
+	s.stop = make(chan struct{})
+	return s
+}
+
+func (s *Inject) Attach() error {
+	k := s.K
+
+	s.fpath = k.String("path")
+	if len(s.fpath) == 0 {
+		return errors.New("path must be set")
+	}
+	s.fpath = filepath.Clean(s.fpath)
+
+	s.opt_every = k.Duration("every")
+	s.opt_poll = k.Duration("poll")
+	if s.opt_poll <= 0 {
+		s.opt_poll = time.Second
+	}
+	s.opt_wstop = k.Bool("withdraw-on-stop")
+
+	// by default, wait for the session to be established
+	if len(k.Strings("wait")) == 0 {
+		k.Set("wait", []string{"ESTABLISHED"})
+	}
+
+	s.in = s.P.AddInput(s.Dir)
+	return nil
+}
+
+func (s *Inject) Prepare() error {
+	// check the file is there
+	_, err := os.Stat(s.fpath)
+	return err
+}
+
+func (s *Inject) Run() error {
+	// initial announcement
+	if err := s.reload(false); err != nil {
+		return err
+	}
+
+	poll := time.NewTicker(s.opt_poll)
+	defer poll.Stop()
+
+	var every <-chan time.Time
+	if s.opt_every > 0 {
+		t := time.NewTicker(s.opt_every)
+		defer t.Stop()
+		every = t.C
+	}
+
+	for {
+		select {
+		case <-poll.C:
+			if err := s.reload(false); err != nil {
+				return err
+			}
+		case <-every:
+			if err := s.reload(true); err != nil {
+				return err
+			}
+		case <-s.stop:
+			if s.opt_wstop {
+				s.withdraw(s.state, nil)
+			}
+			return nil
+		case <-s.Ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (s *Inject) Stop() error {
+	close_safe(s.stop)
+	return nil
+}
+
+// reload re-reads the file if changed (or if all is true),
+// and injects the difference against the last state
+func (s *Inject) reload(all bool) error {
+	// file changed?
+	fi, err := os.Stat(s.fpath)
+	if err != nil {
+		return err
+	}
+	changed := !fi.ModTime().Equal(s.mtime) || fi.Size() != s.size
+	if !changed && !all {
+		return nil
+	}
+
+	// read the file
+	if changed {
+		s.Info().Msgf("reading %s", s.fpath)
+	}
+	fh, err := os.Open(s.fpath)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	// parse and announce new (or all) routes
+	next := make(map[string][]nlri.NLRI)
+	var announced, lineno int
+	scan := bufio.NewScanner(fh)
+	for scan.Scan() {
+		lineno++
+		line := bytes.TrimSpace(scan.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		// parse
+		m := s.P.GetMsg()
+		if err := s.parse(m, line); err != nil {
+			s.P.PutMsg(m)
+			s.Warn().Err(err).Msgf("%s line %d: could not parse", s.fpath, lineno)
+			continue
+		}
+		key := string(line)
+		next[key] = m.Update.GetReach(nil)
+
+		// already announced?
+		if _, ok := s.state[key]; ok && !all {
+			s.P.PutMsg(m)
+			continue
+		}
+
+		// sail
+		m.CopyData()
+		if err := s.in.WriteMsg(m); err != nil {
+			return err
+		}
+		announced++
+	}
+	if err := scan.Err(); err != nil {
+		return err
+	}
+
+	// withdraw what's gone
+	withdrawn := s.withdraw(s.state, next)
+
+	s.Debug().Msgf("announced %d and withdrawn %d prefix(es) from %s", announced, withdrawn, s.fpath)
+	s.state = next
+	s.mtime = fi.ModTime()
+	s.size = fi.Size()
+	return nil
+}
+
+// parse parses an UPDATE in JSON format from line into m
+func (s *Inject) parse(m *msg.Msg, line []byte) error {
+	switch line[0] {
+	case '[':
+		if err := m.FromJSON(line); err != nil {
+			return err
+		}
+		if m.Type != msg.UPDATE {
+			return errors.New("not an UPDATE message")
+		}
+		return nil
+	case '{':
+		m.Use(msg.UPDATE)
+		return m.Update.FromJSON(line)
+	default:
+		return errors.New("invalid format, need an UPDATE in JSON format")
+	}
+}
+
+// withdraw withdraws prefixes found in prev but not in next (if nil, withdraws everything).
+// Returns the number of withdrawn prefixes.
+func (s *Inject) withdraw(prev, next map[string][]nlri.NLRI) int {
+	// collect prefixes still reachable
+	keep := make(map[nlri.NLRI]bool)
+	for _, prefixes := range next {
+		for _, p := range prefixes {
+			keep[p] = true
+		}
+	}
+
+	// collect prefixes to withdraw
+	var unreach []nlri.NLRI
+	done := make(map[nlri.NLRI]bool)
+	for _, prefixes := range prev {
+		for _, p := range prefixes {
+			if !keep[p] && !done[p] {
+				done[p] = true
+				unreach = append(unreach, p)
+			}
+		}
+	}
+
+	// withdraw in batches
+	count := 0
+	for len(unreach) > 0 {
+		n := min(len(unreach), update_withdraw_batch)
+		m := s.P.GetMsg()
+		if err := update_withdraw(m, unreach[:n]...); err != nil {
+			s.P.PutMsg(m)
+			s.Warn().Err(err).Msg("could not build withdrawal")
+			break
+		}
+		if err := s.in.WriteMsg(m); err != nil {
+			s.Warn().Err(err).Msg("could not withdraw")
+			break
+		}
+		count += n
+		unreach = unreach[n:]
+	}
+	return count
+}
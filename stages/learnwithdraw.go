@@ -0,0 +1,165 @@
+package stages
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/nlri"
+	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/bgpfix/bgpipe/core"
+)
+
+type LearnWithdraw struct {
+	*core.StageBase
+	in *pipe.Input
+
+	opt_max  int  // --max-routes
+	opt_stop bool // --on-stop
+
+	mu     sync.Mutex         // guards below
+	routes map[nlri.NLRI]bool // reachable prefixes
+	full   bool               // reached --max-routes?
+}
+
+func NewLearnWithdraw(parent *core.StageBase) core.Stage {
+	var (
+		s = &LearnWithdraw{StageBase: parent}
+		o = &s.Options
+		f = o.Flags
+	)
+
+	o.Descr = "learn announced prefixes, withdraw them all on given events"
+	o.IsProducer = true
+
+	o.Events = map[string]string{
+		"withdrawn": "withdrew all learned prefixes",
+		"full":      "reached --max-routes, not learning more prefixes",
+	}
+
+	f.StringSlice("on", nil, "withdraw on given events (eg. connect/STOP)")
+	f.Bool("on-stop", false, "withdraw when the stage stops")
+	f.Int("max-routes", 1000000, "max number of prefixes to learn (0 means no limit)")
+
+	s.routes = make(map[nlri.NLRI]bool)
+	return s
+}
+
+func (s *LearnWithdraw) Attach() error {
+	k := s.K
+
+	s.opt_max = k.Int("max-routes")
+	if s.opt_max < 0 {
+		return fmt.Errorf("--max-routes must not be negative")
+	}
+
+	s.opt_stop = k.Bool("on-stop")
+	evs := core.ParseEvents(k.Strings("on"), "STOP")
+	if len(evs) == 0 && !s.opt_stop {
+		return fmt.Errorf("nothing to do: need --on or --on-stop")
+	} else if len(evs) > 0 {
+		s.P.Options.OnEvent(s.onEvent, evs...)
+	}
+
+	s.P.OnMsg(s.onUpdate, s.Dir, msg.UPDATE)
+	s.in = s.P.AddInput(s.Dir)
+	return nil
+}
+
+// onUpdate learns prefixes announced and withdrawn in UPDATE m
+func (s *LearnWithdraw) onUpdate(m *msg.Msg) bool {
+	u := &m.Update
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range u.GetUnreach(nil) {
+		delete(s.routes, p)
+	}
+	for _, p := range u.GetReach(nil) {
+		if s.opt_max > 0 && len(s.routes) >= s.opt_max && !s.routes[p] {
+			if !s.full {
+				s.full = true
+				s.Warn().Int("max-routes", s.opt_max).Msg("too many prefixes, not learning more")
+				s.Event("full", s.opt_max)
+			}
+			continue
+		}
+		s.routes[p] = true
+	}
+
+	return true
+}
+
+func (s *LearnWithdraw) Stop() error {
+	if s.opt_stop {
+		s.withdrawAll("stop")
+	}
+	return nil
+}
+
+// onEvent withdraws all learned prefixes on event ev
+func (s *LearnWithdraw) onEvent(ev *pipe.Event) bool {
+	s.withdrawAll(ev.Type)
+	return true
+}
+
+// withdrawAll withdraws all learned prefixes, because of why
+func (s *LearnWithdraw) withdrawAll(why string) {
+	s.mu.Lock()
+	routes := s.routes
+	s.routes = make(map[nlri.NLRI]bool)
+	s.full = false
+	s.mu.Unlock()
+
+	if len(routes) == 0 {
+		return
+	}
+
+	// withdraw in batches
+	var (
+		unreach = make([]nlri.NLRI, 0, update_withdraw_batch)
+		count   int
+	)
+	flush := func() bool {
+		if len(unreach) == 0 {
+			return true
+		}
+		if err := s.withdraw(unreach); err != nil {
+			s.Warn().Err(err).Msg("could not withdraw")
+			return false
+		}
+		count += len(unreach)
+		unreach = unreach[:0]
+		return true
+	}
+	for p := range routes {
+		unreach = append(unreach, p)
+		if len(unreach) == update_withdraw_batch && !flush() {
+			break
+		}
+	}
+	flush()
+
+	s.Info().Str("why", why).Msgf("withdrew %d prefix(es)", count)
+	s.Event("withdrawn", count)
+}
+
+// withdraw sends an UPDATE withdrawing given prefixes
+func (s *LearnWithdraw) withdraw(unreach []nlri.NLRI) error {
+	m := s.P.GetMsg()
+	if err := update_withdraw(m, unreach...); err != nil {
+		s.P.PutMsg(m)
+		return err
+	}
+	return s.in.WriteMsg(m)
+}
+
+// Counters implements core.StageCounters
+func (s *LearnWithdraw) Counters() map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]any{
+		"routes": len(s.routes),
+	}
+}
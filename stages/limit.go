@@ -11,14 +11,22 @@ package stages
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
 	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/bgpfix/bgpfix/afi"
 	"github.com/bgpfix/bgpfix/attrs"
 	"github.com/bgpfix/bgpfix/msg"
 	"github.com/bgpfix/bgpfix/nlri"
+	"github.com/bgpfix/bgpfix/pipe"
 	"github.com/bgpfix/bgpipe/core"
 	"github.com/puzpuzpuz/xsync/v3"
 )
@@ -40,10 +48,21 @@ type Limit struct {
 	limit_session int64 // max global prefix count
 	limit_origin  int64 // max prefix count for single origin
 	limit_block   int64 // max prefix count for IP block
+	limit_peer    int64 // max prefix count for single peer
+
+	peer_key string // message tag identifying the peer
+	warn_pct int64  // warn at this percentage of a limit
+
+	session_warn limitCounter // session size, for --warn-pct
+
+	opt_state      string        // --state
+	opt_state_ival time.Duration // --state-interval
+	stop           chan struct{} // closed on Stop()
 
 	session *xsync.MapOf[nlri.NLRI, *limitPrefix] // session db
 	origin  *xsync.MapOf[uint32, *limitCounter]   // per-origin db
 	block   *xsync.MapOf[uint64, *limitCounter]   // per-block db
+	peer    *xsync.MapOf[string, *limitCounter]   // per-peer db
 }
 
 func NewLimit(parent *core.StageBase) core.Stage {
@@ -64,6 +83,11 @@ func NewLimit(parent *core.StageBase) core.Stage {
 	sf.IntP("origin", "o", 0, "per-AS origin limit (0 = no limit)")
 	sf.IntP("block", "b", 0, "per-IP block limit (0 = no limit)")
 	sf.IntP("block-length", "B", 0, "IP block length (max. 64, 0 = 8/32 for v4/v6)")
+	sf.Int("peer", 0, "per-peer limit (0 = no limit)")
+	sf.String("peer-key", "PEER_IP", "message tag identifying the peer for --peer")
+	sf.Int("warn-pct", 0, "emit a warn event when a count reaches this percentage of its limit (0 = never)")
+	sf.String("state", "", "save the prefix database to given file, and restore it on start")
+	sf.Duration("state-interval", time.Minute, "how often to save --state (0 = on exit only)")
 
 	so.Descr = "limit prefix lengths and counts"
 
@@ -73,6 +97,8 @@ func NewLimit(parent *core.StageBase) core.Stage {
 		"count":  "too many prefixes reachable over the session",
 		"origin": "too many prefixes for a single AS origin",
 		"block":  "too many prefixes for a single IP block",
+		"peer":   "too many prefixes for a single peer",
+		"warn":   "prefix count reached --warn-pct of its limit",
 	}
 
 	so.Bidir = true // will aggregate both directions
@@ -81,6 +107,8 @@ func NewLimit(parent *core.StageBase) core.Stage {
 	s.session = xsync.NewMapOf[nlri.NLRI, *limitPrefix]()
 	s.origin = xsync.NewMapOf[uint32, *limitCounter]()
 	s.block = xsync.NewMapOf[uint64, *limitCounter]()
+	s.peer = xsync.NewMapOf[string, *limitCounter]()
+	s.stop = make(chan struct{})
 
 	return s
 }
@@ -122,6 +150,17 @@ func (s *Limit) Attach() error {
 	s.limit_session = k.Int64("session")
 	s.limit_origin = k.Int64("origin")
 	s.limit_block = k.Int64("block")
+	s.limit_peer = k.Int64("peer")
+
+	s.peer_key = k.String("peer-key")
+	if s.limit_peer > 0 && len(s.peer_key) == 0 {
+		return fmt.Errorf("--peer needs a non-empty --peer-key")
+	}
+
+	s.warn_pct = k.Int64("warn-pct")
+	if s.warn_pct < 0 || s.warn_pct > 100 {
+		return fmt.Errorf("--warn-pct %d: need 0-100", s.warn_pct)
+	}
 
 	s.blen6 = k.Int("block-length")
 	if s.blen6 < 0 || s.blen6 > 64 {
@@ -136,10 +175,74 @@ func (s *Limit) Attach() error {
 
 	s.permanent = k.Bool("permanent")
 
+	s.opt_state = k.String("state")
+	if len(s.opt_state) > 0 {
+		s.opt_state = filepath.Clean(s.opt_state)
+	}
+	s.opt_state_ival = k.Duration("state-interval")
+	if s.opt_state_ival < 0 {
+		return fmt.Errorf("--state-interval must not be negative")
+	}
+
 	s.P.OnMsg(s.onMsg, s.Dir, msg.UPDATE)
 	return nil
 }
 
+func (s *Limit) Prepare() error {
+	if len(s.opt_state) > 0 {
+		s.loadState()
+	}
+	return nil
+}
+
+func (s *Limit) Run() error {
+	if len(s.opt_state) == 0 {
+		return s.StageBase.Run()
+	}
+
+	// save on exit
+	defer func() {
+		if err := s.saveState(); err != nil {
+			s.Error().Err(err).Msgf("could not save %s", s.opt_state)
+		}
+	}()
+
+	var tick <-chan time.Time
+	if s.opt_state_ival > 0 {
+		ticker := time.NewTicker(s.opt_state_ival)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+			if err := s.saveState(); err != nil {
+				s.Warn().Err(err).Msgf("could not save %s", s.opt_state)
+			}
+		case <-s.stop:
+			return nil
+		case <-s.Ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (s *Limit) Stop() error {
+	close_safe(s.stop)
+	return nil
+}
+
+// Counters implements core.StageCounters
+func (s *Limit) Counters() map[string]any {
+	return map[string]any{
+		"session": s.session.Size(),
+		"origin":  s.origin.Size(),
+		"block":   s.block.Size(),
+		"peer":    s.peer.Size(),
+	}
+}
+
 func (s *Limit) onMsg(m *msg.Msg) bool {
 	var rbefore, rafter, ubefore, uafter int
 
@@ -189,6 +292,12 @@ func (s *Limit) p2b(p nlri.NLRI) uint64 {
 func (s *Limit) checkReach(u *msg.Update) (before, after int) {
 	origin := u.AsPath().Origin()
 
+	// which peer? (empty if unknown)
+	var peer string
+	if s.limit_peer > 0 && pipe.HasTags(u.Msg) {
+		peer = pipe.MsgTags(u.Msg)[s.peer_key]
+	}
+
 	// drops p from u if violates the rules
 	dropReach := func(p nlri.NLRI) (drop bool) {
 		defer func() {
@@ -241,6 +350,7 @@ func (s *Limit) checkReach(u *msg.Update) (before, after int) {
 				if !drop {
 					pp.origins = append(pp.origins, origin)
 					po.counter++
+					s.warnCounter(po, s.limit_origin, "origin", origin)
 				}
 			}()
 		}
@@ -261,6 +371,29 @@ func (s *Limit) checkReach(u *msg.Update) (before, after int) {
 			defer func() {
 				if !drop {
 					pb.counter++
+					s.warnCounter(pb, s.limit_block, "block", s.p2b(p))
+				}
+			}()
+		}
+
+		// check peer limit
+		if s.limit_peer > 0 && len(peer) > 0 && slices.Index(pp.peers, peer) < 0 {
+			pc, _ := s.peer.LoadOrCompute(peer, newLimitCounter)
+			pc.Lock()
+			defer pc.Unlock()
+
+			// can't add more to peer?
+			if pc.counter >= s.limit_peer {
+				s.Event("peer", p.String(), peer, pc.counter)
+				return true
+			}
+
+			// add to peer iff other checks ok
+			defer func() {
+				if !drop {
+					pp.peers = append(pp.peers, peer)
+					pc.counter++
+					s.warnCounter(pc, s.limit_peer, "peer", peer)
 				}
 			}()
 		}
@@ -276,6 +409,9 @@ func (s *Limit) checkReach(u *msg.Update) (before, after int) {
 
 		// accept the prefix
 		pp.accepted = true
+		if !loaded {
+			s.warnSession()
+		}
 		return false
 	}
 
@@ -301,6 +437,36 @@ func (s *Limit) checkReach(u *msg.Update) (before, after int) {
 	return before, after
 }
 
+// warnCounter emits a one-shot "warn" event when c reaches --warn-pct of limit,
+// re-armed when c drops below it again. Must be called with c locked.
+func (s *Limit) warnCounter(c *limitCounter, limit int64, what ...any) {
+	if s.warn_pct <= 0 || limit <= 0 {
+		return
+	}
+
+	thr := max(1, limit*s.warn_pct/100)
+	switch {
+	case c.counter >= thr && !c.warned:
+		c.warned = true
+		s.Event("warn", append(what, c.counter, limit)...)
+	case c.counter < thr:
+		c.warned = false
+	}
+}
+
+// warnSession calls warnCounter for the session size
+func (s *Limit) warnSession() {
+	if s.warn_pct <= 0 || s.limit_session <= 0 {
+		return
+	}
+
+	c := &s.session_warn
+	c.Lock()
+	defer c.Unlock()
+	c.counter = int64(s.session.Size())
+	s.warnCounter(c, s.limit_session, "session")
+}
+
 func (s *Limit) checkUnreach(u *msg.Update) (before, after int) {
 	// drops p from u if violates the rules
 	dropUnreach := func(p nlri.NLRI) (drop bool) {
@@ -327,6 +493,7 @@ func (s *Limit) checkUnreach(u *msg.Update) (before, after int) {
 		if pp.dropped || !pp.accepted {
 			return false
 		}
+		s.warnSession()
 
 		// remove from origins
 		if s.limit_origin > 0 {
@@ -335,16 +502,31 @@ func (s *Limit) checkUnreach(u *msg.Update) (before, after int) {
 				if ok && po != nil {
 					po.Lock()
 					po.counter--
+					s.warnCounter(po, s.limit_origin, "origin", origin)
 					po.Unlock()
 				}
 			}
 		}
 
+		// remove from peers
+		if s.limit_peer > 0 {
+			for _, peer := range pp.peers {
+				pc, ok := s.peer.Load(peer)
+				if ok && pc != nil {
+					pc.Lock()
+					pc.counter--
+					s.warnCounter(pc, s.limit_peer, "peer", peer)
+					pc.Unlock()
+				}
+			}
+		}
+
 		// remove from IP block
 		if s.limit_block > 0 {
 			if pb, ok := s.block.Load(s.p2b(p)); ok && pb != nil {
 				pb.Lock()
 				pb.counter--
+				s.warnCounter(pb, s.limit_block, "block", s.p2b(p))
 				pb.Unlock()
 			}
 		}
@@ -356,7 +538,7 @@ func (s *Limit) checkUnreach(u *msg.Update) (before, after int) {
 	if s.ipv4 {
 		before += len(u.Unreach)
 		u.Unreach = slices.DeleteFunc(u.Unreach, dropUnreach)
-		after += len(u.Reach)
+		after += len(u.Unreach)
 	}
 
 	// prefixes in the MP part?
@@ -379,6 +561,7 @@ type limitPrefix struct {
 	accepted bool
 	dropped  bool
 	origins  []uint32
+	peers    []string
 }
 
 func newLimitPrefix() *limitPrefix {
@@ -390,8 +573,183 @@ func newLimitPrefix() *limitPrefix {
 type limitCounter struct {
 	sync.Mutex
 	counter int64
+	warned  bool // already reached --warn-pct?
 }
 
 func newLimitCounter() *limitCounter {
 	return &limitCounter{}
 }
+
+// limit_state_version is the --state file schema version.
+// Files with a different version are ignored with a warning.
+const limit_state_version = 1
+
+// limitState is the --state file contents
+type limitState struct {
+	Version  int                         `json:"version"`
+	Blen4    int                         `json:"blen4"`
+	Blen6    int                         `json:"blen6"`
+	Prefixes map[string]limitStatePrefix `json:"prefixes"`
+	Origins  map[uint32]int64            `json:"origins,omitempty"`
+	Blocks   map[uint64]int64            `json:"blocks,omitempty"`
+	Peers    map[string]int64            `json:"peers,omitempty"`
+}
+
+// limitStatePrefix is an accepted prefix in limitState
+type limitStatePrefix struct {
+	Origins []uint32 `json:"origins,omitempty"`
+	Peers   []string `json:"peers,omitempty"`
+}
+
+// limitStateKey returns the limitState.Prefixes key for p: the prefix,
+// followed by "#" and the ADD-PATH path ID if non-zero
+func limitStateKey(p nlri.NLRI) string {
+	if p.Path == 0 {
+		return p.Prefix.String()
+	}
+	return p.Prefix.String() + "#" + strconv.FormatUint(uint64(p.Path), 10)
+}
+
+// parseLimitStateKey is the reverse of limitStateKey
+func parseLimitStateKey(key string) (nlri.NLRI, error) {
+	ps, id, ok := strings.Cut(key, "#")
+	prefix, err := netip.ParsePrefix(ps)
+	if err != nil {
+		return nlri.NLRI{}, err
+	}
+	p := nlri.FromPrefix(prefix)
+	if ok {
+		path, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return nlri.NLRI{}, fmt.Errorf("%s: invalid path ID: %w", key, err)
+		}
+		p.Path = uint32(path)
+	}
+	return p, nil
+}
+
+// saveState writes the prefix database to --state, atomically
+// via a temporary file in the same directory
+func (s *Limit) saveState() error {
+	st := limitState{
+		Version:  limit_state_version,
+		Blen4:    s.blen4,
+		Blen6:    s.blen6,
+		Prefixes: make(map[string]limitStatePrefix),
+		Origins:  make(map[uint32]int64),
+		Blocks:   make(map[uint64]int64),
+		Peers:    make(map[string]int64),
+	}
+	s.session.Range(func(p nlri.NLRI, pp *limitPrefix) bool {
+		pp.Lock()
+		if pp.accepted && !pp.dropped {
+			st.Prefixes[limitStateKey(p)] = limitStatePrefix{
+				Origins: slices.Clone(pp.origins),
+				Peers:   slices.Clone(pp.peers),
+			}
+		}
+		pp.Unlock()
+		return true
+	})
+	s.origin.Range(func(origin uint32, c *limitCounter) bool {
+		c.Lock()
+		if c.counter > 0 {
+			st.Origins[origin] = c.counter
+		}
+		c.Unlock()
+		return true
+	})
+	s.block.Range(func(block uint64, c *limitCounter) bool {
+		c.Lock()
+		if c.counter > 0 {
+			st.Blocks[block] = c.counter
+		}
+		c.Unlock()
+		return true
+	})
+	s.peer.Range(func(peer string, c *limitCounter) bool {
+		c.Lock()
+		if c.counter > 0 {
+			st.Peers[peer] = c.counter
+		}
+		c.Unlock()
+		return true
+	})
+
+	buf, err := json.Marshal(&st)
+	if err != nil {
+		return err
+	}
+
+	fh, err := os.CreateTemp(filepath.Dir(s.opt_state), filepath.Base(s.opt_state)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = fh.Write(buf); err == nil {
+		err = fh.Sync()
+	}
+	if err2 := fh.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(fh.Name(), s.opt_state)
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+		return err
+	}
+
+	s.Debug().Msgf("saved %d prefixes to %s", len(st.Prefixes), s.opt_state)
+	return nil
+}
+
+// loadState restores the prefix database from --state, if possible
+func (s *Limit) loadState() {
+	buf, err := os.ReadFile(s.opt_state)
+	if os.IsNotExist(err) {
+		s.Info().Msgf("%s does not exist yet, starting with empty state", s.opt_state)
+		return
+	} else if err != nil {
+		s.Warn().Err(err).Msgf("could not read %s, starting with empty state", s.opt_state)
+		return
+	}
+
+	var st limitState
+	if err := json.Unmarshal(buf, &st); err != nil {
+		s.Warn().Err(err).Msgf("could not parse %s, starting with empty state", s.opt_state)
+		return
+	}
+	if st.Version != limit_state_version {
+		s.Warn().Msgf("%s: incompatible version %d (need %d), starting with empty state",
+			s.opt_state, st.Version, limit_state_version)
+		return
+	}
+	if st.Blen4 != s.blen4 || st.Blen6 != s.blen6 {
+		s.Warn().Msgf("%s: saved with different --block-length, starting with empty state", s.opt_state)
+		return
+	}
+
+	for key, sp := range st.Prefixes {
+		p, err := parseLimitStateKey(key)
+		if err != nil {
+			s.Warn().Err(err).Msgf("%s: skipping invalid prefix", s.opt_state)
+			continue
+		}
+		pp := newLimitPrefix()
+		pp.accepted = true
+		pp.origins = append(pp.origins, sp.Origins...)
+		pp.peers = sp.Peers
+		s.session.Store(p, pp)
+	}
+	for origin, n := range st.Origins {
+		s.origin.Store(origin, &limitCounter{counter: n})
+	}
+	for block, n := range st.Blocks {
+		s.block.Store(block, &limitCounter{counter: n})
+	}
+	for peer, n := range st.Peers {
+		s.peer.Store(peer, &limitCounter{counter: n})
+	}
+
+	s.Info().Msgf("restored %d prefixes from %s", s.session.Size(), s.opt_state)
+}
@@ -0,0 +1,124 @@
+package stages
+
+import (
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/nlri"
+)
+
+// testPrefixes returns the NLRI for given prefixes
+func testPrefixes(ps ...string) []nlri.NLRI {
+	var dst []nlri.NLRI
+	for _, p := range ps {
+		dst = append(dst, nlri.FromPrefix(netip.MustParsePrefix(p)))
+	}
+	return dst
+}
+
+func TestLimitCheckUnreach(t *testing.T) {
+	sb := testStage(t, "limit", "--ipv4", "--max-length", "24")
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatalf("Attach: %v", err)
+	}
+	s := sb.Stage.(*Limit)
+
+	for _, tc := range []struct {
+		name          string
+		reach         []string
+		unreach       []string
+		before, after int
+	}{
+		{"none dropped", []string{"192.0.2.0/24"}, []string{"10.0.0.0/24", "10.1.0.0/16"}, 2, 2},
+		{"one dropped", []string{"192.0.2.0/24", "198.51.100.0/24"}, []string{"10.0.0.0/24", "10.1.0.0/25"}, 2, 1},
+		{"all dropped", []string{"192.0.2.0/24"}, []string{"10.1.0.0/25"}, 1, 0},
+		{"no reach", nil, []string{"10.0.0.0/24", "10.1.0.0/25", "10.2.0.0/26"}, 3, 1},
+	} {
+		m := msg.NewMsg().Use(msg.UPDATE)
+		u := &m.Update
+		u.Reach = testPrefixes(tc.reach...)
+		u.Unreach = testPrefixes(tc.unreach...)
+
+		before, after := s.checkUnreach(u)
+		if before != tc.before || after != tc.after {
+			t.Errorf("%s: got before=%d after=%d, want %d %d", tc.name, before, after, tc.before, tc.after)
+		}
+		if len(u.Unreach) != tc.after {
+			t.Errorf("%s: got %d withdrawals left, want %d", tc.name, len(u.Unreach), tc.after)
+		}
+		if len(u.Reach) != len(tc.reach) {
+			t.Errorf("%s: reach modified: %v", tc.name, u.Reach)
+		}
+	}
+}
+
+func TestLimitStateKey(t *testing.T) {
+	p := nlri.FromPrefix(netip.MustParsePrefix("192.0.2.0/24"))
+	p7 := p
+	p7.Path = 7
+	for _, tc := range []struct {
+		p   nlri.NLRI
+		key string
+	}{
+		{p, "192.0.2.0/24"},
+		{p7, "192.0.2.0/24#7"},
+	} {
+		key := limitStateKey(tc.p)
+		if key != tc.key {
+			t.Errorf("limitStateKey(%v): got %q, want %q", tc.p, key, tc.key)
+		}
+		got, err := parseLimitStateKey(key)
+		if err != nil || got != tc.p {
+			t.Errorf("parseLimitStateKey(%q): got %v %v, want %v", key, got, err, tc.p)
+		}
+	}
+	for _, key := range []string{"", "192.0.2.0", "192.0.2.0/24#", "192.0.2.0/24#x", "192.0.2.0/24#4294967296"} {
+		if _, err := parseLimitStateKey(key); err == nil {
+			t.Errorf("parseLimitStateKey(%q): expected an error", key)
+		}
+	}
+}
+
+func TestLimitStatePathID(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "state.json")
+	limit := func() *Limit {
+		sb := testStage(t, "limit", "--state", state)
+		if err := sb.Stage.Attach(); err != nil {
+			t.Fatalf("Attach: %v", err)
+		}
+		return sb.Stage.(*Limit)
+	}
+
+	// the same prefix, with and without ADD-PATH
+	var want []nlri.NLRI
+	s := limit()
+	for _, id := range []uint32{0, 1, 2} {
+		p := nlri.FromPrefix(netip.MustParsePrefix("192.0.2.0/24"))
+		p.Path = id
+		pp := newLimitPrefix()
+		pp.accepted = true
+		pp.origins = []uint32{65000 + id}
+		s.session.Store(p, pp)
+		want = append(want, p)
+	}
+	if err := s.saveState(); err != nil {
+		t.Fatalf("saveState: %v", err)
+	}
+
+	s = limit()
+	s.loadState()
+	if n := s.session.Size(); n != len(want) {
+		t.Fatalf("got %d prefixes, want %d", n, len(want))
+	}
+	for _, p := range want {
+		pp, ok := s.session.Load(p)
+		if !ok {
+			t.Errorf("%s path %d: not restored", p.Prefix, p.Path)
+		} else if !slices.Equal(pp.origins, []uint32{65000 + p.Path}) {
+			t.Errorf("%s path %d: got origins %v", p.Prefix, p.Path, pp.origins)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"runtime"
+	"syscall"
 	"time"
 
 	"github.com/bgpfix/bgpfix/pipe"
@@ -14,8 +15,9 @@ type Listen struct {
 	*core.StageBase
 	in *pipe.Input
 
-	bind string
-	conn net.Conn
+	bind    string
+	conn    net.Conn
+	control func(net, addr string, c syscall.RawConn) error // socket options
 }
 
 func NewListen(parent *core.StageBase) core.Stage {
@@ -30,11 +32,15 @@ func NewListen(parent *core.StageBase) core.Stage {
 	if runtime.GOOS == "linux" {
 		f.String("md5", "", "TCP MD5 password")
 	}
+	tcp_flags(f)
 	o.Args = []string{"addr"}
 
 	o.Descr = "wait for a BGP client to connect over TCP"
 	o.IsProducer = true
 	o.IsConsumer = true
+	o.IsSession = true
+	o.IsListener = true
+	o.Secrets = []string{"md5"}
 
 	return s
 }
@@ -52,6 +58,11 @@ func (s *Listen) Attach() error {
 		s.bind += ":179" // best-effort try
 	}
 
+	// socket options
+	if s.control, err = tcp_sockopts(s.K); err != nil {
+		return err
+	}
+
 	s.in = s.P.AddInput(s.Dir)
 	return nil
 }
@@ -59,7 +70,7 @@ func (s *Listen) Attach() error {
 func (s *Listen) Prepare() error {
 	// listen
 	var lc net.ListenConfig
-	lc.Control = tcp_md5(s.K.String("md5"))
+	lc.Control = s.control
 	l, err := lc.Listen(s.Ctx, "tcp", s.bind)
 	if err != nil {
 		return err
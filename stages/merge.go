@@ -0,0 +1,176 @@
+package stages
+
+import (
+	"container/heap"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/bgpfix/bgpipe/core"
+)
+
+type Merge struct {
+	*core.StageBase
+	in *pipe.Input
+
+	opt_sources int           // --sources
+	opt_skew    time.Duration // --max-skew
+	opt_buffer  int           // --max-buffer
+
+	mu     sync.Mutex                // guards below
+	buf    mergeHeap                 // reorder buffer
+	last   map[*pipe.Input]time.Time // source -> last message time
+	newest time.Time                 // newest message time seen
+	seq    uint64                    // arrival counter, for stable ordering
+	output chan *msg.Msg             // messages to inject, in order
+}
+
+// mergeItem is a buffered message
+type mergeItem struct {
+	m   *msg.Msg
+	seq uint64
+}
+
+// mergeHeap is a min-heap of buffered messages, ordered by time
+type mergeHeap []mergeItem
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].m.Time.Equal(h[j].m.Time) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].m.Time.Before(h[j].m.Time)
+}
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x any)   { *h = append(*h, x.(mergeItem)) }
+func (h *mergeHeap) Pop() any {
+	old := *h
+	n := len(old)
+	it := old[n-1]
+	*h = old[:n-1]
+	return it
+}
+
+func NewMerge(parent *core.StageBase) core.Stage {
+	var (
+		s = &Merge{StageBase: parent}
+		o = &s.Options
+		f = o.Flags
+	)
+
+	o.Descr = "merge messages from several sources in time order"
+	o.IsProducer = true
+
+	f.Int("sources", 0, "wait for messages from this many sources before emitting (0 = any)")
+	f.Duration("max-skew", time.Minute, "emit messages older than the newest one by this much (0 = never)")
+	f.Int("max-buffer", 100000, "max number of messages to buffer")
+
+	s.last = make(map[*pipe.Input]time.Time)
+	s.output = make(chan *msg.Msg, 100)
+	return s
+}
+
+func (s *Merge) Attach() error {
+	k := s.K
+
+	s.opt_sources = k.Int("sources")
+	s.opt_skew = k.Duration("max-skew")
+	s.opt_buffer = k.Int("max-buffer")
+	if s.opt_buffer <= 0 {
+		return errors.New("--max-buffer must be positive")
+	}
+
+	s.P.OnMsg(s.onMsg, s.Dir)
+	s.in = s.P.AddInput(s.Dir)
+	return nil
+}
+
+func (s *Merge) Run() error {
+	for m := range s.output {
+		if err := s.in.WriteMsg(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop flushes the buffer
+func (s *Merge) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.buf.Len() > 0 {
+		s.pop()
+	}
+	close_safe(s.output)
+	return nil
+}
+
+func (s *Merge) onMsg(m *msg.Msg) bool {
+	// no timestamp? treat as already ordered
+	if m.Time.IsZero() {
+		return true
+	}
+
+	// which source?
+	mx := pipe.MsgContext(m)
+	src := mx.Input
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// update the source watermark
+	if t, ok := s.last[src]; !ok || m.Time.After(t) {
+		s.last[src] = m.Time
+	}
+	if m.Time.After(s.newest) {
+		s.newest = m.Time
+	}
+
+	// keep it
+	mx.Action.Borrow()
+	s.seq++
+	heap.Push(&s.buf, mergeItem{m, s.seq})
+
+	// emit what's ready
+	s.flush()
+	return false
+}
+
+// flush emits buffered messages that are safe to emit. Must be called with s.mu locked.
+func (s *Merge) flush() {
+	// the lowest time all sources advanced to
+	var mark time.Time
+	if len(s.last) >= s.opt_sources {
+		for _, t := range s.last {
+			if mark.IsZero() || t.Before(mark) {
+				mark = t
+			}
+		}
+	}
+
+	for s.buf.Len() > 0 {
+		t := s.buf[0].m.Time
+		switch {
+		case !mark.IsZero() && !t.After(mark):
+			// all sources past it
+		case s.opt_skew > 0 && s.newest.Sub(t) > s.opt_skew:
+			// too old
+		case s.buf.Len() > s.opt_buffer:
+			// buffer full
+		default:
+			return
+		}
+		s.pop()
+	}
+}
+
+// pop emits the oldest buffered message. Must be called with s.mu locked.
+func (s *Merge) pop() {
+	it := heap.Pop(&s.buf).(mergeItem)
+	if !send_safe(s.output, it.m) {
+		s.P.PutMsg(it.m)
+	}
+}
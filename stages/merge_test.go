@@ -0,0 +1,151 @@
+package stages
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+)
+
+// testMerge returns an attached merge stage with given CLI flags
+func testMerge(t *testing.T, args ...string) *Merge {
+	t.Helper()
+	sb := testStage(t, "merge", args...)
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatal(err)
+	}
+	return sb.Stage.(*Merge)
+}
+
+// feed sends a message from src with time t0+sec (none if negative) to s,
+// returning true iff it passed as-is
+func (s *Merge) feed(src *pipe.Input, t0 time.Time, sec int) bool {
+	m := msg.NewMsg().Use(msg.UPDATE)
+	if sec >= 0 {
+		m.Time = t0.Add(time.Duration(sec) * time.Second)
+	}
+	pipe.MsgContext(m).Input = src
+	return s.onMsg(m)
+}
+
+// emitted returns the message times emitted so far, as seconds since t0
+func (s *Merge) emitted(t0 time.Time) (secs []int) {
+	for {
+		select {
+		case m, ok := <-s.output:
+			if !ok {
+				return
+			}
+			secs = append(secs, int(m.Time.Sub(t0)/time.Second))
+		default:
+			return
+		}
+	}
+}
+
+func checkSecs(t *testing.T, what string, got []int, want ...int) {
+	t.Helper()
+	if !slices.Equal(got, want) {
+		t.Errorf("%s: got %v, want %v", what, got, want)
+	}
+}
+
+func TestMergeInterleaved(t *testing.T) {
+	s := testMerge(t, "--sources", "2", "--max-skew", "0")
+	a, b := &pipe.Input{Name: "a"}, &pipe.Input{Name: "b"}
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// source a arrives first: nothing emitted until b shows up
+	for _, sec := range []int{1, 3, 5} {
+		s.feed(a, t0, sec)
+	}
+	checkSecs(t, "only a", s.emitted(t0))
+
+	// b advances the watermark step by step
+	s.feed(b, t0, 2)
+	checkSecs(t, "b at 2", s.emitted(t0), 1, 2)
+	s.feed(b, t0, 4)
+	checkSecs(t, "b at 4", s.emitted(t0), 3, 4)
+	s.feed(b, t0, 6)
+	checkSecs(t, "b at 6", s.emitted(t0), 5)
+
+	// the rest on stop
+	s.Stop()
+	checkSecs(t, "stop", s.emitted(t0), 6)
+}
+
+func TestMergeNoTime(t *testing.T) {
+	s := testMerge(t, "--sources", "2")
+	a := &pipe.Input{Name: "a"}
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if !s.feed(a, t0, -1) {
+		t.Error("message without a timestamp not passed as-is")
+	}
+	if s.feed(a, t0, 1) {
+		t.Error("message with a timestamp passed as-is")
+	}
+	if s.buf.Len() != 1 {
+		t.Errorf("got %d buffered messages, want 1", s.buf.Len())
+	}
+}
+
+func TestMergeSkew(t *testing.T) {
+	s := testMerge(t, "--sources", "2", "--max-skew", "1m")
+	a := &pipe.Input{Name: "a"}
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// the other source never shows up
+	s.feed(a, t0, 0)
+	s.feed(a, t0, 30)
+	checkSecs(t, "within skew", s.emitted(t0))
+	s.feed(a, t0, 61)
+	checkSecs(t, "past skew", s.emitted(t0), 0)
+	s.feed(a, t0, 120)
+	checkSecs(t, "past skew", s.emitted(t0), 30)
+}
+
+func TestMergeBuffer(t *testing.T) {
+	s := testMerge(t, "--sources", "2", "--max-skew", "0", "--max-buffer", "2")
+	a := &pipe.Input{Name: "a"}
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, sec := range []int{4, 2, 3, 1} {
+		s.feed(a, t0, sec)
+	}
+	checkSecs(t, "buffer full", s.emitted(t0), 2, 1)
+	s.Stop()
+	checkSecs(t, "stop", s.emitted(t0), 3, 4)
+}
+
+func TestMergeStable(t *testing.T) {
+	s := testMerge(t, "--sources", "2", "--max-skew", "0")
+	a, b := &pipe.Input{Name: "a"}, &pipe.Input{Name: "b"}
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// same time: keep the arrival order
+	var want []*msg.Msg
+	for _, src := range []*pipe.Input{a, b, a, b} {
+		m := msg.NewMsg().Use(msg.UPDATE)
+		m.Time = t0
+		pipe.MsgContext(m).Input = src
+		s.onMsg(m)
+		want = append(want, m)
+	}
+	s.Stop()
+
+	var got []*msg.Msg
+	for m := range s.output {
+		got = append(got, m)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d messages, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("message %d out of arrival order", i)
+		}
+	}
+}
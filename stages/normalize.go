@@ -0,0 +1,181 @@
+package stages
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/bgpfix/bgpfix/afi"
+	"github.com/bgpfix/bgpfix/attrs"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/nlri"
+	"github.com/bgpfix/bgpipe/core"
+)
+
+// max number of ASNs in a single AS_PATH segment
+const aspath_seg_max = 255
+
+type Normalize struct {
+	*core.StageBase
+
+	opt_legacy bool // --ipv4-legacy
+}
+
+func NewNormalize(parent *core.StageBase) core.Stage {
+	var (
+		s = &Normalize{StageBase: parent}
+		o = &s.Options
+		f = o.Flags
+	)
+
+	o.Descr = "re-encode UPDATEs in a canonical form"
+	o.Bidir = true
+
+	f.Bool("ipv4-legacy", false, "move IPv4 unicast prefixes from MP attributes to legacy fields")
+
+	return s
+}
+
+func (s *Normalize) Attach() error {
+	s.opt_legacy = s.K.Bool("ipv4-legacy")
+	s.P.OnMsg(s.onUpdate, s.Dir, msg.UPDATE)
+	return nil
+}
+
+// onUpdate normalizes UPDATE m in place, without changing its meaning.
+// Marks m as modified, so it gets re-marshaled with the attributes in code order.
+func (s *Normalize) onUpdate(m *msg.Msg) bool {
+	u := &m.Update
+	ats := &u.Attrs
+
+	// IPv4 unicast in legacy fields?
+	if s.opt_legacy {
+		s.legacyIPv4(u)
+	}
+
+	// prefixes
+	u.Reach = norm_prefixes(u.Reach)
+	u.Unreach = norm_prefixes(u.Unreach)
+	for _, ac := range []attrs.Code{attrs.ATTR_MP_REACH, attrs.ATTR_MP_UNREACH} {
+		if mpp := u.MP(ac).Prefixes(); mpp != nil {
+			mpp.Prefixes = norm_prefixes(mpp.Prefixes)
+		}
+	}
+
+	// AS_PATH and AS4_PATH
+	for _, ac := range []attrs.Code{attrs.ATTR_ASPATH, attrs.ATTR_AS4PATH} {
+		if ap, ok := ats.Get(ac).(*attrs.Aspath); ok && ap != nil {
+			norm_aspath(ap)
+		}
+	}
+
+	// communities
+	if com := u.Community(); com != nil {
+		norm_community(com)
+	}
+	if lc := u.LargeCom(); lc != nil {
+		norm_largecom(lc)
+	}
+
+	m.Modified()
+	return true
+}
+
+// legacyIPv4 moves IPv4 unicast prefixes from MP_REACH and MP_UNREACH in u
+// to the legacy NLRI fields, along with the next-hop
+func (s *Normalize) legacyIPv4(u *msg.Update) {
+	ats := &u.Attrs
+
+	// NB: can't merge with legacy prefixes that have a different next-hop
+	if mpp := u.MP(attrs.ATTR_MP_REACH).Prefixes(); mpp != nil && mpp.AS == afi.AS_IPV4_UNICAST &&
+		mpp.NextHop.Is4() && (len(u.Reach) == 0 || u.NextHop() == mpp.NextHop) {
+		if nh, ok := ats.Use(attrs.ATTR_NEXTHOP).(*attrs.IP); ok {
+			nh.Addr = mpp.NextHop
+			u.Reach = append(u.Reach, mpp.Prefixes...)
+			ats.Drop(attrs.ATTR_MP_REACH)
+		}
+	}
+
+	if mpp := u.MP(attrs.ATTR_MP_UNREACH).Prefixes(); mpp != nil && mpp.AS == afi.AS_IPV4_UNICAST {
+		u.Unreach = append(u.Unreach, mpp.Prefixes...)
+		ats.Drop(attrs.ATTR_MP_UNREACH)
+	}
+}
+
+// norm_prefixes sorts prefixes and drops duplicates
+func norm_prefixes(prefixes []nlri.NLRI) []nlri.NLRI {
+	slices.SortFunc(prefixes, func(a, b nlri.NLRI) int {
+		return cmp.Or(
+			a.Addr().Compare(b.Addr()),
+			cmp.Compare(a.Bits(), b.Bits()),
+			cmp.Compare(a.Path, b.Path),
+		)
+	})
+	return slices.Compact(prefixes)
+}
+
+// norm_aspath merges adjacent AS_SEQUENCE segments where they fit in one segment,
+// and sorts the ASNs in AS_SET segments, dropping duplicates. Keeps prepends.
+func norm_aspath(ap *attrs.Aspath) {
+	var dst []attrs.Segment
+	for _, seg := range ap.Segments {
+		if seg.IsSet {
+			slices.Sort(seg.List)
+			seg.List = slices.Compact(seg.List)
+		} else if l := len(dst); l > 0 && !dst[l-1].IsSet && len(dst[l-1].List)+len(seg.List) <= aspath_seg_max {
+			dst[l-1].List = slices.Concat(dst[l-1].List, seg.List)
+			continue
+		}
+		dst = append(dst, seg)
+	}
+	ap.Segments = dst
+}
+
+// norm_community sorts standard communities, dropping duplicates
+func norm_community(com *attrs.Community) {
+	idx := make([]int, len(com.ASN))
+	for i := range idx {
+		idx[i] = i
+	}
+	slices.SortFunc(idx, func(a, b int) int {
+		return cmp.Or(
+			cmp.Compare(com.ASN[a], com.ASN[b]),
+			cmp.Compare(com.Value[a], com.Value[b]),
+		)
+	})
+
+	var asn, val []uint16
+	for n, i := range idx {
+		if n > 0 && com.ASN[i] == asn[len(asn)-1] && com.Value[i] == val[len(val)-1] {
+			continue // duplicate
+		}
+		asn = append(asn, com.ASN[i])
+		val = append(val, com.Value[i])
+	}
+	com.ASN, com.Value = asn, val
+}
+
+// norm_largecom sorts large communities, dropping duplicates
+func norm_largecom(lc *attrs.LargeCom) {
+	idx := make([]int, len(lc.ASN))
+	for i := range idx {
+		idx[i] = i
+	}
+	slices.SortFunc(idx, func(a, b int) int {
+		return cmp.Or(
+			cmp.Compare(lc.ASN[a], lc.ASN[b]),
+			cmp.Compare(lc.Value1[a], lc.Value1[b]),
+			cmp.Compare(lc.Value2[a], lc.Value2[b]),
+		)
+	})
+
+	var asn, v1, v2 []uint32
+	for n, i := range idx {
+		if n > 0 && lc.ASN[i] == asn[len(asn)-1] && lc.Value1[i] == v1[len(v1)-1] && lc.Value2[i] == v2[len(v2)-1] {
+			continue // duplicate
+		}
+		asn = append(asn, lc.ASN[i])
+		v1 = append(v1, lc.Value1[i])
+		v2 = append(v2, lc.Value2[i])
+	}
+	lc.ASN, lc.Value1, lc.Value2 = asn, v1, v2
+}
@@ -0,0 +1,85 @@
+package stages
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/bgpfix/bgpfix/attrs"
+	"github.com/bgpfix/bgpfix/caps"
+	"github.com/bgpfix/bgpfix/msg"
+)
+
+// testNormalizable returns an UPDATE with unsorted, duplicate and split values
+func testNormalizable() *msg.Msg {
+	m := testUpdate(0, []string{"192.0.2.0/24", "10.0.0.0/8", "192.0.2.0/24"}, []string{"198.51.100.0/24", "10.1.0.0/16"})
+	u := &m.Update
+
+	ap := u.Attrs.Use(attrs.ATTR_ASPATH).(*attrs.Aspath)
+	ap.Segments = []attrs.Segment{
+		{List: []uint32{65001, 65001}},
+		{List: []uint32{65002}},
+		{IsSet: true, List: []uint32{65005, 65003, 65005}},
+	}
+
+	com := u.Attrs.Use(attrs.ATTR_COMMUNITY).(*attrs.Community)
+	com.ASN = []uint16{65002, 65001, 65002}
+	com.Value = []uint16{1, 2, 1}
+
+	lc := u.Attrs.Use(attrs.ATTR_LARGE_COMMUNITY).(*attrs.LargeCom)
+	lc.ASN = []uint32{65002, 65001}
+	lc.Value1 = []uint32{1, 1}
+	lc.Value2 = []uint32{2, 2}
+	return m
+}
+
+// testNormalState returns the normalized parts of UPDATE m as text
+func testNormalState(m *msg.Msg) string {
+	u := &m.Update
+	return fmt.Sprint(u.Reach, u.Unreach, u.AsPath().Segments, *u.Community(), *u.LargeCom())
+}
+
+func TestNormalizeIdempotent(t *testing.T) {
+	sb := testStage(t, "normalize")
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatal(err)
+	}
+	s := sb.Stage.(*Normalize)
+
+	m := testNormalizable()
+	norm := func() (string, []byte) {
+		s.onUpdate(m)
+		if err := m.Marshal(caps.Caps{}); err != nil {
+			t.Fatal(err)
+		}
+		return testNormalState(m), slices.Clone(m.Data)
+	}
+
+	state1, data1 := norm()
+	state2, data2 := norm()
+	if state1 != state2 {
+		t.Errorf("not idempotent:\n 1st: %s\n 2nd: %s", state1, state2)
+	}
+	if !bytes.Equal(data1, data2) {
+		t.Errorf("not idempotent:\n 1st: %x\n 2nd: %x", data1, data2)
+	}
+
+	// and actually normalized
+	u := &m.Update
+	if got := fmt.Sprint(u.Reach); got != "[10.0.0.0/8 192.0.2.0/24]" {
+		t.Errorf("reach: got %s", got)
+	}
+	if got := fmt.Sprint(u.AsPath().Segments); got != fmt.Sprint([]attrs.Segment{
+		{List: []uint32{65001, 65001, 65002}},
+		{IsSet: true, List: []uint32{65003, 65005}},
+	}) {
+		t.Errorf("AS_PATH: got %s", got)
+	}
+	if com := u.Community(); !slices.Equal(com.ASN, []uint16{65001, 65002}) || !slices.Equal(com.Value, []uint16{2, 1}) {
+		t.Errorf("communities: got %v %v", com.ASN, com.Value)
+	}
+	if lc := u.LargeCom(); !slices.Equal(lc.ASN, []uint32{65001, 65002}) {
+		t.Errorf("large communities: got %v", lc.ASN)
+	}
+}
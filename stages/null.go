@@ -0,0 +1,101 @@
+package stages
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/bgpfix/bgpipe/core"
+)
+
+type Null struct {
+	*core.StageBase
+
+	msgs  atomic.Uint64 // messages discarded
+	bytes atomic.Uint64 // bytes discarded (wire format)
+
+	start time.Time     // when Run started
+	cpu   time.Duration // CPU time when Run started
+	stop  chan struct{} // closed on Stop()
+	once  sync.Once     // report only once
+}
+
+func NewNull(parent *core.StageBase) core.Stage {
+	s := &Null{StageBase: parent}
+
+	o := &s.Options
+	o.Descr = "discard messages and report throughput"
+	o.Bidir = true
+
+	s.stop = make(chan struct{})
+	return s
+}
+
+func (s *Null) Attach() error {
+	cb := s.P.OnMsg(s.discard, s.Dir)
+	cb.Post = true
+	cb.Order = math.MaxInt // always run as very last
+
+	// report also when the pipe stops before us
+	s.P.Options.OnEvent(s.onPipeStop, pipe.EVENT_STOP)
+	return nil
+}
+
+// Counters implements core.StageCounters
+func (s *Null) Counters() map[string]any {
+	return map[string]any{
+		"msgs":  s.msgs.Load(),
+		"bytes": s.bytes.Load(),
+	}
+}
+
+func (s *Null) discard(m *msg.Msg) bool {
+	s.msgs.Add(1)
+	s.bytes.Add(uint64(m.Length()))
+	return false
+}
+
+func (s *Null) Run() error {
+	s.start = time.Now()
+	s.cpu = cpu_time()
+
+	select {
+	case <-s.stop:
+	case <-s.Ctx.Done():
+	}
+
+	s.report()
+	return nil
+}
+
+func (s *Null) onPipeStop(ev *pipe.Event) bool {
+	s.report()
+	return false
+}
+
+// report logs the stage throughput
+func (s *Null) report() {
+	s.once.Do(func() {
+		var (
+			wall  = time.Since(s.start)
+			cpu   = cpu_time() - s.cpu
+			msgs  = s.msgs.Load()
+			bytes = s.bytes.Load()
+			secs  = max(wall.Seconds(), 1e-9)
+		)
+		s.Info().
+			Uint64("msgs", msgs).
+			Uint64("bytes", bytes).
+			Stringer("wall", wall.Round(time.Millisecond)).
+			Stringer("cpu", cpu.Round(time.Millisecond)).
+			Msgf("discarded %.0f msg/s, %.2f MB/s", float64(msgs)/secs, float64(bytes)/secs/1e6)
+	})
+}
+
+func (s *Null) Stop() error {
+	close_safe(s.stop)
+	return nil
+}
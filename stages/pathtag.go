@@ -0,0 +1,110 @@
+package stages
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/bgpfix/bgpfix/attrs"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/bgpfix/bgpipe/core"
+)
+
+type PathTag struct {
+	*core.StageBase
+
+	opt_watch []uint32 // --watch
+}
+
+func NewPathTag(parent *core.StageBase) core.Stage {
+	var (
+		s = &PathTag{StageBase: parent}
+		o = &s.Options
+		f = o.Flags
+	)
+
+	o.Descr = "tag UPDATEs with origin, upstream and transit ASNs"
+	o.Bidir = true
+
+	f.StringSlice("watch", nil, "tag if given transit ASNs appear in the path")
+
+	return s
+}
+
+func (s *PathTag) Attach() error {
+	for _, v := range s.K.Strings("watch") {
+		asn, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return fmt.Errorf("--watch %s: %w", v, err)
+		}
+		s.opt_watch = append(s.opt_watch, uint32(asn))
+	}
+
+	s.P.OnMsg(s.onUpdate, s.Dir, msg.UPDATE)
+	return nil
+}
+
+// onUpdate adds path/* tags to UPDATE m. Never drops m.
+func (s *PathTag) onUpdate(m *msg.Msg) bool {
+	ap, ok := m.Update.Attrs.Get(attrs.ATTR_ASPATH).(*attrs.Aspath)
+	if !ok || ap == nil {
+		return true // eg. withdrawal
+	}
+
+	tags := pipe.MsgContext(m).UseTags()
+	tags["path/length"] = strconv.Itoa(ap.Len())
+
+	// walk the path from the origin, skipping prepends
+	var (
+		origin, upstream uint32
+		hops             int
+	)
+	for i := len(ap.Segments) - 1; i >= 0 && hops < 2; i-- {
+		seg := &ap.Segments[i]
+		if seg.IsSet {
+			break // can't tell which ASN is next
+		}
+		for j := len(seg.List) - 1; j >= 0 && hops < 2; j-- {
+			asn := seg.List[j]
+			switch {
+			case hops == 0:
+				origin = asn
+				hops++
+			case asn != origin:
+				upstream = asn
+				hops++
+			}
+		}
+	}
+	if hops > 0 {
+		tags["path/origin"] = strconv.FormatUint(uint64(origin), 10)
+	}
+	if hops > 1 {
+		tags["path/upstream"] = strconv.FormatUint(uint64(upstream), 10)
+	}
+
+	// any AS_SET?
+	if slices.ContainsFunc(ap.Segments, func(seg attrs.Segment) bool { return seg.IsSet }) {
+		tags["path/set"] = "true"
+	}
+
+	// watched ASNs
+	for _, asn := range s.opt_watch {
+		if path_contains(ap, asn) {
+			tags["path/contains-"+strconv.FormatUint(uint64(asn), 10)] = "true"
+		}
+	}
+
+	return true
+}
+
+// path_contains returns true iff asn appears anywhere in ap
+func path_contains(ap *attrs.Aspath, asn uint32) bool {
+	for i := range ap.Segments {
+		if slices.Contains(ap.Segments[i].List, asn) {
+			return true
+		}
+	}
+	return false
+}
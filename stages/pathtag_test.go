@@ -0,0 +1,105 @@
+package stages
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/bgpfix/bgpfix/attrs"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+)
+
+func TestPathTagShapes(t *testing.T) {
+	sb := testStage(t, "path-tag", "--watch", "65100,65200")
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatal(err)
+	}
+	s := sb.Stage.(*PathTag)
+
+	seq := func(asns ...uint32) attrs.Segment { return attrs.Segment{List: asns} }
+	set := func(asns ...uint32) attrs.Segment { return attrs.Segment{IsSet: true, List: asns} }
+
+	tests := []struct {
+		name string
+		segs []attrs.Segment
+		want map[string]string
+	}{
+		{"empty", nil, map[string]string{
+			"path/length": "0",
+		}},
+		{"single AS", []attrs.Segment{seq(65001)}, map[string]string{
+			"path/length": "1",
+			"path/origin": "65001",
+		}},
+		{"plain", []attrs.Segment{seq(65000, 65100, 65001)}, map[string]string{
+			"path/length":         "3",
+			"path/origin":         "65001",
+			"path/upstream":       "65100",
+			"path/contains-65100": "true",
+		}},
+		{"origin prepends", []attrs.Segment{seq(65000, 65002, 65001, 65001, 65001)}, map[string]string{
+			"path/length":   "5",
+			"path/origin":   "65001",
+			"path/upstream": "65002",
+		}},
+		{"only prepends", []attrs.Segment{seq(65001, 65001, 65001)}, map[string]string{
+			"path/length": "3",
+			"path/origin": "65001",
+		}},
+		{"upstream prepends", []attrs.Segment{seq(65000, 65200, 65200, 65001)}, map[string]string{
+			"path/length":         "4",
+			"path/origin":         "65001",
+			"path/upstream":       "65200",
+			"path/contains-65200": "true",
+		}},
+		{"split segments", []attrs.Segment{seq(65000, 65002), seq(65001)}, map[string]string{
+			"path/length":   "3",
+			"path/origin":   "65001",
+			"path/upstream": "65002",
+		}},
+		{"AS_SET at origin", []attrs.Segment{seq(65000, 65002), set(65001, 65100)}, map[string]string{
+			"path/length":         "3",
+			"path/set":            "true",
+			"path/contains-65100": "true",
+		}},
+		{"AS_SET in transit", []attrs.Segment{set(65000, 65003), seq(65002, 65001)}, map[string]string{
+			"path/length":   "3",
+			"path/origin":   "65001",
+			"path/upstream": "65002",
+			"path/set":      "true",
+		}},
+		{"AS_SET before upstream", []attrs.Segment{seq(65000), set(65003), seq(65001, 65001)}, map[string]string{
+			"path/length": "4",
+			"path/origin": "65001",
+			"path/set":    "true",
+		}},
+	}
+	for _, tt := range tests {
+		m := msg.NewMsg().Use(msg.UPDATE)
+		ap := m.Update.Attrs.Use(attrs.ATTR_ASPATH).(*attrs.Aspath)
+		ap.Segments = tt.segs
+
+		if !s.onUpdate(m) {
+			t.Fatalf("%s: dropped", tt.name)
+		}
+		if got := pipe.MsgTags(m); !maps.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPathTagNoPath(t *testing.T) {
+	sb := testStage(t, "path-tag")
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatal(err)
+	}
+	s := sb.Stage.(*PathTag)
+
+	m := testUpdate(0, nil, []string{"192.0.2.0/24"})
+	if !s.onUpdate(m) {
+		t.Fatal("withdrawal dropped")
+	}
+	if pipe.HasTags(m) {
+		t.Errorf("withdrawal tagged: %v", pipe.MsgTags(m))
+	}
+}
@@ -0,0 +1,336 @@
+package stages
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bgpfix/bgpfix/attrs"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpipe/core"
+)
+
+type PolicyCom struct {
+	*core.StageBase
+	fpath string // mapping file
+
+	opt_asn    string        // --asn
+	opt_reload time.Duration // --reload
+
+	db    atomic.Pointer[map[uint32]*policyEntry] // ASN -> communities to add / remove
+	mtime time.Time                               // last file modification time
+	stop  chan struct{}                           // closed on Stop()
+
+	modified atomic.Uint64 // number of modified messages
+}
+
+// policyEntry lists communities to add and to remove for an ASN
+type policyEntry struct {
+	add [][]comField // communities to add (no wildcards)
+	del [][]comField // community patterns to remove
+}
+
+func NewPolicyCom(parent *core.StageBase) core.Stage {
+	var (
+		s = &PolicyCom{StageBase: parent}
+		o = &s.Options
+		f = o.Flags
+	)
+
+	o.Descr = "add or remove communities per ASN, using a mapping file"
+	o.Args = []string{"path"}
+	o.Bidir = true
+
+	f.String("asn", "origin", "ASN to look up: origin, neighbor (first in AS_PATH), or peer (from OPEN)")
+	f.Duration("reload", 0, "check the mapping file for changes every time interval (0 means never)")
+
+	s.stop = make(chan struct{})
+	return s
+}
+
+func (s *PolicyCom) Attach() error {
+	k := s.K
+
+	s.fpath = k.String("path")
+	if len(s.fpath) == 0 {
+		return errors.New("path must be set")
+	}
+	s.fpath = filepath.Clean(s.fpath)
+
+	switch v := k.String("asn"); v {
+	case "origin", "neighbor", "peer":
+		s.opt_asn = v
+	default:
+		return fmt.Errorf("--asn %s: need origin, neighbor, or peer", v)
+	}
+
+	s.opt_reload = k.Duration("reload")
+
+	s.P.OnMsg(s.onUpdate, s.Dir, msg.UPDATE)
+	return nil
+}
+
+func (s *PolicyCom) Prepare() error {
+	return s.load()
+}
+
+func (s *PolicyCom) Run() error {
+	if s.opt_reload <= 0 {
+		<-s.stop
+		return nil
+	}
+
+	ticker := time.NewTicker(s.opt_reload)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fi, err := os.Stat(s.fpath)
+			if err != nil {
+				s.Warn().Err(err).Msg("could not check the mapping file")
+				continue
+			}
+			if fi.ModTime().Equal(s.mtime) {
+				continue
+			}
+			if err := s.load(); err != nil {
+				s.Warn().Err(err).Msg("could not reload the mapping file, keeping the old one")
+			}
+		case <-s.stop:
+			return nil
+		case <-s.Ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (s *PolicyCom) Stop() error {
+	close_safe(s.stop)
+	return nil
+}
+
+// load reads the mapping file, with lines in the format: ASN +COMMUNITY... -COMMUNITY...
+// where + adds and - removes a standard or large community ("*" matches any field in -).
+// Repeated lines for the same ASN are merged.
+func (s *PolicyCom) load() error {
+	fh, err := os.Open(s.fpath)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	fi, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+
+	db := make(map[uint32]*policyEntry)
+	scan := bufio.NewScanner(fh)
+	for lineno := 1; scan.Scan(); lineno++ {
+		line := strings.TrimSpace(scan.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return fmt.Errorf("%s line %d: need ASN and communities", s.fpath, lineno)
+		}
+
+		asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(fields[0]), "AS"), 10, 32)
+		if err != nil {
+			return fmt.Errorf("%s line %d: invalid ASN: %w", s.fpath, lineno, err)
+		}
+
+		e := db[uint32(asn)]
+		if e == nil {
+			e = &policyEntry{}
+			db[uint32(asn)] = e
+		}
+		for _, v := range fields[1:] {
+			if len(v) < 2 || (v[0] != '+' && v[0] != '-') {
+				return fmt.Errorf("%s line %d: %s: need +COMMUNITY or -COMMUNITY", s.fpath, lineno, v)
+			}
+			com, err := parse_com(v[1:])
+			if err != nil {
+				return fmt.Errorf("%s line %d: %w", s.fpath, lineno, err)
+			}
+			if v[0] == '-' {
+				e.del = append(e.del, com)
+				continue
+			}
+			for _, f := range com {
+				if f.any {
+					return fmt.Errorf("%s line %d: %s: wildcards not allowed when adding", s.fpath, lineno, v)
+				}
+			}
+			e.add = append(e.add, com)
+		}
+	}
+	if err := scan.Err(); err != nil {
+		return err
+	}
+
+	s.Info().Msgf("loaded %d ASNs from %s", len(db), s.fpath)
+	s.db.Store(&db)
+	s.mtime = fi.ModTime()
+	return nil
+}
+
+// asn returns the ASN to look up for UPDATE m, or 0 if unknown
+func (s *PolicyCom) asn(m *msg.Msg) uint32 {
+	switch s.opt_asn {
+	case "peer":
+		if asn := s.SessionASN(m.Dir); asn > 0 {
+			return uint32(asn)
+		}
+	case "neighbor":
+		if ap := m.Update.AsPath(); ap != nil && len(ap.Segments) > 0 && len(ap.Segments[0].List) > 0 {
+			return ap.Segments[0].List[0]
+		}
+	default:
+		if ap := m.Update.AsPath(); ap != nil {
+			return ap.Origin()
+		}
+	}
+	return 0
+}
+
+func (s *PolicyCom) onUpdate(m *msg.Msg) bool {
+	u := &m.Update
+	if !u.HasReach() {
+		return true // nothing to do
+	}
+
+	asn := s.asn(m)
+	if asn == 0 {
+		return true
+	}
+	e := (*s.db.Load())[asn]
+	if e == nil {
+		return true // not in the mapping
+	}
+
+	var (
+		ats     = &u.Attrs
+		changed bool
+	)
+
+	// remove
+	if len(e.del) > 0 {
+		if com, ok := ats.Get(attrs.ATTR_COMMUNITY).(*attrs.Community); ok && com != nil {
+			if policy_del_std(com, e.del) {
+				changed = true
+				if len(com.ASN) == 0 {
+					ats.Drop(attrs.ATTR_COMMUNITY)
+				}
+			}
+		}
+		if lc, ok := ats.Get(attrs.ATTR_LARGE_COMMUNITY).(*attrs.LargeCom); ok && lc != nil {
+			if policy_del_large(lc, e.del) {
+				changed = true
+				if len(lc.ASN) == 0 {
+					ats.Drop(attrs.ATTR_LARGE_COMMUNITY)
+				}
+			}
+		}
+	}
+
+	// add
+	for _, c := range e.add {
+		if len(c) == 2 {
+			com, ok := ats.Use(attrs.ATTR_COMMUNITY).(*attrs.Community)
+			if ok && !policy_has_std(com, c) {
+				com.Add(uint16(c[0].val), uint16(c[1].val))
+				changed = true
+			}
+		} else {
+			lc, ok := ats.Use(attrs.ATTR_LARGE_COMMUNITY).(*attrs.LargeCom)
+			if ok && !policy_has_large(lc, c) {
+				lc.Add(c[0].val, c[1].val, c[2].val)
+				changed = true
+			}
+		}
+	}
+
+	if changed {
+		s.modified.Add(1)
+		m.Modified()
+	}
+	return true
+}
+
+// policy_del_std removes standard communities matching any of pats from com
+func policy_del_std(com *attrs.Community, pats [][]comField) (changed bool) {
+	asn, val := com.ASN[:0], com.Value[:0]
+	for i := range com.ASN {
+		drop := false
+		for _, pat := range pats {
+			if com_match(pat, uint32(com.ASN[i]), uint32(com.Value[i])) {
+				drop = true
+				break
+			}
+		}
+		if drop {
+			changed = true
+			continue
+		}
+		asn, val = append(asn, com.ASN[i]), append(val, com.Value[i])
+	}
+	com.ASN, com.Value = asn, val
+	return changed
+}
+
+// policy_del_large removes large communities matching any of pats from lc
+func policy_del_large(lc *attrs.LargeCom, pats [][]comField) (changed bool) {
+	asn, v1, v2 := lc.ASN[:0], lc.Value1[:0], lc.Value2[:0]
+	for i := range lc.ASN {
+		drop := false
+		for _, pat := range pats {
+			if com_match(pat, lc.ASN[i], lc.Value1[i], lc.Value2[i]) {
+				drop = true
+				break
+			}
+		}
+		if drop {
+			changed = true
+			continue
+		}
+		asn, v1, v2 = append(asn, lc.ASN[i]), append(v1, lc.Value1[i]), append(v2, lc.Value2[i])
+	}
+	lc.ASN, lc.Value1, lc.Value2 = asn, v1, v2
+	return changed
+}
+
+// policy_has_std returns true iff com already has standard community c
+func policy_has_std(com *attrs.Community, c []comField) bool {
+	for i := range com.ASN {
+		if com_match(c, uint32(com.ASN[i]), uint32(com.Value[i])) {
+			return true
+		}
+	}
+	return false
+}
+
+// policy_has_large returns true iff lc already has large community c
+func policy_has_large(lc *attrs.LargeCom, c []comField) bool {
+	for i := range lc.ASN {
+		if com_match(c, lc.ASN[i], lc.Value1[i], lc.Value2[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Counters implements core.StageCounters
+func (s *PolicyCom) Counters() map[string]any {
+	return map[string]any{
+		"modified": s.modified.Load(),
+	}
+}
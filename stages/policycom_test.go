@@ -0,0 +1,135 @@
+package stages
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/bgpfix/bgpfix/attrs"
+	"github.com/bgpfix/bgpfix/msg"
+)
+
+func testPolicyCom(t *testing.T, mapping string, args ...string) *PolicyCom {
+	t.Helper()
+	fpath := filepath.Join(t.TempDir(), "policy.txt")
+	if err := os.WriteFile(fpath, []byte(mapping), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sb := testStage(t, "policy-com", append(args, fpath)...)
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.Stage.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	return sb.Stage.(*PolicyCom)
+}
+
+// testCommunities returns the standard and large communities of m, as strings
+func testCommunities(m *msg.Msg) (std, large []string) {
+	if com, ok := m.Update.Attrs.Get(attrs.ATTR_COMMUNITY).(*attrs.Community); ok && com != nil {
+		for i := range com.ASN {
+			std = append(std, fmt.Sprintf("%d:%d", com.ASN[i], com.Value[i]))
+		}
+	}
+	if lc, ok := m.Update.Attrs.Get(attrs.ATTR_LARGE_COMMUNITY).(*attrs.LargeCom); ok && lc != nil {
+		for i := range lc.ASN {
+			large = append(large, fmt.Sprintf("%d:%d:%d", lc.ASN[i], lc.Value1[i], lc.Value2[i]))
+		}
+	}
+	return
+}
+
+func TestPolicyComMapping(t *testing.T) {
+	s := testPolicyCom(t, `
+# several ASNs, one repeated
+AS65001 +65000:1 -65000:666
+65002 +65000:2 +65000:2:2
+65001 +65000:11
+65003 -65000:* -65000:*:*
+`)
+
+	if n := len(*s.db.Load()); n != 3 {
+		t.Fatalf("loaded %d ASNs, want 3", n)
+	}
+
+	tests := []struct {
+		name    string
+		origin  uint32
+		std     []string // communities before
+		want    []string // standard communities after
+		large   []string // large communities after
+		changed bool
+	}{
+		{"merged lines", 65001, []string{"65000:666", "65100:1"}, []string{"65100:1", "65000:1", "65000:11"}, nil, true},
+		{"std and large", 65002, nil, []string{"65000:2"}, []string{"65000:2:2"}, true},
+		{"already there", 65002, []string{"65000:2"}, []string{"65000:2"}, []string{"65000:2:2"}, true},
+		{"wildcard delete", 65003, []string{"65000:1", "65100:1", "65000:2"}, []string{"65100:1"}, nil, true},
+		{"delete all", 65003, []string{"65000:1"}, nil, nil, true},
+		{"not in mapping", 65004, []string{"65000:666"}, []string{"65000:666"}, nil, false},
+	}
+	for _, tt := range tests {
+		m := testUpdate(tt.origin, []string{"192.0.2.0/24"}, nil)
+		if len(tt.std) > 0 {
+			com := m.Update.Attrs.Use(attrs.ATTR_COMMUNITY).(*attrs.Community)
+			for _, c := range tt.std {
+				f, err := parse_com(c)
+				if err != nil {
+					t.Fatal(err)
+				}
+				com.Add(uint16(f[0].val), uint16(f[1].val))
+			}
+		}
+
+		before := s.modified.Load()
+		if !s.onUpdate(m) {
+			t.Fatalf("%s: dropped", tt.name)
+		}
+		if changed := s.modified.Load() > before; changed != tt.changed {
+			t.Errorf("%s: got modified %v, want %v", tt.name, changed, tt.changed)
+		}
+
+		std, large := testCommunities(m)
+		if !slices.Equal(std, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, std, tt.want)
+		}
+		if !slices.Equal(large, tt.large) {
+			t.Errorf("%s: got large %v, want %v", tt.name, large, tt.large)
+		}
+	}
+}
+
+func TestPolicyComNeighbor(t *testing.T) {
+	s := testPolicyCom(t, "65000 +65000:1\n65001 +65001:1\n", "--asn", "neighbor")
+
+	// testUpdate puts 65000 first in AS_PATH, so --asn neighbor picks it over the origin
+	m := testUpdate(65001, []string{"192.0.2.0/24"}, nil)
+	s.onUpdate(m)
+	if std, _ := testCommunities(m); !slices.Equal(std, []string{"65000:1"}) {
+		t.Errorf("got %v, want [65000:1]", std)
+	}
+}
+
+func TestPolicyComInvalid(t *testing.T) {
+	for _, mapping := range []string{
+		"65001\n",
+		"ASX +65000:1\n",
+		"65001 65000:1\n",
+		"65001 +65000:*\n",
+		"65001 +65000:70000\n",
+	} {
+		fpath := filepath.Join(t.TempDir(), "policy.txt")
+		if err := os.WriteFile(fpath, []byte(mapping), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		sb := testStage(t, "policy-com", fpath)
+		if err := sb.Stage.Attach(); err != nil {
+			t.Fatal(err)
+		}
+		if err := sb.Stage.Prepare(); err == nil {
+			t.Errorf("%q: no error", mapping)
+		}
+	}
+}
@@ -1,13 +1,26 @@
 package stages
 
 import (
+	"bufio"
+	"bytes"
 	"compress/bzip2"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
 	"github.com/bgpfix/bgpipe/core"
 	"github.com/bgpfix/bgpipe/pkg/extio"
 )
@@ -16,8 +29,14 @@ type Read struct {
 	*core.StageBase
 	eio   *extio.Extio
 	fpath string
-	fh    *os.File
+	fh    io.ReadCloser
 	rd    io.Reader
+
+	verify string    // expected checksum (--verify)
+	hash   hash.Hash // checksum of uncompressed data (--verify)
+
+	rt_first time.Time // time of the first message (--realtime)
+	rt_start time.Time // wall clock at the first message (--realtime)
 }
 
 func NewRead(parent *core.StageBase) core.Stage {
@@ -26,11 +45,14 @@ func NewRead(parent *core.StageBase) core.Stage {
 	o := &s.Options
 	o.IsProducer = true
 	o.Bidir = true
-	o.Descr = "read messages from file"
+	o.Descr = "read messages from file, http(s) URL, or stdin (-)"
 	o.Args = []string{"path"}
 
 	f := o.Flags
-	f.Bool("uncompress", true, "uncompress based on file extension (.gz/.bz2)")
+	f.Bool("uncompress", true, "uncompress based on file extension (.gz/.bz2), or contents for stdin")
+	f.Bool("resume", true, "on http(s) connection errors, reconnect and continue where left")
+	f.Bool("verify", false, "fail at end of file if its data does not match the .sha256 sidecar file")
+	f.Bool("realtime", false, "replay as if happening now: shift message time to the wall clock and pace accordingly")
 
 	s.eio = extio.NewExtio(parent, extio.MODE_READ)
 	return s
@@ -43,38 +65,122 @@ func (s *Read) Attach() error {
 	if len(s.fpath) == 0 {
 		return errors.New("path must be set")
 	}
-	s.fpath = filepath.Clean(s.fpath)
+	if s.fpath == "-" {
+		s.Options.IsStdin = true
+	} else if !is_url(s.fpath) {
+		s.fpath = filepath.Clean(s.fpath)
+	}
+	if k.Bool("verify") && (is_url(s.fpath) || s.fpath == "-") {
+		return errors.New("--verify: supported for local files only")
+	}
+	if k.Bool("realtime") && k.Bool("no-time") {
+		return errors.New("--realtime and --no-time: must not use both at the same time")
+	}
 
 	return s.eio.Attach()
 }
 
 func (s *Read) Prepare() error {
 	s.Info().Msgf("opening %s", s.fpath)
-	fh, err := os.Open(s.fpath)
+
+	// stdin may not deliver anything for long, so sniff it in Run
+	if s.fpath == "-" {
+		s.fh = stdinReader{bufio.NewReader(os.Stdin)} // closed in .Stop()
+		s.rd = s.fh
+		return nil
+	}
+
+	var (
+		fh  io.ReadCloser
+		ext string
+		err error
+	)
+	if is_url(s.fpath) {
+		fh, err = s.openURL()
+		ext = path.Ext(strings.SplitN(s.fpath, "?", 2)[0])
+	} else {
+		fh, err = os.Open(s.fpath)
+		ext = filepath.Ext(s.fpath)
+	}
 	if err != nil {
 		return err
 	}
 	s.fh = fh // closed in .Stop()
 
+	return s.openReader(ext)
+}
+
+// openReader sets s.rd for reading s.fh, with file extension ext
+func (s *Read) openReader(ext string) (err error) {
 	// transparent uncompress?
-	s.rd = fh
+	s.rd = s.fh
 	if s.K.Bool("uncompress") {
-		switch filepath.Ext(s.fpath) {
+		switch ext {
 		case ".bz2":
-			s.rd = bzip2.NewReader(fh)
+			s.rd = bzip2.NewReader(s.fh)
 		case ".gz":
-			s.rd, err = gzip.NewReader(fh)
+			s.rd, err = gzip.NewReader(s.fh)
 			if err != nil {
 				return err
 			}
 		}
 	}
 
+	// verify the checksum while reading?
+	if s.K.Bool("verify") {
+		buf, err := os.ReadFile(s.fpath + ".sha256")
+		if err != nil {
+			return fmt.Errorf("--verify: %w", err)
+		}
+		fields := strings.Fields(string(buf))
+		if len(fields) == 0 {
+			return fmt.Errorf("--verify: %s.sha256: no checksum", s.fpath)
+		}
+		s.verify = strings.ToLower(fields[0])
+		s.hash = sha256.New()
+		s.rd = io.TeeReader(s.rd, s.hash)
+	}
+
 	return nil
 }
 
 func (s *Read) Run() error {
-	return s.eio.ReadStream(s.rd, nil)
+	var cb pipe.CallbackFunc
+	if s.K.Bool("realtime") {
+		cb = s.realtime
+	}
+	return s.read(cb)
+}
+
+// read reads all messages from s.fh, calling cb on each if not nil
+func (s *Read) read(cb pipe.CallbackFunc) error {
+	// stdin: wait for the first bytes to guess the compression
+	if sr, ok := s.fh.(stdinReader); ok {
+		ext, err := sr.ext()
+		if err != nil {
+			return err
+		}
+		if err := s.openReader(ext); err != nil {
+			return err
+		}
+	}
+
+	if err := s.eio.ReadStream(s.rd, cb); err != nil {
+		return err
+	}
+	return s.checkVerify()
+}
+
+// checkVerify checks the --verify checksum of data read so far, if needed
+func (s *Read) checkVerify() error {
+	if s.hash == nil {
+		return nil
+	}
+	if sum := hex.EncodeToString(s.hash.Sum(nil)); sum != s.verify {
+		return fmt.Errorf("--verify: %s: checksum mismatch (got %s, want %s)", s.fpath, sum, s.verify)
+	}
+	s.Info().Msgf("verified checksum of %s", s.fpath)
+	return nil
 }
 
 func (s *Read) Stop() error {
@@ -82,3 +188,171 @@ func (s *Read) Stop() error {
 	s.fh.Close()
 	return nil
 }
+
+// realtime delays message m until its time relative to the first message,
+// counting from when the first message was read, and shifts m.Time accordingly.
+// Messages out of order are not delayed. Returns false on stage cancel.
+func (s *Read) realtime(m *msg.Msg) bool {
+	if m.Time.IsZero() {
+		return true // nothing to align
+	}
+
+	now := time.Now()
+	if s.rt_start.IsZero() {
+		s.rt_first, s.rt_start = m.Time, now
+	}
+	at := s.rt_start.Add(m.Time.Sub(s.rt_first))
+
+	if delay := at.Sub(now); delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-s.Ctx.Done():
+			return false
+		}
+	}
+
+	m.Time = at.UTC()
+	return true
+}
+
+// Counters implements core.StageCounters
+func (s *Read) Counters() map[string]any {
+	return map[string]any{
+		"partial": s.eio.Partials(),
+	}
+}
+
+// is_url returns true iff v is an http(s) URL
+func is_url(v string) bool {
+	return strings.HasPrefix(v, "http://") || strings.HasPrefix(v, "https://")
+}
+
+// stdinReader reads buffered stdin, closing os.Stdin on Close
+type stdinReader struct{ *bufio.Reader }
+
+// Close implements io.Closer
+func (sr stdinReader) Close() error {
+	return os.Stdin.Close()
+}
+
+// ext returns a file extension guessed from the compression magic bytes
+// of stdin, if any. Blocks until stdin delivers some data, or EOF.
+func (sr stdinReader) ext() (string, error) {
+	magic, err := sr.Peek(3)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return ".gz", nil
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return ".bz2", nil
+	default:
+		return "", nil
+	}
+}
+
+// openURL starts downloading s.fpath, returning a reader that optionally
+// survives connection errors (--resume)
+func (s *Read) openURL() (io.ReadCloser, error) {
+	hr := &httpReader{
+		ctx:    s.Ctx,
+		url:    s.fpath,
+		resume: s.K.Bool("resume"),
+		s:      s,
+	}
+	if err := hr.open(); err != nil {
+		return nil, err
+	}
+	return hr, nil
+}
+
+// httpReader reads an HTTP resource, resuming on errors using Range requests.
+// If the server does not support ranges, it restarts from zero and skips
+// what was already read. For compressed files, the offset is in the compressed stream.
+type httpReader struct {
+	ctx    context.Context
+	url    string
+	resume bool
+	s      *Read
+
+	body   io.ReadCloser // current response body
+	off    int64         // bytes consumed so far
+	ranges bool          // server supports Range requests?
+}
+
+// maximum number of reconnects in a row, without any progress
+const http_max_retries = 5
+
+// open (re-)starts the download at hr.off
+func (hr *httpReader) open() error {
+	req, err := http.NewRequestWithContext(hr.ctx, http.MethodGet, hr.url, nil)
+	if err != nil {
+		return err
+	}
+	if hr.off > 0 && hr.ranges {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", hr.off))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		hr.ranges = resp.Header.Get("Accept-Ranges") == "bytes"
+		if hr.off > 0 { // restart from zero, skip what we already have
+			if _, err := io.CopyN(io.Discard, resp.Body, hr.off); err != nil {
+				resp.Body.Close()
+				return err
+			}
+		}
+	case http.StatusPartialContent:
+		break // resumed
+	default:
+		resp.Body.Close()
+		return fmt.Errorf("%s: %s", hr.url, resp.Status)
+	}
+
+	hr.body = resp.Body
+	return nil
+}
+
+// Read implements io.Reader
+func (hr *httpReader) Read(p []byte) (int, error) {
+	for try := 0; ; try++ {
+		n, err := hr.body.Read(p)
+		hr.off += int64(n)
+		if err == nil || err == io.EOF || !hr.resume || hr.ctx.Err() != nil {
+			return n, err
+		} else if n > 0 {
+			return n, nil // report the error on next Read
+		} else if try >= http_max_retries {
+			return 0, err
+		}
+
+		// reconnect
+		hr.s.Warn().Err(err).Int64("offset", hr.off).Msg("download interrupted, resuming")
+		hr.body.Close()
+		select {
+		case <-time.After(time.Duration(try+1) * time.Second):
+		case <-hr.ctx.Done():
+			return 0, hr.ctx.Err()
+		}
+		if err := hr.open(); err != nil {
+			hr.body = io.NopCloser(errReader{err})
+		}
+	}
+}
+
+// Close implements io.Closer
+func (hr *httpReader) Close() error {
+	return hr.body.Close()
+}
+
+// errReader always fails with err
+type errReader struct{ err error }
+
+func (e errReader) Read([]byte) (int, error) { return 0, e.err }
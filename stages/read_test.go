@@ -0,0 +1,143 @@
+package stages
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bgpfix/bgpfix/msg"
+)
+
+// testStdin replaces os.Stdin with a pipe for the duration of the test,
+// returning its write end
+func testStdin(t *testing.T) *os.File {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin := os.Stdin
+	os.Stdin = r
+	t.Cleanup(func() {
+		os.Stdin = stdin
+		r.Close()
+		w.Close()
+	})
+	return w
+}
+
+func TestReadStdinPrepare(t *testing.T) {
+	w := testStdin(t)
+	sb := testStage(t, "read", "-")
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing on stdin yet: Prepare must not wait for it
+	done := make(chan error, 1)
+	go func() { done <- sb.Stage.Prepare() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Prepare: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Prepare blocked on empty stdin")
+	}
+
+	// the compression is guessed once the data comes
+	s := sb.Stage.(*Read)
+	sr, ok := s.fh.(stdinReader)
+	if !ok {
+		t.Fatalf("got %T, want stdinReader", s.fh)
+	}
+	w.Write([]byte("BZh91AY"))
+	if ext, err := sr.ext(); err != nil || ext != ".bz2" {
+		t.Errorf("got %q %v, want .bz2", ext, err)
+	}
+}
+
+// testKeepalive is a raw BGP KEEPALIVE message
+var testKeepalive = append(bytes.Repeat([]byte{0xff}, 16), 0, 19, byte(msg.KEEPALIVE))
+
+// testMrt returns raw BGP message bgp wrapped in an MRT BGP4MP_MESSAGE_AS4 record
+func testMrt(ts uint32, bgp []byte) []byte {
+	rec := make([]byte, 12+20, 12+20+len(bgp))
+	binary.BigEndian.PutUint32(rec[0:], ts)
+	binary.BigEndian.PutUint16(rec[4:], 16) // BGP4MP
+	binary.BigEndian.PutUint16(rec[6:], 4)  // BGP4MP_MESSAGE_AS4
+	binary.BigEndian.PutUint32(rec[8:], uint32(20+len(bgp)))
+	binary.BigEndian.PutUint32(rec[12:], 65001) // peer AS
+	binary.BigEndian.PutUint32(rec[16:], 65000) // local AS
+	binary.BigEndian.PutUint16(rec[22:], 1)     // AFI IPv4
+	copy(rec[24:], []byte{192, 0, 2, 1, 192, 0, 2, 2})
+	return append(rec, bgp...)
+}
+
+func TestReadStdinFormats(t *testing.T) {
+	json := []byte("# comment\n" +
+		"[\"R\",1,\"2025-01-01T00:00:00.000\",\"KEEPALIVE\",null]\n" +
+		"[\"R\",2,\"2025-01-01T00:00:01.000\",\"KEEPALIVE\",null]") // no final newline
+	raw := slices.Concat(testKeepalive, testKeepalive, testKeepalive)
+	mrt := slices.Concat(testMrt(1735689600, testKeepalive), testMrt(1735689601, testKeepalive))
+
+	gz := func(data []byte) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(data)
+		zw.Close()
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		data []byte
+		want int // KEEPALIVEs read
+	}{
+		{"json", nil, json, 2},
+		{"json.gz", nil, gz(json), 2},
+		{"raw", []string{"--raw"}, raw, 3},
+		{"raw.gz", []string{"--raw"}, gz(raw), 3},
+		{"mrt", []string{"--mrt"}, mrt, 2},
+		{"mrt.gz", []string{"--mrt"}, gz(mrt), 2},
+	}
+	for _, tt := range tests {
+		w := testStdin(t)
+		sb := testStage(t, "read", append(tt.args, "-")...)
+		if err := sb.Stage.Attach(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if err := sb.Stage.Prepare(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		// write in small chunks, as a slow producer would
+		go func(data []byte) {
+			for len(data) > 0 {
+				n := min(len(data), 7)
+				w.Write(data[:n])
+				data = data[n:]
+			}
+			w.Close()
+		}(tt.data)
+
+		got := 0
+		err := sb.Stage.(*Read).read(func(m *msg.Msg) bool {
+			if m.Type == msg.KEEPALIVE {
+				got++
+			}
+			return false // don't write to the pipe
+		})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %d KEEPALIVEs, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package stages
+
+import (
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpipe/core"
+)
+
+// Replay reads a table snapshot from file like Read, but then sends End-of-RIB
+// and emits an EOR event, eg. for a live source to --wait on.
+type Replay struct {
+	*Read
+}
+
+func NewReplay(parent *core.StageBase) core.Stage {
+	s := &Replay{NewRead(parent).(*Read)}
+
+	o := &s.Options
+	o.Bidir = false
+	o.Descr = "replay a table snapshot from file, then send End-of-RIB"
+	o.Events = map[string]string{
+		"EOR": "snapshot replayed and End-of-RIB processed",
+	}
+	return s
+}
+
+func (s *Replay) Run() error {
+	// replay the snapshot
+	if err := s.Read.Run(); err != nil {
+		return err
+	}
+
+	// send End-of-RIB (an empty UPDATE)
+	in := s.eio.InputD
+	if err := in.WriteMsg(s.P.GetMsg().Use(msg.UPDATE)); err != nil {
+		return err
+	}
+
+	// wait until the pipe processed it all, then let the live source go
+	in.Close()
+	in.Wait()
+	s.Info().Msgf("replayed %s and sent End-of-RIB", s.fpath)
+	s.Event("EOR")
+	return nil
+}
@@ -3,16 +3,38 @@ package stages
 import "github.com/bgpfix/bgpipe/core"
 
 var Repo = map[string]core.NewStage{
-	"connect":   NewConnect,
-	"exec":      NewExec,
-	"grep":      NewGrep,
-	"limit":     NewLimit,
-	"listen":    NewListen,
-	"pipe":      NewPipe,
-	"read":      NewRead,
-	"speaker":   NewSpeaker,
-	"stdin":     NewStdin,
-	"stdout":    NewStdout,
-	"websocket": NewWebsocket,
-	"write":     NewWrite,
+	"anonymize":         NewAnonymize,
+	"assert":            NewAssert,
+	"asn-rewrite":       NewAsnRewrite,
+	"bestpath":          NewBestpath,
+	"community-rewrite": NewComRewrite,
+	"connect":           NewConnect,
+	"damp":              NewDamp,
+	"exec":              NewExec,
+	"flood-guard":       NewFloodGuard,
+	"gen":               NewGen,
+	"geo":               NewGeo,
+	"grep":              NewGrep,
+	"inject":            NewInject,
+	"learn-withdraw":    NewLearnWithdraw,
+	"limit":             NewLimit,
+	"merge":             NewMerge,
+	"normalize":         NewNormalize,
+	"listen":            NewListen,
+	"null":              NewNull,
+	"path-tag":          NewPathTag,
+	"policy-com":        NewPolicyCom,
+	"pipe":              NewPipe,
+	"read":              NewRead,
+	"replay":            NewReplay,
+	"select-peer":       NewSelectPeer,
+	"shuffle":           NewShuffle,
+	"speaker":           NewSpeaker,
+	"stdin":             NewStdin,
+	"stdout":            NewStdout,
+	"tap":               NewTap,
+	"threshold":         NewThreshold,
+	"timeshift-detect":  NewTimeshift,
+	"websocket":         NewWebsocket,
+	"write":             NewWrite,
 }
@@ -0,0 +1,168 @@
+package stages
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/bgpfix/bgpfix/dir"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/bgpfix/bgpipe/core"
+)
+
+// selectPeer targets
+const (
+	sp_pass = "pass" // keep the message direction
+	sp_drop = "drop" // drop the message
+	sp_L    = "L"    // move the message to the L direction
+	sp_R    = "R"    // move the message to the R direction
+)
+
+type SelectPeer struct {
+	*core.StageBase
+	inL *pipe.Input // L direction input
+	inR *pipe.Input // R direction input
+
+	opt_tag string            // --tag
+	opt_map map[string]string // --map: tag value -> target
+	opt_def string            // --default
+
+	output chan *msg.Msg // messages to move to the other direction
+
+	moved   atomic.Uint64 // messages moved to the other direction
+	dropped atomic.Uint64 // messages dropped
+}
+
+func NewSelectPeer(parent *core.StageBase) core.Stage {
+	var (
+		s = &SelectPeer{StageBase: parent}
+		o = &s.Options
+		f = o.Flags
+	)
+
+	o.Descr = "route messages to L or R by their peer tag, eg. for multi-peer feeds"
+	o.IsProducer = true
+	o.Bidir = true
+
+	f.String("tag", "PEER_IP", "message tag that identifies the peer")
+	f.StringSlice("map", nil, "where to send messages of given peer (format: VALUE=TARGET, TARGET is L, R, pass, or drop)")
+	f.String("default", sp_pass, "where to send other messages (L, R, pass, or drop)")
+
+	s.output = make(chan *msg.Msg, 100)
+	return s
+}
+
+func (s *SelectPeer) Attach() error {
+	k := s.K
+
+	// writes to both directions
+	if !s.IsBidir {
+		return fmt.Errorf("needs both directions: use -LR")
+	}
+
+	s.opt_tag = k.String("tag")
+	if len(s.opt_tag) == 0 {
+		return fmt.Errorf("--tag must be set")
+	}
+
+	var err error
+	s.opt_def, err = parse_sp_target(k.String("default"))
+	if err != nil {
+		return fmt.Errorf("--default %w", err)
+	}
+
+	s.opt_map = make(map[string]string)
+	for _, v := range k.Strings("map") {
+		val, target, ok := strings.Cut(v, "=")
+		if !ok || len(val) == 0 {
+			return fmt.Errorf("--map %s: need VALUE=TARGET", v)
+		}
+		s.opt_map[val], err = parse_sp_target(target)
+		if err != nil {
+			return fmt.Errorf("--map %s: %w", v, err)
+		}
+	}
+	if len(s.opt_map) == 0 && s.opt_def == sp_pass {
+		return fmt.Errorf("nothing to do: need --map or --default")
+	}
+
+	s.P.OnMsg(s.onMsg, s.Dir)
+	s.inL = s.P.AddInput(dir.DIR_L)
+	s.inR = s.P.AddInput(dir.DIR_R)
+	return nil
+}
+
+func (s *SelectPeer) Run() error {
+	for m := range s.output {
+		in := s.inR
+		if m.Dir == dir.DIR_R {
+			in = s.inL
+		}
+		if err := in.WriteMsg(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SelectPeer) Stop() error {
+	close_safe(s.output)
+	return nil
+}
+
+// parse_sp_target parses select-peer target v
+func parse_sp_target(v string) (string, error) {
+	switch t := strings.ToUpper(v); t {
+	case sp_L, sp_R:
+		return t, nil
+	case "PASS":
+		return sp_pass, nil
+	case "DROP":
+		return sp_drop, nil
+	}
+	return "", fmt.Errorf("%s: need L, R, pass, or drop", v)
+}
+
+// onMsg sends m where its peer tag says
+func (s *SelectPeer) onMsg(m *msg.Msg) bool {
+	target := s.opt_def
+	if pipe.HasTags(m) {
+		if t, ok := s.opt_map[pipe.MsgTags(m)[s.opt_tag]]; ok {
+			target = t
+		}
+	}
+
+	var in *pipe.Input
+	switch target {
+	case sp_pass:
+		return true
+	case sp_drop:
+		s.dropped.Add(1)
+		return false
+	case sp_L:
+		in = s.inL
+	case sp_R:
+		in = s.inR
+	}
+	if in.Dir == m.Dir {
+		return true // already there
+	}
+
+	// move it to the other direction
+	pipe.MsgContext(m).Action.Borrow()
+	if !send_safe(s.output, m) {
+		s.P.PutMsg(m)
+		return false
+	}
+	s.moved.Add(1)
+	return false
+}
+
+// Counters implements core.StageCounters
+func (s *SelectPeer) Counters() map[string]any {
+	return map[string]any{
+		"moved":   s.moved.Load(),
+		"dropped": s.dropped.Load(),
+	}
+}
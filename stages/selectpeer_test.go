@@ -0,0 +1,123 @@
+package stages
+
+import (
+	"testing"
+
+	"github.com/bgpfix/bgpfix/dir"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+)
+
+func testSelectPeer(t *testing.T, args ...string) *SelectPeer {
+	t.Helper()
+	sb := testStage(t, "select-peer", args...)
+	sb.IsLeft, sb.IsRight, sb.IsBidir, sb.Dir = true, true, true, dir.DIR_LR
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatal(err)
+	}
+	return sb.Stage.(*SelectPeer)
+}
+
+func TestSelectPeerFeed(t *testing.T) {
+	s := testSelectPeer(t,
+		"--map", "192.0.2.1=L",
+		"--map", "192.0.2.2=R",
+		"--map", "192.0.2.3=drop",
+		"--map", "192.0.2.4=pass",
+		"--default", "drop",
+	)
+
+	// an interleaved multi-peer feed, eg. from a BMP or MRT source
+	feed := []struct {
+		peer string // PEER_IP tag, "" for none
+		dir  dir.Dir
+		keep bool // want onMsg to keep it?
+		move bool // want it moved to the other direction?
+	}{
+		{"192.0.2.1", dir.DIR_R, false, true},
+		{"192.0.2.2", dir.DIR_R, true, false},
+		{"192.0.2.1", dir.DIR_L, true, false},
+		{"192.0.2.3", dir.DIR_R, false, false},
+		{"192.0.2.2", dir.DIR_L, false, true},
+		{"192.0.2.4", dir.DIR_L, true, false},
+		{"192.0.2.4", dir.DIR_R, true, false},
+		{"192.0.2.9", dir.DIR_R, false, false},
+		{"", dir.DIR_L, false, false},
+		{"192.0.2.1", dir.DIR_R, false, true},
+	}
+
+	var moved []*msg.Msg
+	for i, f := range feed {
+		m := testUpdate(65000+uint32(i), []string{"192.0.2.0/24"}, nil)
+		m.Dir = f.dir
+		if f.peer != "" {
+			pipe.MsgContext(m).UseTags()["PEER_IP"] = f.peer
+		}
+		if keep := s.onMsg(m); keep != f.keep {
+			t.Errorf("msg %d: got keep %v, want %v", i, keep, f.keep)
+		}
+		if f.move {
+			moved = append(moved, m)
+		}
+	}
+
+	// moves are queued in feed order, as the very same messages
+	if n := len(s.output); n != len(moved) {
+		t.Fatalf("got %d messages to move, want %d", n, len(moved))
+	}
+	for i, want := range moved {
+		m := <-s.output
+		if m != want {
+			t.Errorf("move %d: got msg %v, want %v", i, m, want)
+		}
+		if pipe.MsgTags(m)["PEER_IP"] == "" {
+			t.Errorf("move %d: lost the peer tag", i)
+		}
+	}
+
+	if n := s.moved.Load(); n != 3 {
+		t.Errorf("got %d moved, want 3", n)
+	}
+	if n := s.dropped.Load(); n != 3 {
+		t.Errorf("got %d dropped, want 3", n)
+	}
+}
+
+func TestSelectPeerStopped(t *testing.T) {
+	s := testSelectPeer(t, "--map", "192.0.2.1=L")
+	s.Stop()
+
+	// moving after Stop must not panic, and must not keep the message
+	m := testUpdate(65001, []string{"192.0.2.0/24"}, nil)
+	m.Dir = dir.DIR_R
+	pipe.MsgContext(m).UseTags()["PEER_IP"] = "192.0.2.1"
+	if s.onMsg(m) {
+		t.Error("kept a message to move")
+	}
+	if n := s.moved.Load(); n != 0 {
+		t.Errorf("got %d moved, want 0", n)
+	}
+}
+
+func TestSelectPeerInvalid(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"--map", "192.0.2.1"},
+		{"--map", "=L"},
+		{"--map", "192.0.2.1=X"},
+		{"--default", "X"},
+		{"--tag", "", "--default", "L"},
+	} {
+		sb := testStage(t, "select-peer", args...)
+		sb.IsLeft, sb.IsRight, sb.IsBidir, sb.Dir = true, true, true, dir.DIR_LR
+		if err := sb.Stage.Attach(); err == nil {
+			t.Errorf("%v: no error", args)
+		}
+	}
+
+	// needs both directions
+	sb := testStage(t, "select-peer", "--default", "L")
+	if err := sb.Stage.Attach(); err == nil {
+		t.Error("not bidir: no error")
+	}
+}
@@ -0,0 +1,215 @@
+package stages
+
+import (
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/nlri"
+	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/bgpfix/bgpipe/core"
+)
+
+type Shuffle struct {
+	*core.StageBase
+	in *pipe.Input
+
+	opt_window int           // --window
+	opt_hold   time.Duration // --max-hold
+
+	mu     sync.Mutex    // guards below
+	rng    *rand.Rand    // deterministic given --seed
+	buf    []shuffleItem // buffered UPDATEs, in arrival order
+	output chan *msg.Msg // messages to inject, in release order
+	stop   chan struct{} // closed on Stop()
+
+	reordered atomic.Uint64 // number of messages released out of order
+}
+
+// shuffleItem is a buffered UPDATE
+type shuffleItem struct {
+	m        *msg.Msg
+	prefixes []nlri.NLRI // announced or withdrawn prefixes
+	at       time.Time   // arrival time
+	passed   int         // number of later messages released before m
+}
+
+func NewShuffle(parent *core.StageBase) core.Stage {
+	var (
+		s = &Shuffle{StageBase: parent}
+		o = &s.Options
+		f = o.Flags
+	)
+
+	o.Descr = "reorder UPDATEs randomly within a window, for testing"
+	o.IsProducer = true
+
+	f.Int("window", 16, "max number of UPDATEs to buffer, and max reorder distance")
+	f.Uint64("seed", 1, "random seed, for deterministic order")
+	f.Duration("max-hold", time.Second, "max time to hold an UPDATE (0 means no limit)")
+
+	s.output = make(chan *msg.Msg, 100)
+	s.stop = make(chan struct{})
+	return s
+}
+
+func (s *Shuffle) Attach() error {
+	k := s.K
+
+	s.opt_window = k.Int("window")
+	if s.opt_window < 2 {
+		return errors.New("--window must be at least 2")
+	}
+	s.opt_hold = k.Duration("max-hold")
+	if s.opt_hold < 0 {
+		return errors.New("--max-hold must not be negative")
+	}
+
+	seed := uint64(k.Int64("seed"))
+	s.rng = rand.New(rand.NewPCG(seed, seed))
+
+	s.P.OnMsg(s.onMsg, s.Dir)
+	s.in = s.P.AddInput(s.Dir)
+	return nil
+}
+
+func (s *Shuffle) Run() error {
+	// release UPDATEs held for too long
+	if s.opt_hold > 0 {
+		go s.holdTimer()
+	}
+
+	for m := range s.output {
+		if err := s.in.WriteMsg(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// holdTimer periodically releases UPDATEs held longer than --max-hold
+func (s *Shuffle) holdTimer() {
+	ticker := time.NewTicker(s.opt_hold / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			for len(s.buf) > 0 && time.Since(s.buf[0].at) > s.opt_hold {
+				s.release(0)
+			}
+			s.mu.Unlock()
+		case <-s.stop:
+			return
+		case <-s.Ctx.Done():
+			return
+		}
+	}
+}
+
+// Stop flushes the buffer in arrival order
+func (s *Shuffle) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	close_safe(s.stop)
+	for len(s.buf) > 0 {
+		s.release(0)
+	}
+	close_safe(s.output)
+	return nil
+}
+
+func (s *Shuffle) onMsg(m *msg.Msg) bool {
+	mx := pipe.MsgContext(m)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// not an UPDATE? release all before it, keep it in order
+	if m.Type != msg.UPDATE {
+		for len(s.buf) > 0 {
+			s.release(s.pick())
+		}
+		mx.Action.Borrow()
+		if !send_safe(s.output, m) {
+			s.P.PutMsg(m)
+		}
+		return false
+	}
+
+	// keep it
+	mx.Action.Borrow()
+	u := &m.Update
+	s.buf = append(s.buf, shuffleItem{
+		m:        m,
+		prefixes: u.GetUnreach(u.GetReach(nil)),
+		at:       time.Now(),
+	})
+
+	// make room
+	for len(s.buf) > s.opt_window {
+		s.release(s.pick())
+	}
+	return false
+}
+
+// pick returns the index of a random buffered UPDATE that can be released next.
+// UPDATEs that share a prefix with an earlier one, eg. an announcement followed
+// by a withdrawal, are never reordered. The oldest UPDATE is released first
+// if --window later UPDATEs already passed it. Must be called with s.mu locked.
+func (s *Shuffle) pick() int {
+	if s.buf[0].passed >= s.opt_window {
+		return 0
+	}
+
+	var (
+		seen     = make(map[nlri.NLRI]bool)
+		eligible []int
+	)
+	for i := range s.buf {
+		ok := true
+		for _, p := range s.buf[i].prefixes {
+			if seen[p] {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			eligible = append(eligible, i)
+		}
+		for _, p := range s.buf[i].prefixes {
+			seen[p] = true
+		}
+	}
+	return eligible[s.rng.IntN(len(eligible))] // NB: index 0 is always eligible
+}
+
+// release emits buffered UPDATE i. Must be called with s.mu locked.
+func (s *Shuffle) release(i int) {
+	it := s.buf[i]
+	for j := range i {
+		s.buf[j].passed++
+	}
+	if i > 0 {
+		s.reordered.Add(1)
+	}
+	s.buf = append(s.buf[:i], s.buf[i+1:]...)
+
+	if !send_safe(s.output, it.m) {
+		s.P.PutMsg(it.m)
+	}
+}
+
+// Counters implements core.StageCounters
+func (s *Shuffle) Counters() map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]any{
+		"buffered":  len(s.buf),
+		"reordered": s.reordered.Load(),
+	}
+}
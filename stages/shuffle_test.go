@@ -0,0 +1,107 @@
+package stages
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/bgpfix/bgpfix/msg"
+)
+
+func testShuffle(t *testing.T, args ...string) *Shuffle {
+	t.Helper()
+	sb := testStage(t, "shuffle", append(args, "--max-hold", "0")...)
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatal(err)
+	}
+	return sb.Stage.(*Shuffle)
+}
+
+// testShuffleRun sends msgs through s, returning their indexes in release order
+func testShuffleRun(s *Shuffle, msgs []*msg.Msg) []int {
+	idx := make(map[*msg.Msg]int, len(msgs))
+	for i, m := range msgs {
+		idx[m] = i
+		s.onMsg(m)
+	}
+	s.Stop()
+
+	var order []int
+	for m := range s.output {
+		order = append(order, idx[m])
+	}
+	return order
+}
+
+func TestShuffleWindow(t *testing.T) {
+	var msgs []*msg.Msg
+	for i := 0; i < 90; i++ {
+		msgs = append(msgs, testUpdate(65001, []string{fmt.Sprintf("10.0.%d.0/24", i)}, nil))
+	}
+	s := testShuffle(t, "--window", "4")
+	order := testShuffleRun(s, msgs)
+	if len(order) != len(msgs) {
+		t.Fatalf("got %d messages, want %d", len(order), len(msgs))
+	}
+
+	// no message gets passed by more than --window later messages
+	reordered := 0
+	for pos, i := range order {
+		passed := 0
+		for _, j := range order[:pos] {
+			if j > i {
+				passed++
+			}
+		}
+		if passed > 4 {
+			t.Errorf("message %d passed by %d later messages", i, passed)
+		}
+		if pos != i {
+			reordered++
+		}
+	}
+	if reordered == 0 {
+		t.Error("nothing reordered")
+	}
+}
+
+func TestShufflePrefixOrder(t *testing.T) {
+	// announce and withdraw the same prefixes, with unrelated UPDATEs in between
+	var msgs []*msg.Msg
+	for i := 0; i < 30; i++ {
+		p := []string{fmt.Sprintf("10.0.%d.0/24", i%5)}
+		if i%2 == 0 {
+			msgs = append(msgs, testUpdate(65001, p, nil))
+		} else {
+			msgs = append(msgs, testUpdate(0, nil, p))
+		}
+		msgs = append(msgs, testUpdate(65001, []string{fmt.Sprintf("192.168.%d.0/24", i)}, nil))
+	}
+	s := testShuffle(t, "--window", "8", "--seed", "42")
+	order := testShuffleRun(s, msgs)
+
+	// UPDATEs for the same prefix keep their order
+	last := make(map[string]int)
+	for _, i := range order {
+		key := fmt.Sprint(msgs[i].Update.GetUnreach(msgs[i].Update.GetReach(nil)))
+		if j, ok := last[key]; ok && j > i {
+			t.Errorf("%s: message %d released before %d", key, j, i)
+		}
+		last[key] = i
+	}
+}
+
+func TestShuffleNonUpdate(t *testing.T) {
+	// a KEEPALIVE releases all buffered UPDATEs before it
+	var msgs []*msg.Msg
+	for i := 0; i < 10; i++ {
+		msgs = append(msgs, testUpdate(65001, []string{fmt.Sprintf("10.0.%d.0/24", i)}, nil))
+	}
+	msgs = append(msgs, msg.NewMsg().Use(msg.KEEPALIVE))
+	msgs = append(msgs, testUpdate(65001, []string{"10.1.0.0/16"}, nil))
+
+	s := testShuffle(t, "--window", "16")
+	order := testShuffleRun(s, msgs)
+	if len(order) != 12 || order[10] != 10 || order[11] != 11 {
+		t.Errorf("got order %v, want KEEPALIVE (10) after all UPDATEs before it", order)
+	}
+}
@@ -1,8 +1,19 @@
 package stages
 
 import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
 	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/bgpfix/bgpfix/caps"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
 	"github.com/bgpfix/bgpfix/speaker"
 	"github.com/bgpfix/bgpipe/core"
 )
@@ -10,21 +21,43 @@ import (
 type Speaker struct {
 	*core.StageBase
 
-	spk *speaker.Speaker
+	spk    *speaker.Speaker
+	notify *pipe.Input // for NOTIFICATION to the peer
+
+	opt_id      string      // --id
+	opt_require []caps.Code // --require-caps
+	opt_forbid  []caps.Code // --forbid-caps
+
+	opt_notify *msg.Notify   // --notify
+	opt_nafter time.Duration // --notify-after
+	opt_nclose time.Duration // --notify-close
+	notifyOnce sync.Once     // send --notify only once
 }
 
+// NOTIFICATION error code for UPDATE message errors (RFC 4271)
+const notify_update_error = 3
+
 func NewSpeaker(parent *core.StageBase) core.Stage {
 	s := &Speaker{StageBase: parent}
 
 	o := &s.Options
 	o.Descr = "run a simple BGP speaker"
 	o.IsProducer = true
+	o.Events = map[string]string{
+		"notify": "sent the --notify NOTIFICATION to the peer",
+	}
 
 	do := &speaker.DefaultOptions
 	o.Flags.Bool("active", false, "send the OPEN message first")
-	o.Flags.Int("asn", do.LocalASN, "local ASN, -1 means use remote ASN")
-	o.Flags.String("id", "", "local router ID, empty means use remote-1")
+	o.Flags.String("asn", strconv.Itoa(do.LocalASN), "local ASN, -1 means use remote ASN ($ENV or @FILE allowed)")
+	o.Flags.String("id", "", "local router ID, empty means use remote-1, auto means a local IPv4 address ($ENV or @FILE allowed)")
 	o.Flags.Int("hold", do.LocalHoldTime, "hold time")
+	o.Flags.StringSlice("require-caps", nil, "reject peer OPEN without given capabilities")
+	o.Flags.StringSlice("forbid-caps", nil, "reject peer OPEN with given capabilities")
+	o.Flags.String("notify", "", "send NOTIFICATION to the peer (format: CODE:SUBCODE[:HEXDATA])")
+	o.Flags.StringSlice("notify-on", []string{"ESTABLISHED"}, "send --notify on given events")
+	o.Flags.Duration("notify-after", 0, "delay --notify after its event")
+	o.Flags.Duration("notify-close", 5*time.Second, "shut down after --notify if the peer did not close the session (0 means never)")
 	return s
 }
 
@@ -37,17 +70,237 @@ func (s *Speaker) Attach() error {
 	so := &spk.Options
 	so.Logger = &s.Logger
 	so.Passive = !k.Bool("active")
-	so.LocalASN = k.Int("asn")
 	so.LocalHoldTime = k.Int("hold")
 
-	lid := k.String("id")
-	if len(lid) > 0 {
-		so.LocalId = netip.MustParseAddr(lid)
-	} else if so.Passive {
+	// local ASN
+	v, err := core.ResolveValue(k.String("asn"))
+	if err != nil {
+		return fmt.Errorf("--asn: %w", err)
+	}
+	asn, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || asn < -1 || asn > math.MaxUint32 {
+		return fmt.Errorf("--asn %s: invalid ASN", v)
+	}
+	so.LocalASN = int(asn)
+
+	// local router ID
+	if s.opt_id, err = core.ResolveValue(k.String("id")); err != nil {
+		return fmt.Errorf("--id: %w", err)
+	}
+	switch {
+	case s.opt_id == "auto":
+		break // see Prepare
+	case len(s.opt_id) > 0:
+		if so.LocalId, err = netip.ParseAddr(s.opt_id); err != nil || !so.LocalId.Is4() {
+			return fmt.Errorf("--id %s: need an IPv4 address", s.opt_id)
+		}
+	case so.Passive:
 		so.LocalId = netip.Addr{}
-	} else {
+	default:
 		so.LocalId = netip.MustParseAddr("0.0.0.1")
 	}
 
+	// check peer capabilities?
+	if s.opt_require, err = parse_caps(k.Strings("require-caps")); err != nil {
+		return fmt.Errorf("--require-caps: %w", err)
+	}
+	if s.opt_forbid, err = parse_caps(k.Strings("forbid-caps")); err != nil {
+		return fmt.Errorf("--forbid-caps: %w", err)
+	}
+	if len(s.opt_require) > 0 || len(s.opt_forbid) > 0 {
+		s.P.OnMsg(s.checkOpen, s.Dir.Flip(), msg.OPEN)
+	}
+
+	// send a NOTIFICATION on purpose?
+	if v := k.String("notify"); len(v) > 0 {
+		if s.opt_notify, err = parse_notify(v); err != nil {
+			return fmt.Errorf("--notify %s: %w", v, err)
+		}
+		s.opt_nafter = k.Duration("notify-after")
+		s.opt_nclose = k.Duration("notify-close")
+		evs := core.ParseEvents(k.Strings("notify-on"), "START")
+		if len(evs) == 0 {
+			return fmt.Errorf("--notify-on: need at least one event")
+		}
+		s.P.Options.OnEvent(s.onNotify, evs...)
+	}
+
+	// tell the peer why we are going down?
+	kill := s.B.K.String("on-parse-error") == "kill"
+	if kill || len(s.opt_require) > 0 || len(s.opt_forbid) > 0 || s.opt_notify != nil {
+		s.notify = s.P.AddInput(s.Dir)
+	}
+	if kill {
+		s.P.Options.OnEvent(s.onParseError, pipe.EVENT_PARSE)
+	}
+
 	return spk.Attach(s.P, s.Dir)
 }
+
+// Prepare resolves --id auto
+func (s *Speaker) Prepare() error {
+	if s.opt_id != "auto" {
+		return nil
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return fmt.Errorf("--id auto: %w", err)
+	}
+	id, err := auto_router_id(addrs)
+	if err != nil {
+		return fmt.Errorf("--id auto: %w", err)
+	}
+	s.Info().Stringer("id", id).Msg("using local router ID")
+	s.spk.Options.LocalId = id
+	return nil
+}
+
+// auto_router_id returns the lowest global unicast IPv4 address in addrs,
+// which is stable across restarts if the interfaces don't change
+func auto_router_id(addrs []net.Addr) (netip.Addr, error) {
+	var best netip.Addr
+	for _, a := range addrs {
+		ipn, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip, ok := netip.AddrFromSlice(ipn.IP)
+		if !ok {
+			continue
+		}
+		ip = ip.Unmap()
+		if !ip.Is4() || !ip.IsGlobalUnicast() {
+			continue
+		}
+		if !best.IsValid() || ip.Less(best) {
+			best = ip
+		}
+	}
+	if !best.IsValid() {
+		return best, fmt.Errorf("no IPv4 address found")
+	}
+	return best, nil
+}
+
+// onParseError sends a NOTIFICATION to the peer before the session gets killed
+func (s *Speaker) onParseError(ev *pipe.Event) bool {
+	m := s.P.GetMsg().Use(msg.NOTIFY)
+	m.Notify.Code = notify_update_error
+	if err := s.notify.WriteMsg(m); err != nil {
+		s.Warn().Err(err).Msg("could not send NOTIFICATION")
+	}
+	return false
+}
+
+// onNotify schedules sending the --notify NOTIFICATION to the peer, once
+func (s *Speaker) onNotify(ev *pipe.Event) bool {
+	s.notifyOnce.Do(func() {
+		s.Info().Stringer("ev", ev).Msgf("will send NOTIFICATION in %s", s.opt_nafter)
+		time.AfterFunc(s.opt_nafter, s.sendNotify)
+	})
+	return false // unregister
+}
+
+// sendNotify sends the --notify NOTIFICATION to the peer, and lets the session
+// close. If it's still up after --notify-close, shuts down the pipe gracefully,
+// so that the NOTIFICATION gets flushed before the connection closes.
+func (s *Speaker) sendNotify() {
+	n := s.opt_notify
+	m := s.P.GetMsg().Use(msg.NOTIFY)
+	m.Notify.Code = n.Code
+	m.Notify.Subcode = n.Subcode
+	m.Notify.Data = n.Data
+	if err := s.notify.WriteMsg(m); err != nil {
+		s.Warn().Err(err).Msg("could not send NOTIFICATION")
+		return
+	}
+
+	s.Info().Uint8("code", n.Code).Uint8("subcode", n.Subcode).Hex("data", n.Data).Msg("sent NOTIFICATION")
+	s.Event("notify", n.Code, n.Subcode)
+
+	if s.opt_nclose > 0 {
+		time.AfterFunc(s.opt_nclose, func() {
+			if s.Ctx.Err() == nil {
+				s.Warn().Msgf("session still up %s after NOTIFICATION, shutting down", s.opt_nclose)
+				s.B.Shutdown()
+			}
+		})
+	}
+}
+
+// parse_notify parses a NOTIFICATION in the CODE:SUBCODE[:HEXDATA] format
+func parse_notify(v string) (*msg.Notify, error) {
+	parts := strings.SplitN(v, ":", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("need CODE:SUBCODE[:HEXDATA]")
+	}
+
+	code, err := strconv.ParseUint(parts[0], 0, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid code: %w", err)
+	}
+	subcode, err := strconv.ParseUint(parts[1], 0, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subcode: %w", err)
+	}
+
+	n := &msg.Notify{Code: byte(code), Subcode: byte(subcode)}
+	if len(parts) == 3 {
+		if n.Data, err = hex.DecodeString(parts[2]); err != nil {
+			return nil, fmt.Errorf("invalid data: %w", err)
+		}
+	}
+	return n, nil
+}
+
+// checkOpen rejects peer OPEN m if its capabilities violate --require-caps or --forbid-caps
+func (s *Speaker) checkOpen(m *msg.Msg) bool {
+	if cc, err := check_caps(&m.Open.Caps, s.opt_require, s.opt_forbid); err != nil {
+		s.reject(cc, err)
+		return false
+	}
+	return true
+}
+
+// check_caps returns the first capability in cps that violates require or forbid,
+// with an error describing why; or a nil error if there is no violation
+func check_caps(cps *caps.Caps, require, forbid []caps.Code) (caps.Code, error) {
+	for _, cc := range require {
+		if !cps.Has(cc) {
+			return cc, fmt.Errorf("peer OPEN without required capability %s", cc)
+		}
+	}
+	for _, cc := range forbid {
+		if cps.Has(cc) {
+			return cc, fmt.Errorf("peer OPEN with forbidden capability %s", cc)
+		}
+	}
+	return 0, nil
+}
+
+// reject sends a NOTIFICATION about capability cc to the peer, and stops the pipe with err
+func (s *Speaker) reject(cc caps.Code, err error) {
+	s.Error().Err(err).Msg("rejecting the session")
+	notify_cancel(s.StageBase, s.notify, &msg.Notify{
+		Code:    msg.NOTIFY_OPEN,
+		Subcode: msg.NOTIFY_OPEN_UNSUPPORTED_CAPABILITY,
+		Data:    []byte{byte(cc), 0},
+	}, err)
+}
+
+// parse_caps parses capability names (or numbers)
+func parse_caps(vals []string) (ret []caps.Code, err error) {
+	for _, v := range vals {
+		cc, err := caps.CodeString(strings.ToUpper(v))
+		if err != nil {
+			num, err2 := strconv.ParseUint(v, 0, 8)
+			if err2 != nil {
+				return nil, fmt.Errorf("%s: unknown capability", v)
+			}
+			cc = caps.Code(num)
+		}
+		ret = append(ret, cc)
+	}
+	return ret, nil
+}
@@ -0,0 +1,77 @@
+package stages
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/bgpfix/bgpfix/caps"
+)
+
+func TestParseCaps(t *testing.T) {
+	got, err := parse_caps([]string{"as4", "ROUTE_REFRESH", "69", "0x49"})
+	want := []caps.Code{caps.CAP_AS4, caps.CAP_ROUTE_REFRESH, caps.CAP_ADDPATH, caps.CAP_FQDN}
+	if err != nil || !slices.Equal(got, want) {
+		t.Errorf("got %v, %v, want %v", got, err, want)
+	}
+
+	for _, v := range []string{"BOGUS", "256", "-1"} {
+		if _, err := parse_caps([]string{v}); err == nil {
+			t.Errorf("%s: expected an error", v)
+		}
+	}
+}
+
+func TestCheckCapsOpen(t *testing.T) {
+	var open caps.Caps
+	open.Use(caps.CAP_AS4)
+	open.Use(caps.CAP_ROUTE_REFRESH)
+
+	tests := []struct {
+		name    string
+		require []caps.Code
+		forbid  []caps.Code
+		bad     caps.Code // expected violating capability, or 0
+		err     string    // expected error substring
+	}{
+		{"nothing to check", nil, nil, 0, ""},
+		{"required present", []caps.Code{caps.CAP_AS4, caps.CAP_ROUTE_REFRESH}, nil, 0, ""},
+		{"forbidden absent", nil, []caps.Code{caps.CAP_ADDPATH}, 0, ""},
+		{"required missing", []caps.Code{caps.CAP_AS4, caps.CAP_ADDPATH}, nil, caps.CAP_ADDPATH, "without required"},
+		{"forbidden present", []caps.Code{caps.CAP_AS4}, []caps.Code{caps.CAP_ROUTE_REFRESH}, caps.CAP_ROUTE_REFRESH, "with forbidden"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc, err := check_caps(&open, tt.require, tt.forbid)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("got error %v, want %q", err, tt.err)
+			case cc != tt.bad:
+				t.Errorf("got capability %s, want %s", cc, tt.bad)
+			}
+		})
+	}
+}
+
+func TestSpeakerCapsFlags(t *testing.T) {
+	sb := testStage(t, "speaker", "--require-caps", "AS4", "--forbid-caps", "ADDPATH")
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatal(err)
+	}
+	s := sb.Stage.(*Speaker)
+	if !slices.Equal(s.opt_require, []caps.Code{caps.CAP_AS4}) || !slices.Equal(s.opt_forbid, []caps.Code{caps.CAP_ADDPATH}) {
+		t.Errorf("got require %v, forbid %v", s.opt_require, s.opt_forbid)
+	}
+	if s.notify == nil {
+		t.Error("no input for the rejecting NOTIFICATION")
+	}
+
+	for _, flag := range []string{"--require-caps", "--forbid-caps"} {
+		sb := testStage(t, "speaker", flag, "BOGUS")
+		if err := sb.Stage.Attach(); err == nil || !strings.Contains(err.Error(), flag) {
+			t.Errorf("%s BOGUS: got %v", flag, err)
+		}
+	}
+}
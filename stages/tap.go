@@ -0,0 +1,268 @@
+package stages
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bgpfix/bgpfix/dir"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpipe/core"
+)
+
+type Tap struct {
+	*core.StageBase
+
+	opt_last int // --last
+	opt_buf  int // --buffer
+
+	ln  net.Listener // HTTP listener
+	srv *http.Server // HTTP server
+
+	mu      sync.Mutex          // guards below
+	clients map[*tapClient]bool // connected clients
+	last    []tapItem           // recent messages (--last)
+	pos     int                 // next position in last
+	full    bool                // last full?
+
+	drops atomic.Uint64 // messages dropped for slow clients
+}
+
+// tapItem is a message broadcast to tap clients
+type tapItem struct {
+	typ msg.Type
+	dir dir.Dir
+	js  []byte
+}
+
+// tapClient is an SSE client connected to the tap
+type tapClient struct {
+	ch    chan tapItem // messages to send
+	types []msg.Type   // only these types (if non-empty)
+	dir   dir.Dir      // only this direction (if non-zero)
+}
+
+func NewTap(parent *core.StageBase) core.Stage {
+	var (
+		s = &Tap{StageBase: parent}
+		o = &s.Options
+		f = o.Flags
+	)
+
+	o.Descr = "serve passing messages as server-sent events over HTTP"
+	o.Args = []string{"addr"}
+	o.Bidir = true
+
+	f.Int("last", 0, "send last N messages to new clients on connect")
+	f.Int("buffer", 1000, "max number of messages queued per client, before dropping")
+
+	s.clients = make(map[*tapClient]bool)
+	return s
+}
+
+func (s *Tap) Attach() error {
+	k := s.K
+
+	if len(k.String("addr")) == 0 {
+		return errors.New("listen address must be set")
+	}
+	s.opt_last = k.Int("last")
+	if s.opt_last < 0 {
+		return fmt.Errorf("--last must not be negative")
+	} else if s.opt_last > 0 {
+		s.last = make([]tapItem, s.opt_last)
+	}
+	s.opt_buf = k.Int("buffer")
+	if s.opt_buf <= 0 {
+		return fmt.Errorf("--buffer must be positive")
+	}
+
+	s.P.OnMsg(s.onMsg, s.Dir)
+	return nil
+}
+
+func (s *Tap) Prepare() error {
+	addr := s.K.String("addr")
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.serveClient)
+	s.srv = &http.Server{
+		Handler:     mux,
+		BaseContext: func(l net.Listener) context.Context { return s.Ctx },
+	}
+
+	s.Info().Msgf("serving events on http://%s/", ln.Addr())
+	return nil
+}
+
+func (s *Tap) Run() error {
+	err := s.srv.Serve(s.ln)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (s *Tap) Stop() error {
+	if s.srv != nil {
+		s.srv.Close()
+	}
+	return nil
+}
+
+// onMsg broadcasts m to all clients, never dropping it from the pipe
+func (s *Tap) onMsg(m *msg.Msg) bool {
+	// nobody to send it to, now or later?
+	s.mu.Lock()
+	idle := len(s.clients) == 0 && len(s.last) == 0
+	s.mu.Unlock()
+	if idle {
+		return true
+	}
+
+	it := tapItem{
+		typ: m.Type,
+		dir: m.Dir,
+		js:  bytes.TrimSpace(slices.Clone(m.GetJSON())),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.last) > 0 {
+		s.last[s.pos] = it
+		s.pos = (s.pos + 1) % len(s.last)
+		if s.pos == 0 {
+			s.full = true
+		}
+	}
+
+	for c := range s.clients {
+		if !c.wants(it) {
+			continue
+		}
+		select {
+		case c.ch <- it:
+		default:
+			s.drops.Add(1) // client too slow
+		}
+	}
+
+	return true
+}
+
+// serveClient streams messages to an HTTP client as server-sent events.
+// The client may filter messages with eg. ?type=UPDATE,OPEN&dir=R
+func (s *Tap) serveClient(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// per-client filter
+	c := &tapClient{ch: make(chan tapItem, s.opt_buf)}
+	q := r.URL.Query()
+	if v := q.Get("type"); len(v) > 0 {
+		types, err := core.ParseTypes(strings.Split(v, ","), nil)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("type: %s", err), http.StatusBadRequest)
+			return
+		}
+		c.types = types
+	}
+	if v := q.Get("dir"); len(v) > 0 {
+		d, err := dir.DirString(strings.ToUpper(v))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("dir: %s", err), http.StatusBadRequest)
+			return
+		}
+		c.dir = d
+	}
+
+	// register, taking recent messages
+	s.mu.Lock()
+	var replay []tapItem
+	if s.full {
+		replay = append(replay, s.last[s.pos:]...)
+	}
+	replay = append(replay, s.last[:s.pos]...)
+	s.clients[c] = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+	}()
+
+	s.Info().Msgf("%s: client connected", r.RemoteAddr)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	// send recent messages
+	for _, it := range replay {
+		if c.wants(it) {
+			if err := tap_write(w, it); err != nil {
+				return
+			}
+		}
+	}
+	flusher.Flush()
+
+	// stream new messages
+	for {
+		select {
+		case <-r.Context().Done():
+			s.Info().Msgf("%s: client disconnected", r.RemoteAddr)
+			return
+		case it := <-c.ch:
+			if err := tap_write(w, it); err != nil {
+				s.Info().Err(err).Msgf("%s: client write error", r.RemoteAddr)
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// wants returns true iff client c wants message it
+func (c *tapClient) wants(it tapItem) bool {
+	if c.dir != 0 && c.dir != it.dir {
+		return false
+	}
+	if len(c.types) > 0 && !slices.Contains(c.types, it.typ) {
+		return false
+	}
+	return true
+}
+
+// tap_write writes it to w as a server-sent event
+func tap_write(w http.ResponseWriter, it tapItem) error {
+	_, err := fmt.Fprintf(w, "data: %s\n\n", it.js)
+	return err
+}
+
+// Counters implements core.StageCounters
+func (s *Tap) Counters() map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]any{
+		"clients": len(s.clients),
+		"drops":   s.drops.Load(),
+	}
+}
@@ -0,0 +1,117 @@
+package stages
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bgpfix/bgpfix/msg"
+)
+
+func testTap(t *testing.T, args ...string) *Tap {
+	t.Helper()
+	sb := testStage(t, "tap", append(args, "localhost:0")...)
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatal(err)
+	}
+	return sb.Stage.(*Tap)
+}
+
+// testTapClients waits until s has n clients
+func testTapClients(t *testing.T, s *Tap, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+		s.mu.Lock()
+		got := len(s.clients)
+		s.mu.Unlock()
+		if got == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %d clients", n)
+}
+
+func TestTapBuffer(t *testing.T) {
+	s := testTap(t, "--buffer", "2")
+	c := &tapClient{ch: make(chan tapItem, s.opt_buf)}
+	s.clients[c] = true
+
+	// the client does not read: queue 2, drop the rest
+	for i := 0; i < 5; i++ {
+		if !s.onMsg(msg.NewMsg().Use(msg.KEEPALIVE)) {
+			t.Fatal("message dropped from the pipe")
+		}
+	}
+	if len(c.ch) != 2 {
+		t.Errorf("queued %d messages, want 2", len(c.ch))
+	}
+	if got := s.drops.Load(); got != 3 {
+		t.Errorf("dropped %d messages, want 3", got)
+	}
+
+	// filtered messages are not queued nor dropped
+	c.types = []msg.Type{msg.UPDATE}
+	<-c.ch
+	s.onMsg(msg.NewMsg().Use(msg.KEEPALIVE))
+	if len(c.ch) != 1 || s.drops.Load() != 3 {
+		t.Errorf("filtered message: queued %d, dropped %d", len(c.ch), s.drops.Load())
+	}
+}
+
+func TestTapLast(t *testing.T) {
+	s := testTap(t)
+	s.onMsg(msg.NewMsg().Use(msg.KEEPALIVE))
+	if s.pos != 0 || s.full {
+		t.Error("--last 0: message recorded")
+	}
+
+	s = testTap(t, "--last", "2")
+	for i := 0; i < 3; i++ {
+		s.onMsg(msg.NewMsg().Use(msg.KEEPALIVE))
+	}
+	if s.pos != 1 || !s.full {
+		t.Errorf("--last 2: got pos %d full %v, want 1 true", s.pos, s.full)
+	}
+}
+
+func TestTapDisconnect(t *testing.T) {
+	s := testTap(t, "--last", "1")
+	s.onMsg(msg.NewMsg().Use(msg.KEEPALIVE))
+
+	srv := httptest.NewServer(http.HandlerFunc(s.serveClient))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/?type=KEEPALIVE", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	testTapClients(t, s, 1)
+
+	// replayed, then streamed
+	s.onMsg(msg.NewMsg().Use(msg.KEEPALIVE))
+	rd := bufio.NewReader(resp.Body)
+	for i := 0; i < 2; i++ {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		} else if !strings.HasPrefix(line, "data: ") {
+			t.Errorf("got %q, want an event", line)
+		}
+		rd.ReadString('\n') // empty line
+	}
+
+	// the client goes away
+	cancel()
+	testTapClients(t, s, 0)
+	if !s.onMsg(msg.NewMsg().Use(msg.KEEPALIVE)) {
+		t.Error("message dropped from the pipe")
+	}
+}
@@ -0,0 +1,164 @@
+package stages
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/bgpfix/bgpipe/core"
+)
+
+type Threshold struct {
+	*core.StageBase
+
+	opt_count    int           // --count
+	opt_window   time.Duration // --window
+	opt_cooldown time.Duration // --cooldown
+
+	mu   sync.Mutex  // guards below
+	ring []time.Time // times of the last opt_count matches
+	pos  int         // oldest entry in ring
+	high bool        // above the threshold?
+	rise time.Time   // last rise event
+	stop chan struct{}
+}
+
+func NewThreshold(parent *core.StageBase) core.Stage {
+	var (
+		s = &Threshold{StageBase: parent}
+		o = &s.Options
+		f = o.Flags
+	)
+
+	o.Descr = "emit an event when matches exceed a rate"
+	o.Bidir = true
+
+	o.Events = map[string]string{
+		"rise": "number of matches in the window reached --count",
+		"fall": "number of matches in the window dropped below --count",
+	}
+
+	f.StringSlice("event", nil, "count given events (default: count messages)")
+	f.StringSlice("type", nil, "count only messages of given type(s)")
+	f.Int("count", 100, "threshold number of matches")
+	f.Duration("window", time.Minute, "sliding time window")
+	f.Duration("cooldown", time.Minute, "min time between rise events")
+
+	s.stop = make(chan struct{})
+	return s
+}
+
+func (s *Threshold) Attach() error {
+	k := s.K
+
+	s.opt_count = k.Int("count")
+	if s.opt_count <= 0 {
+		return fmt.Errorf("--count must be positive")
+	}
+	s.opt_window = k.Duration("window")
+	if s.opt_window <= 0 {
+		return fmt.Errorf("--window must be positive")
+	}
+	s.opt_cooldown = k.Duration("cooldown")
+	s.ring = make([]time.Time, s.opt_count)
+
+	// count events or messages?
+	if evs := core.ParseEvents(k.Strings("event")); len(evs) > 0 {
+		s.P.Options.OnEvent(s.onEvent, evs...)
+	} else {
+		types, err := core.ParseTypes(k.Strings("type"), nil)
+		if err != nil {
+			return fmt.Errorf("--type: %w", err)
+		}
+		cb := s.P.OnMsg(s.onMsg, s.Dir, types...)
+		cb.Raw = true // no need to parse
+	}
+
+	return nil
+}
+
+func (s *Threshold) Run() error {
+	// check for falling edges in time
+	ticker := time.NewTicker(max(min(time.Second, s.opt_window/10), time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.mu.Lock()
+			s.check(now)
+			s.mu.Unlock()
+		case <-s.stop:
+			return nil
+		case <-s.Ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (s *Threshold) Stop() error {
+	close_safe(s.stop)
+	return nil
+}
+
+func (s *Threshold) onMsg(m *msg.Msg) bool {
+	s.match(time.Now())
+	return true
+}
+
+func (s *Threshold) onEvent(ev *pipe.Event) bool {
+	s.match(time.Now())
+	return true
+}
+
+// match records a match at time now
+func (s *Threshold) match(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ring[s.pos] = now
+	s.pos = (s.pos + 1) % len(s.ring)
+	s.check(now)
+}
+
+// check emits rise and fall events at time now. Must be called with s.mu locked.
+func (s *Threshold) check(now time.Time) {
+	// the oldest of the last opt_count matches still in the window?
+	oldest := s.ring[s.pos]
+	above := !oldest.IsZero() && now.Sub(oldest) <= s.opt_window
+
+	switch {
+	case above && !s.high:
+		if !s.rise.IsZero() && now.Sub(s.rise) < s.opt_cooldown {
+			return // still cooling down
+		}
+		s.high = true
+		s.rise = now
+		s.Event("rise", s.opt_count, s.opt_window.String())
+	case !above && s.high:
+		s.high = false
+		s.Event("fall", s.rate(now))
+	}
+}
+
+// rate returns the number of matches in the window at time now. Must be called with s.mu locked.
+func (s *Threshold) rate(now time.Time) (n int) {
+	for _, t := range s.ring {
+		if !t.IsZero() && now.Sub(t) <= s.opt_window {
+			n++
+		}
+	}
+	return n
+}
+
+// Counters implements core.StageCounters
+func (s *Threshold) Counters() map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]any{
+		"in_window": s.rate(time.Now()),
+		"high":      s.high,
+	}
+}
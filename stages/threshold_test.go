@@ -0,0 +1,93 @@
+package stages
+
+import (
+	"testing"
+	"time"
+)
+
+func testThreshold(t *testing.T, args ...string) *Threshold {
+	t.Helper()
+	sb := testStage(t, "threshold", args...)
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatal(err)
+	}
+	return sb.Stage.(*Threshold)
+}
+
+func TestThresholdWindow(t *testing.T) {
+	t0 := time.Now()
+	tests := []struct {
+		name string
+		at   []time.Duration // match times
+		high bool
+	}{
+		{"below count", []time.Duration{0, time.Second}, false},
+		{"inside", []time.Duration{0, time.Second, 2 * time.Second}, true},
+		{"at the boundary", []time.Duration{0, 5 * time.Second, 10 * time.Second}, true},
+		{"past the boundary", []time.Duration{0, 5 * time.Second, 10*time.Second + time.Millisecond}, false},
+		{"old match expired", []time.Duration{0, 20 * time.Second, 21 * time.Second, 22 * time.Second}, true},
+	}
+	for _, tt := range tests {
+		s := testThreshold(t, "--count", "3", "--window", "10s", "--cooldown", "0")
+		for _, d := range tt.at {
+			s.match(t0.Add(d))
+		}
+		if s.high != tt.high {
+			t.Errorf("%s: got high %v, want %v", tt.name, s.high, tt.high)
+		}
+	}
+}
+
+func TestThresholdFall(t *testing.T) {
+	t0 := time.Now()
+	s := testThreshold(t, "--count", "3", "--window", "10s")
+	for _, d := range []time.Duration{0, time.Second, 2 * time.Second} {
+		s.match(t0.Add(d))
+	}
+	if !s.high {
+		t.Fatal("no rise")
+	}
+
+	// the oldest match leaves the window
+	s.check(t0.Add(10 * time.Second))
+	if !s.high {
+		t.Error("fell at the window boundary")
+	}
+	s.check(t0.Add(10*time.Second + time.Millisecond))
+	if s.high {
+		t.Error("no fall past the window")
+	}
+	if n := s.rate(t0.Add(10*time.Second + time.Millisecond)); n != 2 {
+		t.Errorf("got %d matches in the window, want 2", n)
+	}
+}
+
+func TestThresholdCooldown(t *testing.T) {
+	t0 := time.Now()
+	s := testThreshold(t, "--count", "2", "--window", "1s", "--cooldown", "1m")
+	burst := func(at time.Duration) {
+		s.match(t0.Add(at))
+		s.match(t0.Add(at + time.Millisecond))
+	}
+
+	burst(0)
+	if !s.high || !s.rise.Equal(t0.Add(time.Millisecond)) {
+		t.Fatal("no 1st rise")
+	}
+	s.check(t0.Add(10 * time.Second))
+	if s.high {
+		t.Fatal("no fall")
+	}
+
+	// another burst within the cooldown: no rise
+	burst(30 * time.Second)
+	if s.high {
+		t.Error("rise within the cooldown")
+	}
+
+	// after the cooldown
+	burst(2 * time.Minute)
+	if !s.high || !s.rise.Equal(t0.Add(2*time.Minute+time.Millisecond)) {
+		t.Error("no rise after the cooldown")
+	}
+}
@@ -0,0 +1,154 @@
+package stages
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+	"github.com/bgpfix/bgpipe/core"
+)
+
+type Timeshift struct {
+	*core.StageBase
+
+	opt_skew   time.Duration // --max-skew
+	opt_median bool          // --ref median
+	opt_drop   bool          // --action drop
+
+	mu   sync.Mutex  // guards below
+	ring []time.Time // recent message times (--ref median)
+	pos  int         // next position in ring
+	full bool        // ring full?
+
+	skewed atomic.Uint64 // number of skewed messages
+}
+
+func NewTimeshift(parent *core.StageBase) core.Stage {
+	var (
+		s = &Timeshift{StageBase: parent}
+		o = &s.Options
+		f = o.Flags
+	)
+
+	o.Descr = "flag or drop messages with implausible timestamps"
+	o.Bidir = true
+
+	f.Duration("max-skew", 5*time.Minute, "max allowed deviation of message time")
+	f.String("ref", "wall", "reference time: wall (clock) or median (of recent messages)")
+	f.Int("window", 100, "number of recent messages for --ref median")
+	f.String("action", "tag", "what to do with skewed messages: tag or drop")
+	f.StringSlice("type", nil, "check only messages of given type(s)")
+
+	return s
+}
+
+func (s *Timeshift) Attach() error {
+	k := s.K
+
+	s.opt_skew = k.Duration("max-skew")
+	if s.opt_skew <= 0 {
+		return fmt.Errorf("--max-skew must be positive")
+	}
+
+	switch v := k.String("ref"); v {
+	case "wall":
+		s.opt_median = false
+	case "median":
+		s.opt_median = true
+		n := k.Int("window")
+		if n <= 0 {
+			return fmt.Errorf("--window must be positive")
+		}
+		s.ring = make([]time.Time, n)
+	default:
+		return fmt.Errorf("--ref %s: need wall or median", v)
+	}
+
+	switch v := k.String("action"); v {
+	case "tag":
+		s.opt_drop = false
+	case "drop":
+		s.opt_drop = true
+	default:
+		return fmt.Errorf("--action %s: need tag or drop", v)
+	}
+
+	types, err := core.ParseTypes(k.Strings("type"), nil)
+	if err != nil {
+		return fmt.Errorf("--type: %w", err)
+	}
+	cb := s.P.OnMsg(s.onMsg, s.Dir, types...)
+	cb.Raw = true // no need to parse
+	return nil
+}
+
+func (s *Timeshift) onMsg(m *msg.Msg) bool {
+	if m.Time.IsZero() {
+		return true // nothing to check
+	}
+
+	skew := m.Time.Sub(s.reference(m.Time))
+	fine := skew >= -s.opt_skew && skew <= s.opt_skew
+	if s.opt_median {
+		s.record(m.Time, fine)
+	}
+	if fine {
+		return true
+	}
+
+	s.skewed.Add(1)
+	if s.opt_drop {
+		return false
+	}
+	pipe.MsgContext(m).UseTags()["time/skew"] = skew.Round(time.Millisecond).String()
+	return true
+}
+
+// reference returns the reference time to compare message time t against
+func (s *Timeshift) reference(t time.Time) time.Time {
+	if !s.opt_median {
+		return time.Now()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// median of the window, or t itself if empty
+	n := s.pos
+	if s.full {
+		n = len(s.ring)
+	}
+	if n == 0 {
+		return t
+	}
+	sorted := slices.Clone(s.ring[:n])
+	slices.SortFunc(sorted, time.Time.Compare)
+	return sorted[n/2]
+}
+
+// record adds message time t to the --ref median window, unless it is skewed
+// and the window is already full (so that eg. a skewed first message can't stick)
+func (s *Timeshift) record(t time.Time, fine bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !fine && s.full {
+		return
+	}
+	s.ring[s.pos] = t
+	s.pos = (s.pos + 1) % len(s.ring)
+	if s.pos == 0 {
+		s.full = true
+	}
+}
+
+// Counters implements core.StageCounters
+func (s *Timeshift) Counters() map[string]any {
+	return map[string]any{
+		"skewed": s.skewed.Load(),
+	}
+}
@@ -0,0 +1,107 @@
+package stages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/pipe"
+)
+
+func testTimeshift(t *testing.T, args ...string) *Timeshift {
+	t.Helper()
+	sb := testStage(t, "timeshift-detect", args...)
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatal(err)
+	}
+	return sb.Stage.(*Timeshift)
+}
+
+// testTimeshiftMsg returns true iff s keeps a message with time at, and its tag
+func testTimeshiftMsg(s *Timeshift, at time.Time) (bool, string) {
+	m := msg.NewMsg().Use(msg.KEEPALIVE)
+	m.Time = at
+	keep := s.onMsg(m)
+	if !pipe.HasTags(m) {
+		return keep, ""
+	}
+	return keep, pipe.MsgTags(m)["time/skew"]
+}
+
+func TestTimeshiftWall(t *testing.T) {
+	s := testTimeshift(t, "--max-skew", "1m")
+	now := time.Now()
+	tests := []struct {
+		name string
+		at   time.Time
+		skew bool
+	}{
+		{"normal", now, false},
+		{"slightly off", now.Add(-30 * time.Second), false},
+		{"future", now.Add(time.Hour), true},
+		{"past", now.Add(-time.Hour), true},
+	}
+	for _, tt := range tests {
+		keep, tag := testTimeshiftMsg(s, tt.at)
+		if !keep {
+			t.Errorf("%s: dropped with --action tag", tt.name)
+		}
+		if (tag != "") != tt.skew {
+			t.Errorf("%s: got tag %q, want skewed %v", tt.name, tag, tt.skew)
+		}
+	}
+	if got := s.skewed.Load(); got != 2 {
+		t.Errorf("got %d skewed, want 2", got)
+	}
+
+	// no time: not checked
+	if keep, tag := testTimeshiftMsg(s, time.Time{}); !keep || tag != "" {
+		t.Errorf("zero time: got %v %q", keep, tag)
+	}
+
+	// --action drop
+	s = testTimeshift(t, "--max-skew", "1m", "--action", "drop")
+	if keep, _ := testTimeshiftMsg(s, now.Add(time.Hour)); keep {
+		t.Error("future: not dropped")
+	}
+	if keep, _ := testTimeshiftMsg(s, time.Now()); !keep {
+		t.Error("normal: dropped")
+	}
+}
+
+func TestTimeshiftMedian(t *testing.T) {
+	// an MRT replay from long ago: wall clock does not matter
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := testTimeshift(t, "--max-skew", "1m", "--ref", "median", "--window", "5")
+	for i := range 5 {
+		if _, tag := testTimeshiftMsg(s, t0.Add(time.Duration(i)*time.Second)); tag != "" {
+			t.Fatalf("message %d: skewed by %s", i, tag)
+		}
+	}
+
+	// skewed messages do not move the median
+	for range 10 {
+		if _, tag := testTimeshiftMsg(s, t0.Add(time.Hour)); tag == "" {
+			t.Fatal("future: not skewed")
+		}
+	}
+	if _, tag := testTimeshiftMsg(s, t0.Add(-time.Hour)); tag == "" {
+		t.Error("past: not skewed")
+	}
+	if _, tag := testTimeshiftMsg(s, t0.Add(10*time.Second)); tag != "" {
+		t.Errorf("normal after skewed: skewed by %s", tag)
+	}
+}
+
+func TestTimeshiftMedianSkewedFirst(t *testing.T) {
+	// a skewed first message can't stick in the window
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := testTimeshift(t, "--max-skew", "1m", "--ref", "median", "--window", "3")
+	testTimeshiftMsg(s, t0.Add(24*time.Hour))
+	for i := range 3 {
+		testTimeshiftMsg(s, t0.Add(time.Duration(i)*time.Second))
+	}
+	if _, tag := testTimeshiftMsg(s, t0.Add(5*time.Second)); tag != "" {
+		t.Errorf("skewed by %s after a skewed first message", tag)
+	}
+}
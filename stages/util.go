@@ -2,17 +2,67 @@ package stages
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"slices"
+	"syscall"
 	"time"
 
+	"github.com/bgpfix/bgpfix/attrs"
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpfix/nlri"
 	"github.com/bgpfix/bgpfix/pipe"
 	"github.com/bgpfix/bgpipe/core"
+	"github.com/knadh/koanf/v2"
+	"github.com/spf13/pflag"
 )
 
+// tcp_control returns a socket control function that calls all non-nil fns in order
+func tcp_control(fns ...func(net, addr string, c syscall.RawConn) error) func(net, addr string, c syscall.RawConn) error {
+	fns = slices.DeleteFunc(fns, func(fn func(string, string, syscall.RawConn) error) bool {
+		return fn == nil
+	})
+	if len(fns) == 0 {
+		return nil
+	}
+
+	return func(net, addr string, c syscall.RawConn) error {
+		for _, fn := range fns {
+			if err := fn(net, addr, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// tcp_flags adds the IP socket option flags for connect and listen
+func tcp_flags(f *pflag.FlagSet) {
+	f.Int("ttl", 0, "set IP TTL / hop limit of outgoing packets (eg. 255 for GTSM)")
+	f.Int("min-ttl", 0, "drop packets with lower IP TTL / hop limit (eg. 254 for GTSM, RFC 5082)")
+	f.Int("dscp", 0, "set DSCP of outgoing packets (0-63)")
+}
+
+// tcp_sockopts returns the socket control function for md5 and tcp_flags options in k
+func tcp_sockopts(k *koanf.Koanf) (func(net, addr string, c syscall.RawConn) error, error) {
+	ttl, minttl, dscp := k.Int("ttl"), k.Int("min-ttl"), k.Int("dscp")
+	switch {
+	case ttl < 0 || ttl > 255:
+		return nil, fmt.Errorf("--ttl %d: need 0-255", ttl)
+	case minttl < 0 || minttl > 255:
+		return nil, fmt.Errorf("--min-ttl %d: need 0-255", minttl)
+	case dscp < 0 || dscp > 63:
+		return nil, fmt.Errorf("--dscp %d: need 0-63", dscp)
+	}
+	return tcp_control(tcp_md5(k.String("md5")), tcp_ipopts(ttl, minttl, dscp)), nil
+}
+
 func tcp_handle(s *core.StageBase, conn net.Conn, in *pipe.Input, timeout time.Duration) error {
 	s.Info().Msgf("connected %s -> %s", conn.LocalAddr(), conn.RemoteAddr())
+	s.PublishConn(conn)
 	defer conn.Close()
 
 	// get tcp conn
@@ -89,6 +139,26 @@ func tcp_handle(s *core.StageBase, conn net.Conn, in *pipe.Input, timeout time.D
 	return err
 }
 
+// dial_timeout returns the stage --timeout value, or the global --connect-timeout
+// if the stage value was not set explicitly and the global value is non-zero
+func dial_timeout(s *core.StageBase) time.Duration {
+	if !s.Options.Flags.Changed("timeout") {
+		if t := s.B.K.Duration("connect-timeout"); t > 0 {
+			return t
+		}
+	}
+	return s.K.Duration("timeout")
+}
+
+// dial_error makes DNS resolution failures in err easier to tell apart
+func dial_error(err error) error {
+	var dnserr *net.DNSError
+	if errors.As(err, &dnserr) && dnserr.IsNotFound {
+		return fmt.Errorf("could not resolve %s: %w", dnserr.Name, err)
+	}
+	return err
+}
+
 func close_safe[T any](ch chan T) (ok bool) {
 	if ch != nil {
 		defer func() { recover() }()
@@ -106,3 +176,56 @@ func send_safe[T any](ch chan T, v T) (ok bool) {
 	}
 	return
 }
+
+// notify_cancel sends NOTIFICATION n to the peer via in, and cancels the pipe
+// with err a second later, giving the NOTIFICATION some time to go out
+func notify_cancel(s *core.StageBase, in *pipe.Input, n *msg.Notify, err error) {
+	m := s.P.GetMsg().Use(msg.NOTIFY)
+	m.Notify.Code = n.Code
+	m.Notify.Subcode = n.Subcode
+	m.Notify.Data = n.Data
+	if err := in.WriteMsg(m); err != nil {
+		s.Warn().Err(err).Msg("could not send NOTIFICATION")
+	}
+	time.AfterFunc(time.Second, func() { s.B.Cancel(s.Errorf("%w", err)) })
+}
+
+// max number of prefixes in a single withdrawal UPDATE, see update_withdraw
+const update_withdraw_batch = 200
+
+// update_withdraw makes m an UPDATE withdrawing given prefixes
+func update_withdraw(m *msg.Msg, prefixes ...nlri.NLRI) error {
+	unreach := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		unreach = append(unreach, p.String())
+	}
+	js, err := json.Marshal(map[string][]string{"unreach": unreach})
+	if err != nil {
+		return err
+	}
+	return m.Use(msg.UPDATE).Update.FromJSON(js)
+}
+
+// update_single makes m an UPDATE announcing only prefix p, with the attributes
+// taken from message js in JSON format. If mp is true, p goes in MP_REACH.
+func update_single(m *msg.Msg, p nlri.NLRI, js []byte, mp bool) error {
+	if err := m.FromJSON(js); err != nil {
+		return err
+	}
+
+	u := &m.Update
+	u.Unreach = nil
+	u.Attrs.Drop(attrs.ATTR_MP_UNREACH)
+	if mp {
+		u.Reach = nil
+		if mpp := u.MP(attrs.ATTR_MP_REACH).Prefixes(); mpp != nil {
+			mpp.Prefixes = []nlri.NLRI{p}
+		}
+	} else {
+		u.Reach = []nlri.NLRI{p}
+		u.Attrs.Drop(attrs.ATTR_MP_REACH)
+	}
+
+	m.Modified()
+	return nil
+}
@@ -3,7 +3,9 @@
 package stages
 
 import (
+	"errors"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -42,3 +44,54 @@ func tcp_md5(md5pass string) func(net, addr string, c syscall.RawConn) error {
 		return err
 	}
 }
+
+func tcp_ipopts(ttl, minttl, dscp int) func(net, addr string, c syscall.RawConn) error {
+	if ttl == 0 && minttl == 0 && dscp == 0 {
+		return nil
+	}
+
+	// set sets the options on fd at given level, using given option names
+	set := func(fd, lvl, opt_ttl, opt_minttl, opt_tos int) (err error) {
+		if ttl > 0 && err == nil {
+			err = unix.SetsockoptInt(fd, lvl, opt_ttl, ttl)
+		}
+		if minttl > 0 && err == nil {
+			err = unix.SetsockoptInt(fd, lvl, opt_minttl, minttl)
+		}
+		if dscp > 0 && err == nil {
+			err = unix.SetsockoptInt(fd, lvl, opt_tos, dscp<<2)
+		}
+		return err
+	}
+
+	return func(net, addr string, c syscall.RawConn) error {
+		var err error
+		c.Control(func(fd uintptr) {
+			switch net {
+			case "tcp6", "udp6", "ip6":
+				err = set(int(fd), unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, unix.IPV6_MINHOPCOUNT, unix.IPV6_TCLASS)
+				if err != nil {
+					break
+				}
+
+				// dual-stack socket? IPv4-mapped peers need the IPv4 options too
+				err = set(int(fd), unix.IPPROTO_IP, unix.IP_TTL, unix.IP_MINTTL, unix.IP_TOS)
+				if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOPROTOOPT) {
+					err = nil // IPv6-only socket
+				}
+			default:
+				err = set(int(fd), unix.IPPROTO_IP, unix.IP_TTL, unix.IP_MINTTL, unix.IP_TOS)
+			}
+		})
+		return err
+	}
+}
+
+// cpu_time returns the user+system CPU time used by the process so far
+func cpu_time() time.Duration {
+	var ru unix.Rusage
+	if unix.Getrusage(unix.RUSAGE_SELF, &ru) != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
@@ -0,0 +1,71 @@
+//go:build linux
+
+package stages
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// testSockopt returns the integer socket option at lvl/opt on listener l
+func testSockopt(t *testing.T, l net.Listener, lvl, opt int) (v int) {
+	t.Helper()
+	rc, err := l.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Control(func(fd uintptr) {
+		v, err = unix.GetsockoptInt(int(fd), lvl, opt)
+	})
+	if err != nil {
+		t.Fatalf("getsockopt %d/%d: %v", lvl, opt, err)
+	}
+	return v
+}
+
+func TestTcpIpoptsDualStack(t *testing.T) {
+	lc := net.ListenConfig{Control: tcp_ipopts(255, 254, 48)}
+	l, err := lc.Listen(context.Background(), "tcp6", "[::]:0")
+	if err != nil {
+		t.Skipf("no IPv6: %v", err)
+	}
+	defer l.Close()
+
+	for _, tt := range []struct {
+		name     string
+		lvl, opt int
+		want     int
+	}{
+		{"IPV6_UNICAST_HOPS", unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, 255},
+		{"IPV6_MINHOPCOUNT", unix.IPPROTO_IPV6, unix.IPV6_MINHOPCOUNT, 254},
+		{"IPV6_TCLASS", unix.IPPROTO_IPV6, unix.IPV6_TCLASS, 48 << 2},
+		{"IP_TTL", unix.IPPROTO_IP, unix.IP_TTL, 255},
+		{"IP_MINTTL", unix.IPPROTO_IP, unix.IP_MINTTL, 254},
+		{"IP_TOS", unix.IPPROTO_IP, unix.IP_TOS, 48 << 2},
+	} {
+		if got := testSockopt(t, l, tt.lvl, tt.opt); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTcpIpoptsV6Only(t *testing.T) {
+	ipopts := tcp_ipopts(255, 254, 0)
+	lc := net.ListenConfig{Control: func(network, addr string, c syscall.RawConn) error {
+		c.Control(func(fd uintptr) { unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 1) })
+		return ipopts(network, addr, c)
+	}}
+	l, err := lc.Listen(context.Background(), "tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6: %v", err)
+	}
+	defer l.Close()
+
+	if got := testSockopt(t, l, unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS); got != 255 {
+		t.Errorf("IPV6_UNICAST_HOPS: got %d, want 255", got)
+	}
+}
@@ -0,0 +1,87 @@
+package stages
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bgpfix/bgpipe/core"
+	"github.com/knadh/koanf/providers/posflag"
+)
+
+// testStage returns a new stage cmd with CLI args parsed, not attached yet
+func testStage(t *testing.T, cmd string, args ...string) *core.StageBase {
+	t.Helper()
+	b := core.NewBgpipe(Repo)
+	s := b.NewStage(cmd)
+	if s == nil {
+		t.Fatalf("%s: no such stage", cmd)
+	}
+
+	f := s.Options.Flags
+	if err := f.Parse(args); err != nil {
+		t.Fatalf("%s: %v", cmd, err)
+	}
+	s.K.Load(posflag.Provider(f, ".", s.K), nil)
+	rem := f.Args()
+	for _, name := range s.Options.Args {
+		if len(rem) == 0 {
+			t.Fatalf("%s: needs an argument: %s", cmd, name)
+		}
+		s.K.Set(name, rem[0])
+		rem = rem[1:]
+	}
+	return s
+}
+
+func TestDialError(t *testing.T) {
+	nxdomain := &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{
+		Err: "no such host", Name: "bgp.invalid", IsNotFound: true,
+	}}
+	timeout := &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{
+		Err: "i/o timeout", Name: "bgp.example", IsTimeout: true,
+	}}
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+	// NXDOMAIN is reported as such, keeping the original error
+	err := dial_error(nxdomain)
+	if !strings.HasPrefix(err.Error(), "could not resolve bgp.invalid: ") {
+		t.Errorf("NXDOMAIN: got %q", err)
+	}
+	var dnserr *net.DNSError
+	if !errors.As(err, &dnserr) || !dnserr.IsNotFound {
+		t.Errorf("NXDOMAIN: lost the *net.DNSError: %v", err)
+	}
+
+	// temporary DNS failures and other dial errors are passed as-is
+	for _, e := range []error{timeout, refused} {
+		if got := dial_error(e); got != e {
+			t.Errorf("got %v, want %v", got, e)
+		}
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	tests := []struct {
+		args   []string
+		global time.Duration
+		want   time.Duration
+	}{
+		{nil, 0, time.Minute},                             // stage default
+		{nil, 5 * time.Second, 5 * time.Second},           // global default
+		{[]string{"--timeout", "3s"}, 0, 3 * time.Second}, // stage value
+		{[]string{"--timeout", "3s"}, 5 * time.Second, 3 * time.Second},
+		{[]string{"--timeout", "0"}, 5 * time.Second, 0},
+	}
+	for _, tt := range tests {
+		s := testStage(t, "connect", append(tt.args, "localhost")...)
+		if tt.global > 0 {
+			s.B.K.Set("connect-timeout", tt.global)
+		}
+		if got := dial_timeout(s); got != tt.want {
+			t.Errorf("%v with --connect-timeout %s: got %s, want %s", tt.args, tt.global, got, tt.want)
+		}
+	}
+}
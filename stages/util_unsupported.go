@@ -5,6 +5,7 @@ package stages
 import (
 	"fmt"
 	"syscall"
+	"time"
 )
 
 func tcp_md5(md5pass string) func(net, addr string, c syscall.RawConn) error {
@@ -16,3 +17,18 @@ func tcp_md5(md5pass string) func(net, addr string, c syscall.RawConn) error {
 		return fmt.Errorf("no TCP-MD5 support on this platform")
 	}
 }
+
+func tcp_ipopts(ttl, minttl, dscp int) func(net, addr string, c syscall.RawConn) error {
+	if ttl == 0 && minttl == 0 && dscp == 0 {
+		return nil
+	}
+
+	return func(net, addr string, c syscall.RawConn) error {
+		return fmt.Errorf("no --ttl, --min-ttl, or --dscp support on this platform")
+	}
+}
+
+// cpu_time returns 0 on this platform
+func cpu_time() time.Duration {
+	return 0
+}
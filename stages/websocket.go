@@ -43,6 +43,7 @@ func NewWebsocket(parent *core.StageBase) core.Stage {
 	o.Descr = "filter messages over websocket"
 	o.IsProducer = true
 	o.Bidir = true
+	o.Secrets = []string{"header"}
 
 	f := o.Flags
 	f.Bool("listen", false, "listen on given URL instead of dialing it")
@@ -61,7 +62,7 @@ func NewWebsocket(parent *core.StageBase) core.Stage {
 func (s *Websocket) Attach() error {
 	// options
 	k := s.K
-	if t := k.Duration("timeout"); t > 0 {
+	if t := dial_timeout(s.StageBase); t > 0 {
 		s.timeout = t
 	} else {
 		s.timeout = 10 * time.Second
@@ -176,7 +177,7 @@ func (s *Websocket) prepareClient() error {
 	s.Info().Msgf("dialing %s", url)
 	conn, resp, err := dialer.DialContext(s.Ctx, url, s.headers)
 	if err != nil {
-		return err
+		return dial_error(err)
 	}
 	s.Info().
 		Interface("headers", resp.Header).
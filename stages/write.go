@@ -2,16 +2,22 @@ package stages
 
 import (
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/bgpfix/bgpipe/core"
 	"github.com/bgpfix/bgpipe/pkg/extio"
+	"github.com/valyala/bytebufferpool"
 )
 
 type Write struct {
@@ -23,10 +29,25 @@ type Write struct {
 	opt_every    time.Duration
 	opt_timefmt  string
 	opt_compress string
+	opt_split    bool
+	opt_records  int
+	opt_checksum bool
+	opt_fifo     time.Duration
 
+	files map[string]*writeFile // open files, by message type (or "" if not splitting)
+}
+
+// writeFile represents an open target file
+type writeFile struct {
 	fh      *os.File
 	wr      io.WriteCloser
 	timeout time.Time
+	seq     int       // file sequence number ($SEQ)
+	records int       // number of messages written
+	hash    hash.Hash // checksum of uncompressed data (or nil)
+	fifo    bool      // a named pipe?
+	created bool      // new or empty when opened?
+	dirty   bool      // written since last flush?
 }
 
 func NewWrite(parent *core.StageBase) core.Stage {
@@ -44,6 +65,10 @@ func NewWrite(parent *core.StageBase) core.Stage {
 	f.Bool("compress", true, "compress based on file extension (.gz only)")
 	f.Duration("every", 0, "start new file every time interval")
 	f.String("time-format", "20060102.1504", "time format to replace $TIME in paths")
+	f.Bool("split-by-type", false, "write each message type to a separate file ($TYPE in path)")
+	f.Int("max-records", 0, "start new file after given number of messages ($SEQ in path)")
+	f.String("checksum", "", "write a checksum of uncompressed data to a .sha256 sidecar file on close (sha256)")
+	f.Duration("fifo-timeout", 0, "if path is a named pipe, max time to wait for a reader (0 means forever)")
 	return s
 }
 
@@ -76,6 +101,30 @@ func (s *Write) Attach() error {
 		return fmt.Errorf("--every requires the file path to specify $TIME")
 	}
 
+	s.opt_split = k.Bool("split-by-type")
+	if s.opt_split && !strings.Contains(s.fpath, `$TYPE`) {
+		return fmt.Errorf("--split-by-type requires the file path to specify $TYPE")
+	}
+
+	s.opt_records = k.Int("max-records")
+	if s.opt_records < 0 {
+		return fmt.Errorf("--max-records must not be negative")
+	} else if s.opt_records > 0 && !strings.Contains(s.fpath, `$SEQ`) {
+		return fmt.Errorf("--max-records requires the file path to specify $SEQ")
+	}
+
+	switch v := k.String("checksum"); v {
+	case "":
+		break
+	case "sha256":
+		if k.Bool("append") {
+			return fmt.Errorf("--checksum can't be used with --append")
+		}
+		s.opt_checksum = true
+	default:
+		return fmt.Errorf("--checksum %s: only sha256 is supported", v)
+	}
+
 	if k.Bool("compress") {
 		switch filepath.Ext(s.fpath) {
 		case ".bz2":
@@ -85,87 +134,303 @@ func (s *Write) Attach() error {
 		}
 	}
 
-	return s.eio.Attach()
+	s.opt_fifo = k.Duration("fifo-timeout")
+
+	s.files = make(map[string]*writeFile)
+
+	err := s.eio.Attach()
+	if err != nil {
+		return err
+	}
+
+	// need to know message types?
+	if s.opt_split {
+		s.eio.OutputTyped = make(chan extio.Typed, cap(s.eio.Output))
+	}
+
+	return nil
 }
 
 func (s *Write) Prepare() error {
-	return s.reopenFile(time.Now())
+	// files opened on first message of given type?
+	if s.opt_split {
+		return nil
+	}
+
+	// a named pipe? may wait for a reader for long, so open in Run
+	if fi, err := os.Stat(s.fpath); err == nil && fi.Mode()&os.ModeNamedPipe != 0 {
+		return nil
+	}
+
+	return s.reopenFile("", time.Now())
 }
 
-// reopenFile opens the target file; it can be called repeatedly to update
-// the target file path, and re-open the current target file when needed
-func (s *Write) reopenFile(now time.Time) error {
+// reopenFile opens the target file for message type typ; it can be called repeatedly
+// to update the target file path, and re-open the current target file when needed
+func (s *Write) reopenFile(typ string, now time.Time) error {
 	// have some file already opened?
-	if s.fh != nil {
+	f := s.files[typ]
+	seq := 0
+	if f != nil {
 		// still good?
-		if s.timeout.IsZero() || now.Before(s.timeout) {
+		if (f.timeout.IsZero() || now.Before(f.timeout)) &&
+			(s.opt_records == 0 || f.records < s.opt_records) {
 			return nil
 		}
 
 		// close the current file in background
-		go func(wr io.WriteCloser, fh *os.File) {
-			s.Debug().Msgf("closing %s", fh.Name())
-			wr.Close()
-			fh.Close()
-		}(s.wr, s.fh)
+		go s.closeFile(f)
+		seq = f.seq + 1
 	}
 
-	// replace $TIME in target
+	// replace $TIME, $TYPE and $SEQ in target
 	target := s.fpath
+	f = &writeFile{seq: seq}
 	if s.opt_timefmt != "" {
 		t := now
 		if s.opt_every > 0 {
 			t = t.Truncate(s.opt_every)
-			s.timeout = t.Add(s.opt_every)
+			f.timeout = t.Add(s.opt_every)
 		}
 		target = strings.Replace(target, `$TIME`, t.UTC().Format(s.opt_timefmt), 1)
 	}
+	if s.opt_split {
+		target = strings.Replace(target, `$TYPE`, typ, 1)
+	}
+	if s.opt_records > 0 {
+		target = strings.Replace(target, `$SEQ`, fmt.Sprintf("%06d", seq), 1)
+	}
+
+	// a named pipe? or are we creating the file?
+	if fi, err := os.Stat(target); errors.Is(err, os.ErrNotExist) {
+		f.created = true
+	} else if err == nil && fi.Mode()&os.ModeNamedPipe != 0 {
+		f.fifo = true
+	} else if err == nil && fi.Size() == 0 {
+		f.created = true
+	}
 
 	// try to open the new target
 	s.Info().Msgf("opening %s", target)
-	fh, err := os.OpenFile(target, s.flags, 0666)
+	var fh *os.File
+	var err error
+	if f.fifo {
+		fh, err = s.openFifo(target)
+	} else {
+		fh, err = os.OpenFile(target, s.flags, 0666)
+	}
 	if err != nil {
+		delete(s.files, typ)
 		return err
 	}
-	s.fh = fh
+	f.fh = fh
+	if s.opt_checksum {
+		f.hash = sha256.New()
+	}
+	s.compress(f)
 
-	// transparent compress?
-	s.wr = fh
+	s.files[typ] = f
+	return nil
+}
+
+// compress sets f.wr, transparently compressing if needed
+func (s *Write) compress(f *writeFile) {
+	f.wr = f.fh
 	switch s.opt_compress {
 	case ".gz":
-		s.wr = gzip.NewWriter(fh)
+		f.wr = gzip.NewWriter(f.fh)
+	}
+}
+
+// openFifo opens named pipe target for writing, waiting for a reader
+// up to --fifo-timeout
+func (s *Write) openFifo(target string) (*os.File, error) {
+	var deadline time.Time
+	if s.opt_fifo > 0 {
+		deadline = time.Now().Add(s.opt_fifo)
 	}
 
+	for logged := false; ; logged = true {
+		// fails with ENXIO if no reader
+		fh, err := os.OpenFile(target, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+		if !errors.Is(err, syscall.ENXIO) {
+			return fh, err
+		} else if !logged {
+			s.Info().Msgf("%s: waiting for a reader", target)
+		}
+
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return nil, fmt.Errorf("%s: no reader after %s", target, s.opt_fifo)
+		}
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-s.Ctx.Done():
+			return nil, context.Cause(s.Ctx)
+		}
+	}
+}
+
+// reopenFifo re-opens the named pipe of f after its reader went away
+func (s *Write) reopenFifo(f *writeFile) error {
+	target := f.fh.Name()
+	s.Warn().Msgf("%s: reader went away, re-opening", target)
+	f.fh.Close()
+
+	fh, err := s.openFifo(target)
+	if err != nil {
+		return err
+	}
+	f.fh = fh
+	s.compress(f)
+	return nil
+}
+
+// closeFile closes file f
+func (s *Write) closeFile(f *writeFile) {
+	s.Debug().Msgf("closing %s", f.fh.Name())
+	f.wr.Close()
+	f.fh.Close()
+
+	// nothing written in the last file we created?
+	if s.opt_records > 0 && f.records == 0 && f.created {
+		s.Debug().Msgf("removing empty %s", f.fh.Name())
+		os.Remove(f.fh.Name())
+		return
+	}
+
+	// write the checksum, in the sha256sum format.
+	// NB: it covers the uncompressed data, so name it without the compression
+	// extension, eg. "foo.mrt" in foo.mrt.gz.sha256 (check with zcat | sha256sum)
+	if f.hash != nil {
+		sum := hex.EncodeToString(f.hash.Sum(nil))
+		name := strings.TrimSuffix(filepath.Base(f.fh.Name()), s.opt_compress)
+		line := fmt.Sprintf("%s  %s\n", sum, name)
+		if err := os.WriteFile(f.fh.Name()+".sha256", []byte(line), 0666); err != nil {
+			s.Warn().Err(err).Msgf("could not write checksum of %s", f.fh.Name())
+		}
+	}
+}
+
+// writeBuf writes bb to the target file for message type typ
+func (s *Write) writeBuf(typ string, bb *bytebufferpool.ByteBuffer) error {
+	f := s.files[typ]
+	if f == nil || (s.opt_records > 0 && f.records >= s.opt_records) {
+		if err := s.reopenFile(typ, time.Now()); err != nil {
+			return err
+		}
+		f = s.files[typ]
+	}
+
+	if f.hash != nil {
+		f.hash.Write(bb.B)
+	}
+	_, err := bb.WriteTo(f.wr)
+	if err != nil && f.fifo && errors.Is(err, syscall.EPIPE) {
+		if err = s.reopenFifo(f); err == nil {
+			_, err = bb.WriteTo(f.wr)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	f.records++
+	f.dirty = true
+
+	s.eio.Put(bb)
 	return nil
 }
 
 func (s *Write) Run() (err error) {
 	defer func() {
-		s.Debug().Msgf("closing %s", s.fh.Name())
-		s.wr.Close()
-		s.fh.Close()
+		for _, f := range s.files {
+			s.closeFile(f)
+		}
 	}()
 
-	eio := s.eio
+	// update the target files first?
 	last := time.Now()
-	for bb := range eio.Output {
-		// update the target file first?
+	reopen := func() error {
 		if s.opt_every != 0 && time.Since(last) > time.Second {
 			last = time.Now()
-			err = s.reopenFile(last)
-			if err != nil {
-				break
+			for typ := range s.files {
+				if err := s.reopenFile(typ, last); err != nil {
+					return err
+				}
 			}
 		}
+		return nil
+	}
+
+	// flush compressed output periodically?
+	var flush <-chan time.Time
+	if d := s.eio.FlushInterval(); d > 0 {
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+		flush = ticker.C
+	}
 
-		// write to file
-		_, err = bb.WriteTo(s.wr)
-		if err != nil {
-			break
+	// not opened in Prepare?
+	if !s.opt_split && s.files[""] == nil {
+		if err = s.reopenFile("", time.Now()); err != nil {
+			return err
 		}
-		eio.Put(bb)
 	}
-	return err
+
+	// split by message type?
+	if s.opt_split {
+		for {
+			select {
+			case t, ok := <-s.eio.OutputTyped:
+				if !ok {
+					return nil
+				}
+				if err = reopen(); err != nil {
+					return err
+				}
+				if err = s.writeBuf(t.Type.String(), t.BB); err != nil {
+					return err
+				}
+			case <-flush:
+				if err = s.flushFiles(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for {
+		select {
+		case bb, ok := <-s.eio.Output:
+			if !ok {
+				return nil
+			}
+			if err = reopen(); err != nil {
+				return err
+			}
+			if err = s.writeBuf("", bb); err != nil {
+				return err
+			}
+		case <-flush:
+			if err = s.flushFiles(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// flushFiles flushes compressed data written to open files since last call
+func (s *Write) flushFiles() error {
+	for _, f := range s.files {
+		fl, ok := f.wr.(extio.Flusher)
+		if !ok || !f.dirty {
+			continue
+		}
+		if err := fl.Flush(); err != nil {
+			return err
+		}
+		f.dirty = false
+	}
+	return nil
 }
 
 func (s *Write) Stop() error {
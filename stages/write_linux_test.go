@@ -0,0 +1,123 @@
+//go:build linux
+
+package stages
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/valyala/bytebufferpool"
+)
+
+// testFifo returns the path to a new named pipe
+func testFifo(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fifo")
+	if err := syscall.Mkfifo(path, 0666); err != nil {
+		t.Skipf("mkfifo: %v", err)
+	}
+	return path
+}
+
+func TestWriteFifoPrepare(t *testing.T) {
+	fifo := testFifo(t)
+	sb := testStage(t, "write", "--fifo-timeout", "200ms", fifo)
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatal(err)
+	}
+
+	// no reader: Prepare must not wait for it, nor count against --prepare-timeout
+	start := time.Now()
+	if err := sb.Stage.Prepare(); err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("Prepare took %s, waiting for a reader", d)
+	}
+
+	// Run waits for the reader, up to --fifo-timeout
+	err := sb.Stage.Run()
+	if err == nil || !strings.Contains(err.Error(), "no reader") {
+		t.Errorf("Run: got %v, want no reader", err)
+	}
+}
+
+func TestWriteFifoReopen(t *testing.T) {
+	fifo := testFifo(t)
+	sb := testStage(t, "write", "--fifo-timeout", "5s", fifo)
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.Stage.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	s := sb.Stage.(*Write)
+	defer func() {
+		for _, f := range s.files {
+			s.closeFile(f)
+		}
+	}()
+
+	// a reader opens the fifo, without waiting for a writer
+	open := func() (*os.File, error) {
+		return os.OpenFile(fifo, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	}
+	read := func(r *os.File) string {
+		buf := make([]byte, 100)
+		n, err := r.Read(buf)
+		if err != nil && err != io.EOF {
+			t.Fatalf("read: %v", err)
+		}
+		return string(buf[:n])
+	}
+	write := func(data string) {
+		if err := s.writeBuf("", &bytebufferpool.ByteBuffer{B: []byte(data)}); err != nil {
+			t.Fatalf("write %q: %v", data, err)
+		}
+	}
+
+	// the first reader gets the first line
+	r1, err := open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("one\n")
+	if got := read(r1); got != "one\n" {
+		t.Errorf("reader 1: got %q", got)
+	}
+	fh := s.files[""].fh
+
+	// the reader restarts: the write gets EPIPE, waits for the new reader, and goes to it
+	r1.Close()
+	ready := make(chan *os.File, 1)
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		r2, err := open()
+		if err != nil {
+			t.Error(err)
+		}
+		ready <- r2
+	}()
+	write("two\n")
+	r2 := <-ready
+	if r2 == nil {
+		t.FailNow()
+	}
+	defer r2.Close()
+	if got := read(r2); got != "two\n" {
+		t.Errorf("reader 2: got %q", got)
+	}
+
+	f := s.files[""]
+	if f.fh == fh {
+		t.Error("fifo not re-opened")
+	}
+	if f.records != 2 {
+		t.Errorf("got %d records, want 2", f.records)
+	}
+}
@@ -0,0 +1,202 @@
+package stages
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bgpfix/bgpfix/msg"
+	"github.com/bgpfix/bgpipe/pkg/extio"
+)
+
+// typed returns a test extio.Typed value with given type and contents
+func typed(s *Write, typ msg.Type, data string) extio.Typed {
+	bb := s.eio.Pool.Get()
+	bb.WriteString(data)
+	return extio.Typed{Type: typ, BB: bb}
+}
+
+func TestWriteSplitByType(t *testing.T) {
+	dir := t.TempDir()
+	sb := testStage(t, "write", "--split-by-type", filepath.Join(dir, "out-$TYPE.json"))
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatal(err)
+	}
+	s := sb.Stage.(*Write)
+	if s.eio.OutputTyped == nil {
+		t.Fatal("--split-by-type must use the typed extio output")
+	}
+
+	for _, v := range []extio.Typed{
+		typed(s, msg.OPEN, "open 1\n"),
+		typed(s, msg.UPDATE, "update 1\n"),
+		typed(s, msg.KEEPALIVE, "keepalive 1\n"),
+		typed(s, msg.UPDATE, "update 2\n"),
+	} {
+		s.eio.OutputTyped <- v
+	}
+	s.Stop()
+	if err := s.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"out-OPEN.json":      "open 1\n",
+		"out-UPDATE.json":    "update 1\nupdate 2\n",
+		"out-KEEPALIVE.json": "keepalive 1\n",
+	}
+	for name, data := range want {
+		buf, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if string(buf) != data {
+			t.Errorf("%s: got %q, want %q", name, buf, data)
+		}
+	}
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != len(want) {
+		t.Errorf("got %d files, want %d", len(files), len(want))
+	}
+}
+
+func TestWriteSplitByTypeNeedsPlaceholder(t *testing.T) {
+	sb := testStage(t, "write", "--split-by-type", filepath.Join(t.TempDir(), "out.json"))
+	if err := sb.Stage.Attach(); err == nil {
+		t.Fatal("expected an error for a path without $TYPE")
+	}
+}
+
+func TestWriteMrtFlags(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out.mrt")
+	for _, tc := range []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{"--mrt-type", "bgp4mp"}, true},
+		{[]string{"--mrt-type", "BGP4MP_ET"}, true},
+		{[]string{"--mrt-type", "TABLE_DUMP_V2"}, false},
+		{[]string{"--mrt-time", "now"}, true},
+		{[]string{"--mrt-time", "later"}, false},
+		{[]string{"--mrt-peer-ip", "192.0.2.1", "--mrt-local-ip", "2001:db8::1"}, true},
+		{[]string{"--mrt-peer-ip", "192.0.2"}, false},
+		{[]string{"--mrt-local-ip", "bogus"}, false},
+	} {
+		sb := testStage(t, "write", append(tc.args, out)...)
+		if err := sb.Stage.Attach(); (err == nil) != tc.ok {
+			t.Errorf("%v: got error %v, want ok=%v", tc.args, err, tc.ok)
+		}
+	}
+}
+
+func TestWriteIncludeRawSelect(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out.json")
+	sb := testStage(t, "write", "--include-raw", "--select", "type,reach", out)
+	if err := sb.Stage.Attach(); err == nil {
+		t.Fatal("expected an error for --include-raw with --select")
+	}
+	sb = testStage(t, "write", "--select", "type,raw", out)
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatalf("--select raw: %v", err)
+	}
+}
+
+func TestWriteKeepsAppended(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, "out-000000.json")
+	if err := os.WriteFile(old, []byte("old\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	sb := testStage(t, "write", "--append", "--max-records", "10", filepath.Join(dir, "out-$SEQ.json"))
+	if err := sb.Stage.Attach(); err != nil {
+		t.Fatal(err)
+	}
+	s := sb.Stage.(*Write)
+
+	// open the existing file, write nothing, close
+	if err := s.reopenFile("", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	s.closeFile(s.files[""])
+	if buf, err := os.ReadFile(old); err != nil || string(buf) != "old\n" {
+		t.Errorf("existing file: got %q, %v", buf, err)
+	}
+
+	// an empty file we created is removed
+	delete(s.files, "")
+	os.Remove(old)
+	if err := s.reopenFile("", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	s.closeFile(s.files[""])
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("empty new file not removed: %v", err)
+	}
+}
+
+func TestWriteChecksumVerify(t *testing.T) {
+	for _, name := range []string{"out.json", "out.json.gz"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			sb := testStage(t, "write", "--checksum", "sha256", path)
+			if err := sb.Stage.Attach(); err != nil {
+				t.Fatal(err)
+			}
+			s := sb.Stage.(*Write)
+			if err := s.reopenFile("", time.Now()); err != nil {
+				t.Fatal(err)
+			}
+			bb := s.eio.Pool.Get()
+			bb.WriteString("update 1\nupdate 2\n")
+			if err := s.writeBuf("", bb); err != nil {
+				t.Fatal(err)
+			}
+			s.closeFile(s.files[""])
+
+			// the sidecar names the uncompressed data
+			buf, err := os.ReadFile(path + ".sha256")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := "a83c9a3350cfc245fea34438a03c6e442d1227818aca4f2c53f3e844eeca5c23  out.json\n"
+			if string(buf) != want {
+				t.Errorf("sidecar: got %q, want %q", buf, want)
+			}
+
+			// read it back
+			verify := func() error {
+				sb := testStage(t, "read", "--verify", path)
+				if err := sb.Stage.Attach(); err != nil {
+					t.Fatal(err)
+				}
+				if err := sb.Stage.Prepare(); err != nil {
+					t.Fatal(err)
+				}
+				r := sb.Stage.(*Read)
+				defer r.fh.Close()
+				if data, err := io.ReadAll(r.rd); err != nil {
+					t.Fatal(err)
+				} else if string(data) != "update 1\nupdate 2\n" {
+					t.Errorf("read: got %q", data)
+				}
+				return r.checkVerify()
+			}
+			if err := verify(); err != nil {
+				t.Errorf("matching checksum: %v", err)
+			}
+
+			// corrupt the checksum
+			bad := strings.Replace(want, "a83c", "0000", 1)
+			if err := os.WriteFile(path+".sha256", []byte(bad), 0666); err != nil {
+				t.Fatal(err)
+			}
+			if err := verify(); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+				t.Errorf("mismatching checksum: got %v", err)
+			}
+		})
+	}
+}